@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/admin"
+	"strings"
+)
+
+func registerAdminCommands(a *admin.Admin) {
+	a.Register("flows", "flows", adminFlows)
+}
+
+func adminFlows(args []string) (string, error) {
+	sb := strings.Builder{}
+	for _, status := range flowStatuses() {
+		sb.WriteString(fmt.Sprintf("%s\n", status))
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/discovery"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const waitDiscovery = 2 * time.Second
+
+// discoverServer discovers servers in the LAN and returns the address of the first server with the same fingerprint.
+func discoverServer(password string) (string, error) {
+	log.Infoln("Discover server in LAN")
+
+	resps, err := discovery.Discover(discovery.Port, discovery.Key(password), waitDiscovery)
+	if err != nil {
+		return "", fmt.Errorf("discover: %w", err)
+	}
+
+	result := ""
+	for _, resp := range resps {
+		addr := net.JoinHostPort(resp.IP.String(), strconv.Itoa(int(resp.Port)))
+		if resp.Fingerprint != fingerprint {
+			log.Infof("  %s (fingerprint %s mismatch)\n", addr, resp.Fingerprint)
+			continue
+		}
+
+		log.Infof("  %s\n", addr)
+		if result == "" {
+			result = addr
+		}
+	}
+	if result == "" {
+		return "", errors.New("no server found")
+	}
+
+	return result, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/zhxie/ikago/internal/log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keepAlive is the duration after which idle flows expire, the same as NAT in the server.
+const keepAlive = 30 * time.Second
+
+// flowGuide describes the embedded five-tuple of a flow from the perspective of the local source.
+type flowGuide struct {
+	Protocol gopacket.LayerType
+	Src      string
+	Dst      string
+}
+
+// flowStat describes the traffic of a flow. Upstream traffic is sent by the local source and downstream traffic is
+// received by it.
+type flowStat struct {
+	appear      time.Time
+	seen        time.Time
+	upPackets   uint64
+	upBytes     uint64
+	downPackets uint64
+	downBytes   uint64
+}
+
+type flowStatus struct {
+	Protocol    string    `json:"protocol"`
+	Src         string    `json:"source"`
+	Dst         string    `json:"destination"`
+	Appear      time.Time `json:"appear"`
+	Seen        time.Time `json:"seen"`
+	UpPackets   uint64    `json:"up-packets"`
+	UpBytes     uint64    `json:"up-bytes"`
+	DownPackets uint64    `json:"down-packets"`
+	DownBytes   uint64    `json:"down-bytes"`
+}
+
+var (
+	flowsLock sync.Mutex
+	flows     = make(map[flowGuide]*flowStat)
+)
+
+// flowOf returns the stat of the flow, and creates it if it does not exist. flowsLock must be held.
+func flowOf(guide flowGuide, now time.Time) *flowStat {
+	fs, ok := flows[guide]
+	if !ok {
+		fs = &flowStat{appear: now}
+		flows[guide] = fs
+	}
+	fs.seen = now
+
+	return fs
+}
+
+// addFlowUp records a packet sent by the local source through the tunnel at the time.
+func addFlowUp(protocol gopacket.LayerType, src, dst string, size int, t time.Time) {
+	flowsLock.Lock()
+	defer flowsLock.Unlock()
+
+	fs := flowOf(flowGuide{Protocol: protocol, Src: src, Dst: dst}, t)
+	fs.upPackets++
+	fs.upBytes += uint64(size)
+}
+
+// addFlowDown records a packet received by the local source through the tunnel at the time.
+func addFlowDown(protocol gopacket.LayerType, src, dst string, size int, t time.Time) {
+	flowsLock.Lock()
+	defer flowsLock.Unlock()
+
+	fs := flowOf(flowGuide{Protocol: protocol, Src: src, Dst: dst}, t)
+	fs.downPackets++
+	fs.downBytes += uint64(size)
+}
+
+// sweepFlows removes flows which have not been seen for keep alive periodically.
+func sweepFlows() {
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if isClosed {
+			return
+		}
+
+		now := time.Now()
+		n := 0
+
+		flowsLock.Lock()
+		for guide, fs := range flows {
+			if now.Sub(fs.seen) > keepAlive {
+				delete(flows, guide)
+				n++
+			}
+		}
+		flowsLock.Unlock()
+
+		if n > 0 {
+			log.Verbosef("Expire %d flows\n", n)
+		}
+	}
+}
+
+// flowStatuses returns statuses of all flows sorted by sources.
+func flowStatuses() []flowStatus {
+	flowsLock.Lock()
+	defer flowsLock.Unlock()
+
+	result := make([]flowStatus, 0, len(flows))
+	for guide, fs := range flows {
+		result = append(result, flowStatus{
+			Protocol:    guide.Protocol.String(),
+			Src:         guide.Src,
+			Dst:         guide.Dst,
+			Appear:      fs.appear,
+			Seen:        fs.seen,
+			UpPackets:   fs.upPackets,
+			UpBytes:     fs.upBytes,
+			DownPackets: fs.downPackets,
+			DownBytes:   fs.downBytes,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Src != result[j].Src {
+			return result[i].Src < result[j].Src
+		}
+		if result[i].Dst != result[j].Dst {
+			return result[i].Dst < result[j].Dst
+		}
+
+		return result[i].Protocol < result[j].Protocol
+	})
+
+	return result
+}
+
+func (s flowStatus) String() string {
+	sb := strings.Builder{}
+
+	now := time.Now()
+	sb.WriteString(fmt.Sprintf("%s %s -> %s: age %s, seen %s ago, ", s.Protocol, s.Src, s.Dst, now.Sub(s.Appear).Truncate(time.Second), now.Sub(s.Seen).Truncate(time.Second)))
+	sb.WriteString(fmt.Sprintf("up %d packets (%d Bytes), down %d packets (%d Bytes)", s.UpPackets, s.UpBytes, s.DownPackets, s.DownBytes))
+
+	return sb.String()
+}
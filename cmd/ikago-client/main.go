@@ -10,6 +10,7 @@
 	"github.com/sparrc/go-ping"
 	"github.com/xtaci/kcp-go"
 	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/admin"
 	"github.com/zhxie/ikago/internal/config"
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/exec"
@@ -50,6 +51,7 @@ type natIndicator struct {
 var (
 	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
 	argConfig         = flag.String("c", "", "Configuration file.")
+	argPrintConfig    = flag.Bool("print-config", false, "Print configuration.")
 	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
 	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
 	argGateway        = flag.String("gateway", "", "Gateway address.")
@@ -58,9 +60,12 @@ type natIndicator struct {
 	argPassword       = flag.String("password", "", "Password of encryption.")
 	argRule           = flag.Bool("rule", false, "Add firewall rule.")
 	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
+	argMetrics        = flag.String("metrics", "", "Address for serving metrics.")
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
-	argMTU            = flag.Int("mtu", pcap.MaxEthernetMTU, "MTU.")
+	argLogJSON        = flag.Bool("log-json", false, "Print logs as JSON objects.")
+	argLogLevel       = flag.String("log-level", "", "Min level of printing logs.")
+	argMTU            = config.BytesFlag("mtu", pcap.MaxEthernetMTU, "MTU.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
 	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
@@ -72,28 +77,43 @@ type natIndicator struct {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argDisguise       = flag.Bool("disguise", false, "Disguise handshakes with TCP options.")
+	argDisguiseWindow = flag.Int("disguise-window", 64240, "Disguise option window.")
+	argDisguiseMSS    = flag.Int("disguise-mss", 1460, "Disguise option mss.")
+	argDisguiseWScale = flag.Int("disguise-wscale", 7, "Disguise option wscale.")
+	argDisguiseSACK   = flag.Bool("disguise-sack", true, "Disguise option sack.")
+	argDisguiseTS     = flag.Bool("disguise-timestamps", true, "Disguise option timestamps.")
+	argPadding        = flag.Bool("padding", false, "Pad packets.")
+	argBucket         = flag.Bool("bucket", false, "Pad packets to buckets.")
 	argPublish        = flag.String("publish", "", "ARP publishing address.")
-	argFragment       = flag.Int("fragment", pcap.MaxEthernetMTU, "Fragmentation size for listening.")
+	argFragment       = config.BytesFlag("fragment", pcap.MaxEthernetMTU, "Fragmentation size for listening.")
 	argUpPort         = flag.Int("p", 0, "Port for routing upstream.")
 	argSources        = flag.String("r", "", "Sources.")
 	argServer         = flag.String("s", "", "Server.")
+	argDiscover       = flag.Bool("discover", false, "Discover the server.")
+	argAdmin          = flag.String("admin", "", "Unix socket for admin commands.")
+	argSocks          = flag.String("socks", "", "Local address of SOCKS5 proxy.")
+	argKeepAlive      = config.SecondsFlag("keepalive", 0, "Interval of sending keep-alives to the server.")
 )
 
 var (
-	publishIP  *net.IPAddr
-	fragment   int
-	upPort     uint16
-	sources    []*net.IPAddr
-	serverIP   net.IP
-	serverPort uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
+	publishIP    *net.IPAddr
+	fragment     int
+	upPort       uint16
+	sources      []*net.IPAddr
+	serverIP     net.IP
+	serverPort   uint16
+	listenDevs   []*pcap.Device
+	upDev        *pcap.Device
+	gatewayDev   *pcap.Device
+	mode         string
+	crypt        crypto.Crypt
+	fingerprint  string
+	mtu          int
+	isKCP        bool
+	kcpConfig    *config.KCPConfig
+	socksAddr    string
+	keepAliveInt time.Duration
 )
 
 var (
@@ -109,6 +129,7 @@ type natIndicator struct {
 	monitor     *stat.TrafficMonitor
 	dnsLock     sync.RWMutex
 	dns         map[string]string
+	console     *admin.Admin
 )
 
 func init() {
@@ -177,8 +198,11 @@ func main() {
 		cfg.Password = *argPassword
 		cfg.Rule = *argRule
 		cfg.Monitor = *argMonitor
+		cfg.Metrics = *argMetrics
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		cfg.LogJSON = *argLogJSON
+		cfg.LogLevel = *argLogLevel
 		cfg.MTU = *argMTU
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
@@ -192,15 +216,46 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.Disguise = *argDisguise
+		cfg.DisguiseConfig = *config.NewDisguiseConfig()
+		cfg.DisguiseConfig.Window = *argDisguiseWindow
+		cfg.DisguiseConfig.MSS = *argDisguiseMSS
+		cfg.DisguiseConfig.WindowScale = *argDisguiseWScale
+		cfg.DisguiseConfig.SACK = *argDisguiseSACK
+		cfg.DisguiseConfig.Timestamps = *argDisguiseTS
+		cfg.Padding = *argPadding
+		cfg.Bucket = *argBucket
 		cfg.Publish = *argPublish
 		cfg.Fragment = *argFragment
 		cfg.Port = *argUpPort
 		cfg.Sources = splitArg(*argSources)
 		cfg.Server = *argServer
+		cfg.Discover = *argDiscover
+		cfg.Admin = *argAdmin
+		cfg.Socks = *argSocks
+		cfg.KeepAlive = *argKeepAlive
+	}
+
+	// Print configuration
+	if *argPrintConfig {
+		b, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			log.Fatalln(fmt.Errorf("print configuration: %w", err))
+		}
+		fmt.Println(string(b))
+		os.Exit(0)
 	}
 
 	// Log
 	log.SetVerbose(cfg.Verbose || *argVerbose)
+	if cfg.LogLevel != "" {
+		level, err := log.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("log level: %w", err))
+		}
+		log.SetLevel(level)
+	}
+	log.SetJSON(cfg.LogJSON || *argLogJSON)
 	err = log.SetLog(cfg.Log)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("log %s: %w", cfg.Log, err))
@@ -280,16 +335,28 @@ func main() {
 	if cfg.KCPConfig.NC < 0 {
 		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
 	}
+	if cfg.DisguiseConfig.Window <= 0 || cfg.DisguiseConfig.Window > 65535 {
+		log.Fatalln(fmt.Errorf("disguise window %d out of range", cfg.DisguiseConfig.Window))
+	}
+	if cfg.DisguiseConfig.MSS < 0 || cfg.DisguiseConfig.MSS > 65535 {
+		log.Fatalln(fmt.Errorf("disguise mss %d out of range", cfg.DisguiseConfig.MSS))
+	}
+	if cfg.DisguiseConfig.WindowScale < -1 || cfg.DisguiseConfig.WindowScale > 14 {
+		log.Fatalln(fmt.Errorf("disguise wscale %d out of range", cfg.DisguiseConfig.WindowScale))
+	}
 	if cfg.Fragment < 576 || cfg.Fragment > pcap.MaxMTU {
 		log.Fatalln(fmt.Errorf("fragment %d out of range", cfg.Fragment))
 	}
 	if cfg.Port < 0 || cfg.Port > 65535 {
 		log.Fatalln(fmt.Errorf("upstream port %d out of range", cfg.Port))
 	}
-	if len(cfg.Sources) <= 0 {
-		log.Fatalln("Please provide sources by -r addresses.")
+	if cfg.KeepAlive < 0 {
+		log.Fatalln(fmt.Errorf("keepalive %s out of range", cfg.KeepAlive))
 	}
-	if cfg.Server == "" {
+	if len(cfg.Sources) <= 0 && cfg.Socks == "" {
+		log.Fatalln("Please provide sources by -r addresses or SOCKS5 proxy by -socks address.")
+	}
+	if cfg.Server == "" && !cfg.Discover {
 		log.Fatalln("Please provide server by -s address.")
 	}
 
@@ -311,7 +378,7 @@ func main() {
 
 		listenDevs = result
 	}
-	if len(listenDevs) <= 0 {
+	if len(listenDevs) <= 0 && len(cfg.Sources) > 0 {
 		log.Fatalln(errors.New("cannot determine listen device"))
 	}
 
@@ -337,6 +404,9 @@ func main() {
 	case "tcp":
 		mode = "tcp"
 		log.Infoln("Use standard TCP")
+	case "udp":
+		mode = "udp"
+		log.Infoln("Use UDP")
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
 	}
@@ -346,9 +416,18 @@ func main() {
 	if err != nil {
 		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
 	}
+	err = crypto.SelfTest(crypt)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("crypto self-test with %s: %w", cfg.Method, err))
+	}
+	fingerprint = crypto.Fingerprint(cfg.Method, cfg.Password)
 	method := crypt.Method()
 	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
+		log.Infof("Encrypt with %s (fingerprint %s)\n", method, fingerprint)
+	}
+	// Only FakeTCP authenticates with hellos in handshakes
+	if method != crypto.MethodPlain && (mode != "faketcp" || !pcap.Features().Has(pcap.FeatureHello)) {
+		log.Infoln("WARNING: There is no authenticated handshake between client and server, mismatched methods or passwords will only surface as decrypt errors of every packet. Compare fingerprints on both sides if so.")
 	}
 
 	// Monitor
@@ -367,12 +446,14 @@ func main() {
 				Time    int                  `json:"time"`
 				Monitor *stat.TrafficMonitor `json:"monitor"`
 				Ping    int64                `json:"ping"`
+				Method  string               `json:"method"`
 			}{
 				Name:    name,
 				Version: versionInfo,
 				Time:    int(time.Now().Sub(startTime).Seconds()),
 				Monitor: monitor,
 				Ping:    pingTime,
+				Method:  crypt.Method().String(),
 			})
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
@@ -387,6 +468,21 @@ func main() {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
 			}
 		})
+		http.HandleFunc("/flows", func(w http.ResponseWriter, req *http.Request) {
+			b, err := json.Marshal(flowStatuses())
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+				return
+			}
+
+			// Handle CORS
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			_, err = io.WriteString(w, string(b))
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
 		http.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
 			type IPName struct {
 				IP   string `json:"ip"`
@@ -428,6 +524,32 @@ type IPName struct {
 		log.Infoln("You can now observe traffic on https://zhxie.github.io/ikago-web")
 	}
 
+	// Metrics
+	if cfg.Metrics != "" {
+		serveMetrics(cfg.Metrics)
+
+		log.Infof("Metrics on %s\n", cfg.Metrics)
+	}
+
+	// Admin
+	if cfg.Admin != "" {
+		console = admin.NewAdmin(false)
+		registerAdminCommands(console)
+
+		err := console.Listen(cfg.Admin)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("admin: %w", err))
+		}
+		go func() {
+			err := console.Serve()
+			if err != nil {
+				log.Errorln(fmt.Errorf("admin: %w", err))
+			}
+		}()
+
+		log.Infof("Admin on %s\n", cfg.Admin)
+	}
+
 	// Add rule
 	if cfg.Rule {
 		var (
@@ -467,8 +589,8 @@ type IPName struct {
 	// Mode-related options
 	switch mode {
 	case "faketcp":
-		// MTU
-		mtu = cfg.MTU
+		// MTU, segments should fit in the upstream device
+		mtu = upDev.FitMTU(int(cfg.MTU))
 		log.Infof("Set MTU to %d Bytes\n", mtu)
 
 		// KCP
@@ -477,7 +599,37 @@ type IPName struct {
 		if isKCP {
 			log.Infoln("Enable KCP")
 		}
-	case "tcp":
+
+		// Padding
+		if cfg.Padding {
+			err = pcap.SetFeatures(pcap.Features() | pcap.FeaturePadding)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("padding: %w", err))
+			}
+			log.Infoln("Enable padding")
+		}
+
+		// Bucket
+		if cfg.Bucket {
+			err = pcap.SetFeatures(pcap.Features() | pcap.FeatureBucket)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("bucket: %w", err))
+			}
+			log.Infoln("Enable bucket padding")
+		}
+
+		// Disguise
+		if cfg.Disguise {
+			pcap.SetDisguise(&pcap.Disguise{
+				Window:        uint16(cfg.DisguiseConfig.Window),
+				MSS:           uint16(cfg.DisguiseConfig.MSS),
+				WindowScale:   cfg.DisguiseConfig.WindowScale,
+				SACKPermitted: cfg.DisguiseConfig.SACK,
+				Timestamps:    cfg.DisguiseConfig.Timestamps,
+			})
+			log.Infoln("Disguise handshakes with TCP options")
+		}
+	case "tcp", "udp":
 		break
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", mode))
@@ -496,7 +648,7 @@ type IPName struct {
 	}
 
 	// Fragment
-	fragment = cfg.Fragment
+	fragment = int(cfg.Fragment)
 	log.Infof("Set fragment to %d Bytes\n", fragment)
 
 	// Randomize upstream port
@@ -519,6 +671,16 @@ type IPName struct {
 	}
 
 	// Server
+	if cfg.Server == "" {
+		if method == crypto.MethodPlain {
+			log.Fatalln(errors.New("discovery requires encryption"))
+		}
+
+		cfg.Server, err = discoverServer(cfg.Password)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("discover: %w", err))
+		}
+	}
 	serverAddr, err := addr.ParseTCPAddr(cfg.Server)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("parse server %s: %w", cfg.Server, err))
@@ -537,14 +699,29 @@ type IPName struct {
 			} else {
 				log.Infoln("Add firewall rule")
 			}
-		case "tcp":
+		case "tcp", "udp":
 			break
 		default:
 			log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
 		}
 	}
 
-	if len(sources) == 1 {
+	// SOCKS5
+	socksAddr = cfg.Socks
+
+	// Keep-alive
+	keepAliveInt = time.Duration(cfg.KeepAlive)
+	if keepAliveInt > 0 && (mode != "faketcp" || isKCP) {
+		keepAliveInt = 0
+		log.Infoln("WARNING: Keep-alives are only sent in mode faketcp without KCP, do not send keep-alives to the server.")
+	}
+	if keepAliveInt > 0 {
+		log.Infof("Send keep-alives to the server every %s\n", keepAliveInt)
+	}
+
+	if len(sources) == 0 {
+		log.Infof("Proxy through :%d to %s\n", upPort, serverAddr)
+	} else if len(sources) == 1 {
 		log.Infof("Proxy %s through :%d to %s\n", sources[0], upPort, serverAddr)
 	} else {
 		log.Infoln("Proxy:")
@@ -558,7 +735,7 @@ type IPName struct {
 	}
 
 	// Wait signals
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sig
@@ -576,7 +753,16 @@ type IPName struct {
 func open() error {
 	var err error
 
-	if len(listenDevs) == 1 {
+	// Verify
+	err = upDev.CheckAddr()
+	if err != nil {
+		return fmt.Errorf("upstream device: %w", err)
+	}
+
+	if len(sources) == 0 {
+		// Only SOCKS5 is served
+		listenDevs = nil
+	} else if len(listenDevs) == 1 {
 		log.Infof("Listen on %s\n", listenDevs[0].String())
 	} else {
 		log.Infoln("Listen on:")
@@ -640,6 +826,8 @@ func open() error {
 		}
 	case "tcp":
 		upConn, err = pcap.DialTCP(upDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt)
+	case "udp":
+		upConn, err = pcap.DialUDP(upDev, upPort, &net.UDPAddr{IP: serverIP, Port: int(serverPort)}, crypt)
 	default:
 		err = fmt.Errorf("mode %s not support", mode)
 	}
@@ -681,6 +869,15 @@ func open() error {
 		}()
 	}
 
+	// SOCKS5
+	if socksAddr != "" {
+		err = listenSocks(socksAddr)
+		if err != nil {
+			return fmt.Errorf("listen socks %s: %w", socksAddr, err)
+		}
+		log.Infof("Serve SOCKS5 on %s\n", socksAddr)
+	}
+
 	// Start handling
 	for i := 0; i < len(listenConns); i++ {
 		conn := listenConns[i]
@@ -692,6 +889,7 @@ func open() error {
 					if isClosed {
 						return
 					}
+					countError(errorReadListen)
 					log.Errorln(fmt.Errorf("read listen device %s: %w", conn.LocalDev().Alias(), err))
 					continue
 				}
@@ -701,11 +899,18 @@ func open() error {
 		}()
 	}
 
+	go sweepFlows()
+
+	if keepAliveInt > 0 {
+		go keepAliveServer()
+	}
+
 	go func() {
 		for cp := range c {
 			err := handleListen(cp.Packet, cp.Conn)
 			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
+				countError(errorHandleListen)
+				log.With(log.Fields{"device": cp.Conn.LocalDev().Alias(), "size": len(cp.Packet.Data())}).Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
 				log.Verboseln(cp.Packet)
 				continue
 			}
@@ -713,6 +918,7 @@ func open() error {
 	}()
 
 	b := make([]byte, pcap.IPv4MaxSize)
+	decoder := pcap.NewEmbDecoder()
 	for {
 		n, err := upConn.Read(b)
 		if err != nil {
@@ -722,13 +928,15 @@ func open() error {
 			if errors.Is(err, io.EOF) {
 				log.Fatalf("Connection to server %s is closed, is the server or your network down?\n", upConn.RemoteAddr())
 			}
+			countError(errorReadUpstream)
 			log.Errorln(fmt.Errorf("read upstream: %w", err))
 			continue
 		}
 
-		err = handleUpstream(b[:n])
+		err = handleUpstream(b[:n], decoder)
 		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", upConn.LocalAddr().String(), err))
+			countError(errorHandleUpstream)
+			log.With(log.Fields{"server": upConn.RemoteAddr().String(), "size": n}).Errorln(fmt.Errorf("handle upstream in address %s: %w", upConn.LocalAddr().String(), err))
 			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", upConn.RemoteAddr().String(), n)
 			continue
 		}
@@ -745,9 +953,42 @@ func closeAll() {
 	if upConn != nil {
 		upConn.Close()
 	}
+	if socksListener != nil {
+		socksListener.Close()
+	}
 	if pinger != nil {
 		pinger.Stop()
 	}
+	if console != nil {
+		console.Close()
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+}
+
+// keepAliveServer sends keep-alives to the server periodically, so mappings of middleboxes in the path stay and the
+// server never drops the client as idle. Keep-alives are not sent if the server does not negotiate them.
+func keepAliveServer() {
+	ticker := time.NewTicker(keepAliveInt)
+	defer ticker.Stop()
+
+	data := pcap.CreateKeepAlive(pcap.KeepAliveRequest)
+	for range ticker.C {
+		if isClosed {
+			return
+		}
+
+		if !pcap.SupportsKeepAlive(upConn) {
+			continue
+		}
+
+		_, err := upConn.Write(data)
+		if err != nil {
+			log.Errorln(fmt.Errorf("keep alive: %w", err))
+			continue
+		}
+	}
 }
 
 func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
@@ -879,17 +1120,19 @@ func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 
 	// Statistics
 	size := indicator.MTU()
+	addFlowUp(indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size, pcap.CaptureTime(packet))
+	traffic.Add(stat.DirectionOut, statProtocol(indicator), size)
 	if monitor != nil {
 		monitor.AddBidirectional(indicator.SrcIP().String(), indicator.DstIP().String(), stat.DirectionOut, uint(size))
 	}
 
-	log.Verbosef("Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
-		indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
+	log.VerboseWith(log.Fields{"protocol": indicator.TransportProtocol().String(), "src": indicator.Src().String(), "dst": indicator.Dst().String(), "size": size},
+		"Redirect an outbound %s packet: %s -> %s (%d Bytes)\n", indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
 
 	return nil
 }
 
-func handleUpstream(contents []byte) error {
+func handleUpstream(contents []byte, decoder *pcap.Decoder) error {
 	var (
 		err              error
 		embIndicator     *pcap.PacketIndicator
@@ -904,12 +1147,31 @@ func handleUpstream(contents []byte) error {
 		return nil
 	}
 
+	// Keep-alive
+	switch pcap.ParseKeepAlive(contents) {
+	case pcap.KeepAliveRequest:
+		_, err = upConn.Write(pcap.CreateKeepAlive(pcap.KeepAliveReply))
+		if err != nil {
+			return fmt.Errorf("reply keep-alive: %w", err)
+		}
+		log.Verboseln("Reply a keep-alive to the server")
+		return nil
+	case pcap.KeepAliveReply:
+		log.Verboseln("Receive a keep-alive from the server")
+		return nil
+	}
+
 	// Parse embedded packet
-	embIndicator, err = pcap.ParseEmbPacket(contents)
+	embIndicator, err = decoder.Decode(contents)
 	if err != nil {
 		return fmt.Errorf("parse embedded packet: %w", err)
 	}
 
+	// SOCKS5
+	if handleSocks(embIndicator) {
+		return nil
+	}
+
 	// Check map
 	natLock.RLock()
 	ni, ok := nat[embIndicator.DstIP().String()]
@@ -952,15 +1214,17 @@ func handleUpstream(contents []byte) error {
 		}
 
 		if i == len(fragments)-1 {
-			log.Verbosef("Redirect an inbound %s packet: %s <- %s (%d Bytes)\n",
-				embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
+			log.VerboseWith(log.Fields{"protocol": embIndicator.TransportProtocol().String(), "src": embIndicator.Src().String(), "dst": embIndicator.Dst().String(), "size": embIndicator.Size()},
+				"Redirect an inbound %s packet: %s <- %s (%d Bytes)\n", embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
 		} else {
-			log.Verbosef("Redirect an inbound %s packet: %s <- %s (...)\n",
-				embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String())
+			log.VerboseWith(log.Fields{"protocol": embIndicator.TransportProtocol().String(), "src": embIndicator.Src().String(), "dst": embIndicator.Dst().String()},
+				"Redirect an inbound %s packet: %s <- %s (...)\n", embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String())
 		}
 	}
 
 	// Statistics
+	addFlowDown(embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size(), time.Now())
+	traffic.Add(stat.DirectionIn, statProtocol(embIndicator), embIndicator.Size())
 	if monitor != nil {
 		monitor.AddBidirectional(embIndicator.DstIP().String(), embIndicator.SrcIP().String(), stat.DirectionIn, uint(embIndicator.Size()))
 	}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/stat"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// errorCategory describes where an error is raised in handling packets.
+type errorCategory int
+
+const (
+	errorReadListen errorCategory = iota
+	errorHandleListen
+	errorReadUpstream
+	errorHandleUpstream
+	errorCategories
+)
+
+func (c errorCategory) String() string {
+	switch c {
+	case errorReadListen:
+		return "read-listen"
+	case errorHandleListen:
+		return "handle-listen"
+	case errorReadUpstream:
+		return "read-upstream"
+	case errorHandleUpstream:
+		return "handle-upstream"
+	default:
+		return fmt.Sprintf("%d", c)
+	}
+}
+
+var (
+	errorCounts [errorCategories]uint64
+	traffic     = stat.NewProtocolCounter()
+	metricsSrv  *http.Server
+)
+
+// countError records an error in the category.
+func countError(c errorCategory) {
+	atomic.AddUint64(&errorCounts[c], 1)
+}
+
+// statProtocol returns the protocol of the packet in statistics.
+func statProtocol(indicator *pcap.PacketIndicator) stat.Protocol {
+	if indicator.TransportLayer() == nil {
+		return stat.ProtocolOther
+	}
+
+	switch indicator.TransportLayer().LayerType() {
+	case layers.LayerTypeTCP:
+		return stat.ProtocolTCP
+	case layers.LayerTypeUDP:
+		return stat.ProtocolUDP
+	case layers.LayerTypeICMPv4:
+		return stat.ProtocolICMPv4
+	default:
+		return stat.ProtocolOther
+	}
+}
+
+// serveMetrics serves metrics in Prometheus text format on /metrics of the address.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		err := writeMetrics(stat.NewPrometheusWriter(w))
+		if err != nil {
+			log.Errorln(fmt.Errorf("metrics: %w", err))
+		}
+	})
+
+	metricsSrv = &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		err := metricsSrv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorln(fmt.Errorf("metrics: %w", err))
+		}
+	}()
+}
+
+func writeMetrics(p *stat.PrometheusWriter) error {
+	stats := traffic.Stats()
+	for _, s := range stats {
+		protocol := strings.ToLower(s.Protocol)
+		p.Counter("ikago_packets_total", "Embedded packets forwarded.", s.InPackets, "direction", "in", "protocol", protocol)
+		p.Counter("ikago_packets_total", "Embedded packets forwarded.", s.OutPackets, "direction", "out", "protocol", protocol)
+	}
+	for _, s := range stats {
+		protocol := strings.ToLower(s.Protocol)
+		p.Counter("ikago_bytes_total", "Bytes of embedded packets forwarded.", s.InBytes, "direction", "in", "protocol", protocol)
+		p.Counter("ikago_bytes_total", "Bytes of embedded packets forwarded.", s.OutBytes, "direction", "out", "protocol", protocol)
+	}
+
+	p.Counter("ikago_decrypt_failures_total", "Payloads from the server failed to decrypt.", pcap.DecryptFailures())
+
+	for category := errorCategory(0); category < errorCategories; category++ {
+		p.Counter("ikago_errors_total", "Errors in handling packets.", atomic.LoadUint64(&errorCounts[category]), "category", category.String())
+	}
+
+	natLock.RLock()
+	numNAT := len(nat)
+	natLock.RUnlock()
+	p.Gauge("ikago_nat_entries", "Entries in NAT.", numNAT)
+
+	flowsLock.Lock()
+	numFlows := len(flows)
+	flowsLock.Unlock()
+	p.Gauge("ikago_flows", "Flows seen recently.", numFlows)
+
+	p.Gauge("ikago_queued_packets", "Packets queued for handling.", len(c), "queue", "listen")
+
+	return p.Err()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/socks"
+	"github.com/zhxie/ikago/internal/stat"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// socksIP is the source of embedded packets of SOCKS connections. It is reserved for benchmarking so it never
+// conflicts with sources.
+var socksIP = net.IPv4(198, 18, 0, 1).To4()
+
+// socksHandshakeTimeout is the max duration of negotiating and connecting a SOCKS connection.
+const socksHandshakeTimeout = 10 * time.Second
+
+// socksFlow describes a SOCKS connection in the tunnel.
+type socksFlow interface {
+	// handle handles an inbound embedded packet of the flow.
+	handle(indicator *pcap.PacketIndicator)
+}
+
+type socksGuide struct {
+	protocol gopacket.LayerType
+	port     uint16
+}
+
+var (
+	socksListener net.Listener
+	socksLock     sync.RWMutex
+	socksFlows    = make(map[socksGuide]socksFlow)
+	socksNextPort uint16
+)
+
+// mapSocksPort maps the flow to a free port of the protocol in the dynamic range.
+func mapSocksPort(protocol gopacket.LayerType, flow socksFlow) (uint16, error) {
+	socksLock.Lock()
+	defer socksLock.Unlock()
+
+	for i := 0; i < 16384; i++ {
+		port := 49152 + socksNextPort%16384
+		socksNextPort++
+
+		guide := socksGuide{protocol: protocol, port: port}
+		_, ok := socksFlows[guide]
+		if !ok {
+			socksFlows[guide] = flow
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%s ports exhausted", protocol)
+}
+
+func unmapSocksPort(protocol gopacket.LayerType, port uint16) {
+	socksLock.Lock()
+	defer socksLock.Unlock()
+
+	delete(socksFlows, socksGuide{protocol: protocol, port: port})
+}
+
+// handleSocks hands an inbound embedded packet to its SOCKS connection, and returns false if the packet is not to
+// SOCKS connections.
+func handleSocks(indicator *pcap.PacketIndicator) bool {
+	if !indicator.DstIP().Equal(socksIP) {
+		return false
+	}
+
+	socksLock.RLock()
+	flow, ok := socksFlows[socksGuide{protocol: indicator.TransportProtocol(), port: indicator.DstPort()}]
+	socksLock.RUnlock()
+	if !ok {
+		log.Verbosef("Drop an inbound %s packet to closed SOCKS connection: %s <- %s\n", indicator.TransportProtocol(), indicator.Dst(), indicator.Src())
+		return true
+	}
+
+	flow.handle(indicator)
+
+	addFlowDown(indicator.TransportProtocol(), indicator.Dst().String(), indicator.Src().String(), indicator.Size(), time.Now())
+	if monitor != nil {
+		monitor.AddBidirectional(indicator.DstIP().String(), indicator.SrcIP().String(), stat.DirectionIn, uint(indicator.Size()))
+	}
+
+	return true
+}
+
+// writeSocksPacket writes an embedded packet with the transport layer and the data to the destination.
+func writeSocksPacket(transportLayer gopacket.TransportLayer, dstIP net.IP, id uint16, data []byte) error {
+	networkLayer, err := pcap.CreateIPv4Layer(socksIP, dstIP, id, 64, transportLayer)
+	if err != nil {
+		return fmt.Errorf("create network layer: %w", err)
+	}
+
+	b, err := pcap.Serialize(networkLayer, transportLayer.(gopacket.SerializableLayer), gopacket.Payload(data))
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	_, err = upConn.Write(b)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Statistics
+	var srcPort, dstPort int
+	switch t := transportLayer.(type) {
+	case *layers.TCP:
+		srcPort, dstPort = int(t.SrcPort), int(t.DstPort)
+	case *layers.UDP:
+		srcPort, dstPort = int(t.SrcPort), int(t.DstPort)
+	}
+	src := &net.TCPAddr{IP: socksIP, Port: srcPort}
+	dst := &net.TCPAddr{IP: dstIP, Port: dstPort}
+	addFlowUp(transportLayer.LayerType(), src.String(), dst.String(), len(b), time.Now())
+	if monitor != nil {
+		monitor.AddBidirectional(socksIP.String(), dstIP.String(), stat.DirectionOut, uint(len(b)))
+	}
+
+	return nil
+}
+
+// listenSocks serves SOCKS5 connections on the address.
+func listenSocks(address string) error {
+	var err error
+
+	socksListener, err = net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := socksListener.Accept()
+			if err != nil {
+				if isClosed {
+					return
+				}
+				log.Errorln(fmt.Errorf("accept socks: %w", err))
+				continue
+			}
+
+			go func() {
+				err := serveSocks(conn)
+				if err != nil {
+					log.Errorln(fmt.Errorf("socks %s: %w", conn.RemoteAddr(), err))
+				}
+			}()
+		}
+	}()
+
+	return nil
+}
+
+func serveSocks(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+
+	err := socks.Handshake(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	req, err := socks.ReadRequest(conn)
+	if err != nil {
+		if errors.Is(err, socks.ErrAddrNotSupported) {
+			socks.WriteReply(conn, socks.ReplyAddrNotSupported, nil, 0)
+		}
+		conn.Close()
+		return fmt.Errorf("read request: %w", err)
+	}
+
+	switch req.Command {
+	case socks.CommandConnect:
+		return serveSocksConnect(conn, req.Addr)
+	case socks.CommandUDPAssociate:
+		return serveSocksUDPAssociate(conn)
+	default:
+		socks.WriteReply(conn, socks.ReplyCommandNotSupported, nil, 0)
+		conn.Close()
+		return fmt.Errorf("command %d not support", req.Command)
+	}
+}
+
+func serveSocksConnect(conn net.Conn, address string) error {
+	dst, err := net.ResolveTCPAddr("tcp4", address)
+	if err != nil {
+		socks.WriteReply(conn, socks.ReplyHostUnreachable, nil, 0)
+		conn.Close()
+		return fmt.Errorf("resolve %s: %w", address, err)
+	}
+
+	s, err := newTCPStream(conn, dst)
+	if err != nil {
+		socks.WriteReply(conn, socks.ReplyFailure, nil, 0)
+		conn.Close()
+		return fmt.Errorf("stream: %w", err)
+	}
+
+	err = s.connect(socksHandshakeTimeout)
+	if err != nil {
+		reply := byte(socks.ReplyHostUnreachable)
+		if errors.Is(err, errStreamRefused) {
+			reply = socks.ReplyConnectionRefused
+		}
+		socks.WriteReply(conn, reply, nil, 0)
+		return fmt.Errorf("connect %s: %w", dst, err)
+	}
+
+	err = socks.WriteReply(conn, socks.ReplySucceeded, socksIP, s.port)
+	if err != nil {
+		s.lock.Lock()
+		s.close(err, true)
+		s.lock.Unlock()
+		s.release()
+		return fmt.Errorf("reply: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	log.Infof("SOCKS connect from %s to %s\n", conn.RemoteAddr(), dst)
+	s.run()
+	log.Infof("SOCKS disconnect from %s to %s\n", conn.RemoteAddr(), dst)
+
+	return nil
+}
+
+// udpAssociation describes a SOCKS UDP association, which lasts as long as the connection of its request.
+type udpAssociation struct {
+	conn       net.Conn
+	packetConn *net.UDPConn
+	port       uint16
+	id         uint16
+	lock       sync.Mutex
+	// client is the address the client sends datagrams from.
+	client *net.UDPAddr
+}
+
+func serveSocksUDPAssociate(conn net.Conn) error {
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		socks.WriteReply(conn, socks.ReplyFailure, nil, 0)
+		conn.Close()
+		return fmt.Errorf("parse local address: %w", err)
+	}
+
+	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)})
+	if err != nil {
+		socks.WriteReply(conn, socks.ReplyFailure, nil, 0)
+		conn.Close()
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	a := &udpAssociation{conn: conn, packetConn: packetConn}
+	a.port, err = mapSocksPort(layers.LayerTypeUDP, a)
+	if err != nil {
+		socks.WriteReply(conn, socks.ReplyFailure, nil, 0)
+		packetConn.Close()
+		conn.Close()
+		return fmt.Errorf("map: %w", err)
+	}
+	defer func() {
+		unmapSocksPort(layers.LayerTypeUDP, a.port)
+		packetConn.Close()
+		conn.Close()
+	}()
+
+	localAddr := packetConn.LocalAddr().(*net.UDPAddr)
+	err = socks.WriteReply(conn, socks.ReplySucceeded, localAddr.IP, uint16(localAddr.Port))
+	if err != nil {
+		return fmt.Errorf("reply: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	log.Infof("SOCKS associate from %s on %s\n", conn.RemoteAddr(), localAddr)
+	go a.relay()
+
+	// The association terminates when the connection closes
+	io.Copy(ioutil.Discard, conn)
+	log.Infof("SOCKS dissociate from %s\n", conn.RemoteAddr())
+
+	return nil
+}
+
+// relay sends datagrams from the client to their destinations.
+func (a *udpAssociation) relay() {
+	clientIP := a.conn.RemoteAddr().(*net.TCPAddr).IP
+
+	b := make([]byte, pcap.IPv4MaxSize)
+	for {
+		n, addr, err := a.packetConn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(clientIP) {
+			log.Verbosef("Drop a SOCKS datagram from %s out of association\n", addr)
+			continue
+		}
+
+		address, data, err := socks.ParseDatagram(b[:n])
+		if err != nil {
+			log.Verboseln(fmt.Errorf("parse socks datagram from %s: %w", addr, err))
+			continue
+		}
+		dst, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			log.Errorln(fmt.Errorf("resolve %s: %w", address, err))
+			continue
+		}
+
+		a.lock.Lock()
+		a.client = addr
+		err = writeSocksPacket(pcap.CreateUDPLayer(a.port, uint16(dst.Port)), dst.IP, a.id, data)
+		a.id++
+		a.lock.Unlock()
+		if err != nil {
+			log.Errorln(fmt.Errorf("write socks datagram to %s: %w", dst, err))
+		}
+	}
+}
+
+func (a *udpAssociation) handle(indicator *pcap.PacketIndicator) {
+	a.lock.Lock()
+	client := a.client
+	a.lock.Unlock()
+	if client == nil {
+		return
+	}
+
+	b := socks.CreateDatagram(indicator.SrcIP(), indicator.SrcPort(), indicator.TransportLayer().LayerPayload())
+	_, err := a.packetConn.WriteToUDP(b, client)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("write socks datagram to %s: %w", client, err))
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// streamMSS is the max segment size of streams, leaving room for the tunnel overhead in the MTU.
+const streamMSS = 1200
+
+// streamWindow is the max bytes in flight of streams as window scaling is not negotiated.
+const streamWindow = 65535
+
+// streamBuffer is the number of segments received but not yet written to the local connection.
+const streamBuffer = 64
+
+// streamRTO is the initial retransmission timeout of streams, which is doubled on each retransmission.
+const streamRTO = 500 * time.Millisecond
+
+const streamMaxRTO = 30 * time.Second
+
+// streamRetries is the number of retransmissions before a stream is aborted.
+const streamRetries = 8
+
+// streamLinger is the max duration to wait for the remote to close a stream after the local connection closes.
+const streamLinger = 60 * time.Second
+
+var (
+	errStreamRefused = errors.New("connection refused")
+	errStreamReset   = errors.New("connection reset")
+	errStreamTimeout = errors.New("retransmission timeout")
+)
+
+// tcpStream is a minimal TCP endpoint carrying a local connection to the destination as embedded packets in the
+// tunnel. Out of order segments are dropped and recovered by retransmission of the remote.
+type tcpStream struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	conn net.Conn
+	port uint16
+	dst  *net.TCPAddr
+	id   uint16
+	// iss is the initial sequence number.
+	iss    uint32
+	sndUna uint32
+	sndNxt uint32
+	sndWnd uint32
+	// unacked is the data sent but not acknowledged from sndUna, excluding the FIN.
+	unacked       []byte
+	rcvNxt        uint32
+	rto           time.Duration
+	retries       int
+	timer         *time.Timer
+	isEstablished bool
+	isFINSent     bool
+	isRemoteFIN   bool
+	isClosed      bool
+	err           error
+	established   chan struct{}
+	done          chan struct{}
+	// recv queues segments to the local connection, and is closed when the remote closes.
+	recv         chan []byte
+	isRecvClosed bool
+	written      chan struct{}
+}
+
+// newTCPStream returns a new stream from the local connection to the destination with a mapped port.
+func newTCPStream(conn net.Conn, dst *net.TCPAddr) (*tcpStream, error) {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("isn: %w", err)
+	}
+
+	s := &tcpStream{
+		conn:        conn,
+		dst:         dst,
+		iss:         binary.BigEndian.Uint32(b),
+		rto:         streamRTO,
+		established: make(chan struct{}),
+		done:        make(chan struct{}),
+		recv:        make(chan []byte, streamBuffer),
+		written:     make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.lock)
+
+	s.port, err = mapSocksPort(layers.LayerTypeTCP, s)
+	if err != nil {
+		return nil, fmt.Errorf("map: %w", err)
+	}
+
+	return s, nil
+}
+
+// connect handshakes with the destination.
+func (s *tcpStream) connect(timeout time.Duration) error {
+	s.lock.Lock()
+	s.sndUna = s.iss
+	s.sndNxt = s.iss + 1
+	err := s.send(s.iss, true, false, nil)
+	if err != nil {
+		s.close(err, false)
+		s.lock.Unlock()
+		s.release()
+		return err
+	}
+	s.arm()
+	s.lock.Unlock()
+
+	select {
+	case <-s.established:
+	case <-time.After(timeout):
+		s.lock.Lock()
+		s.close(errors.New("timeout"), false)
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	err = s.err
+	s.lock.Unlock()
+	if err != nil {
+		s.release()
+		return err
+	}
+
+	return nil
+}
+
+// run relays the local connection until the stream is closed.
+func (s *tcpStream) run() {
+	go s.deliver()
+
+	b := make([]byte, streamMSS)
+	for {
+		n, err := s.conn.Read(b)
+		if n > 0 {
+			if !s.write(b[:n]) {
+				break
+			}
+		}
+		if err != nil {
+			s.lock.Lock()
+			if errors.Is(err, io.EOF) {
+				s.closeWrite()
+			} else {
+				s.close(err, true)
+			}
+			s.lock.Unlock()
+			break
+		}
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(streamLinger):
+		s.lock.Lock()
+		s.close(errors.New("linger timeout"), true)
+		s.lock.Unlock()
+	}
+	<-s.written
+
+	s.release()
+}
+
+// release closes the local connection and unmaps the port.
+func (s *tcpStream) release() {
+	s.conn.Close()
+	unmapSocksPort(layers.LayerTypeTCP, s.port)
+}
+
+// deliver writes received segments to the local connection.
+func (s *tcpStream) deliver() {
+	defer close(s.written)
+
+	isFailed := false
+	for data := range s.recv {
+		if isFailed {
+			continue
+		}
+
+		_, err := s.conn.Write(data)
+		if err != nil {
+			isFailed = true
+
+			s.lock.Lock()
+			s.close(fmt.Errorf("write: %w", err), true)
+			s.lock.Unlock()
+		}
+	}
+
+	// The remote has closed
+	if !isFailed {
+		tcpConn, ok := s.conn.(*net.TCPConn)
+		if ok {
+			tcpConn.CloseWrite()
+		}
+	}
+}
+
+// write sends the data to the remote, and returns false if the stream is closed.
+func (s *tcpStream) write(data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Always allow a segment in flight to probe a zero window
+	for !s.isClosed && len(s.unacked) > 0 && len(s.unacked)+len(data) > s.window() {
+		s.cond.Wait()
+	}
+	if s.isClosed {
+		return false
+	}
+
+	err := s.send(s.sndNxt, false, false, data)
+	if err != nil {
+		s.close(err, false)
+		return false
+	}
+	if s.sndUna == s.sndNxt {
+		s.arm()
+	}
+	s.unacked = append(s.unacked, data...)
+	s.sndNxt = s.sndNxt + uint32(len(data))
+
+	return true
+}
+
+// window returns the bytes allowed in flight. lock must be held.
+func (s *tcpStream) window() int {
+	if s.sndWnd < streamWindow {
+		return int(s.sndWnd)
+	}
+
+	return streamWindow
+}
+
+// closeWrite sends a FIN to the remote. lock must be held.
+func (s *tcpStream) closeWrite() {
+	if s.isClosed || s.isFINSent {
+		return
+	}
+
+	err := s.send(s.sndNxt, false, true, nil)
+	if err != nil {
+		s.close(err, false)
+		return
+	}
+	if s.sndUna == s.sndNxt {
+		s.arm()
+	}
+	s.sndNxt++
+	s.isFINSent = true
+}
+
+// close closes the stream with the error, and sends a RST if rst. It is safe to call it more than once. lock must be
+// held.
+func (s *tcpStream) close(err error, rst bool) {
+	if s.isClosed {
+		return
+	}
+	s.isClosed = true
+	s.err = err
+
+	if rst && s.isEstablished {
+		tcpLayer := pcap.CreateTCPLayer(s.port, uint16(s.dst.Port), s.sndNxt, s.rcvNxt)
+		pcap.FlagTCPLayer(tcpLayer, false, false, false)
+		tcpLayer.RST = true
+		s.writeLayer(tcpLayer, nil)
+	}
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	if !s.isEstablished {
+		close(s.established)
+	}
+	if !s.isRecvClosed {
+		s.isRecvClosed = true
+		close(s.recv)
+	}
+	// Unblock reading and writing of the local connection
+	if err != nil {
+		s.conn.SetDeadline(time.Now())
+	}
+	s.cond.Broadcast()
+	close(s.done)
+}
+
+// arm starts the retransmission timer. lock must be held.
+func (s *tcpStream) arm() {
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.rto, s.retransmit)
+	} else {
+		s.timer.Reset(s.rto)
+	}
+}
+
+// retransmit resends unacknowledged segments from sndUna.
+func (s *tcpStream) retransmit() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.isClosed || s.sndUna == s.sndNxt {
+		return
+	}
+
+	s.retries++
+	if s.retries > streamRetries {
+		s.close(errStreamTimeout, true)
+		return
+	}
+
+	var err error
+	if !s.isEstablished {
+		err = s.send(s.iss, true, false, nil)
+	} else {
+		seq := s.sndUna
+		for i := 0; i < len(s.unacked) && (i == 0 || i < s.window()); i = i + streamMSS {
+			end := i + streamMSS
+			if end > len(s.unacked) {
+				end = len(s.unacked)
+			}
+
+			err = s.send(seq, false, false, s.unacked[i:end])
+			if err != nil {
+				break
+			}
+			seq = seq + uint32(end-i)
+		}
+		if err == nil && s.isFINSent && seq == s.sndNxt-1 {
+			err = s.send(seq, false, true, nil)
+		}
+	}
+	if err != nil {
+		s.close(err, false)
+		return
+	}
+
+	s.rto = s.rto * 2
+	if s.rto > streamMaxRTO {
+		s.rto = streamMaxRTO
+	}
+	s.arm()
+}
+
+// handle handles an inbound embedded packet of the stream.
+func (s *tcpStream) handle(indicator *pcap.PacketIndicator) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.isClosed {
+		return
+	}
+
+	tcpLayer := indicator.TCPLayer()
+
+	if tcpLayer.RST {
+		if s.isEstablished {
+			s.close(errStreamReset, false)
+		} else {
+			s.close(errStreamRefused, false)
+		}
+		return
+	}
+
+	// Handshake
+	if !s.isEstablished {
+		if !tcpLayer.SYN || !tcpLayer.ACK || tcpLayer.Ack != s.iss+1 {
+			return
+		}
+
+		s.rcvNxt = tcpLayer.Seq + 1
+		s.sndUna = tcpLayer.Ack
+		s.sndWnd = uint32(tcpLayer.Window)
+		s.isEstablished = true
+		s.reset()
+		close(s.established)
+		s.ack()
+		return
+	}
+	if tcpLayer.SYN {
+		// The ACK to the SYN+ACK is lost
+		s.ack()
+		return
+	}
+
+	// Acknowledge
+	if tcpLayer.ACK {
+		if seqAfter(tcpLayer.Ack, s.sndUna) && !seqAfter(tcpLayer.Ack, s.sndNxt) {
+			n := int(tcpLayer.Ack - s.sndUna)
+			if n > len(s.unacked) {
+				// The FIN is acknowledged
+				n = len(s.unacked)
+			}
+			s.unacked = s.unacked[n:]
+			s.sndUna = tcpLayer.Ack
+
+			s.reset()
+			if s.sndUna != s.sndNxt {
+				s.arm()
+			}
+		}
+		s.sndWnd = uint32(tcpLayer.Window)
+		s.cond.Broadcast()
+	}
+
+	// Receive, segments which are out of order or cannot be queued are dropped and will be retransmitted
+	payload := indicator.TransportLayer().LayerPayload()
+	if len(payload) > 0 {
+		if tcpLayer.Seq == s.rcvNxt && !s.isRemoteFIN {
+			data := make([]byte, len(payload))
+			copy(data, payload)
+
+			select {
+			case s.recv <- data:
+				s.rcvNxt = s.rcvNxt + uint32(len(data))
+			default:
+				break
+			}
+		}
+		s.ack()
+	}
+	if tcpLayer.FIN && !s.isRemoteFIN && tcpLayer.Seq+uint32(len(payload)) == s.rcvNxt {
+		s.rcvNxt++
+		s.isRemoteFIN = true
+		s.isRecvClosed = true
+		close(s.recv)
+		s.ack()
+	}
+
+	if s.isRemoteFIN && s.isFINSent && s.sndUna == s.sndNxt {
+		s.close(nil, false)
+	}
+}
+
+// reset stops the retransmission timer and resets the timeout. lock must be held.
+func (s *tcpStream) reset() {
+	s.retries = 0
+	s.rto = streamRTO
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// ack sends an ACK to the remote. lock must be held.
+func (s *tcpStream) ack() {
+	tcpLayer := pcap.CreateTCPLayer(s.port, uint16(s.dst.Port), s.sndNxt, s.rcvNxt)
+	pcap.FlagTCPLayer(tcpLayer, false, false, true)
+
+	err := s.writeLayer(tcpLayer, nil)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("ack %s: %w", s.dst, err))
+	}
+}
+
+// send sends a SYN, a FIN or a segment with the data to the remote. lock must be held.
+func (s *tcpStream) send(seq uint32, syn, fin bool, data []byte) error {
+	var tcpLayer *layers.TCP
+	if syn {
+		tcpLayer = pcap.CreateTCPLayer(s.port, uint16(s.dst.Port), seq, 0)
+		pcap.FlagTCPLayer(tcpLayer, true, false, false)
+		tcpLayer.Options = append(tcpLayer.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindMSS,
+			OptionLength: 4,
+			OptionData:   []byte{byte(streamMSS >> 8), byte(streamMSS & 0xff)},
+		})
+	} else {
+		tcpLayer = pcap.CreateTCPLayer(s.port, uint16(s.dst.Port), seq, s.rcvNxt)
+		tcpLayer.FIN = fin
+	}
+
+	return s.writeLayer(tcpLayer, data)
+}
+
+// writeLayer writes the TCP layer with the data as an embedded packet. lock must be held.
+func (s *tcpStream) writeLayer(tcpLayer *layers.TCP, data []byte) error {
+	err := writeSocksPacket(tcpLayer, s.dst.IP, s.id, data)
+	if err != nil {
+		return err
+	}
+	s.id++
+
+	return nil
+}
+
+// seqAfter returns if the sequence number a is after b in serial number arithmetic.
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// aclRule describes a rule matching destinations of embedded packets.
+type aclRule struct {
+	ipNet *net.IPNet
+	// protocol is the transport protocol of the rule, which matches all protocols if it is 0.
+	protocol gopacket.LayerType
+	// minPort and maxPort are the port range of the rule, which matches all ports if both are 0.
+	minPort uint16
+	maxPort uint16
+}
+
+// parseACLRule returns the rule parsed from a string like "192.168.0.0/16", "0.0.0.0/0 tcp" or "0.0.0.0/0 tcp 25".
+// Ports can be a range like "1000-2000", and can only be used with TCP or UDP.
+func parseACLRule(s string) (aclRule, error) {
+	var rule aclRule
+
+	fields := strings.Fields(s)
+	if len(fields) <= 0 || len(fields) > 3 {
+		return aclRule{}, fmt.Errorf("invalid rule %s", s)
+	}
+
+	// CIDR
+	ipNet, err := parseIPNet(fields[0])
+	if err != nil {
+		return aclRule{}, err
+	}
+	rule.ipNet = ipNet
+
+	// Protocol
+	if len(fields) > 1 {
+		switch strings.ToLower(fields[1]) {
+		case "tcp":
+			rule.protocol = layers.LayerTypeTCP
+		case "udp":
+			rule.protocol = layers.LayerTypeUDP
+		case "icmp":
+			rule.protocol = layers.LayerTypeICMPv4
+		default:
+			return aclRule{}, fmt.Errorf("protocol %s not support", fields[1])
+		}
+	}
+
+	// Ports
+	if len(fields) > 2 {
+		if rule.protocol != layers.LayerTypeTCP && rule.protocol != layers.LayerTypeUDP {
+			return aclRule{}, fmt.Errorf("ports of protocol %s not support", fields[1])
+		}
+
+		ends := strings.Split(fields[2], "-")
+		if len(ends) > 2 {
+			return aclRule{}, fmt.Errorf("invalid ports %s", fields[2])
+		}
+		min, err := strconv.ParseUint(ends[0], 10, 16)
+		if err != nil {
+			return aclRule{}, fmt.Errorf("parse port %s: %w", ends[0], err)
+		}
+		max := min
+		if len(ends) > 1 {
+			max, err = strconv.ParseUint(ends[1], 10, 16)
+			if err != nil {
+				return aclRule{}, fmt.Errorf("parse port %s: %w", ends[1], err)
+			}
+		}
+		if min == 0 || min > max {
+			return aclRule{}, fmt.Errorf("ports %s out of range", fields[2])
+		}
+		rule.minPort, rule.maxPort = uint16(min), uint16(max)
+	}
+
+	return rule, nil
+}
+
+// parseIPNet returns the CIDR parsed from a string like "192.168.0.0/16". A single IP is taken as a CIDR of the IP
+// only.
+func parseIPNet(s string) (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err == nil {
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("parse cidr %s: %w", s, err)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// parseACLRules returns rules parsed from strings.
+func parseACLRules(strs []string) ([]aclRule, error) {
+	rules := make([]aclRule, 0)
+	for _, s := range strs {
+		rule, err := parseACLRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// match returns if the destination matches the rule. The port is ignored if the protocol is neither TCP nor UDP.
+func (r aclRule) match(protocol gopacket.LayerType, ip net.IP, port uint16) bool {
+	if !r.ipNet.Contains(ip) {
+		return false
+	}
+	if r.protocol != 0 && r.protocol != protocol {
+		return false
+	}
+	if r.minPort != 0 && (port < r.minPort || port > r.maxPort) {
+		return false
+	}
+
+	return true
+}
+
+func (r aclRule) String() string {
+	sb := strings.Builder{}
+
+	sb.WriteString(r.ipNet.String())
+	switch r.protocol {
+	case layers.LayerTypeTCP:
+		sb.WriteString(" tcp")
+	case layers.LayerTypeUDP:
+		sb.WriteString(" udp")
+	case layers.LayerTypeICMPv4:
+		sb.WriteString(" icmp")
+	}
+	if r.minPort == r.maxPort && r.minPort != 0 {
+		sb.WriteString(fmt.Sprintf(" %d", r.minPort))
+	} else if r.minPort != 0 {
+		sb.WriteString(fmt.Sprintf(" %d-%d", r.minPort, r.maxPort))
+	}
+
+	return sb.String()
+}
+
+// isAllowedDst returns if the destination may be reached by clients. Deny rules take precedence over allow rules, and
+// destinations are denied by default only if there are allow rules.
+func isAllowedDst(protocol gopacket.LayerType, ip net.IP, port uint16) bool {
+	for _, rule := range denyRules {
+		if rule.match(protocol, ip, port) {
+			return false
+		}
+	}
+
+	if len(allowRules) <= 0 {
+		return true
+	}
+	for _, rule := range allowRules {
+		if rule.match(protocol, ip, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAllowed returns if the destination of the embedded packet may be reached by clients.
+func isAllowed(indicator *pcap.PacketIndicator) bool {
+	var port uint16
+
+	t := indicator.TransportLayer().LayerType()
+	switch t {
+	case layers.LayerTypeTCP, layers.LayerTypeUDP:
+		port = indicator.DstPort()
+	}
+
+	return isAllowedDst(t, indicator.DstIP(), port)
+}
+
+// createRST returns an embedded TCP RST from the destination to the source of the TCP packet like the destination
+// refuses the connection. It returns nil if the packet is a RST which must not be answered.
+func createRST(indicator *pcap.PacketIndicator) ([]byte, error) {
+	tcpLayer := indicator.TCPLayer()
+	if tcpLayer.RST {
+		return nil, nil
+	}
+
+	newTCPLayer := &layers.TCP{
+		SrcPort:    tcpLayer.DstPort,
+		DstPort:    tcpLayer.SrcPort,
+		DataOffset: 5,
+		RST:        true,
+	}
+	if tcpLayer.ACK {
+		newTCPLayer.Seq = tcpLayer.Ack
+	} else {
+		newTCPLayer.ACK = true
+		newTCPLayer.Ack = tcpLayer.Seq + uint32(len(indicator.Payload()))
+		if tcpLayer.SYN {
+			newTCPLayer.Ack++
+		}
+		if tcpLayer.FIN {
+			newTCPLayer.Ack++
+		}
+	}
+
+	newIPv4Layer, err := pcap.CreateIPv4Layer(indicator.DstIP(), indicator.SrcIP(), 0, 64, newTCPLayer)
+	if err != nil {
+		return nil, fmt.Errorf("create network layer: %w", err)
+	}
+
+	data, err := pcap.Serialize(newIPv4Layer, newTCPLayer)
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"testing"
+)
+
+func TestParseACLRule(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+		ok   bool
+	}{
+		{"192.168.0.0/16", "192.168.0.0/16", true},
+		{"10.1.2.3", "10.1.2.3/32", true},
+		{"2001:db8::/32", "2001:db8::/32", true},
+		{"2001:db8::1", "2001:db8::1/128", true},
+		{"0.0.0.0/0 TCP", "0.0.0.0/0 tcp", true},
+		{"0.0.0.0/0 icmp", "0.0.0.0/0 icmp", true},
+		{"0.0.0.0/0 udp 53", "0.0.0.0/0 udp 53", true},
+		{"0.0.0.0/0 tcp 1000-2000", "0.0.0.0/0 tcp 1000-2000", true},
+		{"0.0.0.0/0 tcp 25-25", "0.0.0.0/0 tcp 25", true},
+		{"", "", false},
+		{"example.com", "", false},
+		{"0.0.0.0/0 sctp", "", false},
+		{"0.0.0.0/0 icmp 8", "", false},
+		{"0.0.0.0/0 tcp 0", "", false},
+		{"0.0.0.0/0 tcp 2000-1000", "", false},
+		{"0.0.0.0/0 tcp 1-2-3", "", false},
+		{"0.0.0.0/0 tcp 65536", "", false},
+		{"0.0.0.0/0 tcp 25 extra", "", false},
+	}
+
+	for _, tt := range tests {
+		rule, err := parseACLRule(tt.s)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("parse %q: %s, expect error", tt.s, rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse %q: %v", tt.s, err)
+			continue
+		}
+		if rule.String() != tt.want {
+			t.Errorf("parse %q: %s, expect %s", tt.s, rule, tt.want)
+		}
+	}
+}
+
+// setTestACL sets allow and deny rules, which are reset after the test.
+func setTestACL(t *testing.T, allow, deny []string) {
+	var err error
+
+	prevAllowRules, prevDenyRules := allowRules, denyRules
+	t.Cleanup(func() {
+		allowRules, denyRules = prevAllowRules, prevDenyRules
+	})
+
+	allowRules, err = parseACLRules(allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denyRules, err = parseACLRules(deny)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsAllowedDst(t *testing.T) {
+	tcp, udp, icmp := layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4
+
+	tests := []struct {
+		name     string
+		allow    []string
+		deny     []string
+		protocol gopacket.LayerType
+		ip       string
+		port     uint16
+		want     bool
+	}{
+		{"default allow", nil, nil, tcp, "203.0.113.1", 80, true},
+		{"default allow with deny", nil, []string{"10.0.0.0/8"}, tcp, "203.0.113.1", 80, true},
+		{"deny cidr", nil, []string{"10.0.0.0/8"}, udp, "10.1.2.3", 53, false},
+		{"deny protocol", nil, []string{"0.0.0.0/0 tcp"}, udp, "203.0.113.1", 25, true},
+		{"deny port", nil, []string{"0.0.0.0/0 tcp 25"}, tcp, "203.0.113.1", 25, false},
+		{"deny other port", nil, []string{"0.0.0.0/0 tcp 25"}, tcp, "203.0.113.1", 26, true},
+		{"deny port range start", nil, []string{"0.0.0.0/0 udp 1000-2000"}, udp, "203.0.113.1", 1000, false},
+		{"deny port range end", nil, []string{"0.0.0.0/0 udp 1000-2000"}, udp, "203.0.113.1", 2000, false},
+		{"deny out of port range", nil, []string{"0.0.0.0/0 udp 1000-2000"}, udp, "203.0.113.1", 2001, true},
+		{"default deny", []string{"192.168.0.0/16"}, nil, tcp, "203.0.113.1", 80, false},
+		{"allow cidr", []string{"192.168.0.0/16"}, nil, tcp, "192.168.1.1", 80, true},
+		{"allow port", []string{"0.0.0.0/0 tcp 443"}, nil, tcp, "203.0.113.1", 443, true},
+		{"allow other port", []string{"0.0.0.0/0 tcp 443"}, nil, tcp, "203.0.113.1", 80, false},
+		{"allow icmp", []string{"0.0.0.0/0 icmp"}, nil, icmp, "203.0.113.1", 0, true},
+		{"deny precedence", []string{"0.0.0.0/0"}, []string{"203.0.113.0/24 tcp 25"}, tcp, "203.0.113.1", 25, false},
+		{"deny precedence other port", []string{"0.0.0.0/0"}, []string{"203.0.113.0/24 tcp 25"}, tcp, "203.0.113.1", 80, true},
+		{"allow v6", []string{"2001:db8::/32"}, nil, tcp, "2001:db8::1", 80, true},
+		{"deny v6", nil, []string{"2001:db8::/32 udp"}, udp, "2001:db8::1", 53, false},
+		{"v6 rule against v4", []string{"::/0"}, nil, tcp, "203.0.113.1", 80, false},
+		{"v4 rule against v6", nil, []string{"0.0.0.0/0"}, tcp, "2001:db8::1", 80, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			setTestACL(t, tt.allow, tt.deny)
+
+			got := isAllowedDst(tt.protocol, net.ParseIP(tt.ip), tt.port)
+			if got != tt.want {
+				t.Errorf("allow %s %s:%d: %t, expect %t", tt.protocol, tt.ip, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	setTestACL(t, []string{"0.0.0.0/0 udp 53"}, nil)
+
+	tests := []struct {
+		port int
+		want bool
+	}{
+		{53, true},
+		{54, false},
+	}
+
+	for _, tt := range tests {
+		indicator, err := pcap.ParseEmbPacket(createEmbUDP(t, embSrcOf(0), &net.UDPAddr{IP: testDstAddr.IP, Port: tt.port}, 64, []byte("query")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := isAllowed(indicator)
+		if got != tt.want {
+			t.Errorf("allow %s: %t, expect %t", indicator.Dst(), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/admin"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+func registerAdminCommands(a *admin.Admin) {
+	a.Register("clients", "clients", adminClients)
+	a.Register("drops", "drops", adminDrops)
+	a.Register("health", "health", adminHealth)
+	a.Register("nat", "nat", adminNAT)
+	a.Register("routines", "routines", adminRoutines)
+	a.Register("sizes", "sizes", adminSizes)
+	a.Register("stats", "stats", adminStats)
+	a.RegisterMutating("drop-client", "drop-client <address>", adminDropClient)
+	a.RegisterMutating("drop-flow", "drop-flow <protocol> <address>", adminDropFlow)
+	a.RegisterMutating("snapshot", "snapshot <path> [json|envelope]", adminSnapshot)
+}
+
+func adminClients(args []string) (string, error) {
+	sb := strings.Builder{}
+	for _, status := range takeClientStats() {
+		sb.WriteString(fmt.Sprintf("%s\n", status))
+	}
+
+	return sb.String(), nil
+}
+
+func adminHealth(args []string) (string, error) {
+	if !isHealthy() {
+		return fmt.Sprintf("unhealthy, last packet %s ago\n", time.Now().Sub(lastActivity()).Truncate(time.Millisecond)), nil
+	}
+
+	return fmt.Sprintf("healthy, last packet %s ago\n", time.Now().Sub(lastActivity()).Truncate(time.Millisecond)), nil
+}
+
+func adminNAT(args []string) (string, error) {
+	lines := make([]string, 0)
+
+	nat.forEach(func(guide pcap.NATGuide, ni *natIndicator) {
+		lines = append(lines, fmt.Sprintf("%s %s -> %s (%s), seen %s ago", guide.Protocol, guide.Src, ni.embSrc, ni.src, time.Now().Sub(ni.lastSeen()).Truncate(time.Second)))
+	})
+
+	sort.Strings(lines)
+
+	sb := strings.Builder{}
+	for _, line := range lines {
+		sb.WriteString(fmt.Sprintf("%s\n", line))
+	}
+
+	return sb.String(), nil
+}
+
+func adminRoutines(args []string) (string, error) {
+	sb := strings.Builder{}
+	for _, r := range routines.Routines() {
+		sb.WriteString(fmt.Sprintf("%d %s (%s)\n", r.Id, r.Name, time.Now().Sub(r.Start).Truncate(time.Second)))
+	}
+
+	return sb.String(), nil
+}
+
+func adminSizes(args []string) (string, error) {
+	return sizes.String(), nil
+}
+
+func adminStats(args []string) (string, error) {
+	sb := strings.Builder{}
+
+	clientsLock.RLock()
+	clientsSize := len(clients)
+	clientsLock.RUnlock()
+
+	natSize := nat.size()
+
+	patLock.RLock()
+	flowsSize := countFlows()
+	patLock.RUnlock()
+
+	sb.WriteString(fmt.Sprintf("Time: %s\n", time.Now().Sub(startTime).Truncate(time.Second)))
+	if up := activeUpConn(); up != nil {
+		sb.WriteString(fmt.Sprintf("Upstream: %s\n", up.LocalDev().Alias()))
+	}
+	sb.WriteString(fmt.Sprintf("Clients: %d\n", clientsSize))
+	sb.WriteString(fmt.Sprintf("NAT: %d\n", natSize))
+	if maxFlows > 0 {
+		sb.WriteString(fmt.Sprintf("Flows: %d/%d\n", flowsSize, maxFlows))
+	} else {
+		sb.WriteString(fmt.Sprintf("Flows: %d\n", flowsSize))
+	}
+	sb.WriteString(fmt.Sprintf("NAT mismatches: %d\n", dropCount(dropMismatch)))
+	sb.WriteString(fmt.Sprintf("Queued: %d (peak %d/%d, %d dropped)\n", queued(), peakQueued(), queueSize, dropCount(dropQueueFull)))
+	sb.WriteString(fmt.Sprintf("Queued upstream: %d\n", upQueued()))
+	sb.WriteString(fmt.Sprintf("Kernel drops: %d\n", kernelDropCount()))
+	sb.WriteString(fmt.Sprintf("Padding: %d bytes\n", pcap.PaddingBytes()))
+	sb.WriteString(fmt.Sprintf("Routines: %d\n", routines.Len()))
+	if events != nil {
+		sb.WriteString(fmt.Sprintf("Dropped events: %d\n", events.Dropped()))
+	}
+	if status := drainProgress(); status != nil {
+		sb.WriteString(fmt.Sprintf("Draining: %s, %d queued packets, %d flows, %d clients\n", time.Now().Sub(status.Since).Truncate(time.Millisecond), status.Queued, status.Flows, status.Clients))
+	}
+
+	sb.WriteString("\n")
+	sb.WriteString(traffic.String())
+
+	sb.WriteString("\n")
+	sb.WriteString(sizes.String())
+
+	if monitor != nil {
+		sb.WriteString("\n")
+		sb.WriteString(monitor.String())
+	}
+
+	return sb.String(), nil
+}
+
+func adminDropClient(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("usage: drop-client <address>")
+	}
+
+	conns := make([]net.Conn, 0)
+
+	clientsLock.RLock()
+	for addr, conn := range clients {
+		if addr == args[0] || addrIP(conn.RemoteAddr()) == args[0] {
+			conns = append(conns, conn)
+		}
+	}
+	clientsLock.RUnlock()
+
+	if len(conns) <= 0 {
+		return "", fmt.Errorf("client %s not found", args[0])
+	}
+
+	for _, conn := range conns {
+		dropClient(conn)
+	}
+
+	return fmt.Sprintf("Drop %d clients\n", len(conns)), nil
+}
+
+func adminDropFlow(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("usage: drop-flow <protocol> <address>")
+	}
+
+	var (
+		guide pcap.NATGuide
+		ni    *natIndicator
+	)
+
+	for _, t := range []gopacket.LayerType{layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4} {
+		if !strings.EqualFold(t.String(), args[0]) {
+			continue
+		}
+
+		guide = pcap.NATGuide{Src: args[1], Protocol: t}
+		ni, _ = nat.remove(guide)
+		break
+	}
+
+	if ni == nil {
+		return "", fmt.Errorf("flow %s %s not found", args[0], args[1])
+	}
+
+	// Forget the distributed port/Id so the flow is not recognized any more
+	q := quintuple{
+		src:      ni.embSrc.String(),
+		dst:      ni.src.String(),
+		protocol: guide.Protocol,
+	}
+	patLock.Lock()
+	delete(patMap, q)
+	patLock.Unlock()
+
+	if guide.Protocol == layers.LayerTypeTCP {
+		resetFlow(ni)
+	}
+
+	return fmt.Sprintf("Drop flow %s %s\n", guide.Protocol, guide.Src), nil
+}
+
+func dropClient(conn net.Conn) {
+	releaseClient(conn)
+
+	log.Infof("Drop client %s\n", conn.RemoteAddr().String())
+}
+
+func addrIP(a net.Addr) string {
+	switch a.(type) {
+	case *net.TCPAddr:
+		return a.(*net.TCPAddr).IP.String()
+	case *net.UDPAddr:
+		return a.(*net.UDPAddr).IP.String()
+	case *net.IPAddr:
+		return a.(*net.IPAddr).IP.String()
+	default:
+		return a.String()
+	}
+}
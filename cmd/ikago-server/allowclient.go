@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// logRefused is the period in which refusing the same source is logged at most once.
+const logRefused = time.Minute
+
+// keepRefusedLogs is the number of sources whose logs of refusing are remembered before forgetting expired ones.
+const keepRefusedLogs = 4096
+
+var (
+	refusedLock sync.Mutex
+	refusedLogs = make(map[string]time.Time)
+)
+
+// ipOf returns the IP of the address, or nil if the address has no IP.
+func ipOf(addr net.Addr) net.IP {
+	switch t := addr.(type) {
+	case *net.TCPAddr:
+		return t.IP
+	case *net.UDPAddr:
+		return t.IP
+	case *net.IPAddr:
+		return t.IP
+	default:
+		return nil
+	}
+}
+
+// isAllowedClient returns if a client from the address is allowed to connect. All clients are allowed if no allowed
+// clients are set.
+func isAllowedClient(addr net.Addr) bool {
+	if len(allowedIPNets) <= 0 {
+		return true
+	}
+
+	ip := ipOf(addr)
+	if ip != nil {
+		for _, ipNet := range allowedIPNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	drop(dropNotAllowed, "", fmt.Sprintf("client %s", addr))
+	logRefusedClient(addr, ip)
+
+	return false
+}
+
+// logRefusedClient logs refusing the client at most once a period for each source, so scanners cannot flood logs.
+func logRefusedClient(addr net.Addr, ip net.IP) {
+	src := addr.String()
+	if ip != nil {
+		src = ip.String()
+	}
+
+	now := time.Now()
+
+	refusedLock.Lock()
+	last, ok := refusedLogs[src]
+	if ok && now.Sub(last) < logRefused {
+		refusedLock.Unlock()
+		return
+	}
+	if len(refusedLogs) >= keepRefusedLogs {
+		for s, t := range refusedLogs {
+			if now.Sub(t) >= logRefused {
+				delete(refusedLogs, s)
+			}
+		}
+	}
+	refusedLogs[src] = now
+	refusedLock.Unlock()
+
+	log.Infof("Refuse client %s not allowed\n", addr)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsAllowedClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		addr    net.Addr
+		expect  bool
+	}{
+		{name: "empty", allowed: nil, addr: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 50000}, expect: true},
+		{name: "cidr", allowed: []string{"203.0.113.0/24"}, addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 50000}, expect: true},
+		{name: "cidr udp", allowed: []string{"203.0.113.0/24"}, addr: &net.UDPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 50000}, expect: true},
+		{name: "cidr outside", allowed: []string{"203.0.113.0/24"}, addr: &net.TCPAddr{IP: net.IPv4(203, 0, 114, 5), Port: 50000}, expect: false},
+		{name: "any cidr", allowed: []string{"192.0.2.0/24", "203.0.113.0/24"}, addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 50000}, expect: true},
+		{name: "ip", allowed: []string{"203.0.113.7"}, addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 50000}, expect: true},
+		{name: "ip other", allowed: []string{"203.0.113.7"}, addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 8), Port: 50000}, expect: false},
+		{name: "ipv4-mapped client", allowed: []string{"203.0.113.0/24"}, addr: &net.TCPAddr{IP: net.ParseIP("::ffff:203.0.113.5"), Port: 50000}, expect: true},
+		{name: "ipv4-mapped client outside", allowed: []string{"203.0.113.0/24"}, addr: &net.TCPAddr{IP: net.ParseIP("::ffff:203.0.114.5"), Port: 50000}, expect: false},
+		{name: "ipv4-mapped cidr", allowed: []string{"::ffff:203.0.113.0/120"}, addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5).To4(), Port: 50000}, expect: true},
+		{name: "ipv4-mapped ip", allowed: []string{"::ffff:203.0.113.7"}, addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7).To4(), Port: 50000}, expect: true},
+		{name: "ipv6", allowed: []string{"2001:db8::/32"}, addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}, expect: true},
+		{name: "ipv4 in ipv6", allowed: []string{"2001:db8::/32"}, addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 50000}, expect: false},
+		{name: "no ip", allowed: []string{"0.0.0.0/0"}, addr: &net.UnixAddr{Name: "/tmp/ikago.sock", Net: "unix"}, expect: false},
+	}
+
+	defer func() {
+		allowedIPNets = nil
+	}()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowedIPNets = nil
+			for _, s := range test.allowed {
+				ipNet, err := parseIPNet(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				allowedIPNets = append(allowedIPNets, ipNet)
+			}
+
+			refused := dropCount(dropNotAllowed)
+			if isAllowedClient(test.addr) != test.expect {
+				t.Errorf("client %s in %v allowed: %t, expect %t", test.addr, test.allowed, !test.expect, test.expect)
+			}
+
+			n := dropCount(dropNotAllowed) - refused
+			if test.expect && n != 0 || !test.expect && n != 1 {
+				t.Errorf("refused %d clients", n)
+			}
+		})
+	}
+}
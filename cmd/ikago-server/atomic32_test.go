@@ -0,0 +1,87 @@
+// +build 386 arm
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestClientStatAtomic updates statistics of clients concurrently, which panics on 32-bit platforms if any 64-bit field
+// accessed atomically is not aligned.
+func TestClientStatAtomic(t *testing.T) {
+	const (
+		routines = 8
+		packets  = 1000
+	)
+
+	conns := newTestConns(4)
+	clientsLock.Lock()
+	for _, conn := range conns {
+		clients[conn.RemoteAddr().String()] = conn
+		clientStats[conn.RemoteAddr().String()] = newClientStat(1 << 30)
+	}
+	clientsLock.Unlock()
+	defer func() {
+		clientsLock.Lock()
+		for _, conn := range conns {
+			delete(clients, conn.RemoteAddr().String())
+			delete(clientStats, conn.RemoteAddr().String())
+		}
+		clientsLock.Unlock()
+		forgetClientDrops(conns[0].RemoteAddr().String())
+	}()
+
+	ni := newNATIndicator(conns[0].RemoteAddr(), &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1234}, conns[0], 0)
+	errors := atomic.LoadUint64(&errorCounts[errorHandleListen])
+	drops := dropCount(dropQueueFull)
+
+	var wg sync.WaitGroup
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < packets; j++ {
+				for _, conn := range conns {
+					if !allowClientIn(conn, 100) {
+						t.Error("client in over rate limit")
+						return
+					}
+					addClientIn(conn, 100)
+					if !allowClientOut(conn, 200) {
+						t.Error("client out over rate limit")
+						return
+					}
+					addClientOut(conn, 200)
+				}
+
+				ni.see(time.Now())
+				ni.lastSeen()
+				touchActivity()
+				lastActivity()
+				countError(errorHandleListen)
+				drop(dropQueueFull, conns[0].RemoteAddr().String(), "")
+			}
+		}()
+	}
+	wg.Wait()
+
+	clientsLock.RLock()
+	statuses := clientStatuses()
+	clientsLock.RUnlock()
+	for _, s := range statuses {
+		if s.InPackets != routines*packets || s.InBytes != routines*packets*100 || s.OutPackets != routines*packets || s.OutBytes != routines*packets*200 {
+			t.Errorf("client %s: in %d packets (%d Bytes), out %d packets (%d Bytes)", s.Addr, s.InPackets, s.InBytes, s.OutPackets, s.OutBytes)
+		}
+	}
+	if n := atomic.LoadUint64(&errorCounts[errorHandleListen]) - errors; n != routines*packets {
+		t.Errorf("counted %d errors, expect %d", n, routines*packets)
+	}
+	if n := dropCount(dropQueueFull) - drops; n != routines*packets {
+		t.Errorf("counted %d drops, expect %d", n, routines*packets)
+	}
+}
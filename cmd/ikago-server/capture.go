@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"sync/atomic"
+	"time"
+)
+
+// pollCaptureInt is the interval of polling statistics of capture handles.
+const pollCaptureInt = 10 * time.Second
+
+// kernelDrops is the number of packets dropped by the kernel or interfaces in capturing, which is accessed atomically.
+var kernelDrops uint64
+
+// captureStatser describes a connection reporting statistics of its capture handle.
+type captureStatser interface {
+	Stats() (received, dropped int, err error)
+}
+
+// captureHandles returns connections of all capture handles of upstream and clients.
+func captureHandles() []captureStatser {
+	result := make([]captureStatser, 0)
+	if upConn != nil {
+		result = append(result, upConn)
+	}
+	for _, conn := range upReadConns {
+		result = append(result, conn)
+	}
+	for _, conn := range fallbackConns {
+		result = append(result, conn)
+	}
+
+	clientsLock.RLock()
+	for _, conn := range clients {
+		c, ok := conn.(*pcap.FakeTCPConn)
+		if ok {
+			result = append(result, c)
+		}
+	}
+	clientsLock.RUnlock()
+
+	return result
+}
+
+// pollCapture polls statistics of capture handles periodically, and records and logs packets dropped by the kernel so
+// they can be told from packets dropped by IkaGo.
+func pollCapture() {
+	ticker := time.NewTicker(pollCaptureInt)
+	defer ticker.Stop()
+
+	last := make(map[captureStatser]int)
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		n := 0
+		current := make(map[captureStatser]int)
+		for _, h := range captureHandles() {
+			_, dropped, err := h.Stats()
+			if err != nil {
+				continue
+			}
+
+			// Counters may be reset
+			prev := last[h]
+			if dropped < prev {
+				prev = 0
+			}
+			n = n + dropped - prev
+			current[h] = dropped
+		}
+		last = current
+
+		if n > 0 {
+			atomic.AddUint64(&kernelDrops, uint64(n))
+			log.Infof("Kernel dropped %d packets in capturing in %s\n", n, pollCaptureInt)
+		}
+	}
+}
+
+// kernelDropCount returns the number of packets dropped by the kernel or interfaces in capturing.
+func kernelDropCount() uint64 {
+	return atomic.LoadUint64(&kernelDrops)
+}
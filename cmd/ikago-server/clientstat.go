@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clientStat describes the traffic of a client. Inbound traffic is received from the client and outbound traffic is
+// sent to the client.
+type clientStat struct {
+	// 64-bit fields accessed atomically must be first to be aligned on 32-bit platforms
+	seen       int64
+	active     int64
+	inPackets  uint64
+	inBytes    uint64
+	outPackets uint64
+	outBytes   uint64
+	inDrops    uint64
+	outDrops   uint64
+	connect    time.Time
+	inLimit    *tokenBucket
+	outLimit   *tokenBucket
+}
+
+// newClientStat returns a new stat of a client limited by the rate in bytes per second in each direction. The rate of
+// 0 means unlimited.
+func newClientStat(rate int) *clientStat {
+	now := time.Now()
+
+	s := &clientStat{
+		connect: now,
+		seen:    now.UnixNano(),
+		active:  now.UnixNano(),
+	}
+	if rate > 0 {
+		s.inLimit = newTokenBucket(rate)
+		s.outLimit = newTokenBucket(rate)
+	}
+
+	return s
+}
+
+// lastSeen returns the time when the client is seen lastly.
+func (s *clientStat) lastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.seen))
+}
+
+// lastActive returns the time when traffic from or to the client is handled lastly.
+func (s *clientStat) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.active))
+}
+
+type clientStatus struct {
+	Addr       string    `json:"address"`
+	Connect    time.Time `json:"connect"`
+	Seen       time.Time `json:"seen"`
+	InPackets  uint64    `json:"in-packets"`
+	InBytes    uint64    `json:"in-bytes"`
+	OutPackets uint64    `json:"out-packets"`
+	OutBytes   uint64    `json:"out-bytes"`
+	InDrops    uint64    `json:"in-drops"`
+	OutDrops   uint64    `json:"out-drops"`
+	// FakeTCP is the state of the client in FakeTCP, or nil if the client is not in FakeTCP.
+	FakeTCP *pcap.FakeTCPClient `json:"faketcp,omitempty"`
+}
+
+// clientStatOf returns the stat of the client, or nil if the connection is not the client. clientsLock must be held.
+func clientStatOf(conn net.Conn) *clientStat {
+	c, ok := clients[conn.RemoteAddr().String()]
+	if !ok || c != conn {
+		return nil
+	}
+
+	return clientStats[conn.RemoteAddr().String()]
+}
+
+// addClientIn records a packet received from the client.
+func addClientIn(conn net.Conn, size int) {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	s := clientStatOf(conn)
+	if s == nil {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&s.seen, now)
+	atomic.StoreInt64(&s.active, now)
+	atomic.AddUint64(&s.inPackets, 1)
+	atomic.AddUint64(&s.inBytes, uint64(size))
+}
+
+// addClientOut records a packet sent to the client.
+func addClientOut(conn net.Conn, size int) {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	s := clientStatOf(conn)
+	if s == nil {
+		return
+	}
+
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+	atomic.AddUint64(&s.outPackets, 1)
+	atomic.AddUint64(&s.outBytes, uint64(size))
+}
+
+// clientStatuses returns statuses of all clients sorted by addresses. clientsLock must be held.
+func clientStatuses() []clientStatus {
+	result := make([]clientStatus, 0)
+	for addr, s := range clientStats {
+		result = append(result, clientStatus{
+			Addr:       addr,
+			Connect:    s.connect,
+			Seen:       s.lastSeen(),
+			InPackets:  atomic.LoadUint64(&s.inPackets),
+			InBytes:    atomic.LoadUint64(&s.inBytes),
+			OutPackets: atomic.LoadUint64(&s.outPackets),
+			OutBytes:   atomic.LoadUint64(&s.outBytes),
+			InDrops:    atomic.LoadUint64(&s.inDrops),
+			OutDrops:   atomic.LoadUint64(&s.outDrops),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Addr < result[j].Addr
+	})
+
+	return result
+}
+
+// takeClientStats returns a snapshot of statuses of all clients.
+func takeClientStats() []clientStatus {
+	clientsLock.RLock()
+	result := clientStatuses()
+	conns := clientConns()
+	clientsLock.RUnlock()
+
+	fillFakeTCP(result, conns)
+
+	return result
+}
+
+// clientConns returns a copy of connections of all clients. clientsLock must be held.
+func clientConns() map[string]net.Conn {
+	result := make(map[string]net.Conn, len(clients))
+	for addr, conn := range clients {
+		result[addr] = conn
+	}
+
+	return result
+}
+
+// fillFakeTCP fills states in FakeTCP of the statuses from the connections. clientsLock must not be held, as FakeTCP
+// connections call back to release clients while locked.
+func fillFakeTCP(statuses []clientStatus, conns map[string]net.Conn) {
+	for i := range statuses {
+		conn, ok := conns[statuses[i].Addr].(*pcap.FakeTCPConn)
+		if !ok {
+			continue
+		}
+
+		for _, c := range conn.Clients() {
+			if c.Addr == statuses[i].Addr {
+				c := c
+				statuses[i].FakeTCP = &c
+				break
+			}
+		}
+	}
+}
+
+func (s clientStatus) String() string {
+	sb := strings.Builder{}
+
+	now := time.Now()
+	sb.WriteString(fmt.Sprintf("%s: connected %s ago, seen %s ago, ", s.Addr, now.Sub(s.Connect).Truncate(time.Second), now.Sub(s.Seen).Truncate(time.Second)))
+	sb.WriteString(fmt.Sprintf("in %d packets (%d Bytes), out %d packets (%d Bytes)", s.InPackets, s.InBytes, s.OutPackets, s.OutBytes))
+	if s.InDrops > 0 || s.OutDrops > 0 {
+		sb.WriteString(fmt.Sprintf(", dropped %d in and %d out over rate limit", s.InDrops, s.OutDrops))
+	}
+	if s.FakeTCP != nil {
+		sb.WriteString(fmt.Sprintf(", seq %d, ack %d", s.FakeTCP.Seq, s.FakeTCP.Ack))
+	}
+
+	return sb.String()
+}
+
+// pendingClient describes a client which has handshaken but not sent any valid payload yet.
+type pendingClient struct {
+	conn net.Conn
+	// state is 0 if pending, 1 if registered and 2 if expired, which is accessed atomically.
+	state int32
+}
+
+// newPendingClient returns a pending client of the connection, which is closed if it sends no valid payload in time.
+func newPendingClient(conn net.Conn) *pendingClient {
+	p := &pendingClient{conn: conn}
+
+	clientsLock.Lock()
+	pendings[p] = true
+	clientsLock.Unlock()
+
+	time.AfterFunc(waitPayload, func() {
+		if atomic.CompareAndSwapInt32(&p.state, 0, 2) {
+
+			countHandshake(handshakeFailed)
+			log.Verbosef("Close client %s without payloads\n", conn.RemoteAddr().String())
+			p.close()
+		}
+	})
+
+	return p
+}
+
+// register tracks the client on its first valid payload, and returns if the client is tracked.
+func (p *pendingClient) register() bool {
+	if atomic.LoadInt32(&p.state) == 1 {
+		return true
+	}
+	if !atomic.CompareAndSwapInt32(&p.state, 0, 1) {
+		return false
+	}
+
+	conn := p.conn
+	log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
+	atomic.AddUint64(&connects, 1)
+	countHandshake(handshakeAccepted)
+	publish(eventClientConnect, fmt.Sprintf("Connect from client %s", conn.RemoteAddr()), map[string]string{"client": conn.RemoteAddr().String()})
+
+	clientsLock.Lock()
+	delete(pendings, p)
+	clients[conn.RemoteAddr().String()] = conn
+	clientStats[conn.RemoteAddr().String()] = newClientStat(rateLimitOf(conn.RemoteAddr()))
+	clientsLock.Unlock()
+
+	return true
+}
+
+// isRegistered returns if the client is tracked.
+func (p *pendingClient) isRegistered() bool {
+	return atomic.LoadInt32(&p.state) == 1
+}
+
+// isExpired returns if the client is closed for sending no valid payload in time.
+func (p *pendingClient) isExpired() bool {
+	return atomic.LoadInt32(&p.state) == 2
+}
+
+// close closes the connection of the client which is never tracked.
+func (p *pendingClient) close() {
+	clientsLock.Lock()
+	delete(pendings, p)
+	clientsLock.Unlock()
+
+	err := p.conn.Close()
+	if err != nil {
+		log.Verboseln(fmt.Errorf("close pending client %s: %w", p.conn.RemoteAddr(), err))
+	}
+}
+
+// acceptClient returns if a new client from the address may be accepted.
+func acceptClient(addr net.Addr) bool {
+	if !isAllowedClient(addr) {
+		countHandshake(handshakeRefused)
+		return false
+	}
+	if maxClients <= 0 || evictClients {
+		return true
+	}
+
+	clientsLock.RLock()
+	isFull := len(clients) >= maxClients
+	clientsLock.RUnlock()
+	if isFull {
+		countHandshake(handshakeRefused)
+	}
+
+	return !isFull
+}
+
+// makeRoomForClient returns if a new client can be served, and evicts the least recently active client with its NAT
+// if clients are full and evicting is enabled.
+func makeRoomForClient() bool {
+	if maxClients <= 0 {
+		return true
+	}
+
+	var lru net.Conn
+
+	clientsLock.RLock()
+	if len(clients) < maxClients {
+		clientsLock.RUnlock()
+		return true
+	}
+	if evictClients {
+		var active time.Time
+		for addr, conn := range clients {
+			t := clientStats[addr].lastActive()
+			if lru == nil || t.Before(active) {
+				lru, active = conn, t
+			}
+		}
+	}
+	clientsLock.RUnlock()
+
+	if lru == nil {
+		return false
+	}
+
+	releaseClient(lru)
+	log.Infof("Evict client %s over %d clients\n", lru.RemoteAddr().String(), maxClients)
+	publish(eventClientDisconnect, fmt.Sprintf("Evict client %s", lru.RemoteAddr()), map[string]string{"client": lru.RemoteAddr().String()})
+
+	return true
+}
+
+// disconnectClient releases the client of the address which disconnects from a connection serving multiple clients.
+func disconnectClient(addr net.Addr) {
+	clientsLock.RLock()
+	conn, ok := clients[addr.String()]
+	clientsLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
+	publish(eventClientDisconnect, fmt.Sprintf("Disconnect from client %s", conn.RemoteAddr()), map[string]string{"client": conn.RemoteAddr().String()})
+	releaseClient(conn)
+}
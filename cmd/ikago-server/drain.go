@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/zhxie/ikago/internal/log"
+	"os"
+	"sync"
+	"time"
+)
+
+const checkDrain = 100 * time.Millisecond
+const waitDrain = 5 * time.Second
+
+type drainStatus struct {
+	Since   time.Time `json:"since"`
+	Queued  int       `json:"queued"`
+	Flows   int       `json:"flows"`
+	Clients int       `json:"clients"`
+}
+
+var (
+	drainLock sync.RWMutex
+	drainTime time.Time
+)
+
+// isDraining returns if the server is draining before closing.
+func isDraining() bool {
+	drainLock.RLock()
+	defer drainLock.RUnlock()
+
+	return !drainTime.IsZero()
+}
+
+// drainProgress returns the progress of draining, or nil if the server is not draining.
+func drainProgress() *drainStatus {
+	drainLock.RLock()
+	t := drainTime
+	drainLock.RUnlock()
+
+	if t.IsZero() {
+		return nil
+	}
+
+	clientsLock.RLock()
+	clientsSize := len(clients)
+	clientsLock.RUnlock()
+
+	patLock.RLock()
+	flowsSize := countFlows()
+	patLock.RUnlock()
+
+	return &drainStatus{
+		Since:   t,
+		Queued:  queued(),
+		Flows:   flowsSize,
+		Clients: clientsSize,
+	}
+}
+
+// drain refuses new clients and waits for queued packets to be handled before closing. Draining stops if it
+// times out or another signal is received.
+func drain(force <-chan os.Signal) {
+	drainLock.Lock()
+	drainTime = time.Now()
+	drainLock.Unlock()
+
+	status := drainProgress()
+	log.Infof("Drain %d queued packets, %d flows and %d clients, send the signal again to close immediately\n", status.Queued, status.Flows, status.Clients)
+
+	ticker := time.NewTicker(checkDrain)
+	defer ticker.Stop()
+	timer := time.NewTimer(waitDrain)
+	defer timer.Stop()
+
+	for queued() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			log.Infof("Drain timed out with %d queued packets\n", queued())
+			return
+		case <-force:
+			log.Infof("Stop draining with %d queued packets\n", queued())
+			return
+		}
+	}
+
+	log.Infof("Drained in %s\n", time.Now().Sub(status.Since).Truncate(time.Millisecond))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dropReason describes why a packet is dropped intentionally.
+type dropReason int
+
+const (
+	dropEmpty dropReason = iota
+	dropMalformed
+	dropUnsupported
+	dropMissingNAT
+	dropTooManyFlows
+	dropExhausted
+	dropNotInNAT
+	dropMismatch
+	dropStale
+	dropRateLimited
+	dropQueueFull
+	dropDenied
+	dropNotAllowed
+	dropTTLExceeded
+	dropReasons
+)
+
+func (r dropReason) String() string {
+	switch r {
+	case dropEmpty:
+		return "empty"
+	case dropMalformed:
+		return "malformed"
+	case dropUnsupported:
+		return "unsupported"
+	case dropMissingNAT:
+		return "missing-nat"
+	case dropTooManyFlows:
+		return "too-many-flows"
+	case dropExhausted:
+		return "exhausted"
+	case dropNotInNAT:
+		return "not-in-nat"
+	case dropMismatch:
+		return "mismatch"
+	case dropStale:
+		return "stale"
+	case dropRateLimited:
+		return "rate-limited"
+	case dropQueueFull:
+		return "queue-full"
+	case dropDenied:
+		return "denied"
+	case dropNotAllowed:
+		return "not-allowed"
+	case dropTTLExceeded:
+		return "ttl-exceeded"
+	default:
+		return fmt.Sprintf("%d", r)
+	}
+}
+
+// isRare returns if the reason is unexpected in normal traffic and drops of it should be recorded in detail.
+func (r dropReason) isRare() bool {
+	switch r {
+	case dropMalformed, dropUnsupported, dropMissingNAT, dropExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+const logDrop = time.Second
+const keepRareDrops = 64
+
+type dropRecord struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Client string    `json:"client,omitempty"`
+	Info   string    `json:"info"`
+}
+
+var (
+	dropCounts    [dropReasons]uint64
+	dropLogTimes  [dropReasons]int64
+	dropSkips     [dropReasons]uint64
+	dropsLock     sync.Mutex
+	clientDrops   = make(map[string]*[dropReasons]uint64)
+	rareDrops     []dropRecord
+	lastDropTime  = time.Now()
+	lastDropCount [dropReasons]uint64
+)
+
+// drop records a packet dropped for the reason. The client may be empty if it is unknown.
+func drop(reason dropReason, client string, info string) {
+	atomic.AddUint64(&dropCounts[reason], 1)
+
+	if client != "" || reason.isRare() {
+		dropsLock.Lock()
+		if client != "" {
+			counts, ok := clientDrops[client]
+			if !ok {
+				counts = &[dropReasons]uint64{}
+				clientDrops[client] = counts
+			}
+			counts[reason]++
+		}
+		if reason.isRare() {
+			rareDrops = append(rareDrops, dropRecord{
+				Time:   time.Now(),
+				Reason: reason.String(),
+				Client: client,
+				Info:   info,
+			})
+			if len(rareDrops) > keepRareDrops {
+				rareDrops = rareDrops[len(rareDrops)-keepRareDrops:]
+			}
+		}
+		dropsLock.Unlock()
+	}
+
+	// Log at most once a period in each reason
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&dropLogTimes[reason])
+	if now-last < int64(logDrop) || !atomic.CompareAndSwapInt64(&dropLogTimes[reason], last, now) {
+		atomic.AddUint64(&dropSkips[reason], 1)
+		return
+	}
+
+	skips := atomic.SwapUint64(&dropSkips[reason], 0)
+	if skips > 0 {
+		log.Verbosef("Drop a packet (%s): %s (%d similar suppressed)\n", reason, info, skips)
+	} else {
+		log.Verbosef("Drop a packet (%s): %s\n", reason, info)
+	}
+}
+
+// dropCount returns the number of packets dropped for the reason.
+func dropCount(reason dropReason) uint64 {
+	return atomic.LoadUint64(&dropCounts[reason])
+}
+
+// dropCountMap returns the numbers of dropped packets by reasons.
+func dropCountMap() map[string]uint64 {
+	m := make(map[string]uint64)
+	for r := dropReason(0); r < dropReasons; r++ {
+		m[r.String()] = dropCount(r)
+	}
+
+	return m
+}
+
+// forgetClientDrops removes counters of the client.
+func forgetClientDrops(client string) {
+	dropsLock.Lock()
+	defer dropsLock.Unlock()
+
+	delete(clientDrops, client)
+}
+
+func adminDrops(args []string) (string, error) {
+	sb := strings.Builder{}
+
+	now := time.Now()
+	counts := [dropReasons]uint64{}
+	for r := dropReason(0); r < dropReasons; r++ {
+		counts[r] = dropCount(r)
+	}
+
+	dropsLock.Lock()
+	interval := now.Sub(lastDropTime).Truncate(time.Second)
+	last := lastDropCount
+	lastDropTime = now
+	lastDropCount = counts
+
+	clients := make([]string, 0)
+	for client := range clientDrops {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	lines := make([]string, 0)
+	for _, client := range clients {
+		reasons := make([]string, 0)
+		for r, count := range clientDrops[client] {
+			if count > 0 {
+				reasons = append(reasons, fmt.Sprintf("%s %d", dropReason(r), count))
+			}
+		}
+		if len(reasons) > 0 {
+			lines = append(lines, fmt.Sprintf("  %s: %s\n", client, strings.Join(reasons, ", ")))
+		}
+	}
+
+	records := make([]dropRecord, len(rareDrops))
+	copy(records, rareDrops)
+	dropsLock.Unlock()
+
+	sb.WriteString(fmt.Sprintf("Drops in last %s (total):\n", interval))
+	for r := dropReason(0); r < dropReasons; r++ {
+		sb.WriteString(fmt.Sprintf("  %s: %d (%d)\n", r, counts[r]-last[r], counts[r]))
+	}
+
+	if len(lines) > 0 {
+		sb.WriteString("Drops by clients:\n")
+		for _, line := range lines {
+			sb.WriteString(line)
+		}
+	}
+
+	if len(records) > 0 {
+		sb.WriteString("Recent rare drops:\n")
+		for _, record := range records {
+			if record.Client != "" {
+				sb.WriteString(fmt.Sprintf("  %s %s %s: %s\n", record.Time.Format(time.RFC3339), record.Reason, record.Client, record.Info))
+			} else {
+				sb.WriteString(fmt.Sprintf("  %s %s: %s\n", record.Time.Format(time.RFC3339), record.Reason, record.Info))
+			}
+		}
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/exec"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const checkUpstream = time.Second
+const failbackDelay = 30 * time.Second
+const maxWriteFailures = 3
+const maxReadFailures = 3
+const maxProbeFailures = 3
+
+var (
+	fallbackUpDevs      []*pcap.Device
+	fallbackGatewayDevs []*pcap.Device
+	fallbackConns       []*pcap.RawConn
+	// fallbackConn is the fallback upstream in use, or nil if the primary upstream is in use.
+	fallbackConn  *pcap.RawConn
+	upLock        sync.RWMutex
+	fallbackTime  time.Time
+	writeFailures uint32
+	readFailures  uint32
+	upProbe       time.Duration
+	probeFailures uint32
+	// isCarrierUp returns if the carrier of the device is up, which is replaced in tests.
+	isCarrierUp = func(dev *pcap.Device) (bool, error) {
+		return exec.IsCarrierUp(dev.Name())
+	}
+)
+
+// activeUpConn returns the connection for routing upstream currently in use.
+func activeUpConn() *pcap.RawConn {
+	upLock.RLock()
+	defer upLock.RUnlock()
+
+	if fallbackConn != nil {
+		return fallbackConn
+	}
+
+	return upConn
+}
+
+// activeFallbackConn returns the fallback upstream in use, or nil if the primary upstream is in use.
+func activeFallbackConn() *pcap.RawConn {
+	upLock.RLock()
+	defer upLock.RUnlock()
+
+	return fallbackConn
+}
+
+// isFallbackConn returns if the connection is of a fallback upstream.
+func isFallbackConn(conn *pcap.RawConn) bool {
+	for _, c := range fallbackConns {
+		if c == conn {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reportWrite records the result of a write to the upstream and fails over if the primary upstream keeps failing.
+func reportWrite(conn *pcap.RawConn, err error) {
+	if len(fallbackConns) <= 0 || conn != upConn {
+		return
+	}
+
+	if err == nil {
+		atomic.StoreUint32(&writeFailures, 0)
+		return
+	}
+
+	if atomic.AddUint32(&writeFailures, 1) >= maxWriteFailures {
+		failOver(fmt.Sprintf("%d consecutive write failures", maxWriteFailures))
+	}
+}
+
+// reportRead records the result of a read from the upstream and fails over if the primary upstream keeps failing, like
+// when the device is reset.
+func reportRead(conn *pcap.RawConn, err error) {
+	if len(fallbackConns) <= 0 || conn != upConn {
+		return
+	}
+
+	if err == nil {
+		if atomic.LoadUint32(&readFailures) > 0 {
+			atomic.StoreUint32(&readFailures, 0)
+		}
+		return
+	}
+
+	if atomic.AddUint32(&readFailures, 1) >= maxReadFailures {
+		failOver(fmt.Sprintf("%d consecutive read failures", maxReadFailures))
+	}
+}
+
+// pickFallback returns the first fallback upstream whose carrier is up or unknown, or the first fallback upstream if
+// carriers of all of them are down.
+func pickFallback() *pcap.RawConn {
+	for _, conn := range fallbackConns {
+		isUp, err := isCarrierUp(conn.LocalDev())
+		if err != nil || isUp {
+			return conn
+		}
+	}
+
+	return fallbackConns[0]
+}
+
+// failOver switches from the primary upstream to a fallback upstream.
+func failOver(reason string) {
+	switchUpstream(nil, pickFallback(), reason)
+}
+
+// failBack re-opens the primary upstream and switches back to it. The handles of the primary upstream may be unusable
+// after the device is reset, so the upstream stays in the fallback if they cannot be re-opened, instead of failing
+// back and over again.
+func failBack(reason string) {
+	from := activeFallbackConn()
+	if from == nil {
+		return
+	}
+
+	for _, conn := range append([]*pcap.RawConn{upConn}, upReadConns...) {
+		err := conn.Reopen()
+		if err != nil {
+			log.Errorln(fmt.Errorf("reopen upstream device %s: %w", conn.LocalDev().Alias(), err))
+
+			// Retry after another delay
+			upLock.Lock()
+			fallbackTime = time.Now()
+			upLock.Unlock()
+			return
+		}
+	}
+
+	switchUpstream(from, nil, reason)
+}
+
+// switchUpstream switches from an upstream to another if the upstream is in use, and re-homes NAT to the new upstream.
+// A nil connection means the primary upstream.
+func switchUpstream(from, to *pcap.RawConn, reason string) {
+	upLock.Lock()
+	if fallbackConn != from || from == to {
+		upLock.Unlock()
+		return
+	}
+	fallbackConn = to
+	fallbackTime = time.Now()
+	upLock.Unlock()
+
+	atomic.StoreUint32(&writeFailures, 0)
+	atomic.StoreUint32(&readFailures, 0)
+
+	if from == nil {
+		from = upConn
+	}
+	if to == nil {
+		to = upConn
+		log.Infof("Fail back upstream from %s to %s: %s\n", from.LocalDev().Alias(), to.LocalDev().Alias(), reason)
+		publish(eventFailback, fmt.Sprintf("Fail back upstream from %s to %s: %s", from.LocalDev().Alias(), to.LocalDev().Alias(), reason), map[string]string{"from": from.LocalDev().Alias(), "to": to.LocalDev().Alias(), "reason": reason})
+	} else {
+		log.Errorf("Fail over upstream from %s to %s: %s\n", from.LocalDev().Alias(), to.LocalDev().Alias(), reason)
+		publish(eventFailover, fmt.Sprintf("Fail over upstream from %s to %s: %s", from.LocalDev().Alias(), to.LocalDev().Alias(), reason), map[string]string{"from": from.LocalDev().Alias(), "to": to.LocalDev().Alias(), "reason": reason})
+	}
+
+	rehomeNAT(from.LocalDev().IPAddr().IP, to.LocalDev().IPAddr().IP)
+}
+
+// rehomeNAT moves NAT from an upstream IP to another so replies to the new upstream can be recognized.
+func rehomeNAT(from, to net.IP) {
+	if from.Equal(to) {
+		return
+	}
+
+	n := nat.rekey(func(guide pcap.NATGuide) (pcap.NATGuide, bool) {
+		src, ok := replaceHost(guide.Src, from, to)
+		if !ok {
+			return pcap.NATGuide{}, false
+		}
+
+		return pcap.NATGuide{
+			Src:      src,
+			Protocol: guide.Protocol,
+		}, true
+	})
+
+	log.Infof("Re-home %d NAT from %s to %s\n", n, from, to)
+}
+
+// replaceHost replaces the IP in an address in NAT.
+func replaceHost(s string, from, to net.IP) (string, bool) {
+	for _, sep := range []string{":", "@"} {
+		prefix := from.String() + sep
+		if strings.HasPrefix(s, prefix) {
+			return to.String() + sep + s[len(prefix):], true
+		}
+	}
+
+	return s, false
+}
+
+// checkUpstreams checks the carrier of the primary upstream periodically, fails over if it is down and fails back
+// if it recovers. It also moves to another fallback upstream if the carrier of the one in use is down.
+func checkUpstreams() {
+	ticker := time.NewTicker(checkUpstream)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		isUp, err := isCarrierUp(upDev)
+		if err != nil {
+			// Carrier is unknown, rely on write failures
+			isUp = true
+		}
+		isReachable := atomic.LoadUint32(&probeFailures) < maxProbeFailures
+
+		upLock.RLock()
+		fb := fallbackConn
+		t := fallbackTime
+		upLock.RUnlock()
+
+		if fb == nil {
+			if !isUp {
+				failOver("carrier down")
+			} else if !isReachable {
+				failOver("gateway unreachable")
+			}
+			continue
+		}
+
+		if isUp && isReachable && time.Now().Sub(t) > failbackDelay {
+			failBack("primary recovered")
+			continue
+		}
+
+		// Move to another fallback upstream if the one in use is down
+		isFallbackUp, err := isCarrierUp(fb.LocalDev())
+		if err == nil && !isFallbackUp {
+			to := pickFallback()
+			if to != fb {
+				switchUpstream(fb, to, "carrier down")
+			}
+		}
+	}
+}
+
+// probeUpstream probes the gateway of the primary upstream periodically, including when it has failed over, so the
+// upstream fails over if the gateway keeps unreachable and fails back only if the gateway is reachable again.
+func probeUpstream() {
+	ticker := time.NewTicker(upProbe)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		// Each probe waits no longer than the interval
+		timeout := upProbe
+		if timeout > checkUpstream {
+			timeout = checkUpstream
+		}
+
+		err := pcap.ProbeGateway(upConn, timeout)
+		if err != nil {
+			if atomic.AddUint32(&probeFailures, 1) == maxProbeFailures {
+				log.Errorln(fmt.Errorf("probe gateway of upstream device %s: %w", upConn.LocalDev().Alias(), err))
+			}
+			continue
+		}
+
+		if atomic.SwapUint32(&probeFailures, 0) >= maxProbeFailures {
+			log.Infof("Gateway of upstream device %s is reachable\n", upConn.LocalDev().Alias())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zhxie/ikago/internal/pcap"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestUpConn returns a connection replaying an empty file in a device with the alias and the IP address, which
+// cannot be re-opened.
+func newTestUpConn(t *testing.T, alias, ip string) *pcap.RawConn {
+	dev := pcap.NewDevice(alias, []*net.IPNet{{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(24, 32)}}, nil, false)
+
+	return newTestReplayConn(t, dev, dev, nil)
+}
+
+// newTestReplayConn returns a connection between devices replaying an empty file, which writes to the writer.
+func newTestReplayConn(tb testing.TB, srcDev, dstDev *pcap.Device, w io.Writer) *pcap.RawConn {
+	path := filepath.Join(tb.TempDir(), "empty.pcap")
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = pcapgo.NewWriter(file).WriteFileHeader(65535, layers.LinkTypeEthernet)
+	file.Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	conn, err := pcap.CreateReplayRawConn(srcDev, dstDev, path, "", w)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn
+}
+
+// setTestUpstreams sets the primary upstream and fallback upstreams, and the carriers of devices which are up. The
+// carrier of a device not in carriers is unknown.
+func setTestUpstreams(t *testing.T, up *pcap.RawConn, fallbacks []*pcap.RawConn, carriers map[string]bool) {
+	prevUpConn, prevFallbackConns, prevIsCarrierUp := upConn, fallbackConns, isCarrierUp
+	t.Cleanup(func() {
+		upConn, fallbackConns, isCarrierUp = prevUpConn, prevFallbackConns, prevIsCarrierUp
+		fallbackConn = nil
+	})
+
+	upConn = up
+	fallbackConns = fallbacks
+	fallbackConn = nil
+	isCarrierUp = func(dev *pcap.Device) (bool, error) {
+		isUp, ok := carriers[dev.Alias()]
+		if !ok {
+			return false, errors.New("unknown")
+		}
+
+		return isUp, nil
+	}
+}
+
+func TestPickFallback(t *testing.T) {
+	up := newTestUpConn(t, "up", "192.168.1.2")
+	a := newTestUpConn(t, "a", "192.168.2.2")
+	b := newTestUpConn(t, "b", "192.168.3.2")
+	c := newTestUpConn(t, "c", "192.168.4.2")
+
+	tests := []struct {
+		name     string
+		carriers map[string]bool
+		want     *pcap.RawConn
+	}{
+		{"first up", map[string]bool{"a": true, "b": true, "c": true}, a},
+		{"skip down", map[string]bool{"a": false, "b": true, "c": true}, b},
+		{"unknown as up", map[string]bool{"a": false, "b": false}, c},
+		{"all down", map[string]bool{"a": false, "b": false, "c": false}, a},
+	}
+
+	for _, tt := range tests {
+		setTestUpstreams(t, up, []*pcap.RawConn{a, b, c}, tt.carriers)
+
+		got := pickFallback()
+		if got != tt.want {
+			t.Errorf("%s: pick %s, want %s", tt.name, got.LocalDev().Alias(), tt.want.LocalDev().Alias())
+		}
+	}
+}
+
+func TestSwitchUpstream(t *testing.T) {
+	up := newTestUpConn(t, "up", "192.168.1.2")
+	a := newTestUpConn(t, "a", "192.168.2.2")
+	b := newTestUpConn(t, "b", "192.168.3.2")
+	setTestUpstreams(t, up, []*pcap.RawConn{a, b}, map[string]bool{"a": false, "b": true})
+
+	failOver("carrier down")
+	if activeUpConn() != b {
+		t.Fatalf("active upstream %s after failing over, want b", activeUpConn().LocalDev().Alias())
+	}
+
+	// Failing over again keeps the fallback upstream in use
+	switchUpstream(nil, a, "carrier down")
+	if activeUpConn() != b {
+		t.Errorf("active upstream %s after failing over again, want b", activeUpConn().LocalDev().Alias())
+	}
+
+	switchUpstream(b, a, "carrier down")
+	if activeUpConn() != a {
+		t.Errorf("active upstream %s after moving, want a", activeUpConn().LocalDev().Alias())
+	}
+}
+
+func TestFailBackReopenFailed(t *testing.T) {
+	up := newTestUpConn(t, "up", "192.168.1.2")
+	a := newTestUpConn(t, "a", "192.168.2.2")
+	setTestUpstreams(t, up, []*pcap.RawConn{a}, map[string]bool{"up": true, "a": true})
+
+	failOver("carrier down")
+
+	upLock.Lock()
+	fallbackTime = time.Now().Add(-2 * failbackDelay)
+	upLock.Unlock()
+
+	// Replayed connections cannot be re-opened, so the upstream stays in the fallback and retries after the delay
+	failBack("primary recovered")
+	if activeUpConn() != a {
+		t.Fatalf("active upstream %s after failing back, want a", activeUpConn().LocalDev().Alias())
+	}
+
+	upLock.RLock()
+	d := time.Now().Sub(fallbackTime)
+	upLock.RUnlock()
+	if d > failbackDelay {
+		t.Errorf("fail back again in %s, want after %s", failbackDelay-d, failbackDelay)
+	}
+}
+
+func TestReplaceHost(t *testing.T) {
+	from := net.ParseIP("192.168.1.2")
+	to := net.ParseIP("192.168.2.2")
+
+	tests := []struct {
+		s    string
+		want string
+		ok   bool
+	}{
+		{"192.168.1.2:1234", "192.168.2.2:1234", true},
+		{"192.168.1.2@1", "192.168.2.2@1", true},
+		{"192.168.1.20:1234", "192.168.1.20:1234", false},
+		{"10.0.0.1:1234", "10.0.0.1:1234", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := replaceHost(tt.s, from, to)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("replace %s: %s, %t, want %s, %t", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"time"
+)
+
+const resolveGateway = 3 * time.Second
+
+var (
+	gatewayRefresh time.Duration
+	// isGatewayFound is true if the gateway is found from the default route instead of being specified.
+	isGatewayFound bool
+)
+
+// refreshGateways resolves the hardware address of gateways of upstream devices periodically, so packets are routed to
+// the new gateway if the gateway is replaced with the same IP address, like in VRRP failover. It also warns if the
+// default route changes to another gateway, which is not followed until restarting.
+func refreshGateways() {
+	ticker := time.NewTicker(gatewayRefresh)
+	defer ticker.Stop()
+
+	var routeGateway net.IP
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		// Each resolution waits no longer than the interval
+		timeout := gatewayRefresh
+		if timeout > resolveGateway {
+			timeout = resolveGateway
+		}
+
+		for _, conn := range append([]*pcap.RawConn{upConn}, fallbackConns...) {
+			refreshGateway(arpResolver{}, conn, timeout)
+		}
+
+		if !isGatewayFound {
+			continue
+		}
+
+		ip, err := pcap.FindGatewayAddr()
+		if err != nil {
+			log.Verboseln(fmt.Errorf("find gateway address: %w", err))
+			continue
+		}
+		if ip.Equal(upConn.RemoteDev().IPAddr().IP) || ip.Equal(routeGateway) {
+			continue
+		}
+		routeGateway = ip
+
+		log.Errorf("Default route changes to gateway %s, but upstream device %s still routes to gateway %s until restarting\n", ip, upConn.LocalDev().Alias(), upConn.RemoteDev().IPAddr().IP)
+	}
+}
+
+// gatewayResolver resolves the hardware address of the gateway of a connection.
+type gatewayResolver interface {
+	ResolveGateway(conn *pcap.RawConn, timeout time.Duration) (net.HardwareAddr, error)
+}
+
+// arpResolver resolves gateways with ARP.
+type arpResolver struct{}
+
+func (arpResolver) ResolveGateway(conn *pcap.RawConn, timeout time.Duration) (net.HardwareAddr, error) {
+	return pcap.ResolveGateway(conn, timeout)
+}
+
+// refreshGateway resolves the hardware address of the gateway of the connection with the resolver, and updates it if
+// it changes.
+func refreshGateway(resolver gatewayResolver, conn *pcap.RawConn, timeout time.Duration) {
+	gatewayDev := conn.RemoteDev()
+
+	addr, err := resolver.ResolveGateway(conn, timeout)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("resolve gateway of upstream device %s: %w", conn.LocalDev().Alias(), err))
+		return
+	}
+
+	old := gatewayDev.HardwareAddr()
+	if gatewayDev.SetHardwareAddr(addr) {
+		log.Infof("Gateway %s of upstream device %s changes hardware address from %s to %s\n", gatewayDev.IPAddr().IP, conn.LocalDev().Alias(), old, addr)
+	}
+}
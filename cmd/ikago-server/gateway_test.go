@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testResolver resolves gateways to the hardware address, or fails with the error.
+type testResolver struct {
+	addr net.HardwareAddr
+	err  error
+}
+
+func (r *testResolver) ResolveGateway(conn *pcap.RawConn, timeout time.Duration) (net.HardwareAddr, error) {
+	return r.addr, r.err
+}
+
+func TestRefreshGateway(t *testing.T) {
+	oldAddr := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	newAddr := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+
+	upDev := pcap.NewDevice("up", []*net.IPNet{{IP: net.IPv4(192, 168, 1, 2).To4(), Mask: net.CIDRMask(24, 32)}}, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x10}, false)
+	gatewayDev := pcap.NewDevice("gateway", []*net.IPNet{{IP: net.IPv4(192, 168, 1, 1).To4(), Mask: net.CIDRMask(24, 32)}}, oldAddr, false)
+	conn := newTestReplayConn(t, upDev, gatewayDev, nil)
+
+	out := &bytes.Buffer{}
+	log.SetOutput(out, out)
+	defer log.SetOutput(os.Stdout, os.Stderr)
+
+	tests := []struct {
+		name     string
+		resolver *testResolver
+		want     net.HardwareAddr
+		// log is the message logged, or empty if nothing is logged.
+		log string
+	}{
+		{"failed", &testResolver{err: errors.New("timeout")}, oldAddr, ""},
+		{"unchanged", &testResolver{addr: oldAddr}, oldAddr, ""},
+		{"changed", &testResolver{addr: newAddr}, newAddr, "Gateway 192.168.1.1 of upstream device up changes hardware address from 02:00:00:00:00:01 to 02:00:00:00:00:02\n"},
+		{"changed again", &testResolver{addr: newAddr}, newAddr, ""},
+	}
+
+	for _, tt := range tests {
+		out.Reset()
+
+		refreshGateway(tt.resolver, conn, time.Second)
+
+		if !bytes.Equal(gatewayDev.HardwareAddr(), tt.want) {
+			t.Errorf("%s: gateway hardware address %s, want %s", tt.name, gatewayDev.HardwareAddr(), tt.want)
+		}
+		if !strings.Contains(out.String(), tt.log) || (tt.log == "" && out.Len() > 0) {
+			t.Errorf("%s: log %q, want %q", tt.name, out.String(), tt.log)
+		}
+	}
+}
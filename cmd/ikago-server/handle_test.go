@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testUpHardwareAddr      = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x10}
+	testGatewayHardwareAddr = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	testUpIP                = net.IPv4(192, 168, 1, 2).To4()
+	testDstAddr             = &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1).To4(), Port: 7}
+)
+
+// recordConn describes a connection from a client which records payloads written to it.
+type recordConn struct {
+	net.Conn
+	addr    net.Addr
+	lock    sync.Mutex
+	written [][]byte
+	// isDiscarding is true if payloads are discarded instead, like in benchmarks.
+	isDiscarding bool
+}
+
+func (c *recordConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+}
+
+func (c *recordConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.isDiscarding {
+		c.written = append(c.written, append([]byte(nil), b...))
+	}
+
+	return len(b), nil
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+// payloads returns payloads written to the connection.
+func (c *recordConn) payloads() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([][]byte(nil), c.written...)
+}
+
+func newRecordConns(n int) []*recordConn {
+	conns := make([]*recordConn, 0, n)
+	for i := 0; i < n; i++ {
+		conns = append(conns, &recordConn{addr: &net.TCPAddr{IP: net.IPv4(10, 0, 1, byte(i+1)), Port: 50000 + i}})
+	}
+
+	return conns
+}
+
+// recordWriter records frames written to the upstream.
+type recordWriter struct {
+	lock   sync.Mutex
+	frames [][]byte
+	// isDiscarding is true if frames are discarded instead, like in benchmarks.
+	isDiscarding bool
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.isDiscarding {
+		w.frames = append(w.frames, append([]byte(nil), b...))
+	}
+
+	return len(b), nil
+}
+
+// discard discards frames written to the upstream afterwards.
+func (w *recordWriter) discard() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.isDiscarding = true
+}
+
+// written returns frames written to the upstream.
+func (w *recordWriter) written() [][]byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return append([][]byte(nil), w.frames...)
+}
+
+// count returns the number of frames written to the upstream.
+func (w *recordWriter) count() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return len(w.frames)
+}
+
+// setupTestServer sets up the server with an upstream writing to a recorder, and registers the clients. The state is
+// reset after the test.
+func setupTestServer(tb testing.TB, conns []*recordConn) *recordWriter {
+	upDev := pcap.NewDevice("up", []*net.IPNet{{IP: testUpIP, Mask: net.CIDRMask(24, 32)}}, testUpHardwareAddr, false)
+	gatewayDev := pcap.NewDevice("gateway", []*net.IPNet{{IP: net.IPv4(192, 168, 1, 1).To4(), Mask: net.CIDRMask(24, 32)}}, testGatewayHardwareAddr, false)
+
+	w := &recordWriter{}
+	upConn = newTestReplayConn(tb, upDev, gatewayDev, w)
+	fragment = 1480
+	tcpPorts = portRange{min: 49152, max: 65535}
+	udpPorts = portRange{min: 49152, max: 65535}
+	tcpPortPool = make([]time.Time, tcpPorts.size())
+	udpPortPool = make([]time.Time, udpPorts.size())
+	tcpTimeout = time.Minute
+	udpTimeout = time.Minute
+	icmpv4Timeout = time.Minute
+
+	clientsLock.Lock()
+	for _, conn := range conns {
+		clients[conn.RemoteAddr().String()] = conn
+		clientStats[conn.RemoteAddr().String()] = newClientStat(0)
+	}
+	clientsLock.Unlock()
+
+	tb.Cleanup(func() {
+		clientsLock.Lock()
+		for _, conn := range conns {
+			delete(clients, conn.RemoteAddr().String())
+			delete(clientStats, conn.RemoteAddr().String())
+			forgetClientDrops(conn.RemoteAddr().String())
+		}
+		clientsLock.Unlock()
+
+		patLock.Lock()
+		patMap = make(map[quintuple]uint16)
+		activeFlows = 0
+		nextTCPPort, nextUDPPort = 0, 0
+		tcpPortPool, udpPortPool = nil, nil
+		patLock.Unlock()
+
+		nat = newNATTable()
+		upConn = nil
+	})
+
+	return w
+}
+
+// createEmbUDP returns an embedded IPv4 packet of UDP from the source to the destination with the TTL.
+func createEmbUDP(tb testing.TB, src, dst *net.UDPAddr, ttl uint8, payload []byte) []byte {
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		TTL:      ttl,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    src.IP.To4(),
+		DstIP:    dst.IP.To4(),
+	}
+	udpLayer := &layers.UDP{
+		SrcPort: layers.UDPPort(src.Port),
+		DstPort: layers.UDPPort(dst.Port),
+	}
+	err := udpLayer.SetNetworkLayerForChecksum(ipv4Layer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ipv4Layer, udpLayer, gopacket.Payload(payload))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// createReply returns the frame replying from the upstream to the UDP frame written to the upstream.
+func createReply(tb testing.TB, frame []byte, payload []byte) []byte {
+	return createReplyFrom(tb, frame, nil, payload)
+}
+
+// createReplyFrom returns the frame replying from the IP to the UDP frame written to the upstream, or from the
+// destination of the frame if the IP is nil.
+func createReplyFrom(tb testing.TB, frame []byte, srcIP net.IP, payload []byte) []byte {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udpLayer := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if srcIP == nil {
+		srcIP = ipv4Layer.DstIP
+	}
+
+	newEthernetLayer := &layers.Ethernet{
+		SrcMAC:       testGatewayHardwareAddr,
+		DstMAC:       testUpHardwareAddr,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	newIPv4Layer := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    srcIP.To4(),
+		DstIP:    ipv4Layer.SrcIP,
+	}
+	newUDPLayer := &layers.UDP{
+		SrcPort: udpLayer.DstPort,
+		DstPort: udpLayer.SrcPort,
+	}
+	err := newUDPLayer.SetNetworkLayerForChecksum(newIPv4Layer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, newEthernetLayer, newIPv4Layer, newUDPLayer, gopacket.Payload(payload))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// newUpstreamPacket returns the packet of the frame captured from the upstream now.
+func newUpstreamPacket(frame []byte) gopacket.Packet {
+	return newUpstreamPacketAt(frame, time.Now())
+}
+
+// newUpstreamPacketAt returns the packet of the frame captured from the upstream at the time.
+func newUpstreamPacketAt(frame []byte, t time.Time) gopacket.Packet {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().CaptureInfo.Timestamp = t
+
+	return packet
+}
+
+// embSrcOf returns the embedded source address of the client.
+func embSrcOf(i int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 8, 0, byte(i+1)).To4(), Port: 5000 + i}
+}
+
+// TestHandleConcurrently pumps packets from clients and replies from the upstream through handlers concurrently, which
+// catches data races on NAT, PAT and statistics when run with -race.
+func TestHandleConcurrently(t *testing.T) {
+	const packets = 200
+
+	conns := newRecordConns(8)
+	w := setupTestServer(t, conns)
+
+	// The first packet of each client creates the flow, and its frame to the upstream is replied to
+	queries := make([][]byte, len(conns))
+	replies := make([][]byte, len(conns))
+	for i, conn := range conns {
+		queries[i] = createEmbUDP(t, embSrcOf(i), testDstAddr, 64, []byte("query"))
+		err := handleListen(queries[i], conn, pcap.NewEmbDecoder())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frames := w.written()
+		if len(frames) != i+1 {
+			t.Fatalf("write %d frames to the upstream, expect %d", len(frames), i+1)
+		}
+		replies[i] = createReply(t, frames[i], []byte("answer"))
+	}
+
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		i, conn := i, conn
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+
+			decoder := pcap.NewEmbDecoder()
+			for j := 0; j < packets; j++ {
+				err := handleListen(append([]byte(nil), queries[i]...), conn, decoder)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < packets; j++ {
+				err := handleUpstream(newUpstreamPacket(append([]byte(nil), replies[i]...)), upConn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := w.count(); n != len(conns)*(packets+1) {
+		t.Errorf("write %d frames to the upstream, expect %d", n, len(conns)*(packets+1))
+	}
+	for i, conn := range conns {
+		payloads := conn.payloads()
+		if len(payloads) != packets {
+			t.Errorf("client %s: write %d payloads, expect %d", conn.RemoteAddr(), len(payloads), packets)
+			continue
+		}
+
+		// Replies are sent to the embedded source of the client
+		indicator, err := pcap.NewEmbDecoder().Decode(payloads[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !indicator.DstIP().Equal(embSrcOf(i).IP) || indicator.DstPort() != uint16(embSrcOf(i).Port) || !bytes.Equal(indicator.Payload(), []byte("answer")) {
+			t.Errorf("client %s: write %s, expect to %s", conn.RemoteAddr(), indicator.Dst(), embSrcOf(i))
+		}
+	}
+}
+
+// BenchmarkHandleListen handles packets from a client in an existing flow, which allocates buffers from pools.
+func BenchmarkHandleListen(b *testing.B) {
+	conns := newRecordConns(1)
+	w := setupTestServer(b, conns)
+	w.discard()
+
+	query := createEmbUDP(b, embSrcOf(0), testDstAddr, 64, make([]byte, 1200))
+	contents := make([]byte, len(query))
+	decoder := pcap.NewEmbDecoder()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(query)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		copy(contents, query)
+		err := handleListen(contents, conns[0], decoder)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkHandleUpstream handles replies from the upstream to a client, which allocates buffers from pools.
+func BenchmarkHandleUpstream(b *testing.B) {
+	conns := newRecordConns(1)
+	conns[0].isDiscarding = true
+	w := setupTestServer(b, conns)
+
+	err := handleListen(createEmbUDP(b, embSrcOf(0), testDstAddr, 64, []byte("query")), conns[0], pcap.NewEmbDecoder())
+	if err != nil {
+		b.Fatal(err)
+	}
+	reply := createReply(b, w.written()[0], make([]byte, 1200))
+	w.discard()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(reply)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := handleUpstream(newUpstreamPacket(reply), upConn)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
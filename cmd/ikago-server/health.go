@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// activity is the time in Unix nanoseconds when a packet is handled lastly, which is accessed atomically
+	activity     int64
+	listenExits  int32
+	healthWindow time.Duration
+)
+
+// touchActivity records a packet from clients or the upstream is handled.
+func touchActivity() {
+	atomic.StoreInt64(&activity, time.Now().UnixNano())
+}
+
+// lastActivity returns the time when a packet is handled lastly.
+func lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&activity))
+}
+
+// exitListen records a routine accepting clients or handling packets from clients exits.
+func exitListen() {
+	atomic.AddInt32(&listenExits, 1)
+}
+
+// isHealthy returns if the server is still listening, and has handled packets within the health window. It is cheap and
+// safe to be called concurrently.
+func isHealthy() bool {
+	if atomic.LoadInt32(&listenExits) > 0 {
+		return false
+	}
+	if healthWindow > 0 && time.Now().Sub(lastActivity()) > healthWindow {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/config"
+	"github.com/zhxie/ikago/internal/event"
+	"github.com/zhxie/ikago/internal/log"
+)
+
+// keepEvents is the max number of events waiting to be dispatched.
+const keepEvents = 256
+
+const (
+	eventClientConnect    = "client-connect"
+	eventClientDisconnect = "client-disconnect"
+	eventFailover         = "upstream-failover"
+	eventFailback         = "upstream-failback"
+	eventExhausted        = "pool-exhausted"
+	eventTooManyFlows     = "too-many-flows"
+	eventConflict         = "conflict"
+	eventRST              = "rst"
+)
+
+var eventTypes = []string{
+	eventClientConnect,
+	eventClientDisconnect,
+	eventFailover,
+	eventFailback,
+	eventExhausted,
+	eventTooManyFlows,
+	eventConflict,
+	eventRST,
+}
+
+// createEventBus returns a bus with sinks of the hooks, or nil if there are no hooks.
+func createEventBus(hooks []config.HookConfig) (*event.Bus, error) {
+	if len(hooks) <= 0 {
+		return nil, nil
+	}
+
+	bus := event.NewBus(keepEvents)
+	for _, hook := range hooks {
+		var (
+			err  error
+			sink event.Sink
+		)
+
+		n := 0
+		for _, s := range []string{hook.Command, hook.Webhook, hook.File} {
+			if s != "" {
+				n++
+			}
+		}
+
+		switch {
+		case n > 1:
+			return nil, errors.New("hook with more than one of command, webhook and file")
+		case hook.Command != "":
+			sink, err = event.NewCommandSink(hook.Command)
+		case hook.Webhook != "":
+			sink, err = event.NewWebhookSink(hook.Webhook)
+		case hook.File != "":
+			sink, err = event.NewFileSink(hook.File)
+		default:
+			return nil, errors.New("hook without command, webhook or file")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		types := hook.Events
+		if len(types) <= 0 {
+			types = []string{event.All}
+		}
+		for _, t := range types {
+			if t != event.All && !isEventType(t) {
+				return nil, fmt.Errorf("event %s not support", t)
+			}
+			bus.Subscribe(t, sink)
+		}
+
+		log.Infof("Send events %v to %s\n", types, sink)
+	}
+
+	return bus, nil
+}
+
+func isEventType(t string) bool {
+	for _, et := range eventTypes {
+		if et == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// publish publishes an event to hooks if there are any.
+func publish(t string, message string, fields map[string]string) {
+	if events == nil {
+		return
+	}
+
+	events.Publish(t, message, fields)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/zhxie/ikago/internal/config"
+	"github.com/zhxie/ikago/internal/event"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordSink records events sent to it.
+type recordSink struct {
+	events chan event.Event
+}
+
+func (sink *recordSink) Send(e event.Event) error {
+	sink.events <- e
+
+	return nil
+}
+
+func (sink *recordSink) String() string {
+	return "record"
+}
+
+// next returns the next event sent to the sink.
+func (sink *recordSink) next(t *testing.T) event.Event {
+	select {
+	case e := <-sink.events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+		return event.Event{}
+	}
+}
+
+// setTestEvents publishes events to a sink recording all events, which is stopped after the test.
+func setTestEvents(t *testing.T) *recordSink {
+	sink := &recordSink{events: make(chan event.Event, keepEvents)}
+
+	events = event.NewBus(keepEvents)
+	events.Subscribe(event.All, sink)
+	go events.Run()
+
+	bus := events
+	t.Cleanup(func() {
+		bus.Close()
+		events = nil
+	})
+
+	return sink
+}
+
+func TestCreateEventBus(t *testing.T) {
+	tests := []struct {
+		name  string
+		hooks []config.HookConfig
+		ok    bool
+	}{
+		{"none", nil, true},
+		{"all events", []config.HookConfig{{Command: "true"}}, true},
+		{"events", []config.HookConfig{{Events: []string{eventFailover, eventFailback}, Webhook: "http://127.0.0.1/hook"}}, true},
+		{"unknown event", []config.HookConfig{{Events: []string{"unknown"}, Command: "true"}}, false},
+		{"no sink", []config.HookConfig{{Events: []string{eventFailover}}}, false},
+		{"more than one sink", []config.HookConfig{{Command: "true", Webhook: "http://127.0.0.1/hook"}}, false},
+	}
+
+	for _, tt := range tests {
+		bus, err := createEventBus(tt.hooks)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: create: %v, expect ok %t", tt.name, err, tt.ok)
+		}
+		if bus != nil {
+			bus.Close()
+		}
+		if err == nil && (bus == nil) != (len(tt.hooks) <= 0) {
+			t.Errorf("%s: create bus %v with %d hooks", tt.name, bus, len(tt.hooks))
+		}
+	}
+}
+
+func TestPublishClientEvents(t *testing.T) {
+	sink := setTestEvents(t)
+
+	conn := newRecordConns(1)[0]
+	t.Cleanup(func() {
+		removeClient(conn)
+	})
+
+	newPendingClient(conn).register()
+	e := sink.next(t)
+	if e.Type != eventClientConnect || e.Fields["client"] != conn.RemoteAddr().String() {
+		t.Errorf("publish %s of client %s, expect %s of client %s", e.Type, e.Fields["client"], eventClientConnect, conn.RemoteAddr())
+	}
+
+	disconnectClient(conn.RemoteAddr())
+	e = sink.next(t)
+	if e.Type != eventClientDisconnect || e.Fields["client"] != conn.RemoteAddr().String() {
+		t.Errorf("publish %s of client %s, expect %s of client %s", e.Type, e.Fields["client"], eventClientDisconnect, conn.RemoteAddr())
+	}
+}
+
+func TestPublishUpstreamEvents(t *testing.T) {
+	sink := setTestEvents(t)
+
+	up := newTestUpConn(t, "up", "192.168.1.2")
+	a := newTestUpConn(t, "a", "192.168.2.2")
+	setTestUpstreams(t, up, []*pcap.RawConn{a}, map[string]bool{"up": false, "a": true})
+
+	switchUpstream(nil, a, "carrier down")
+	e := sink.next(t)
+	if e.Type != eventFailover || e.Fields["from"] != "up" || e.Fields["to"] != "a" {
+		t.Errorf("publish %s from %s to %s, expect %s from up to a", e.Type, e.Fields["from"], e.Fields["to"], eventFailover)
+	}
+
+	switchUpstream(a, nil, "primary recovered")
+	e = sink.next(t)
+	if e.Type != eventFailback || e.Fields["from"] != "a" || e.Fields["to"] != "up" {
+		t.Errorf("publish %s from %s to %s, expect %s from a to up", e.Type, e.Fields["from"], e.Fields["to"], eventFailback)
+	}
+}
+
+func TestPublishFlowEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxFlows int
+		ports    portRange
+		want     string
+	}{
+		{"too many flows", 1, portRange{min: 49152, max: 65535}, eventTooManyFlows},
+		{"pool exhausted", 0, portRange{min: 49152, max: 49152}, eventExhausted},
+	}
+
+	prevMaxFlows := maxFlows
+	defer func() {
+		maxFlows = prevMaxFlows
+		isFlowsFull, isExhausted = false, false
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := setTestEvents(t)
+			conns := newRecordConns(1)
+			setupTestServer(t, conns)
+			maxFlows = tt.maxFlows
+			isFlowsFull, isExhausted = false, false
+			udpPorts = tt.ports
+			udpPortPool = make([]time.Time, udpPorts.size())
+
+			// The second flow is refused, and the event is published only once until flows are accepted again
+			for i := 0; i < 3; i++ {
+				src := &net.UDPAddr{IP: embSrcOf(0).IP, Port: embSrcOf(0).Port + i}
+				err := handleListen(createEmbUDP(t, src, testDstAddr, 64, []byte("query")), conns[0], pcap.NewEmbDecoder())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			e := sink.next(t)
+			if e.Type != tt.want || e.Fields["client"] != conns[0].RemoteAddr().String() {
+				t.Errorf("publish %s of client %s, expect %s of client %s", e.Type, e.Fields["client"], tt.want, conns[0].RemoteAddr())
+			}
+			select {
+			case e := <-sink.events:
+				t.Errorf("publish %s again", e.Type)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -9,11 +10,17 @@
 	"github.com/google/gopacket/layers"
 	"github.com/xtaci/kcp-go"
 	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/admin"
 	"github.com/zhxie/ikago/internal/config"
 	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/discovery"
+	"github.com/zhxie/ikago/internal/event"
 	"github.com/zhxie/ikago/internal/exec"
+	"github.com/zhxie/ikago/internal/lock"
 	"github.com/zhxie/ikago/internal/log"
 	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/privilege"
+	"github.com/zhxie/ikago/internal/routine"
 	"github.com/zhxie/ikago/internal/stat"
 	"io"
 	"math"
@@ -21,9 +28,12 @@
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -35,9 +45,90 @@ type quintuple struct {
 }
 
 type natIndicator struct {
-	src    net.Addr
-	embSrc net.Addr
-	conn   net.Conn
+	// seen is accessed atomically and must be first to be aligned on 32-bit platforms
+	seen     int64
+	src      net.Addr
+	embSrc   net.Addr
+	conn     net.Conn
+	value    uint16
+	dstsLock sync.RWMutex
+	dsts     map[[16]byte]bool
+	tcpLock  sync.Mutex
+	tcpDst   *net.TCPAddr
+	tcpAck   uint32
+}
+
+func newNATIndicator(src, embSrc net.Addr, conn net.Conn, value uint16) *natIndicator {
+	return &natIndicator{
+		seen:   time.Now().UnixNano(),
+		src:    src,
+		embSrc: embSrc,
+		conn:   conn,
+		value:  value,
+		dsts:   make(map[[16]byte]bool),
+	}
+}
+
+// see records the flow is active at the time.
+func (indicator *natIndicator) see(t time.Time) {
+	atomic.StoreInt64(&indicator.seen, t.UnixNano())
+}
+
+// lastSeen returns the time when the flow is active lastly.
+func (indicator *natIndicator) lastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&indicator.seen))
+}
+
+// addDst records a destination the flow has communicated with.
+func (indicator *natIndicator) addDst(ip net.IP) {
+	key := ipKey(ip)
+
+	indicator.dstsLock.RLock()
+	ok := indicator.dsts[key]
+	indicator.dstsLock.RUnlock()
+	if ok {
+		return
+	}
+
+	indicator.dstsLock.Lock()
+	indicator.dsts[key] = true
+	indicator.dstsLock.Unlock()
+}
+
+// seeTCP records the destination and the acknowledgement of the last TCP packet with ACK in the flow, so the flow can
+// be reset in the client when it is torn down.
+func (indicator *natIndicator) seeTCP(dst *net.TCPAddr, ack uint32) {
+	indicator.tcpLock.Lock()
+	defer indicator.tcpLock.Unlock()
+
+	indicator.tcpDst = dst
+	indicator.tcpAck = ack
+}
+
+// lastTCP returns the destination and the acknowledgement of the last TCP packet with ACK in the flow, or nil if there
+// is none.
+func (indicator *natIndicator) lastTCP() (*net.TCPAddr, uint32) {
+	indicator.tcpLock.Lock()
+	defer indicator.tcpLock.Unlock()
+
+	return indicator.tcpDst, indicator.tcpAck
+}
+
+// hasDst returns if the flow has communicated with the destination.
+func (indicator *natIndicator) hasDst(ip net.IP) bool {
+	indicator.dstsLock.RLock()
+	defer indicator.dstsLock.RUnlock()
+
+	return indicator.dsts[ipKey(ip)]
+}
+
+// ipKey returns the IP in the 16-byte form as a map key, which is the same for IPv4 addresses in both forms and costs
+// no allocation.
+func ipKey(ip net.IP) [16]byte {
+	var key [16]byte
+	copy(key[:], ip.To16())
+
+	return key
 }
 
 func (indicator *natIndicator) embSrcIP() net.IP {
@@ -57,8 +148,24 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 
 const name string = "IkaGo-server"
 
+// keepAlive is the default interval of sweeping expired NAT.
 const keepAlive = 30 * time.Second
+
+// tcpKeepAlive, udpKeepAlive and icmpKeepAlive are the default durations after which idle ports and Ids expire. The TCP
+// one follows the established connection idle-timeout in RFC 5382.
+const tcpKeepAlive = 7440 * time.Second
+const udpKeepAlive = 300 * time.Second
+const icmpKeepAlive = 60 * time.Second
 const keepFragments = 30 * time.Second
+const maxRoutines = 65536
+const waitRoutines = 5 * time.Second
+const retryRead = 100 * time.Millisecond
+
+// waitPayload is the duration for clients to send the first valid payload after handshakes before being closed.
+const waitPayload = 30 * time.Second
+
+// errDrainTimeout is returned by closeAll if queued packets are abandoned when closing.
+var errDrainTimeout = errors.New("drain timed out")
 
 var (
 	version     = ""
@@ -69,65 +176,180 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 )
 
 var (
-	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
-	argConfig         = flag.String("c", "", "Configuration file.")
-	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
-	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
-	argGateway        = flag.String("gateway", "", "Gateway address.")
-	argMode           = flag.String("mode", "faketcp", "Mode.")
-	argMethod         = flag.String("method", "plain", "Method of encryption.")
-	argPassword       = flag.String("password", "", "Password of encryption.")
-	argRule           = flag.Bool("rule", false, "Add firewall rule.")
-	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
-	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
-	argLog            = flag.String("log", "", "Log.")
-	argMTU            = flag.Int("mtu", pcap.MaxEthernetMTU, "MTU.")
-	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
-	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
-	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
-	argKCPRecvWindow  = flag.Int("kcp-rcvwnd", kcp.IKCP_WND_RCV, "KCP tuning option rcvwnd.")
-	argKCPDataShard   = flag.Int("kcp-datashard", 10, "KCP tuning option datashard.")
-	argKCPParityShard = flag.Int("kcp-parityshard", 3, "KCP tuning option parityshard.")
-	argKCPACKNoDelay  = flag.Bool("kcp-acknodelay", false, "KCP tuning option acknodelay.")
-	argKCPNoDelay     = flag.Bool("kcp-nodelay", false, "KCP tuning option nodelay.")
-	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
-	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
-	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
-	argFragment       = flag.Int("fragment", pcap.MaxEthernetMTU, "Fragmentation size for routing upstream.")
-	argPort           = flag.Int("p", 0, "Port for listening.")
+	argListDevs        = flag.Bool("list-devices", false, "List all valid devices in current computer.")
+	argConfig          = flag.String("c", "", "Configuration file.")
+	argPrintConfig     = flag.Bool("print-config", false, "Print configuration.")
+	argListenDevs      = flag.String("listen-devices", "", "Devices for listening.")
+	argListenIPs       = flag.String("listen-ips", "", "IPs for listening.")
+	argUpDev           = flag.String("upstream-device", "", "Device for routing upstream to.")
+	argGateway         = flag.String("gateway", "", "Gateway address.")
+	argMode            = flag.String("mode", "faketcp", "Mode.")
+	argMethod          = flag.String("method", "plain", "Method of encryption.")
+	argPassword        = flag.String("password", "", "Password of encryption.")
+	argExtraPasswords  = flag.String("extra-passwords", "", "Extra passwords accepted from clients.")
+	argRule            = flag.Bool("rule", false, "Add firewall rule.")
+	argNoFirewallRule  = flag.Bool("no-firewall-rule", false, "Do not add firewall rule dropping TCP RST from the listen port.")
+	argMonitor         = flag.Int("monitor", 0, "Port for monitoring.")
+	argMetrics         = flag.String("metrics", "", "Address for serving metrics.")
+	argVerbose         = flag.Bool("v", false, "Print verbose messages.")
+	argLog             = flag.String("log", "", "Log.")
+	argLogJSON         = flag.Bool("log-json", false, "Print logs as JSON objects.")
+	argLogLevel        = flag.String("log-level", "", "Min level of printing logs.")
+	argMTU             = config.BytesFlag("mtu", pcap.MaxEthernetMTU, "MTU.")
+	argKCP             = flag.Bool("kcp", false, "Enable KCP.")
+	argKCPMTU          = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
+	argKCPSendWindow   = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
+	argKCPRecvWindow   = flag.Int("kcp-rcvwnd", kcp.IKCP_WND_RCV, "KCP tuning option rcvwnd.")
+	argKCPDataShard    = flag.Int("kcp-datashard", 10, "KCP tuning option datashard.")
+	argKCPParityShard  = flag.Int("kcp-parityshard", 3, "KCP tuning option parityshard.")
+	argKCPACKNoDelay   = flag.Bool("kcp-acknodelay", false, "KCP tuning option acknodelay.")
+	argKCPNoDelay      = flag.Bool("kcp-nodelay", false, "KCP tuning option nodelay.")
+	argKCPInterval     = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
+	argKCPResend       = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
+	argKCPNC           = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argDisguise        = flag.Bool("disguise", false, "Disguise handshakes with TCP options.")
+	argDisguiseWindow  = flag.Int("disguise-window", 64240, "Disguise option window.")
+	argDisguiseMSS     = flag.Int("disguise-mss", 1460, "Disguise option mss.")
+	argDisguiseWScale  = flag.Int("disguise-wscale", 7, "Disguise option wscale.")
+	argDisguiseSACK    = flag.Bool("disguise-sack", true, "Disguise option sack.")
+	argDisguiseTS      = flag.Bool("disguise-timestamps", true, "Disguise option timestamps.")
+	argPadding         = flag.Bool("padding", false, "Pad packets.")
+	argBucket          = flag.Bool("bucket", false, "Pad packets to buckets.")
+	argFragment        = config.BytesFlag("fragment", pcap.MaxEthernetMTU, "Fragmentation size for routing upstream.")
+	argPort            = flag.Int("p", 0, "Port for listening.")
+	argPorts           = flag.String("ports", "", "Ports for listening, separated by commas.")
+	argAdmin           = flag.String("admin", "", "Unix socket for admin commands.")
+	argAdminWrite      = flag.Bool("admin-write", false, "Allow mutating admin commands.")
+	argMaxFlows        = flag.Int("max-flows", 0, "Max active flows.")
+	argNAT             = flag.String("nat", "restricted", "NAT mode.")
+	argFallbackUpDev   = flag.String("fallback-upstream-device", "", "Fallback devices for routing upstream to.")
+	argFallbackGateway = flag.String("fallback-gateway", "", "Fallback gateway addresses.")
+	argUpstreamProbe   = config.DurationFlag("upstream-probe", 0, "Interval of probing the gateway of the upstream device.")
+	argGatewayRefresh  = config.DurationFlag("gateway-refresh", 0, "Interval of resolving the hardware address of gateways.")
+	argTTL             = flag.Int("ttl", 0, "TTL of packets sent to destinations.")
+	argExclusive       = flag.Bool("exclusive", false, "Exit if another instance is detected.")
+	argMinStrength     = flag.Int("min-strength", 0, "Minimum strength of encryption.")
+	argDiscovery       = flag.Bool("discovery", false, "Answer discovery probes.")
+	argNATSweep        = config.DurationFlag("nat-sweep", config.Duration(keepAlive), "Interval of sweeping expired NAT.")
+	argTCPPorts        = flag.String("tcp-ports", "49152-65535", "Port range for distributing to TCP flows.")
+	argUDPPorts        = flag.String("udp-ports", "49152-65535", "Port range for distributing to UDP flows.")
+	argTCPTimeout      = config.DurationFlag("tcp-timeout", config.Duration(tcpKeepAlive), "Timeout of idle TCP flows.")
+	argUDPTimeout      = config.DurationFlag("udp-timeout", config.Duration(udpKeepAlive), "Timeout of idle UDP flows.")
+	argICMPTimeout     = config.DurationFlag("icmp-timeout", config.Duration(icmpKeepAlive), "Timeout of idle ICMP flows.")
+	argClientTimeout   = config.DurationFlag("client-timeout", 0, "Timeout of idle clients.")
+	argKeepAlive       = config.SecondsFlag("keepalive", 0, "Interval of sending keep-alives to clients.")
+	argUser            = flag.String("user", "", "User to run as after opening pcap.")
+	argKeepNetRaw      = flag.Bool("keep-net-raw", false, "Keep CAP_NET_RAW for opening pcap after switching to the user.")
+	argRateLimit       = config.RateFlag("rate-limit", 0, "Rate limit of each client.")
+	argRateLimits      = flag.String("rate-limits", "", "Rate limits of clients by addresses.")
+	argHookCommand     = flag.String("hook-command", "", "Command to run on events.")
+	argHookWebhook     = flag.String("hook-webhook", "", "Webhook to post events to.")
+	argHookFile        = flag.String("hook-file", "", "Event log to append events to.")
+	argMaxClients      = flag.Int("max-clients", 0, "Max clients.")
+	argEvictClients    = flag.Bool("evict-clients", false, "Evict the least recently active client for new clients.")
+	argAllowNoHello    = flag.Bool("allow-no-hello", false, "Serve clients which do not support the hello without authentication.")
+	argResetUnauth     = flag.Bool("reset-unauthenticated", false, "Reset clients which do not authenticate in time.")
+	argMaxAge          = config.MillisecondsFlag("max-age", config.Milliseconds(300*time.Millisecond), "Max age of packets.")
+	argHealthWindow    = config.DurationFlag("health-window", 0, "Max duration without packets before being unhealthy.")
+	argListenWorkers   = flag.Int("listen-workers", 0, "Workers handling packets from clients.")
+	argUpWorkers       = flag.Int("upstream-workers", 0, "Workers handling packets from upstream.")
+	argUpReaders       = flag.Int("upstream-readers", 1, "Handles reading packets from upstream.")
+	argQueueSize       = flag.Int("queue-size", 1000, "Size of the queue of each worker.")
+	argQueuePolicy     = flag.String("queue-policy", "drop", "Policy when the queue is full, can be drop or block.")
+	argDryRun          = flag.Bool("dry-run", false, "Parse packets from clients without redirecting them.")
+	argDump            = flag.String("dump", "", "File for dumping packets failed to handle.")
+	argDumpInjected    = flag.Bool("dump-injected", false, "Dump packets injected to upstream.")
+	argAllow           = flag.String("allow", "", "Destinations allowed for clients.")
+	argDeny            = flag.String("deny", "", "Destinations denied for clients.")
+	argDenyRST         = flag.Bool("deny-rst", false, "Reset TCP connections to denied destinations.")
+	argAllowedClients  = flag.String("allowed-clients", "", "Sources allowed to connect as clients.")
 )
 
 var (
-	fragment   int
-	port       uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
+	fragment      int
+	port          uint16
+	ports         []uint16
+	listenDevs    []*pcap.Device
+	upDev         *pcap.Device
+	gatewayDev    *pcap.Device
+	mode          string
+	crypt         crypto.Crypt
+	fingerprint   string
+	mtu           int
+	isKCP         bool
+	kcpConfig     *config.KCPConfig
+	maxFlows      int
+	upTTL         uint8
+	isFullCone    bool
+	isExclusive   bool
+	minStrength   int
+	maxAge        time.Duration
+	natSweep      time.Duration
+	tcpPorts      portRange
+	udpPorts      portRange
+	tcpTimeout    time.Duration
+	udpTimeout    time.Duration
+	icmpv4Timeout time.Duration
+	clientTimeout time.Duration
+	keepAliveInt  time.Duration
+	addRSTRule    bool
+	rateLimit     int
+	rateLimits    map[string]int
+	maxClients    int
+	evictClients  bool
+	isDryRun      bool
+	dumpInjected  bool
+	isQueueBlock  bool
+	upReaders     int
+	allowRules    []aclRule
+	denyRules     []aclRule
+	isDenyRST     bool
+	allowedIPNets []*net.IPNet
 )
 
 var (
 	isClosed     bool
+	quit         chan struct{}
+	closeOnce    sync.Once
+	closeErr     error
+	readers      sync.WaitGroup
+	handlers     sync.WaitGroup
+	routines     *routine.Registry
 	listeners    []net.Listener
+	responder    *discovery.Responder
+	portLocks    []*lock.Lock
+	detectors    []*pcap.ConflictDetector
+	rstDetectors []*pcap.RSTDetector
+	rstRulePorts []uint16
 	upConn       *pcap.RawConn
-	c            chan pcap.ConnBytes
+	upReadConns  []*pcap.RawConn
 	defrag       *pcap.EasyDefragmenter
+	embDefrag    *pcap.EasyDefragmenter
 	nextTCPPort  uint16
 	tcpPortPool  []time.Time
 	nextUDPPort  uint16
 	udpPortPool  []time.Time
 	nextICMPv4Id uint16
 	icmpv4IdPool []time.Time
+	patLock      sync.RWMutex
 	patMap       map[quintuple]uint16
-	natLock      sync.RWMutex
-	nat          map[pcap.NATGuide]*natIndicator
+	activeFlows  int
+	isExhausted  bool
+	isFlowsFull  bool
+	nat          *natTable
+	clientsLock  sync.RWMutex
+	clients      map[string]net.Conn
+	clientStats  map[string]*clientStat
+	pendings     map[*pendingClient]bool
 	monitor      *stat.TrafficMonitor
+	sizes        *stat.SizeMonitor
+	traffic      *stat.ProtocolCounter
 	dnsLock      sync.RWMutex
 	dns          map[string]string
+	console      *admin.Admin
+	events       *event.Bus
+	monitorSrv   *http.Server
+	dumper       *pcap.Dumper
 )
 
 func init() {
@@ -150,39 +372,47 @@ func init() {
 
 	// Start time
 	startTime = time.Now()
-
-	// Parse arguments
-	flag.Parse()
-
-	// Load config.json by default
-	if len(os.Args) <= 1 {
-		_, err := os.Stat("config.json")
-		if err == nil {
-			*argConfig = "config.json"
-		}
-	}
+	touchActivity()
 
 	listenDevs = make([]*pcap.Device, 0)
 
+	quit = make(chan struct{})
+	routines = routine.NewRegistry(maxRoutines)
 	listeners = make([]net.Listener, 0)
-	c = make(chan pcap.ConnBytes, 1000)
 	defrag = pcap.NewEasyDefragmenter()
 	defrag.SetDeadline(keepFragments)
-	tcpPortPool = make([]time.Time, 16384)
-	udpPortPool = make([]time.Time, 16384)
+	embDefrag = pcap.NewEasyDefragmenter()
+	embDefrag.SetDeadline(keepFragments)
 	icmpv4IdPool = make([]time.Time, 65536)
 	patMap = make(map[quintuple]uint16)
-	nat = make(map[pcap.NATGuide]*natIndicator)
+	nat = newNATTable()
+	clients = make(map[string]net.Conn)
+	clientStats = make(map[string]*clientStat)
+	pendings = make(map[*pendingClient]bool)
 	dns = make(map[string]string)
+	sizes = stat.NewSizeMonitor()
+	traffic = stat.NewProtocolCounter()
 }
 
 func main() {
 	var (
-		err     error
-		cfg     *config.Config
-		gateway net.IP
+		err              error
+		cfg              *config.Config
+		gateway          net.IP
+		fallbackGateways []net.IP
 	)
 
+	// Parse arguments, which is not in init so tests can parse their flags
+	flag.Parse()
+
+	// Load config.json by default
+	if len(os.Args) <= 1 {
+		_, err := os.Stat("config.json")
+		if err == nil {
+			*argConfig = "config.json"
+		}
+	}
+
 	// Configuration file
 	if *argConfig != "" {
 		cfg, err = config.ParseFile(*argConfig)
@@ -193,15 +423,20 @@ func main() {
 	} else {
 		cfg = config.NewConfig()
 		cfg.ListenDevs = splitArg(*argListenDevs)
+		cfg.ListenIPs = splitArg(*argListenIPs)
 		cfg.UpDev = *argUpDev
 		cfg.Gateway = *argGateway
 		cfg.Mode = *argMode
 		cfg.Method = *argMethod
 		cfg.Password = *argPassword
+		cfg.ExtraPasswords = splitArg(*argExtraPasswords)
 		cfg.Rule = *argRule
 		cfg.Monitor = *argMonitor
+		cfg.Metrics = *argMetrics
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		cfg.LogJSON = *argLogJSON
+		cfg.LogLevel = *argLogLevel
 		cfg.MTU = *argMTU
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
@@ -215,17 +450,107 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.Disguise = *argDisguise
+		cfg.DisguiseConfig = *config.NewDisguiseConfig()
+		cfg.DisguiseConfig.Window = *argDisguiseWindow
+		cfg.DisguiseConfig.MSS = *argDisguiseMSS
+		cfg.DisguiseConfig.WindowScale = *argDisguiseWScale
+		cfg.DisguiseConfig.SACK = *argDisguiseSACK
+		cfg.DisguiseConfig.Timestamps = *argDisguiseTS
+		cfg.Padding = *argPadding
+		cfg.Bucket = *argBucket
 		cfg.Fragment = *argFragment
 		cfg.Port = *argPort
+		for _, s := range splitArg(*argPorts) {
+			p, err := strconv.Atoi(s)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("parse listen port %s: %w", s, err))
+			}
+			cfg.Ports = append(cfg.Ports, p)
+		}
+		cfg.Admin = *argAdmin
+		cfg.AdminWrite = *argAdminWrite
+		cfg.MaxFlows = *argMaxFlows
+		cfg.NAT = *argNAT
+		cfg.FallbackUpDev = *argFallbackUpDev
+		cfg.FallbackGateway = *argFallbackGateway
+		cfg.UpstreamProbe = *argUpstreamProbe
+		cfg.GatewayRefresh = *argGatewayRefresh
+		cfg.TTL = *argTTL
+		cfg.Exclusive = *argExclusive
+		cfg.MinStrength = *argMinStrength
+		cfg.Discovery = *argDiscovery
+		cfg.MaxAge = *argMaxAge
+		cfg.NATSweep = *argNATSweep
+		cfg.TCPPorts = *argTCPPorts
+		cfg.UDPPorts = *argUDPPorts
+		cfg.TCPTimeout = *argTCPTimeout
+		cfg.UDPTimeout = *argUDPTimeout
+		cfg.ICMPTimeout = *argICMPTimeout
+		cfg.ClientTimeout = *argClientTimeout
+		cfg.KeepAlive = *argKeepAlive
+		cfg.HealthWindow = *argHealthWindow
+		cfg.ListenWorkers = *argListenWorkers
+		cfg.UpWorkers = *argUpWorkers
+		cfg.UpReaders = *argUpReaders
+		cfg.QueueSize = *argQueueSize
+		cfg.QueuePolicy = *argQueuePolicy
+		cfg.DryRun = *argDryRun
+		cfg.Dump = *argDump
+		cfg.DumpInjected = *argDumpInjected
+		cfg.Allow = splitArg(*argAllow)
+		cfg.Deny = splitArg(*argDeny)
+		cfg.DenyRST = *argDenyRST
+		cfg.AllowedClients = splitArg(*argAllowedClients)
+		cfg.NoFirewallRule = *argNoFirewallRule
+		cfg.User = *argUser
+		cfg.KeepNetRaw = *argKeepNetRaw
+		cfg.RateLimit = *argRateLimit
+		cfg.RateLimits, err = parseRateLimits(*argRateLimits)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("rate limits: %w", err))
+		}
+		if *argHookCommand != "" {
+			cfg.Hooks = append(cfg.Hooks, config.HookConfig{Command: *argHookCommand})
+		}
+		if *argHookWebhook != "" {
+			cfg.Hooks = append(cfg.Hooks, config.HookConfig{Webhook: *argHookWebhook})
+		}
+		if *argHookFile != "" {
+			cfg.Hooks = append(cfg.Hooks, config.HookConfig{File: *argHookFile})
+		}
+		cfg.MaxClients = *argMaxClients
+		cfg.EvictClients = *argEvictClients
+		cfg.AllowNoHello = *argAllowNoHello
+		cfg.ResetUnauth = *argResetUnauth
+	}
+
+	// Print configuration
+	if *argPrintConfig {
+		b, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			log.Fatalln(fmt.Errorf("print configuration: %w", err))
+		}
+		fmt.Println(string(b))
+		os.Exit(0)
 	}
 
 	// Log
 	log.SetVerbose(cfg.Verbose || *argVerbose)
+	if cfg.LogLevel != "" {
+		level, err := log.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("log level: %w", err))
+		}
+		log.SetLevel(level)
+	}
+	log.SetJSON(cfg.LogJSON || *argLogJSON)
 	err = log.SetLog(cfg.Log)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("log %s: %w", cfg.Log, err))
 	}
 	if cfg.Log != "" {
+		ownPaths = append(ownPaths, cfg.Log)
 		log.Infof("Save log to file %s\n", cfg.Log)
 	}
 
@@ -270,6 +595,20 @@ func main() {
 			log.Fatalln(fmt.Errorf("invalid gateway %s", cfg.Gateway))
 		}
 	}
+	for _, s := range splitArg(cfg.FallbackGateway) {
+		// An empty gateway is determined automatically
+		if s == "" {
+			fallbackGateways = append(fallbackGateways, nil)
+			continue
+		}
+
+		ip := net.ParseIP(s)
+		if ip == nil {
+			log.Fatalln(fmt.Errorf("invalid fallback gateway %s", s))
+		}
+
+		fallbackGateways = append(fallbackGateways, ip)
+	}
 	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
 		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
 	}
@@ -300,15 +639,82 @@ func main() {
 	if cfg.KCPConfig.NC < 0 {
 		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
 	}
+	if cfg.DisguiseConfig.Window <= 0 || cfg.DisguiseConfig.Window > 65535 {
+		log.Fatalln(fmt.Errorf("disguise window %d out of range", cfg.DisguiseConfig.Window))
+	}
+	if cfg.DisguiseConfig.MSS < 0 || cfg.DisguiseConfig.MSS > 65535 {
+		log.Fatalln(fmt.Errorf("disguise mss %d out of range", cfg.DisguiseConfig.MSS))
+	}
+	if cfg.DisguiseConfig.WindowScale < -1 || cfg.DisguiseConfig.WindowScale > 14 {
+		log.Fatalln(fmt.Errorf("disguise wscale %d out of range", cfg.DisguiseConfig.WindowScale))
+	}
 	if cfg.Fragment < 576 || cfg.Fragment > pcap.MaxMTU {
 		log.Fatalln(fmt.Errorf("fragment %d out of range", cfg.Fragment))
 	}
-	if cfg.Port == 0 {
+	if cfg.NATSweep < 0 {
+		log.Fatalln(fmt.Errorf("nat sweep %s out of range", cfg.NATSweep))
+	}
+	if cfg.TCPTimeout <= 0 {
+		log.Fatalln(fmt.Errorf("tcp timeout %s out of range", cfg.TCPTimeout))
+	}
+	if cfg.UDPTimeout <= 0 {
+		log.Fatalln(fmt.Errorf("udp timeout %s out of range", cfg.UDPTimeout))
+	}
+	if cfg.ICMPTimeout <= 0 {
+		log.Fatalln(fmt.Errorf("icmp timeout %s out of range", cfg.ICMPTimeout))
+	}
+	if cfg.ClientTimeout < 0 {
+		log.Fatalln(fmt.Errorf("client timeout %s out of range", cfg.ClientTimeout))
+	}
+	if cfg.KeepAlive < 0 {
+		log.Fatalln(fmt.Errorf("keepalive %s out of range", cfg.KeepAlive))
+	}
+	if cfg.MaxAge < 0 {
+		log.Fatalln(fmt.Errorf("max age %s out of range", cfg.MaxAge))
+	}
+	if cfg.HealthWindow < 0 {
+		log.Fatalln(fmt.Errorf("health window %s out of range", cfg.HealthWindow))
+	}
+	if cfg.ListenWorkers < 0 {
+		log.Fatalln(fmt.Errorf("listen workers %d out of range", cfg.ListenWorkers))
+	}
+	if cfg.UpWorkers < 0 {
+		log.Fatalln(fmt.Errorf("upstream workers %d out of range", cfg.UpWorkers))
+	}
+	if cfg.UpReaders <= 0 {
+		log.Fatalln(fmt.Errorf("upstream readers %d out of range", cfg.UpReaders))
+	}
+	if cfg.QueueSize <= 0 {
+		log.Fatalln(fmt.Errorf("queue size %d out of range", cfg.QueueSize))
+	}
+	switch cfg.QueuePolicy {
+	case "drop", "block":
+		break
+	default:
+		log.Fatalln(fmt.Errorf("queue policy %s not support", cfg.QueuePolicy))
+	}
+	if cfg.MinStrength < 0 {
+		log.Fatalln(fmt.Errorf("min strength %d out of range", cfg.MinStrength))
+	}
+	if cfg.MaxFlows < 0 {
+		log.Fatalln(fmt.Errorf("max flows %d out of range", cfg.MaxFlows))
+	}
+	if cfg.Port == 0 && len(cfg.Ports) <= 0 {
 		log.Fatalln("Please provide listen port by -p port.")
 	}
-	if cfg.Port <= 0 || cfg.Port > 65535 {
+	if cfg.Port < 0 || cfg.Port > 65535 {
 		log.Fatalln(fmt.Errorf("listen port %d out of range", cfg.Port))
 	}
+	isListenPort := make(map[int]bool)
+	for _, p := range cfg.Ports {
+		if p <= 0 || p > 65535 {
+			log.Fatalln(fmt.Errorf("listen port %d out of range", p))
+		}
+		if isListenPort[p] {
+			log.Fatalln(fmt.Errorf("duplicate listen port %d", p))
+		}
+		isListenPort[p] = true
+	}
 
 	// Find devices
 	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
@@ -328,6 +734,33 @@ func main() {
 
 		listenDevs = result
 	}
+	if len(cfg.ListenIPs) > 0 {
+		// Restrict listen devices to listen IPs
+		ips := make([]net.IP, 0)
+		for _, s := range cfg.ListenIPs {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				log.Fatalln(fmt.Errorf("invalid listen ip %s", s))
+			}
+			ips = append(ips, ip)
+		}
+
+		result := make([]*pcap.Device, 0)
+		for _, dev := range listenDevs {
+			d := dev.Restrict(ips)
+			if d == nil {
+				continue
+			}
+			result = append(result, d)
+		}
+		for _, ip := range ips {
+			if pcap.FindDev(result, ip) == nil {
+				log.Fatalln(fmt.Errorf("listen ip %s not in listen devices", ip))
+			}
+		}
+
+		listenDevs = result
+	}
 	if len(listenDevs) <= 0 {
 		log.Fatalln(errors.New("cannot determine listen device"))
 	}
@@ -345,6 +778,67 @@ func main() {
 	if gatewayDev == nil {
 		log.Fatalln(errors.New("cannot determine gateway device"))
 	}
+	fallbackNames := splitArg(cfg.FallbackUpDev)
+	if len(fallbackGateways) > len(fallbackNames) {
+		log.Fatalln(errors.New("more fallback gateways than fallback upstream devices"))
+	}
+	for i, name := range fallbackNames {
+		// Gateways are matched with devices in order
+		var fallbackGateway net.IP
+		if i < len(fallbackGateways) {
+			fallbackGateway = fallbackGateways[i]
+		}
+
+		fallbackUpDev, fallbackGatewayDev, err := pcap.FindUpstreamDevAndGatewayDev(name, fallbackGateway)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find fallback upstream device and gateway device: %w", err))
+		}
+		if fallbackUpDev == nil {
+			log.Fatalln(fmt.Errorf("cannot determine fallback upstream device %s", name))
+		}
+		if fallbackGatewayDev == nil {
+			log.Fatalln(fmt.Errorf("cannot determine fallback gateway device of %s", name))
+		}
+		if fallbackUpDev.Name() == upDev.Name() {
+			log.Fatalln(errors.New("same fallback upstream device with upstream device"))
+		}
+		for _, dev := range fallbackUpDevs {
+			if fallbackUpDev.Name() == dev.Name() {
+				log.Fatalln(fmt.Errorf("duplicate fallback upstream device %s", name))
+			}
+		}
+
+		fallbackUpDevs = append(fallbackUpDevs, fallbackUpDev)
+		fallbackGatewayDevs = append(fallbackGatewayDevs, fallbackGatewayDev)
+	}
+
+	// Upstream probe
+	if cfg.UpstreamProbe < 0 {
+		log.Fatalln(fmt.Errorf("upstream probe %s out of range", cfg.UpstreamProbe))
+	}
+	if cfg.UpstreamProbe > 0 && len(fallbackUpDevs) > 0 {
+		upProbe = time.Duration(cfg.UpstreamProbe)
+		log.Infof("Probe the gateway of upstream device %s every %s\n", upDev.Alias(), upProbe)
+	}
+
+	// Gateway refresh
+	if cfg.GatewayRefresh < 0 {
+		log.Fatalln(fmt.Errorf("gateway refresh %s out of range", cfg.GatewayRefresh))
+	}
+	if cfg.GatewayRefresh > 0 {
+		gatewayRefresh = time.Duration(cfg.GatewayRefresh)
+		isGatewayFound = gateway == nil
+		log.Infof("Refresh the hardware address of gateways every %s\n", gatewayRefresh)
+	}
+
+	// TTL
+	if cfg.TTL < 0 || cfg.TTL > 255 {
+		log.Fatalln(fmt.Errorf("ttl %d out of range", cfg.TTL))
+	}
+	if cfg.TTL > 0 {
+		upTTL = uint8(cfg.TTL)
+		log.Infof("Send packets to destinations in TTL %d\n", upTTL)
+	}
 
 	// Mode
 	switch cfg.Mode {
@@ -354,6 +848,9 @@ func main() {
 	case "tcp":
 		mode = "tcp"
 		log.Infoln("Use standard TCP")
+	case "udp":
+		mode = "udp"
+		log.Infoln("Use UDP")
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
 	}
@@ -363,9 +860,55 @@ func main() {
 	if err != nil {
 		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
 	}
+	err = crypto.SelfTest(crypt)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("crypto self-test with %s: %w", cfg.Method, err))
+	}
+	fingerprint = crypto.Fingerprint(cfg.Method, cfg.Password)
 	method := crypt.Method()
 	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
+		log.Infof("Encrypt with %s (fingerprint %s)\n", method, fingerprint)
+	}
+	// Only FakeTCP authenticates with hellos in handshakes
+	if method != crypto.MethodPlain && (mode != "faketcp" || !pcap.Features().Has(pcap.FeatureHello)) {
+		log.Infoln("WARNING: There is no authenticated handshake between client and server, mismatched methods or passwords will only surface as decrypt errors of every packet. Compare fingerprints on both sides if so.")
+	}
+
+	// Clients are always authenticated unless allowed otherwise, authentication is meaningless without encryption
+	pcap.SetRequireHello(method != crypto.MethodPlain && !cfg.AllowNoHello)
+	if method != crypto.MethodPlain && cfg.AllowNoHello {
+		log.Infoln("WARNING: Clients which do not support the hello are served without authentication.")
+	}
+	pcap.SetResetUnauthenticated(cfg.ResetUnauth)
+	if cfg.ResetUnauth {
+		log.Infoln("Reset clients which do not authenticate in time")
+	}
+
+	// Extra passwords
+	if len(cfg.ExtraPasswords) > 0 {
+		if method == crypto.MethodPlain {
+			log.Fatalln(errors.New("extra passwords require encryption"))
+		}
+
+		extras := make([]crypto.Crypt, 0)
+		for _, password := range cfg.ExtraPasswords {
+			c, err := crypto.ParseCrypt(cfg.Method, password)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("parse crypt of extra password: %w", err))
+			}
+			extras = append(extras, c)
+
+			log.Infof("Accept extra password (fingerprint %s)\n", crypto.Fingerprint(cfg.Method, password))
+		}
+
+		crypt, err = crypto.CreateKeyring(crypt, extras...)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("create keyring: %w", err))
+		}
+	}
+	minStrength = cfg.MinStrength
+	if minStrength > 0 {
+		log.Infof("Require encryption of at least %d bits\n", minStrength)
 	}
 
 	// Add rule
@@ -387,6 +930,9 @@ func main() {
 			devs[dev.Alias()] = true
 		}
 		devs[upDev.Alias()] = true
+		for _, dev := range fallbackUpDevs {
+			devs[dev.Alias()] = true
+		}
 
 		for dev := range devs {
 			err := exec.DisableGRO(dev)
@@ -407,24 +953,39 @@ func main() {
 
 	// Monitor
 	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(port) {
+		if cfg.Monitor == cfg.Port {
 			log.Fatalln(fmt.Errorf("same monitor port with listen port"))
 		}
+		for _, p := range cfg.Ports {
+			if cfg.Monitor == p {
+				log.Fatalln(fmt.Errorf("same monitor port with listen port"))
+			}
+		}
 
 		monitor = stat.NewTrafficMonitor()
 
 		// Host HTTP server
 		http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 			b, err := json.Marshal(&struct {
-				Name    string               `json:"name"`
-				Version string               `json:"version"`
-				Time    int                  `json:"time"`
-				Monitor *stat.TrafficMonitor `json:"monitor"`
+				Name        string               `json:"name"`
+				Version     string               `json:"version"`
+				Time        int                  `json:"time"`
+				Monitor     *stat.TrafficMonitor `json:"monitor"`
+				Sizes       *stat.SizeMonitor    `json:"sizes"`
+				Method      string               `json:"method"`
+				Drops       map[string]uint64    `json:"drops"`
+				KernelDrops uint64               `json:"kernel-drops"`
+				Drain       *drainStatus         `json:"drain,omitempty"`
 			}{
-				Name:    name,
-				Version: versionInfo,
-				Time:    int(time.Now().Sub(startTime).Seconds()),
-				Monitor: monitor,
+				Name:        name,
+				Version:     versionInfo,
+				Time:        int(time.Now().Sub(startTime).Seconds()),
+				Monitor:     monitor,
+				Sizes:       sizes,
+				Method:      crypt.Method().String(),
+				Drops:       dropCountMap(),
+				KernelDrops: kernelDropCount(),
+				Drain:       drainProgress(),
 			})
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
@@ -469,22 +1030,110 @@ type IPName struct {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
 			}
 		})
-		go func() {
-			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), nil)
+		http.HandleFunc("/routines", func(w http.ResponseWriter, req *http.Request) {
+			b, err := json.Marshal(routines.Routines())
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+				return
+			}
+
+			// Handle CORS
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			_, err = io.WriteString(w, string(b))
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
+		http.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+			// Handle CORS
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			if !isHealthy() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, err := io.WriteString(w, "unhealthy")
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+				return
+			}
+
+			_, err := io.WriteString(w, "healthy")
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
+		http.HandleFunc("/traffic", func(w http.ResponseWriter, req *http.Request) {
+			b, err := json.Marshal(traffic)
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+				return
+			}
+
+			// Handle CORS
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			_, err = io.WriteString(w, string(b))
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
 			}
-		}()
+		})
+		monitorSrv = &http.Server{Addr: fmt.Sprintf(":%d", cfg.Monitor)}
+		err := routines.Go("monitor", func() {
+			err := monitorSrv.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
+		if err != nil {
+			log.Fatalln(fmt.Errorf("monitor: %w", err))
+		}
 
 		log.Infof("Monitor on :%d\n", cfg.Monitor)
 		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
 	}
 
+	// Metrics
+	if cfg.Metrics != "" {
+		err := serveMetrics(cfg.Metrics)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("metrics: %w", err))
+		}
+
+		log.Infof("Metrics on %s\n", cfg.Metrics)
+	}
+
+	// Admin
+	if cfg.Admin != "" {
+		console = admin.NewAdmin(cfg.AdminWrite)
+		registerAdminCommands(console)
+
+		err := console.Listen(cfg.Admin)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("admin: %w", err))
+		}
+		err = routines.Go("admin", func() {
+			err := console.Serve()
+			if err != nil {
+				log.Errorln(fmt.Errorf("admin: %w", err))
+			}
+		})
+		if err != nil {
+			log.Fatalln(fmt.Errorf("admin: %w", err))
+		}
+
+		ownPaths = append(ownPaths, cfg.Admin)
+		log.Infof("Admin on %s\n", cfg.Admin)
+		if cfg.AdminWrite {
+			log.Infoln("Allow mutating admin commands")
+		}
+	}
+
 	// Mode-related options
 	switch mode {
 	case "faketcp":
 		// MTU
-		mtu = cfg.MTU
+		mtu = int(cfg.MTU)
 		log.Infof("Set MTU to %d Bytes\n", mtu)
 
 		// KCP
@@ -493,210 +1142,1015 @@ type IPName struct {
 		if isKCP {
 			log.Infoln("Enable KCP")
 		}
-	case "tcp":
+
+		// Padding
+		if cfg.Padding {
+			err = pcap.SetFeatures(pcap.Features() | pcap.FeaturePadding)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("padding: %w", err))
+			}
+			log.Infoln("Enable padding")
+		}
+
+		// Bucket
+		if cfg.Bucket {
+			err = pcap.SetFeatures(pcap.Features() | pcap.FeatureBucket)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("bucket: %w", err))
+			}
+			log.Infoln("Enable bucket padding")
+		}
+
+		// Disguise
+		if cfg.Disguise {
+			pcap.SetDisguise(&pcap.Disguise{
+				Window:        uint16(cfg.DisguiseConfig.Window),
+				MSS:           uint16(cfg.DisguiseConfig.MSS),
+				WindowScale:   cfg.DisguiseConfig.WindowScale,
+				SACKPermitted: cfg.DisguiseConfig.SACK,
+				Timestamps:    cfg.DisguiseConfig.Timestamps,
+			})
+			log.Infoln("Disguise handshakes with TCP options")
+		}
+	case "tcp", "udp":
 		break
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", mode))
 	}
 
 	// Fragment
-	fragment = cfg.Fragment
+	fragment = int(cfg.Fragment)
 	log.Infof("Set fragment to %d Bytes\n", fragment)
 
-	// Port
-	port = uint16(cfg.Port)
+	// NAT sweep
+	natSweep = time.Duration(cfg.NATSweep)
+	if natSweep > 0 {
+		log.Infof("Sweep expired NAT every %s\n", natSweep)
+	}
 
-	log.Infof("Proxy from :%d\n", cfg.Port)
+	// Port range
+	tcpPorts, err = parsePortRange(cfg.TCPPorts)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("tcp ports: %w", err))
+	}
+	udpPorts, err = parsePortRange(cfg.UDPPorts)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("udp ports: %w", err))
+	}
+	tcpPortPool = make([]time.Time, tcpPorts.size())
+	udpPortPool = make([]time.Time, udpPorts.size())
+	log.Infof("Distribute TCP ports %s and UDP ports %s\n", tcpPorts, udpPorts)
 
-	// Wait signals
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sig
-		closeAll()
-		os.Exit(0)
-	}()
+	// Flow timeout
+	tcpTimeout = time.Duration(cfg.TCPTimeout)
+	udpTimeout = time.Duration(cfg.UDPTimeout)
+	icmpv4Timeout = time.Duration(cfg.ICMPTimeout)
+	log.Infof("Expire idle TCP flows after %s, UDP flows after %s and ICMP flows after %s\n", tcpTimeout, udpTimeout, icmpv4Timeout)
 
-	// Open pcap
-	err = open()
+	// Firewall rule of the listen port
+	addRSTRule = mode == "faketcp" && !cfg.NoFirewallRule
+
+	// User
+	if cfg.User != "" {
+		dropUser, err = privilege.Lookup(cfg.User)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("user %s: %w", cfg.User, err))
+		}
+		keepNetRaw = cfg.KeepNetRaw
+		if mode == "faketcp" && !isKCP && !keepNetRaw {
+			log.Infoln("WARNING: Each client opens a pcap handle in FakeTCP without KCP, clients connecting after dropping privileges will be refused.")
+		}
+	} else if cfg.KeepNetRaw {
+		log.Fatalln(errors.New("keep-net-raw requires user"))
+	}
+
+	// Rate limit
+	if cfg.RateLimit < 0 {
+		log.Fatalln(fmt.Errorf("rate limit %s out of range", cfg.RateLimit))
+	}
+	rateLimit = int(cfg.RateLimit)
+	if rateLimit > 0 {
+		log.Infof("Limit each client to %s\n", cfg.RateLimit)
+	}
+	rateLimits = make(map[string]int)
+	for addr, limit := range cfg.RateLimits {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			log.Fatalln(fmt.Errorf("invalid rate limit address %s", addr))
+		}
+		if limit < 0 {
+			log.Fatalln(fmt.Errorf("rate limit %s of %s out of range", limit, addr))
+		}
+		rateLimits[ip.String()] = int(limit)
+		if limit > 0 {
+			log.Infof("Limit client %s to %s\n", ip, limit)
+		} else {
+			log.Infof("Do not limit client %s\n", ip)
+		}
+	}
+
+	// Hooks
+	events, err = createEventBus(cfg.Hooks)
 	if err != nil {
-		log.Fatalln(fmt.Errorf("open pcap: %w", err))
+		log.Fatalln(fmt.Errorf("hooks: %w", err))
+	}
+	if events != nil {
+		err = routines.Go("events", events.Run)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("hooks: %w", err))
+		}
 	}
-}
 
-func open() error {
-	var err error
+	// Max clients
+	if cfg.MaxClients < 0 {
+		log.Fatalln(fmt.Errorf("max clients %d out of range", cfg.MaxClients))
+	}
+	maxClients = cfg.MaxClients
+	evictClients = cfg.EvictClients
+	pcap.SetMaxClients(maxClients, evictClients)
+	pcap.SetDisconnectFunc(disconnectClient)
+	pcap.SetFrameFunc(countFrame)
+	if maxClients > 0 {
+		if evictClients {
+			log.Infof("Serve at most %d clients, evict the least recently active client for new clients\n", maxClients)
+		} else {
+			log.Infof("Serve at most %d clients\n", maxClients)
+		}
+	}
 
-	// Verify
-	if port <= 0 || port > 65535 {
-		return fmt.Errorf("port %d out of range", port)
+	// Client timeout
+	clientTimeout = time.Duration(cfg.ClientTimeout)
+	pcap.SetClientTimeout(clientTimeout)
+	if clientTimeout > 0 {
+		log.Infof("Evict clients idle for %s\n", clientTimeout)
 	}
-	if len(listenDevs) <= 0 {
+
+	// ACL
+	allowRules, err = parseACLRules(cfg.Allow)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse allow: %w", err))
+	}
+	denyRules, err = parseACLRules(cfg.Deny)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse deny: %w", err))
+	}
+	for _, rule := range allowRules {
+		log.Infof("Allow clients to reach %s\n", rule)
+	}
+	for _, rule := range denyRules {
+		log.Infof("Deny clients to reach %s\n", rule)
+	}
+	isDenyRST = cfg.DenyRST
+
+	// Allowed clients
+	for _, s := range cfg.AllowedClients {
+		ipNet, err := parseIPNet(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse allowed clients: %w", err))
+		}
+		allowedIPNets = append(allowedIPNets, ipNet)
+		log.Infof("Allow clients from %s\n", ipNet)
+	}
+	pcap.SetAcceptFunc(isAllowedClient)
+
+	// Dry run
+	isDryRun = cfg.DryRun
+	if isDryRun {
+		log.Infoln("Dry run, packets from clients are parsed and logged in verbose but never redirected")
+	}
+
+	// Dump
+	if cfg.Dump != "" {
+		linkType, err := pcap.LinkTypeOf(upDev)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("dump %s: %w", cfg.Dump, err))
+		}
+
+		dumper, err = pcap.NewDumper(cfg.Dump, linkType)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("dump %s: %w", cfg.Dump, err))
+		}
+		ownPaths = append(ownPaths, cfg.Dump)
+		dumpInjected = cfg.DumpInjected
+		if dumpInjected {
+			log.Infof("Dump packets failed to handle and injected to upstream to %s\n", cfg.Dump)
+		} else {
+			log.Infof("Dump packets failed to handle to %s\n", cfg.Dump)
+		}
+	}
+
+	// Keep-alive
+	keepAliveInt = time.Duration(cfg.KeepAlive)
+	if keepAliveInt > 0 && isDryRun {
+		keepAliveInt = 0
+		log.Infoln("Do not send keep-alives to clients in dry run")
+	}
+	if keepAliveInt > 0 && (mode != "faketcp" || isKCP) {
+		keepAliveInt = 0
+		log.Infoln("WARNING: Keep-alives are only sent in mode faketcp without KCP, do not send keep-alives to clients.")
+	}
+	if keepAliveInt > 0 {
+		log.Infof("Send keep-alives to clients every %s\n", keepAliveInt)
+		if clientTimeout > 0 && keepAliveInt >= clientTimeout {
+			log.Infoln("WARNING: Keep-alives are sent no faster than clients expire, clients may be dropped before replying.")
+		}
+	}
+
+	// Max age
+	maxAge = time.Duration(cfg.MaxAge)
+	if maxAge > 0 {
+		log.Infof("Drop packets older than %s\n", maxAge)
+	}
+
+	// Listen workers
+	workers := cfg.ListenWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	queueSize = cfg.QueueSize
+	newQueues(workers)
+	log.Infof("Handle packets from clients in %d workers queuing %d packets each\n", workers, queueSize)
+	isQueueBlock = cfg.QueuePolicy == "block"
+	if isQueueBlock {
+		log.Infoln("Block reading from clients when queues are full")
+	}
+
+	// Upstream workers
+	upWorkers := cfg.UpWorkers
+	if upWorkers <= 0 {
+		upWorkers = runtime.GOMAXPROCS(0)
+	}
+	newUpQueues(upWorkers)
+	log.Infof("Handle packets from upstream in %d workers queuing %d packets each\n", upWorkers, queueSize)
+
+	// Upstream readers
+	upReaders = cfg.UpReaders
+	if upReaders > 1 {
+		log.Infof("Read packets from upstream in %d handles\n", upReaders)
+	}
+
+	// Health window
+	healthWindow = time.Duration(cfg.HealthWindow)
+	if healthWindow > 0 {
+		log.Infof("Be unhealthy without packets for %s\n", healthWindow)
+	}
+
+	// Max flows
+	maxFlows = cfg.MaxFlows
+	if maxFlows > 0 {
+		log.Infof("Limit active flows to %d\n", maxFlows)
+	}
+
+	// NAT mode
+	switch cfg.NAT {
+	case "restricted":
+		log.Infoln("Use restricted NAT")
+	case "full-cone":
+		isFullCone = true
+		log.Infoln("Use full-cone NAT")
+	default:
+		log.Fatalln(fmt.Errorf("nat mode %s not support", cfg.NAT))
+	}
+
+	// Port
+	ports = make([]uint16, 0)
+	isPort := make(map[uint16]bool)
+	if cfg.Port != 0 {
+		ports = append(ports, uint16(cfg.Port))
+		isPort[uint16(cfg.Port)] = true
+	}
+	for _, p := range cfg.Ports {
+		if !isPort[uint16(p)] {
+			ports = append(ports, uint16(p))
+			isPort[uint16(p)] = true
+		}
+	}
+	port = ports[0]
+
+	// Replies to flows distributed with a listen port would be taken as packets from clients
+	for _, p := range ports {
+		if mode == "udp" {
+			if udpPorts.contains(p) {
+				log.Fatalln(fmt.Errorf("port %d in udp ports %s", p, udpPorts))
+			}
+		} else if tcpPorts.contains(p) {
+			log.Fatalln(fmt.Errorf("port %d in tcp ports %s", p, tcpPorts))
+		}
+	}
+
+	// Exclusive
+	isExclusive = cfg.Exclusive
+	if isExclusive {
+		log.Infoln("Exit if another instance is detected")
+	}
+
+	log.Infof("Proxy from %s\n", formatPorts(ports))
+
+	// Discovery
+	if cfg.Discovery && isDryRun {
+		log.Infoln("Do not answer discovery in dry run")
+	} else if cfg.Discovery {
+		if method == crypto.MethodPlain {
+			log.Fatalln(errors.New("discovery requires encryption"))
+		}
+
+		responder, err = discovery.Listen(discovery.Port, discovery.Key(cfg.Password), port, fingerprint)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("discovery: %w", err))
+		}
+		err = routines.Go("discovery", func() {
+			err := responder.Serve()
+			if err != nil && !isClosed {
+				log.Errorln(fmt.Errorf("discovery: %w", err))
+			}
+		})
+		if err != nil {
+			log.Fatalln(fmt.Errorf("discovery: %w", err))
+		}
+
+		log.Infof("Answer discovery on :%d\n", discovery.Port)
+	}
+
+	// Lock ports
+	for _, p := range ports {
+		portLock, err := lock.Acquire(filepath.Join(lock.Dir(), fmt.Sprintf("ikago-server-%d.lock", p)))
+		if err != nil {
+			for _, portLock := range portLocks {
+				portLock.Release()
+			}
+			if errors.Is(err, lock.ErrLocked) {
+				log.Fatalln(fmt.Errorf("another IkaGo server appears to be running on port %d: %w", p, err))
+			}
+			log.Fatalln(fmt.Errorf("lock port %d: %w", p, err))
+		}
+		portLocks = append(portLocks, portLock)
+	}
+
+	// Wait signals
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		drain(sig)
+		cancel()
+	}()
+
+	// Open pcap
+	err = open(ctx)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("open pcap: %w", err))
+	}
+}
+
+// open opens pcap and serves until the context is done, then closes all.
+func open(ctx context.Context) error {
+	var err error
+
+	// Verify
+	if len(ports) <= 0 {
+		return errors.New("missing listen port")
+	}
+	if len(listenDevs) <= 0 {
 		return errors.New("missing listen device")
 	}
-	if upDev == nil {
-		return errors.New("missing upstream device")
+	if upDev == nil {
+		return errors.New("missing upstream device")
+	}
+	if gatewayDev == nil {
+		return errors.New("missing gateway")
+	}
+	if crypt.Strength() < minStrength {
+		return fmt.Errorf("method %s of %d bits weaker than %d bits", crypt.Method(), crypt.Strength(), minStrength)
+	}
+	for _, dev := range listenDevs {
+		err = dev.CheckAddr()
+		if err != nil {
+			return fmt.Errorf("listen device: %w", err)
+		}
+	}
+	err = upDev.CheckAddr()
+	if err != nil {
+		return fmt.Errorf("upstream device: %w", err)
+	}
+	for _, dev := range fallbackUpDevs {
+		err = dev.CheckAddr()
+		if err != nil {
+			return fmt.Errorf("fallback upstream device: %w", err)
+		}
+	}
+
+	if len(listenDevs) == 1 {
+		log.Infof("Listen on %s\n", listenDevs[0].String())
+	} else {
+		log.Infoln("Listen on:")
+		for _, dev := range listenDevs {
+			log.Infof("  %s\n", dev.String())
+		}
+	}
+	if !gatewayDev.IsLoop() {
+		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
+	} else {
+		log.Infof("Route upstream in %s\n", upDev)
+	}
+	for i, dev := range fallbackUpDevs {
+		if !fallbackGatewayDevs[i].IsLoop() {
+			log.Infof("Fall back upstream from %s to %s\n", dev, fallbackGatewayDevs[i])
+		} else {
+			log.Infof("Fall back upstream in %s\n", dev)
+		}
+	}
+
+	// Stop the OS from resetting connections with clients
+	if addRSTRule {
+		for _, p := range ports {
+			err = exec.AddRSTFirewallRule(p)
+			if err != nil {
+				log.Errorln(fmt.Errorf("add firewall rule: %w", err))
+				log.Errorf("Please drop TCP RST from port %d manually, or the OS may reset connections with clients\n", p)
+				continue
+			}
+
+			rstRulePorts = append(rstRulePorts, p)
+			log.Infof("Add firewall rule dropping TCP RST from port %d\n", p)
+		}
+	}
+
+	for _, dev := range listenDevs {
+		var (
+			err      error
+			listener net.Listener
+		)
+
+		switch mode {
+		case "faketcp":
+			// Segments should fit in the device
+			devMTU := dev.FitMTU(mtu)
+			if devMTU < mtu {
+				log.Infof("Set MTU to %d Bytes in listen device %s\n", devMTU, dev.Alias())
+			}
+
+			if dev.IsLoop() {
+				if isKCP {
+					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, ports, crypt, devMTU, kcpConfig)
+				} else {
+					listener, err = pcap.ListenFakeTCP(dev, dev, ports, crypt, devMTU)
+				}
+			} else {
+				if isKCP {
+					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, ports, crypt, devMTU, kcpConfig)
+				} else {
+					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, ports, crypt, devMTU)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+			}
+
+			// Refuse SYNs before opening handles for clients
+			l, ok := listener.(*pcap.FakeTCPListener)
+			if ok {
+				l.SetAcceptFunc(acceptClient)
+			}
+
+			listeners = append(listeners, listener)
+		case "tcp":
+			for _, p := range ports {
+				listener, err = pcap.ListenTCP(dev, p, crypt)
+				if err != nil {
+					return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+				}
+
+				listeners = append(listeners, listener)
+			}
+		case "udp":
+			for _, p := range ports {
+				listener, err = pcap.ListenUDP(dev, p, crypt)
+				if err != nil {
+					return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+				}
+
+				listeners = append(listeners, listener)
+			}
+		default:
+			return fmt.Errorf("open listen device %s: %w", dev.Alias(), fmt.Errorf("mode %s not support", mode))
+		}
+
+		// Detect other instances answering handshakes
+		if mode == "faketcp" {
+			detector, err := pcap.DetectConflict(dev, ports)
+			if err != nil {
+				return fmt.Errorf("detect conflict in device %s: %w", dev.Alias(), err)
+			}
+
+			detectors = append(detectors, detector)
+
+			rstDetector, err := pcap.DetectRST(dev, ports)
+			if err != nil {
+				return fmt.Errorf("detect rst in device %s: %w", dev.Alias(), err)
+			}
+
+			rstDetectors = append(rstDetectors, rstDetector)
+		}
+	}
+
+	// Handles for routing upstream
+	upFilter := fmt.Sprintf("ip && (((tcp || udp) && not %s) || icmp || (ip[6:2] & 0x1fff) != 0)", pcap.PortsFilter("dst", ports))
+	upConn, err = pcap.CreateRawConn(upDev, gatewayDev, pcap.VLANFilter(pcap.PartitionFilter(upFilter, upReaders, 0)))
+	if err != nil {
+		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
+	}
+	// Extra handles read other parts of packets from the primary upstream, and packets are written in the first handle
+	for i := 1; i < upReaders; i++ {
+		conn, err := pcap.CreateRawConn(upDev, gatewayDev, pcap.VLANFilter(pcap.PartitionFilter(upFilter, upReaders, i)))
+		if err != nil {
+			return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
+		}
+
+		upReadConns = append(upReadConns, conn)
+	}
+	for i, dev := range fallbackUpDevs {
+		conn, err := pcap.CreateRawConn(dev, fallbackGatewayDevs[i], pcap.VLANFilter(upFilter))
+		if err != nil {
+			return fmt.Errorf("open fallback upstream device %s: %w", dev.Alias(), err)
+		}
+
+		fallbackConns = append(fallbackConns, conn)
+	}
+
+	// Start handling
+	for i := 0; i < len(listeners); i++ {
+		listener := listeners[i]
+		err = goReader(fmt.Sprintf("accept %s", listener.Addr().String()), func() {
+			defer exitListen()
+
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					if isClosed {
+						return
+					}
+					countHandshake(handshakeFailed)
+					if isHandleDenied(err) {
+						reportHandleDenied(err)
+						continue
+					}
+					log.Errorln(fmt.Errorf("accept: %w", err))
+					continue
+				}
+				if conn == nil {
+					continue
+				}
+				if !isAllowedClient(conn.RemoteAddr()) {
+					countHandshake(handshakeRefused)
+					conn.Close()
+					continue
+				}
+				if isDraining() {
+					countHandshake(handshakeRefused)
+					log.Infof("Refuse client %s in draining\n", conn.RemoteAddr().String())
+					conn.Close()
+					continue
+				}
+				if !makeRoomForClient() {
+					countHandshake(handshakeRefused)
+					log.Infof("Refuse client %s over %d clients\n", conn.RemoteAddr().String(), maxClients)
+					conn.Close()
+					continue
+				}
+
+				// Tune
+				switch conn.(type) {
+				case *kcp.UDPSession:
+					err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
+					if err != nil {
+						countHandshake(handshakeFailed)
+						conn.Close()
+						log.Errorln(fmt.Errorf("tune: %w", err))
+						continue
+					}
+				default:
+					break
+				}
+
+				// Clients are tracked only after the first valid payload, so SYN scanners never become clients
+				p := newPendingClient(conn)
+
+				err = goReader(fmt.Sprintf("read %s", conn.RemoteAddr().String()), func() {
+					b := make([]byte, pcap.IPv4MaxSize)
+					for {
+						n, err := conn.Read(b)
+						if err != nil {
+							if isClosed {
+								return
+							}
+							if !p.isRegistered() {
+								if p.isExpired() || errors.Is(err, io.EOF) {
+									p.close()
+									return
+								}
+								log.Verboseln(fmt.Errorf("read pending client %s: %w", conn.RemoteAddr(), err))
+								continue
+							}
+							if errors.Is(err, io.EOF) {
+								log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
+								publish(eventClientDisconnect, fmt.Sprintf("Disconnect from client %s", conn.RemoteAddr()), map[string]string{"client": conn.RemoteAddr().String()})
+								releaseClient(conn)
+								return
+							}
+							if !isClient(conn) {
+								// Dropped
+								return
+							}
+							if errors.Is(err, pcap.ErrUnauthenticated) {
+								log.Verboseln(fmt.Errorf("read listen: %w", err))
+								continue
+							}
+							countError(errorReadListen)
+							log.Errorln(fmt.Errorf("read listen: %w", err))
+							continue
+						}
+
+						if !p.register() {
+							return
+						}
+
+						newB := make([]byte, n)
+						copy(newB, b[:n])
+						enqueue(pcap.ConnBytes{
+							Bytes: newB,
+							Conn:  conn,
+							Time:  time.Now(),
+						})
+					}
+				})
+				if err != nil {
+					log.Errorln(fmt.Errorf("read listen: %w", err))
+					dropClient(conn)
+				}
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("accept: %w", err)
+		}
+	}
+
+	for i := 0; i < len(rstDetectors); i++ {
+		detector := rstDetectors[i]
+		dev := listenDevs[i]
+		err = routines.Go(fmt.Sprintf("detect rst %s", dev.Alias()), func() {
+			detectRST(detector, dev)
+		})
+		if err != nil {
+			return fmt.Errorf("detect rst: %w", err)
+		}
+	}
+
+	for i := 0; i < len(detectors); i++ {
+		detector := detectors[i]
+		dev := listenDevs[i]
+		err = routines.Go(fmt.Sprintf("detect conflict %s", dev.Alias()), func() {
+			detectConflict(detector, dev)
+		})
+		if err != nil {
+			return fmt.Errorf("detect conflict: %w", err)
+		}
+	}
+
+	err = goWorkers(handleListen)
+	if err != nil {
+		return fmt.Errorf("handle listen: %w", err)
+	}
+
+	err = goUpWorkers()
+	if err != nil {
+		return fmt.Errorf("handle upstream: %w", err)
+	}
+
+	if natSweep > 0 {
+		err = routines.Go("sweep nat", sweepNATs)
+		if err != nil {
+			return fmt.Errorf("sweep nat: %w", err)
+		}
+	}
+
+	if clientTimeout > 0 {
+		err = routines.Go("sweep clients", sweepClients)
+		if err != nil {
+			return fmt.Errorf("sweep clients: %w", err)
+		}
+	}
+
+	err = routines.Go("poll capture", pollCapture)
+	if err != nil {
+		return fmt.Errorf("poll capture: %w", err)
+	}
+
+	if keepAliveInt > 0 {
+		err = routines.Go("keep alive clients", keepAliveClients)
+		if err != nil {
+			return fmt.Errorf("keep alive clients: %w", err)
+		}
+	}
+
+	for _, conn := range fallbackConns {
+		conn := conn
+		err = routines.Go(fmt.Sprintf("read upstream %s", conn.LocalDev().Alias()), func() {
+			readUpstream(conn)
+		})
+		if err != nil {
+			return fmt.Errorf("read fallback upstream: %w", err)
+		}
+	}
+
+	if len(fallbackConns) > 0 {
+		err = routines.Go("check upstream", checkUpstreams)
+		if err != nil {
+			return fmt.Errorf("check upstream: %w", err)
+		}
+
+		if upProbe > 0 {
+			err = routines.Go("probe upstream", probeUpstream)
+			if err != nil {
+				return fmt.Errorf("probe upstream: %w", err)
+			}
+		}
+	}
+
+	if gatewayRefresh > 0 {
+		err = routines.Go("refresh gateways", refreshGateways)
+		if err != nil {
+			return fmt.Errorf("refresh gateways: %w", err)
+		}
+	}
+
+	err = routines.Go(fmt.Sprintf("read upstream %s", upConn.LocalDev().Alias()), func() {
+		readUpstream(upConn)
+	})
+	if err != nil {
+		return fmt.Errorf("read upstream: %w", err)
+	}
+
+	for i, conn := range upReadConns {
+		conn := conn
+		err = routines.Go(fmt.Sprintf("read upstream %s %d", upConn.LocalDev().Alias(), i+1), func() {
+			readUpstream(conn)
+		})
+		if err != nil {
+			return fmt.Errorf("read upstream: %w", err)
+		}
+	}
+
+	// Handles are opened, the rest needs no privileges
+	if dropUser != nil {
+		err = dropPrivileges()
+		if err != nil {
+			log.Errorln(fmt.Errorf("drop privileges to user %s: %w", dropUser.Name, err))
+		} else {
+			if keepNetRaw {
+				log.Infof("Run as user %s keeping CAP_NET_RAW\n", dropUser.Name)
+			} else {
+				log.Infof("Run as user %s\n", dropUser.Name)
+			}
+		}
+	}
+
+	<-ctx.Done()
+
+	return closeAll()
+}
+
+// goReader starts a routine reading from clients, which will be waited before the listen channel is closed.
+func goReader(name string, f func()) error {
+	readers.Add(1)
+	err := routines.Go(name, func() {
+		defer readers.Done()
+		f()
+	})
+	if err != nil {
+		readers.Done()
+		return err
+	}
+
+	return nil
+}
+
+// waitGroup waits for the wait group until the timeout and returns if the wait group is done.
+func waitGroup(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func readUpstream(conn *pcap.RawConn) {
+	for {
+		packet, err := conn.ReadPacket()
+		reportRead(conn, err)
+		if err != nil {
+			if isClosed {
+				return
+			}
+			countError(errorReadUpstream)
+			log.Errorln(fmt.Errorf("read upstream in device %s: %w", conn.LocalDev().Alias(), err))
+
+			// The device may be resetting
+			select {
+			case <-time.After(retryRead):
+			case <-quit:
+				return
+			}
+			continue
+		}
+
+		// Packets from extra handles are handled as from the primary upstream
+		from := conn
+		if !isFallbackConn(from) {
+			from = upConn
+		}
+
+		enqueueUp(pcap.ConnPacket{Packet: packet, Conn: from})
+	}
+}
+
+// isStale returns if a packet received at the time is too old to be forwarded.
+func isStale(t time.Time) bool {
+	return maxAge > 0 && !t.IsZero() && time.Now().Sub(t) > maxAge
+}
+
+// closeAll stops reading from clients, drains queued packets, and closes all handles. It is safe to call it more than
+// once. An error wrapping errDrainTimeout is returned if queued packets are abandoned.
+func closeAll() error {
+	closeOnce.Do(func() {
+		closeErr = closeAllOnce()
+	})
+
+	return closeErr
+}
+
+func closeAllOnce() error {
+	var err error
+
+	isClosed = true
+	close(quit)
+	if console != nil {
+		console.Close()
+	}
+	if events != nil {
+		events.Close()
+	}
+	if monitorSrv != nil {
+		monitorSrv.Close()
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	if responder != nil {
+		responder.Close()
+	}
+	for _, handle := range listeners {
+		if handle != nil {
+			handle.Close()
+		}
+	}
+
+	conns := make([]net.Conn, 0)
+	clientsLock.RLock()
+	for _, conn := range clients {
+		conns = append(conns, conn)
+	}
+	for p := range pendings {
+		conns = append(conns, p.conn)
+	}
+	clientsLock.RUnlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	// Drain queued packets after no more packets are read from clients
+	if waitGroup(&readers, waitRoutines) {
+		closeQueues()
+		if !waitGroup(&handlers, waitRoutines) {
+			err = fmt.Errorf("%w: abandon %d queued packets", errDrainTimeout, queued())
+			log.Errorln(err)
+		}
+	} else {
+		err = fmt.Errorf("%w: reading from clients has not stopped, abandon queued packets", errDrainTimeout)
+		log.Errorln(err)
+	}
+
+	if upConn != nil {
+		upConn.Close()
+	}
+	for _, conn := range upReadConns {
+		conn.Close()
+	}
+	for _, conn := range fallbackConns {
+		conn.Close()
+	}
+	for _, detector := range detectors {
+		detector.Close()
+	}
+	for _, detector := range rstDetectors {
+		detector.Close()
 	}
-	if gatewayDev == nil {
-		return errors.New("missing gateway")
+	if dumper != nil {
+		dumper.Close()
 	}
 
-	if len(listenDevs) == 1 {
-		log.Infof("Listen on %s\n", listenDevs[0].String())
-	} else {
-		log.Infoln("Listen on:")
-		for _, dev := range listenDevs {
-			log.Infof("  %s\n", dev.String())
-		}
+	// Verify all routines exited
+	leaks := routines.Wait(waitRoutines)
+	for _, r := range leaks {
+		log.Errorln(fmt.Errorf("routine %s started at %s has not exited", r.Name, r.Start.Format(time.RFC3339)))
 	}
-	if !gatewayDev.IsLoop() {
-		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
-	} else {
-		log.Infof("Route upstream in %s\n", upDev)
+	if len(leaks) > 0 && err == nil {
+		err = fmt.Errorf("%d routines leaked", len(leaks))
 	}
 
-	for _, dev := range listenDevs {
-		var (
-			err      error
-			listener net.Listener
-		)
-
-		switch mode {
-		case "faketcp":
-			if dev.IsLoop() {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, mtu)
-				}
-			} else {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, mtu)
-				}
-			}
-		case "tcp":
-			listener, err = pcap.ListenTCP(dev, port, crypt)
-		default:
-			err = fmt.Errorf("mode %s not support", mode)
+	for _, p := range rstRulePorts {
+		err := exec.RemoveRSTFirewallRule(p)
+		if err != nil {
+			log.Errorln(fmt.Errorf("remove firewall rule: %w", err))
 		}
+	}
+	if rstRuleRemover != nil {
+		err := rstRuleRemover.Close()
 		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+			log.Errorln(fmt.Errorf("remove firewall rules: %w", err))
 		}
-
-		listeners = append(listeners, listener)
 	}
 
-	// Handles for routing upstream
-	upConn, err = pcap.CreateRawConn(upDev, gatewayDev, fmt.Sprintf("ip && (((tcp || udp) && not dst port %d) || icmp || (ip[6:2] & 0x1fff) != 0)", port))
-	if err != nil {
-		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
+	for _, portLock := range portLocks {
+		portLock.Release()
 	}
 
-	// Start handling
-	for i := 0; i < len(listeners); i++ {
-		listener := listeners[i]
-		go func() {
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					if isClosed {
-						return
-					}
-					log.Errorln(fmt.Errorf("accept: %w", err))
-					continue
-				}
-				if conn == nil {
-					continue
-				}
-
-				// Tune
-				switch conn.(type) {
-				case *kcp.UDPSession:
-					err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
-					if err != nil {
-						conn.Close()
-						log.Errorln(fmt.Errorf("tune: %w", err))
-						continue
-					}
-				default:
-					break
-				}
-
-				log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
-
-				go func() {
-					b := make([]byte, pcap.IPv4MaxSize)
-					for {
-						n, err := conn.Read(b)
-						if err != nil {
-							if isClosed {
-								return
-							}
-							if errors.Is(err, io.EOF) {
-								log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
-								return
-							}
-							log.Errorln(fmt.Errorf("read listen: %w", err))
-							continue
-						}
+	return err
+}
 
-						newB := make([]byte, n)
-						copy(newB, b[:n])
-						c <- pcap.ConnBytes{
-							Bytes: newB,
-							Conn:  conn,
-						}
-					}
-				}()
+// detectRST warns that the OS is resetting connections with clients in the device.
+func detectRST(detector *pcap.RSTDetector, dev *pcap.Device) {
+	isReported := false
+	for {
+		client, err := detector.Next()
+		if err != nil {
+			if isClosed {
+				return
 			}
-		}()
-	}
+			log.Errorln(fmt.Errorf("detect rst in device %s: %w", dev.Alias(), err))
+			return
+		}
 
-	go func() {
-		for cab := range c {
-			err := handleListen(cab.Bytes, cab.Conn)
-			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
-				log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
-				continue
-			}
+		if isReported {
+			log.Verbosef("OS sent TCP RST to client %s on device %s\n", client, dev.Alias())
+			continue
 		}
-	}()
+		isReported = true
+
+		log.Errorf("WARNING: The OS is resetting connections with clients on device %s (client %s), please drop TCP RST from %s in your firewall. See troubleshoot in README\n", dev.Alias(), client, formatPorts(ports))
+		publish(eventRST, fmt.Sprintf("The OS is resetting connections with clients on device %s", dev.Alias()), map[string]string{"client": client.String(), "device": dev.Alias()})
+	}
+}
 
+// detectConflict logs handshake replies from other instances in the device, and exits if exclusive.
+func detectConflict(detector *pcap.ConflictDetector, dev *pcap.Device) {
+	reported := make(map[string]bool)
 	for {
-		packet, err := upConn.ReadPacket()
+		client, err := detector.Next()
 		if err != nil {
 			if isClosed {
-				return nil
+				return
 			}
-			log.Errorln(fmt.Errorf("read upstream in device %s: %w", upConn.LocalDev().Alias(), err))
-			continue
+			log.Errorln(fmt.Errorf("detect conflict in device %s: %w", dev.Alias(), err))
+			return
 		}
 
-		err = handleUpstream(packet)
-		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in device %s: %w", upConn.LocalDev().Alias(), err))
-			log.Verboseln(packet)
+		if reported[client.String()] {
 			continue
 		}
-	}
-}
+		reported[client.String()] = true
 
-func closeAll() {
-	isClosed = true
-	for _, handle := range listeners {
-		if handle != nil {
-			handle.Close()
+		log.Errorf("Another IkaGo instance appears to be answering on device %s (client %s)\n", dev.Alias(), client)
+		publish(eventConflict, fmt.Sprintf("Another IkaGo instance appears to be answering on device %s", dev.Alias()), map[string]string{"client": client.String(), "device": dev.Alias()})
+
+		if isExclusive {
+			go func() {
+				closeAll()
+				os.Exit(1)
+			}()
+			return
 		}
 	}
-	if upConn != nil {
-		upConn.Close()
-	}
 }
 
-func handleListen(contents []byte, conn net.Conn) error {
+func handleListen(contents []byte, conn net.Conn, decoder *pcap.Decoder) error {
 	var (
 		err               error
 		embIndicator      *pcap.PacketIndicator
@@ -704,47 +2158,173 @@ func handleListen(contents []byte, conn net.Conn) error {
 		newTransportLayer gopacket.Layer
 		newNetworkLayer   gopacket.NetworkLayer
 		upIP              net.IP
-		newLinkLayerType  gopacket.LayerType
 		newLinkLayer      gopacket.Layer
 		fragments         [][]byte
 	)
 
+	touchActivity()
+
+	client := conn.RemoteAddr().String()
+	addClientIn(conn, len(contents))
+
+	// Rate limit
+	if !allowClientIn(conn, len(contents)) {
+		drop(dropRateLimited, client, fmt.Sprintf("%d Bytes from client %s over rate limit", len(contents), client))
+		return nil
+	}
+
 	// Empty payload
 	if len(contents) <= 0 {
-		// return errors.New("empty payload")
+		drop(dropEmpty, client, fmt.Sprintf("empty payload from client %s", client))
+		return nil
+	}
+
+	// Keep-alive, which has refreshed the client
+	switch pcap.ParseKeepAlive(contents) {
+	case pcap.KeepAliveRequest:
+		if isDryRun {
+			log.Verbosef("Dry run: reply a keep-alive to client %s\n", client)
+			return nil
+		}
+		_, err = conn.Write(pcap.CreateKeepAlive(pcap.KeepAliveReply))
+		if err != nil {
+			return fmt.Errorf("reply keep-alive: %w", err)
+		}
+		log.Verbosef("Reply a keep-alive to client %s\n", client)
+		return nil
+	case pcap.KeepAliveReply:
+		log.Verbosef("Receive a keep-alive from client %s\n", client)
 		return nil
 	}
 
+	up := activeUpConn()
+
 	// Parse embedded packet
-	embIndicator, err = pcap.ParseEmbPacket(contents)
+	embIndicator, err = decoder.Decode(contents)
 	if err != nil {
-		return fmt.Errorf("parse embedded packet: %w", err)
+		drop(dropMalformed, client, fmt.Sprintf("parse embedded packet from client %s: %s", client, err))
+		return nil
 	}
 
-	// Distribute port/Id by source and client address and protocol
-	if !embIndicator.IsFrag() {
-		var ok bool
+	// Handle fragments, embedded packets from different clients may share the same addresses
+	embIndicator, err = embDefrag.AppendFrom(client, embIndicator)
+	if err != nil {
+		drop(dropMalformed, client, fmt.Sprintf("defrag embedded packet from client %s: %s", client, err))
+		return nil
+	}
+	if embIndicator == nil {
+		return nil
+	}
 
-		q := quintuple{
-			src:      embIndicator.NATSrc().String(),
-			dst:      conn.RemoteAddr().String(),
-			protocol: embIndicator.NATProtocol(),
-		}
-		upValue, ok = patMap[q]
-		if !ok {
-			// if ICMPv4 error is not in NAT, drop it
-			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
-				return errors.New("missing nat")
+	// ACL
+	if !isAllowed(embIndicator) {
+		drop(dropDenied, client, fmt.Sprintf("outbound %s packet %s -> %s from client %s", embIndicator.TransportProtocol(), embIndicator.Src(), embIndicator.Dst(), client))
+
+		// Fail the connection fast
+		if isDenyRST && embIndicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+			data, err := createRST(embIndicator)
+			if err != nil {
+				return fmt.Errorf("create rst: %w", err)
+			}
+			if data == nil || isDryRun {
+				return nil
 			}
 
-			upValue, err = dist(embIndicator.TransportLayer().LayerType())
+			_, err = conn.Write(data)
 			if err != nil {
-				return fmt.Errorf("distribute: %w", err)
+				return fmt.Errorf("write rst: %w", err)
+			}
+			addClientOut(conn, len(data))
+
+			log.Verbosef("Reset a denied connection: %s <- %s <- %s\n", embIndicator.Src(), client, embIndicator.Dst())
+		}
+
+		return nil
+	}
+
+	// TTL, the server forwards the embedded packet as a hop unless the TTL is rewritten
+	if upTTL == 0 && embIndicator.TTL() <= 1 {
+		drop(dropTTLExceeded, client, fmt.Sprintf("outbound %s packet %s -> %s from client %s", embIndicator.TransportProtocol(), embIndicator.Src(), embIndicator.Dst(), client))
+
+		data, err := createTimeExceeded(embIndicator, up.LocalDev().IPAddr().IP)
+		if err != nil {
+			return fmt.Errorf("create time exceeded: %w", err)
+		}
+		if data == nil || isDryRun {
+			return nil
+		}
+
+		_, err = conn.Write(data)
+		if err != nil {
+			return fmt.Errorf("write time exceeded: %w", err)
+		}
+		addClientOut(conn, len(data))
+
+		log.Verbosef("Reply a time exceeded: %s <- %s\n", embIndicator.Src(), client)
+
+		return nil
+	}
+
+	// Dry run, NAT and PAT are never touched
+	if isDryRun {
+		log.VerboseWith(log.Fields{"protocol": embIndicator.TransportProtocol().String(), "src": embIndicator.Src().String(), "client": client, "dst": embIndicator.Dst().String(), "size": embIndicator.Size()},
+			"Dry run: redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n", embIndicator.TransportProtocol(), embIndicator.Src().String(), client, embIndicator.Dst().String(), embIndicator.Size())
+		return nil
+	}
+
+	// Distribute port/Id by source and client address and protocol
+	var ok bool
+
+	q := quintuple{
+		src:      embIndicator.NATSrc().String(),
+		dst:      conn.RemoteAddr().String(),
+		protocol: embIndicator.NATProtocol(),
+	}
+	patLock.Lock()
+	upValue, ok = patMap[q]
+	if !ok {
+		// if ICMPv4 error is not in NAT, drop it
+		if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
+			patLock.Unlock()
+			drop(dropMissingNAT, client, fmt.Sprintf("outbound ICMPv4 error %s -> %s without NAT", embIndicator.Src(), embIndicator.Dst()))
+			return nil
+		}
+
+		// Refuse new flows if the cap is hit
+		if maxFlows > 0 && activeFlows >= maxFlows {
+			activeFlows = countFlows()
+			if activeFlows >= maxFlows {
+				isBegun := !isFlowsFull
+				isFlowsFull = true
+				patLock.Unlock()
+				if isBegun {
+					publish(eventTooManyFlows, fmt.Sprintf("Refuse new flows over %d flows", maxFlows), map[string]string{"client": client, "max-flows": strconv.Itoa(maxFlows)})
+				}
+				drop(dropTooManyFlows, client, fmt.Sprintf("outbound %s packet %s -> %s over %d flows", embIndicator.TransportProtocol(), embIndicator.Src(), embIndicator.Dst(), maxFlows))
+				return nil
 			}
+		}
 
-			patMap[q] = upValue
+		upValue, err = dist(embIndicator.TransportLayer().LayerType())
+		if err != nil {
+			isBegun := !isExhausted
+			isExhausted = true
+			patLock.Unlock()
+			if isBegun {
+				publish(eventExhausted, fmt.Sprintf("%s pool is exhausted", embIndicator.TransportProtocol()), map[string]string{"client": client, "protocol": embIndicator.TransportProtocol().String()})
+			}
+			drop(dropExhausted, client, fmt.Sprintf("outbound %s packet %s -> %s: %s", embIndicator.TransportProtocol(), embIndicator.Src(), embIndicator.Dst(), err))
+			return nil
 		}
+
+		patMap[q] = upValue
+		activeFlows++
+		isExhausted = false
+		isFlowsFull = false
 	}
+	// Keep the port or Id from being swept before the packet is handled
+	touch(q.protocol, upValue, time.Now())
+	patLock.Unlock()
 
 	// Create new transport layer
 	if embIndicator.TransportLayer() != nil {
@@ -781,7 +2361,7 @@ func handleListen(contents []byte, conn net.Conn) error {
 				temp := *embIndicator.ICMPv4Indicator().EmbIPv4Layer()
 				newEmbIPv4Layer := &temp
 
-				newEmbIPv4Layer.DstIP = upConn.LocalDev().IPAddr().IP
+				newEmbIPv4Layer.DstIP = up.LocalDev().IPAddr().IP
 
 				var (
 					err                  error
@@ -818,7 +2398,8 @@ func handleListen(contents []byte, conn net.Conn) error {
 						newEmbICMPv4Layer.Id = upValue
 					}
 				default:
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
+					drop(dropUnsupported, client, fmt.Sprintf("outbound ICMPv4 error embedding transport layer type %s", embTransportLayerType))
+					return nil
 				}
 				if err != nil {
 					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
@@ -832,7 +2413,8 @@ func handleListen(contents []byte, conn net.Conn) error {
 				newICMPv4Layer.Payload = payload
 			}
 		default:
-			return fmt.Errorf("transport layer type %s not support", t)
+			drop(dropUnsupported, client, fmt.Sprintf("outbound transport layer type %s", t))
+			return nil
 		}
 	}
 
@@ -845,10 +2427,16 @@ func handleListen(contents []byte, conn net.Conn) error {
 
 		newIPv4Layer := newNetworkLayer.(*layers.IPv4)
 
-		newIPv4Layer.SrcIP = upConn.LocalDev().IPAddr().IP
+		newIPv4Layer.SrcIP = up.LocalDev().IPAddr().IP
+		if upTTL > 0 {
+			newIPv4Layer.TTL = upTTL
+		} else {
+			newIPv4Layer.TTL--
+		}
 		upIP = newIPv4Layer.SrcIP
 	default:
-		return fmt.Errorf("network layer type %s not support", t)
+		drop(dropUnsupported, client, fmt.Sprintf("outbound network layer type %s", t))
+		return nil
 	}
 
 	// Set network layer for transport layer
@@ -872,22 +2460,8 @@ func handleListen(contents []byte, conn net.Conn) error {
 		}
 	}
 
-	// Decide Loopback or Ethernet
-	if upConn.IsLoop() {
-		newLinkLayerType = layers.LayerTypeLoopback
-	} else {
-		newLinkLayerType = layers.LayerTypeEthernet
-	}
-
-	// Create new link layer
-	switch newLinkLayerType {
-	case layers.LayerTypeLoopback:
-		newLinkLayer, err = pcap.CreateLoopbackLayer(newNetworkLayer)
-	case layers.LayerTypeEthernet:
-		newLinkLayer, err = pcap.CreateEthernetLayer(upConn.LocalDev().HardwareAddr(), upConn.RemoteDev().HardwareAddr(), newNetworkLayer)
-	default:
-		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
-	}
+	// Create new link layer, which is tagged if replies from the upstream are tagged
+	newLinkLayer, err = pcap.CreateLinkLayer(up, up.RemoteDev().HardwareAddr(), newNetworkLayer)
 	if err != nil {
 		return fmt.Errorf("create link layer: %w", err)
 	}
@@ -900,17 +2474,21 @@ func handleListen(contents []byte, conn net.Conn) error {
 
 	// Write packet data
 	for i, fragment := range fragments {
-		_, err = upConn.Write(fragment)
+		_, err = up.Write(fragment)
+		reportWrite(up, err)
 		if err != nil {
 			return fmt.Errorf("write: %w", err)
 		}
+		if dumpInjected {
+			dumper.Dump(pcap.DumpInjected, time.Time{}, fragment)
+		}
 
 		if i == len(fragment)-1 {
-			log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
-				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+			log.VerboseWith(log.Fields{"protocol": embIndicator.TransportProtocol().String(), "src": embIndicator.Src().String(), "client": conn.RemoteAddr().String(), "dst": embIndicator.Dst().String(), "size": embIndicator.Size()},
+				"Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n", embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
 		} else {
-			log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (...)\n",
-				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+			log.VerboseWith(log.Fields{"protocol": embIndicator.TransportProtocol().String(), "src": embIndicator.Src().String(), "client": conn.RemoteAddr().String(), "dst": embIndicator.Dst().String()},
+				"Redirect an inbound %s packet: %s -> %s -> %s (...)\n", embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
 		}
 	}
 
@@ -958,31 +2536,37 @@ func handleListen(contents []byte, conn net.Conn) error {
 			return fmt.Errorf("transport layer type %s not support", t)
 		}
 		if addNAT {
-			ni := &natIndicator{
-				src:    conn.RemoteAddr(),
-				embSrc: embIndicator.NATSrc(),
-				conn:   conn,
+			s := nat.shard(guide)
+			s.lock.Lock()
+			ni, ok := s.m[guide]
+			if !ok || ni.conn != conn || ni.embSrc.String() != embIndicator.NATSrc().String() {
+				ni = newNATIndicator(conn.RemoteAddr(), embIndicator.NATSrc(), conn, upValue)
+				s.m[guide] = ni
+			}
+			s.lock.Unlock()
+
+			ni.see(time.Now())
+			ni.addDst(embIndicator.DstIP())
+			if guide.Protocol == layers.LayerTypeTCP && embIndicator.TCPLayer().ACK {
+				ni.seeTCP(&net.TCPAddr{IP: embIndicator.DstIP(), Port: int(embIndicator.DstPort())}, embIndicator.TCPLayer().Ack)
 			}
-			natLock.Lock()
-			nat[guide] = ni
-			natLock.Unlock()
 		}
 
 		// Keep alive
 		protocol := embIndicator.NATProtocol()
 		switch protocol {
-		case layers.LayerTypeTCP:
-			tcpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeUDP:
-			udpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeICMPv4:
-			icmpv4IdPool[upValue] = time.Now()
+		case layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4:
+			patLock.Lock()
+			touch(protocol, upValue, time.Now())
+			patLock.Unlock()
 		default:
 			return fmt.Errorf("transport layer type %s not support", protocol)
 		}
 	}
 
 	// Statistics
+	sizes.AddInner(stat.DirectionOut, embIndicator.Size())
+	traffic.Add(stat.DirectionOut, statProtocol(embIndicator), embIndicator.Size())
 	if monitor != nil {
 		monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
 	}
@@ -990,7 +2574,7 @@ func handleListen(contents []byte, conn net.Conn) error {
 	return nil
 }
 
-func handleUpstream(packet gopacket.Packet) error {
+func handleUpstream(packet gopacket.Packet, conn *pcap.RawConn) error {
 	var (
 		err       error
 		indicator *pcap.PacketIndicator
@@ -999,46 +2583,70 @@ func handleUpstream(packet gopacket.Packet) error {
 		data      []byte
 	)
 
+	touchActivity()
+
+	t := pcap.CaptureTime(packet)
+
 	// Parse packet
 	indicator, err = pcap.ParsePacket(packet)
 	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
+		drop(dropMalformed, "", fmt.Sprintf("parse packet in device %s: %s", conn.LocalDev().Alias(), err))
+		return nil
 	}
 
 	// Handle fragments
+	src := indicator.SrcIP()
 	indicator, frags, err = defrag.AppendOriginal(indicator)
 	if err != nil {
-		return fmt.Errorf("defrag: %w", err)
+		drop(dropMalformed, "", fmt.Sprintf("defrag packet from %s: %s", src, err))
+		return nil
 	}
 	if indicator == nil {
 		return nil
 	}
 
-	// NAT
+	// NAT, ICMPv4 errors are guided by their embedded packets
 	guide := pcap.NATGuide{
 		Src:      indicator.NATDst().String(),
-		Protocol: indicator.TransportLayer().LayerType(),
+		Protocol: indicator.NATProtocol(),
 	}
-	natLock.RLock()
-	ni, ok := nat[guide]
-	natLock.RUnlock()
+	ni, ok := nat.load(guide)
 	if !ok {
+		// The packet may belong to the host
+		drop(dropNotInNAT, "", fmt.Sprintf("inbound %s packet %s -> %s", indicator.TransportProtocol(), indicator.Src(), guide.Src))
 		return nil
 	}
 
-	// Keep alive
-	protocol := indicator.NATProtocol()
-	switch protocol {
-	case layers.LayerTypeTCP:
-		tcpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeUDP:
-		udpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeICMPv4:
-		icmpv4IdPool[indicator.ICMPv4Indicator().Id()] = time.Now()
-	default:
-		return fmt.Errorf("transport layer type %s not support", protocol)
+	// The client may be released after the NAT is looked up
+	if !isClient(ni.conn) {
+		drop(dropNotInNAT, "", fmt.Sprintf("inbound %s packet %s -> %s of released client %s", indicator.TransportProtocol(), indicator.Src(), guide.Src, ni.conn.RemoteAddr().String()))
+		return nil
+	}
+
+	// Validate endpoint, the packet may belong to the host if the port is reused
+	if !isFullCone {
+		src := indicator.SrcIP()
+		if indicator.TransportLayer().LayerType() == layers.LayerTypeICMPv4 && !indicator.ICMPv4Indicator().IsQuery() {
+			// ICMPv4 errors may come from routers in the path
+			src = indicator.ICMPv4Indicator().EmbDstIP()
+		}
+		if !ni.hasDst(src) {
+			drop(dropMismatch, ni.conn.RemoteAddr().String(), fmt.Sprintf("inbound %s packet from %s which does not belong to %s", indicator.TransportProtocol(), indicator.Src().String(), guide.Src))
+			return nil
+		}
+	}
+
+	// Remember the VLAN tag for any response
+	if conn.ObserveVLAN(indicator) {
+		log.Infof("Upstream VLAN %d on device %s\n", conn.VLAN(), conn.LocalDev().Alias())
 	}
 
+	// Keep alive
+	patLock.Lock()
+	touch(guide.Protocol, ni.value, t)
+	patLock.Unlock()
+	ni.see(t)
+
 	for _, frag := range frags {
 		var (
 			embTransportLayer gopacket.Layer
@@ -1171,32 +2779,46 @@ func handleUpstream(packet gopacket.Packet) error {
 		}
 
 		// Serialize layers
+		buffer := pcap.AcquireSerializeBuffer()
 		if embTransportLayer == nil {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+			data, err = pcap.SerializeTo(buffer, embNetworkLayer.(gopacket.SerializableLayer),
 				gopacket.Payload(frag.Payload()))
 		} else {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+			data, err = pcap.SerializeTo(buffer, embNetworkLayer.(gopacket.SerializableLayer),
 				embTransportLayer.(gopacket.SerializableLayer),
 				gopacket.Payload(frag.Payload()))
 		}
 		if err != nil {
+			pcap.ReleaseSerializeBuffer(buffer)
 			return fmt.Errorf("serialize: %w", err)
 		}
+		dataSize := len(data)
+
+		// Rate limit
+		if !allowClientOut(ni.conn, dataSize) {
+			pcap.ReleaseSerializeBuffer(buffer)
+			drop(dropRateLimited, ni.conn.RemoteAddr().String(), fmt.Sprintf("%d Bytes to client %s over rate limit", dataSize, ni.conn.RemoteAddr()))
+			continue
+		}
 
-		// Write packet data
+		// Write packet data, the buffer is not released if the write fails as it may be still in use after timing out
 		_, err = ni.conn.Write(data)
 		if err != nil {
 			return fmt.Errorf("write: %w", err)
 		}
+		pcap.ReleaseSerializeBuffer(buffer)
+		addClientOut(ni.conn, dataSize)
 
 		// Statistics
+		sizes.AddInner(stat.DirectionIn, dataSize)
+		traffic.Add(stat.DirectionIn, statProtocol(frag), dataSize)
 		size := frag.MTU()
 		if monitor != nil {
 			monitor.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
 		}
 
-		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
-			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
+		log.VerboseWith(log.Fields{"protocol": frag.TransportProtocol().String(), "src": frag.Src().String(), "client": ni.src.String(), "dst": ni.embSrc.String(), "size": size},
+			"Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n", frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
 	}
 
 	// Record DNS
@@ -1219,40 +2841,103 @@ func handleUpstream(packet gopacket.Packet) error {
 	return nil
 }
 
+// statProtocol returns the protocol of the packet in statistics.
+func statProtocol(indicator *pcap.PacketIndicator) stat.Protocol {
+	if indicator.TransportLayer() == nil {
+		return stat.ProtocolOther
+	}
+
+	switch indicator.TransportLayer().LayerType() {
+	case layers.LayerTypeTCP:
+		return stat.ProtocolTCP
+	case layers.LayerTypeUDP:
+		return stat.ProtocolUDP
+	case layers.LayerTypeICMPv4:
+		return stat.ProtocolICMPv4
+	default:
+		return stat.ProtocolOther
+	}
+}
+
+func isClient(conn net.Conn) bool {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	c, ok := clients[conn.RemoteAddr().String()]
+
+	return ok && c == conn
+}
+
+func removeClient(conn net.Conn) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	c, ok := clients[conn.RemoteAddr().String()]
+	if ok && c == conn {
+		delete(clients, conn.RemoteAddr().String())
+		delete(clientStats, conn.RemoteAddr().String())
+		forgetClientDrops(conn.RemoteAddr().String())
+	}
+}
+
+// releaseClient removes the client and its NAT and PAT, and closes the connection.
+func releaseClient(conn net.Conn) {
+	removeClient(conn)
+
+	// Remove NAT of the client
+	nat.removeFunc(func(guide pcap.NATGuide, ni *natIndicator) bool {
+		return ni.conn == conn
+	})
+
+	patLock.Lock()
+	for q := range patMap {
+		if q.dst == conn.RemoteAddr().String() {
+			delete(patMap, q)
+		}
+	}
+	patLock.Unlock()
+
+	conn.Close()
+}
+
 func dist(t gopacket.LayerType) (uint16, error) {
 	now := time.Now()
 
 	switch t {
 	case layers.LayerTypeTCP:
-		for i := 0; i < 16384; i++ {
-			s := nextTCPPort % 16384
+		size := uint16(tcpPorts.size())
+		for i := 0; i < tcpPorts.size(); i++ {
+			s := nextTCPPort % size
 
 			// Point to next port
-			nextTCPPort++
+			nextTCPPort = (s + 1) % size
 
 			// Check if the port is alive
 			last := tcpPortPool[s]
-			if now.Sub(last) > keepAlive {
+			if now.Sub(last) > tcpTimeout {
 				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
+					log.Verbosef("Recycle %s port %d\n", t, tcpPorts.min+s)
+					expireFlow()
 				}
-				return 49152 + s, nil
+				return tcpPorts.min + s, nil
 			}
 		}
 	case layers.LayerTypeUDP:
-		for i := 0; i < 16384; i++ {
-			s := nextUDPPort % 16384
+		size := uint16(udpPorts.size())
+		for i := 0; i < udpPorts.size(); i++ {
+			s := nextUDPPort % size
 
 			// Point to next port
-			nextUDPPort++
+			nextUDPPort = (s + 1) % size
 
 			// Check if the port is alive
 			last := udpPortPool[s]
-			if now.Sub(last) > keepAlive {
+			if now.Sub(last) > udpTimeout {
 				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
+					log.Verbosef("Recycle %s port %d\n", t, udpPorts.min+s)
+					expireFlow()
 				}
-				return 49152 + s, nil
+				return udpPorts.min + s, nil
 			}
 		}
 	case layers.LayerTypeICMPv4:
@@ -1264,9 +2949,10 @@ func dist(t gopacket.LayerType) (uint16, error) {
 
 			// Check if the Id is alive
 			last := icmpv4IdPool[s]
-			if now.Sub(last) > keepAlive {
+			if now.Sub(last) > icmpv4Timeout {
 				if !last.IsZero() {
 					log.Verbosef("Recycle %s ID %d\n", t, s)
+					expireFlow()
 				}
 				return s, nil
 			}
@@ -1278,8 +2964,40 @@ func dist(t gopacket.LayerType) (uint16, error) {
 	return 0, fmt.Errorf("%s pool empty", t)
 }
 
-func convertFromPort(port uint16) uint16 {
-	return port - 49152
+// expireFlow decreases active flows when a flow is expired. patLock must be held.
+func expireFlow() {
+	if activeFlows > 0 {
+		activeFlows--
+	}
+}
+
+// countFlows returns the number of flows which are still alive across all protocols.
+func countFlows() int {
+	now := time.Now()
+
+	return countAlive(tcpPortPool, tcpTimeout, now) + countAlive(udpPortPool, udpTimeout, now) + countAlive(icmpv4IdPool, icmpv4Timeout, now)
+}
+
+// convertFromPort returns the index of the port in the pool of the protocol.
+func convertFromPort(t gopacket.LayerType, port uint16) uint16 {
+	switch t {
+	case layers.LayerTypeTCP:
+		return port - tcpPorts.min
+	case layers.LayerTypeUDP:
+		return port - udpPorts.min
+	default:
+		return port
+	}
+}
+
+// formatPorts returns ports in a string like ":443, :993".
+func formatPorts(ports []uint16) string {
+	strs := make([]string, 0)
+	for _, p := range ports {
+		strs = append(strs, fmt.Sprintf(":%d", p))
+	}
+
+	return strings.Join(strs, ", ")
 }
 
 func splitArg(s string) []string {
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/stat"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errorCategory describes where an error is raised in handling packets.
+type errorCategory int
+
+const (
+	errorReadListen errorCategory = iota
+	errorHandleListen
+	errorReadUpstream
+	errorHandleUpstream
+	errorCategories
+)
+
+func (c errorCategory) String() string {
+	switch c {
+	case errorReadListen:
+		return "read-listen"
+	case errorHandleListen:
+		return "handle-listen"
+	case errorReadUpstream:
+		return "read-upstream"
+	case errorHandleUpstream:
+		return "handle-upstream"
+	default:
+		return fmt.Sprintf("%d", c)
+	}
+}
+
+// handshakeResult describes how a handshake from a client ends.
+type handshakeResult int
+
+const (
+	handshakeAccepted handshakeResult = iota
+	handshakeRefused
+	handshakeFailed
+	handshakeResults
+)
+
+func (r handshakeResult) String() string {
+	switch r {
+	case handshakeAccepted:
+		return "accepted"
+	case handshakeRefused:
+		return "refused"
+	case handshakeFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("%d", r)
+	}
+}
+
+var (
+	errorCounts [errorCategories]uint64
+	handshakes  [handshakeResults]uint64
+	connects    uint64
+	metricsSrv  *http.Server
+)
+
+// countError records an error in the category.
+func countError(c errorCategory) {
+	atomic.AddUint64(&errorCounts[c], 1)
+}
+
+// countHandshake records a handshake ending in the result.
+func countHandshake(r handshakeResult) {
+	atomic.AddUint64(&handshakes[r], 1)
+}
+
+// countFrame records the size of a frame written to or read from a client.
+func countFrame(isWrite bool, size int) {
+	if isWrite {
+		sizes.AddWire(stat.DirectionIn, size)
+	} else {
+		sizes.AddWire(stat.DirectionOut, size)
+	}
+}
+
+// metricsHandler returns a handler serving metrics in Prometheus text format.
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		err := writeMetrics(stat.NewPrometheusWriter(w))
+		if err != nil {
+			log.Errorln(fmt.Errorf("metrics: %w", err))
+		}
+	})
+}
+
+// serveMetrics serves metrics in Prometheus text format on /metrics of the address.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+
+	metricsSrv = &http.Server{Addr: addr, Handler: mux}
+
+	return routines.Go("metrics", func() {
+		err := metricsSrv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorln(fmt.Errorf("metrics: %w", err))
+		}
+	})
+}
+
+func writeMetrics(p *stat.PrometheusWriter) error {
+	stats := traffic.Stats()
+	for _, s := range stats {
+		protocol := strings.ToLower(s.Protocol)
+		p.Counter("ikago_packets_total", "Embedded packets forwarded.", s.InPackets, "direction", "in", "protocol", protocol)
+		p.Counter("ikago_packets_total", "Embedded packets forwarded.", s.OutPackets, "direction", "out", "protocol", protocol)
+	}
+	for _, s := range stats {
+		protocol := strings.ToLower(s.Protocol)
+		p.Counter("ikago_bytes_total", "Bytes of embedded packets forwarded.", s.InBytes, "direction", "in", "protocol", protocol)
+		p.Counter("ikago_bytes_total", "Bytes of embedded packets forwarded.", s.OutBytes, "direction", "out", "protocol", protocol)
+	}
+
+	p.Histogram("ikago_inner_size_bytes", "Sizes of embedded packets forwarded.", sizes.Inner(stat.DirectionIn), "direction", "in")
+	p.Histogram("ikago_inner_size_bytes", "Sizes of embedded packets forwarded.", sizes.Inner(stat.DirectionOut), "direction", "out")
+	p.Histogram("ikago_wire_size_bytes", "Sizes of frames carrying embedded packets to and from clients.", sizes.Wire(stat.DirectionIn), "direction", "in")
+	p.Histogram("ikago_wire_size_bytes", "Sizes of frames carrying embedded packets to and from clients.", sizes.Wire(stat.DirectionOut), "direction", "out")
+
+	p.Counter("ikago_decrypt_failures_total", "Payloads from clients failed to decrypt.", pcap.DecryptFailures())
+
+	p.Counter("ikago_padding_bytes_total", "Bytes of padding added to payloads to clients.", pcap.PaddingBytes())
+
+	for r := dropReason(0); r < dropReasons; r++ {
+		p.Counter("ikago_drops_total", "Packets dropped intentionally.", dropCount(r), "reason", r.String())
+	}
+
+	for category := errorCategory(0); category < errorCategories; category++ {
+		p.Counter("ikago_errors_total", "Errors in handling packets.", atomic.LoadUint64(&errorCounts[category]), "category", category.String())
+	}
+
+	p.Counter("ikago_kernel_drops_total", "Packets dropped by the kernel or interfaces in capturing.", kernelDropCount())
+
+	p.Counter("ikago_connects_total", "Clients connected.", atomic.LoadUint64(&connects))
+
+	for r := handshakeResult(0); r < handshakeResults; r++ {
+		p.Counter("ikago_handshakes_total", "Handshakes from clients.", atomic.LoadUint64(&handshakes[r]), "result", r.String())
+	}
+
+	clientsLock.RLock()
+	numClients := len(clients)
+	clientsLock.RUnlock()
+	p.Gauge("ikago_clients", "Clients connected currently.", numClients)
+
+	p.Gauge("ikago_nat_entries", "Entries in NAT.", nat.size())
+
+	now := time.Now()
+	patLock.RLock()
+	tcpAlive, udpAlive, icmpv4Alive := countAlive(tcpPortPool, tcpTimeout, now), countAlive(udpPortPool, udpTimeout, now), countAlive(icmpv4IdPool, icmpv4Timeout, now)
+	patLock.RUnlock()
+	p.Gauge("ikago_pool_alive", "Ports or IDs in use in pools.", tcpAlive, "protocol", "tcp")
+	p.Gauge("ikago_pool_alive", "Ports or IDs in use in pools.", udpAlive, "protocol", "udp")
+	p.Gauge("ikago_pool_alive", "Ports or IDs in use in pools.", icmpv4Alive, "protocol", "icmpv4")
+	p.Gauge("ikago_pool_size", "Ports or IDs in pools.", tcpPorts.size(), "protocol", "tcp")
+	p.Gauge("ikago_pool_size", "Ports or IDs in pools.", udpPorts.size(), "protocol", "udp")
+	p.Gauge("ikago_pool_size", "Ports or IDs in pools.", len(icmpv4IdPool), "protocol", "icmpv4")
+
+	p.Gauge("ikago_queued_packets", "Packets queued for handling.", queued(), "queue", "listen")
+	p.Gauge("ikago_queued_packets", "Packets queued for handling.", upQueued(), "queue", "upstream")
+	p.Gauge("ikago_queued_packets_peak", "Max packets ever queued in a queue from clients.", peakQueued())
+
+	return p.Err()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/zhxie/ikago/internal/pcap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsScrape(t *testing.T) {
+	conns := newRecordConns(1)
+	setupTestServer(t, conns)
+
+	err := handleListen(createEmbUDP(t, embSrcOf(0), testDstAddr, 64, []byte("query")), conns[0], pcap.NewEmbDecoder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(metricsHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scrape in status %d, expect %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("scrape in content type %s, expect text/plain", ct)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := string(body)
+
+	names := []string{
+		"ikago_packets_total",
+		"ikago_bytes_total",
+		"ikago_inner_size_bytes",
+		"ikago_wire_size_bytes",
+		"ikago_decrypt_failures_total",
+		"ikago_padding_bytes_total",
+		"ikago_drops_total",
+		"ikago_errors_total",
+		"ikago_kernel_drops_total",
+		"ikago_connects_total",
+		"ikago_handshakes_total",
+		"ikago_clients",
+		"ikago_nat_entries",
+		"ikago_pool_alive",
+		"ikago_pool_size",
+		"ikago_queued_packets",
+		"ikago_queued_packets_peak",
+	}
+	for _, name := range names {
+		if !strings.Contains(metrics, "# TYPE "+name+" ") {
+			t.Errorf("missing metric %s", name)
+		}
+	}
+
+	// Values follow the state of the server
+	samples := []string{
+		"ikago_clients 1\n",
+		"ikago_nat_entries 1\n",
+		"ikago_pool_alive{protocol=\"udp\"} 1\n",
+	}
+	for _, sample := range samples {
+		if !strings.Contains(metrics, sample) {
+			t.Errorf("missing sample %q", strings.TrimSpace(sample))
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/zhxie/ikago/internal/pcap"
+	"sync"
+)
+
+// natShards is the number of shards of NAT.
+const natShards = 64
+
+type natShard struct {
+	lock sync.RWMutex
+	m    map[pcap.NATGuide]*natIndicator
+}
+
+// natTable is NAT sharded by sources of guides, so looking up NAT for inbound packets rarely contends with adding NAT
+// for outbound packets of other flows. A shard must be locked before patLock.
+type natTable [natShards]natShard
+
+func newNATTable() *natTable {
+	t := &natTable{}
+	for i := range t {
+		t[i].m = make(map[pcap.NATGuide]*natIndicator)
+	}
+
+	return t
+}
+
+// shard returns the shard of the guide.
+func (t *natTable) shard(guide pcap.NATGuide) *natShard {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(guide.Src); i++ {
+		h = h ^ uint32(guide.Src[i])
+		h = h * 16777619
+	}
+
+	return &t[h%natShards]
+}
+
+// load returns the NAT of the guide.
+func (t *natTable) load(guide pcap.NATGuide) (*natIndicator, bool) {
+	s := t.shard(guide)
+
+	s.lock.RLock()
+	ni, ok := s.m[guide]
+	s.lock.RUnlock()
+
+	return ni, ok
+}
+
+// remove removes the NAT of the guide and returns it.
+func (t *natTable) remove(guide pcap.NATGuide) (*natIndicator, bool) {
+	s := t.shard(guide)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ni, ok := s.m[guide]
+	if ok {
+		delete(s.m, guide)
+	}
+
+	return ni, ok
+}
+
+// size returns the number of NAT.
+func (t *natTable) size() int {
+	n := 0
+	for i := range t {
+		t[i].lock.RLock()
+		n = n + len(t[i].m)
+		t[i].lock.RUnlock()
+	}
+
+	return n
+}
+
+// forEach calls the function for each NAT. Shards are locked one by one, so NAT changing during the iteration may be
+// missed.
+func (t *natTable) forEach(f func(guide pcap.NATGuide, ni *natIndicator)) {
+	for i := range t {
+		t[i].lock.RLock()
+		for guide, ni := range t[i].m {
+			f(guide, ni)
+		}
+		t[i].lock.RUnlock()
+	}
+}
+
+// removeFunc removes NAT for which the function returns true, and returns how many NAT are removed.
+func (t *natTable) removeFunc(f func(guide pcap.NATGuide, ni *natIndicator) bool) int {
+	n := 0
+	for i := range t {
+		t[i].lock.Lock()
+		for guide, ni := range t[i].m {
+			if f(guide, ni) {
+				delete(t[i].m, guide)
+				n++
+			}
+		}
+		t[i].lock.Unlock()
+	}
+
+	return n
+}
+
+// rekey replaces guides of NAT with guides returned by the function if it returns true, and returns how many NAT are
+// replaced. All shards are locked so NAT never disappears in replacing.
+func (t *natTable) rekey(f func(guide pcap.NATGuide) (pcap.NATGuide, bool)) int {
+	for i := range t {
+		t[i].lock.Lock()
+	}
+	defer func() {
+		for i := range t {
+			t[i].lock.Unlock()
+		}
+	}()
+
+	moved := make(map[pcap.NATGuide]*natIndicator)
+	for i := range t {
+		for guide, ni := range t[i].m {
+			newGuide, ok := f(guide)
+			if !ok {
+				continue
+			}
+
+			delete(t[i].m, guide)
+			moved[newGuide] = ni
+		}
+	}
+	for guide, ni := range moved {
+		t.shard(guide).m[guide] = ni
+	}
+
+	return len(moved)
+}
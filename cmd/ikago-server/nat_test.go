@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// lockedNAT is NAT in a single map under a single lock, which is how NAT was kept before sharding.
+type lockedNAT struct {
+	lock sync.RWMutex
+	m    map[pcap.NATGuide]*natIndicator
+}
+
+func (t *lockedNAT) load(guide pcap.NATGuide) (*natIndicator, bool) {
+	t.lock.RLock()
+	ni, ok := t.m[guide]
+	t.lock.RUnlock()
+
+	return ni, ok
+}
+
+func (t *lockedNAT) store(guide pcap.NATGuide, ni *natIndicator) {
+	t.lock.Lock()
+	t.m[guide] = ni
+	t.lock.Unlock()
+}
+
+// BenchmarkNAT looks up NAT like inbound packets from parallel upstream workers, and adds NAT like outbound packets
+// every eighth operation.
+func BenchmarkNAT(b *testing.B) {
+	const flows = 4096
+
+	guides := make([]pcap.NATGuide, flows)
+	for i := range guides {
+		guides[i] = pcap.NATGuide{
+			Src:      fmt.Sprintf("192.0.2.1:%d", 49152+i%16384),
+			Protocol: layers.LayerTypeUDP,
+		}
+	}
+	ni := newNATIndicator(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1234}, nil, 0)
+
+	sharded := newNATTable()
+	storeSharded := func(guide pcap.NATGuide, ni *natIndicator) {
+		s := sharded.shard(guide)
+
+		s.lock.Lock()
+		s.m[guide] = ni
+		s.lock.Unlock()
+	}
+	locked := &lockedNAT{m: make(map[pcap.NATGuide]*natIndicator)}
+	for _, guide := range guides {
+		storeSharded(guide, ni)
+		locked.store(guide, ni)
+	}
+
+	tables := []struct {
+		name  string
+		load  func(pcap.NATGuide) (*natIndicator, bool)
+		store func(pcap.NATGuide, *natIndicator)
+	}{
+		{name: "sharded", load: sharded.load, store: storeSharded},
+		{name: "single lock", load: locked.load, store: locked.store},
+	}
+
+	for _, table := range tables {
+		table := table
+		b.Run(table.name, func(b *testing.B) {
+			var next uint32
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine walks its own flows
+				i := int(atomic.AddUint32(&next, 1)) * 997
+				for pb.Next() {
+					guide := guides[i%flows]
+					if i%8 == 0 {
+						table.store(guide, ni)
+					} else {
+						_, ok := table.load(guide)
+						if !ok {
+							b.Errorf("NAT of %s not found", guide.Src)
+							return
+						}
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestIPKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "::ffff:192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.2", false},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"2001:db8::1", "2001:db8::2", false},
+	}
+
+	for _, tt := range tests {
+		got := ipKey(net.ParseIP(tt.a)) == ipKey(net.ParseIP(tt.b))
+		if got != tt.want {
+			t.Errorf("key of %s equals %s: %t, expect %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	ni := newNATIndicator(nil, nil, nil, 0)
+	ni.addDst(net.IPv4(192, 0, 2, 1).To4())
+	if !ni.hasDst(net.IPv4(192, 0, 2, 1)) {
+		t.Error("missing destination in another form")
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	other := net.IPv4(198, 51, 100, 1).To4()
+
+	tests := []struct {
+		name       string
+		isFullCone bool
+		srcIP      net.IP
+		want       bool
+	}{
+		{"restricted", false, testDstAddr.IP, true},
+		{"restricted mismatch", false, other, false},
+		{"full cone", true, testDstAddr.IP, true},
+		{"full cone other", true, other, true},
+	}
+
+	prevIsFullCone := isFullCone
+	defer func() {
+		isFullCone = prevIsFullCone
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conns := newRecordConns(1)
+			w := setupTestServer(t, conns)
+			isFullCone = tt.isFullCone
+
+			err := handleListen(createEmbUDP(t, embSrcOf(0), testDstAddr, 64, []byte("query")), conns[0], pcap.NewEmbDecoder())
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply := createReplyFrom(t, w.written()[0], tt.srcIP, []byte("answer"))
+
+			mismatches := dropCount(dropMismatch)
+			err = handleUpstream(newUpstreamPacket(reply), upConn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n := len(conns[0].payloads())
+			if tt.want && n != 1 || !tt.want && n != 0 {
+				t.Errorf("reply from %s: write %d payloads to the client", tt.srcIP, n)
+			}
+			d := dropCount(dropMismatch) - mismatches
+			if tt.want && d != 0 || !tt.want && d != 1 {
+				t.Errorf("reply from %s: %d mismatches", tt.srcIP, d)
+			}
+		})
+	}
+}
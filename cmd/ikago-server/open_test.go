@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/routine"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setTestLoopServer sets up the server listening and routing upstream in the loopback device, or skips the test if
+// packets cannot be captured in it. The state is reset after the test.
+func setTestLoopServer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("capture packets without root")
+	}
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		t.Skipf("find devices: %v", err)
+	}
+	loopDev := pcap.FindLoopDev(devs)
+	if loopDev == nil || loopDev.CheckAddr() != nil {
+		t.Skip("missing loopback device")
+	}
+
+	// A free port to listen on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	c, err := crypto.ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports = []uint16{p}
+	listenDevs = []*pcap.Device{loopDev}
+	upDev, gatewayDev = loopDev, loopDev
+	mode = "faketcp"
+	crypt = c
+	mtu = loopDev.FitMTU(pcap.MaxMTU)
+	upReaders = 1
+	queueSize = 64
+	newQueues(2)
+	newUpQueues(2)
+	tcpPorts = portRange{min: 49152, max: 65535}
+	udpPorts = portRange{min: 49152, max: 65535}
+	tcpPortPool = make([]time.Time, tcpPorts.size())
+	udpPortPool = make([]time.Time, udpPorts.size())
+
+	t.Cleanup(func() {
+		ports, listenDevs, upDev, gatewayDev, crypt = nil, nil, nil, nil, nil
+		mode = ""
+		queues, upQueues = nil, nil
+		tcpPortPool, udpPortPool = nil, nil
+
+		isClosed = false
+		quit = make(chan struct{})
+		closeOnce = sync.Once{}
+		closeErr = nil
+		routines = routine.NewRegistry(maxRoutines)
+		listeners = nil
+		detectors, rstDetectors = nil, nil
+		upConn, upReadConns = nil, nil
+	})
+}
+
+func TestOpenCancel(t *testing.T) {
+	setTestLoopServer(t)
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		done <- open(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * waitRoutines):
+		t.Fatal("open after cancelling")
+	}
+
+	// Routines exit in closing, and others like the runtime's may take a while to exit
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Errorf("leak %d goroutines:\n%s", n-before, buf[:runtime.Stack(buf, true)])
+	}
+	if n := routines.Len(); n != 0 {
+		t.Errorf("leak %d routines", n)
+	}
+}
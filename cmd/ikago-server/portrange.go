@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// minPortRange is the minimum number of ports in a port range.
+const minPortRange = 64
+
+// portRange describes a range of ports distributed to flows, both ends included.
+type portRange struct {
+	min uint16
+	max uint16
+}
+
+// parsePortRange returns the port range parsed from a string like "49152-65535".
+func parsePortRange(s string) (portRange, error) {
+	ends := strings.Split(s, "-")
+	if len(ends) != 2 {
+		return portRange{}, fmt.Errorf("invalid port range %s", s)
+	}
+
+	min, err := strconv.ParseUint(strings.TrimSpace(ends[0]), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("parse min: %w", err)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(ends[1]), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("parse max: %w", err)
+	}
+	if min == 0 || min > max {
+		return portRange{}, fmt.Errorf("port range %s out of range", s)
+	}
+
+	r := portRange{min: uint16(min), max: uint16(max)}
+	if r.size() < minPortRange {
+		return portRange{}, fmt.Errorf("port range %s smaller than %d ports", s, minPortRange)
+	}
+
+	return r, nil
+}
+
+// size returns the number of ports in the range.
+func (r portRange) size() int {
+	return int(r.max) - int(r.min) + 1
+}
+
+// contains returns if the port is in the range.
+func (r portRange) contains(port uint16) bool {
+	return port >= r.min && port <= r.max
+}
+
+func (r portRange) String() string {
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/exec"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/privilege"
+	"net"
+)
+
+var (
+	dropUser *privilege.User
+	// keepNetRaw is true if CAP_NET_RAW is kept for opening handles after dropping privileges.
+	keepNetRaw bool
+	ownPaths   []string
+	isDropped  bool
+	// rstRuleRemover removes firewall rules handed off before dropping privileges.
+	rstRuleRemover *exec.RSTFirewallRuleRemover
+)
+
+// dropPrivileges hands files written later to the user, hands off firewall rules to a process keeping privileges, and
+// switches to the user.
+func dropPrivileges() error {
+	for _, path := range ownPaths {
+		err := dropUser.Chown(path)
+		if err != nil {
+			return fmt.Errorf("own %s: %w", path, err)
+		}
+	}
+
+	// Firewall rules cannot be removed as the user, so a process keeping privileges removes them
+	if len(rstRulePorts) > 0 {
+		remover, err := exec.StartRSTFirewallRuleRemover(rstRulePorts)
+		if err != nil {
+			return fmt.Errorf("hand off firewall rules: %w", err)
+		}
+		rstRuleRemover = remover
+		rstRulePorts = nil
+	}
+
+	err := privilege.Drop(dropUser, keepNetRaw)
+	if err != nil {
+		return err
+	}
+	isDropped = true
+
+	return nil
+}
+
+// isHandleDenied returns if the error is caused by opening a handle for a new client after dropping privileges.
+func isHandleDenied(err error) bool {
+	var opErr *net.OpError
+
+	return isDropped && errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// reportHandleDenied reports clients cannot be accepted any more after dropping privileges.
+func reportHandleDenied(err error) {
+	log.Errorln(fmt.Errorf("accept: %w", err))
+	log.Errorf("Cannot open handles for new clients as user %s, use KCP, -keep-net-raw or run without -user\n", dropUser.Name)
+}
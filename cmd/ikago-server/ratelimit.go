@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/config"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket describes a token bucket limiting bytes per second. Bursts up to one second of the rate are allowed. It
+// is refilled by the time elapsed when tokens are taken, and is safe to be used concurrently without locks.
+type tokenBucket struct {
+	// 64-bit fields accessed atomically must be first to be aligned on 32-bit platforms
+	tokens int64
+	last   int64
+	rate   int64
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		tokens: int64(rate),
+		last:   time.Now().UnixNano(),
+		rate:   int64(rate),
+	}
+}
+
+// refill adds tokens for the time elapsed since the last refill.
+func (b *tokenBucket) refill(now int64) {
+	last := atomic.LoadInt64(&b.last)
+	elapsed := now - last
+	if elapsed <= 0 {
+		return
+	}
+
+	// The time of fractional tokens is left for the next refill
+	var tokens, next int64
+	if elapsed >= int64(time.Second) {
+		tokens, next = b.rate, now
+	} else {
+		tokens = elapsed * b.rate / int64(time.Second)
+		if tokens <= 0 {
+			return
+		}
+		next = last + tokens*int64(time.Second)/b.rate
+	}
+
+	// Only one of concurrent refills of the same period wins
+	if !atomic.CompareAndSwapInt64(&b.last, last, next) {
+		return
+	}
+
+	for {
+		old := atomic.LoadInt64(&b.tokens)
+		t := old + tokens
+		if t > b.rate {
+			t = b.rate
+		}
+		if atomic.CompareAndSwapInt64(&b.tokens, old, t) {
+			return
+		}
+	}
+}
+
+// take takes tokens of the size, and returns false if there are not enough tokens.
+func (b *tokenBucket) take(size int) bool {
+	b.refill(time.Now().UnixNano())
+
+	for {
+		old := atomic.LoadInt64(&b.tokens)
+		if old < int64(size) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.tokens, old, old-int64(size)) {
+			return true
+		}
+	}
+}
+
+// parseRateLimits returns rate limits by addresses parsed from a string like "192.168.1.2=8Mbps,192.168.1.3=512KB/s".
+func parseRateLimits(s string) (map[string]config.Rate, error) {
+	limits := make(map[string]config.Rate)
+	for _, str := range splitArg(s) {
+		pair := strings.Split(str, "=")
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %s", str)
+		}
+
+		rate, err := config.ParseRate(strings.TrimSpace(pair[1]))
+		if err != nil {
+			return nil, fmt.Errorf("parse rate limit %s: %w", str, err)
+		}
+		limits[strings.TrimSpace(pair[0])] = rate
+	}
+
+	return limits, nil
+}
+
+// rateLimitOf returns the rate limit of the client in bytes per second, or 0 if it is unlimited.
+func rateLimitOf(addr net.Addr) int {
+	ip := ipOf(addr)
+	if ip != nil {
+		limit, ok := rateLimits[ip.String()]
+		if ok {
+			return limit
+		}
+	}
+
+	return rateLimit
+}
+
+// allowClientIn returns if a packet of the size received from the client is within its rate limit.
+func allowClientIn(conn net.Conn, size int) bool {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	s := clientStatOf(conn)
+	if s == nil || s.inLimit == nil {
+		return true
+	}
+
+	if !s.inLimit.take(size) {
+		atomic.AddUint64(&s.inDrops, 1)
+		return false
+	}
+
+	return true
+}
+
+// allowClientOut returns if a packet of the size sent to the client is within its rate limit.
+func allowClientOut(conn net.Conn, size int) bool {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+
+	s := clientStatOf(conn)
+	if s == nil || s.outLimit == nil {
+		return true
+	}
+
+	if !s.outLimit.take(size) {
+		atomic.AddUint64(&s.outDrops, 1)
+		return false
+	}
+
+	return true
+}
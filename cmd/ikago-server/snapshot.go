@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/envelope"
+	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/routine"
+	"github.com/zhxie/ikago/internal/stat"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"time"
+)
+
+// Sections of snapshots in the envelope. Each section is in JSON.
+const (
+	// sectionSnapshot is the snapshot without NAT, PAT and pools.
+	sectionSnapshot = iota + 1
+	sectionNAT
+	sectionPAT
+	sectionPools
+)
+
+type snapshotNAT struct {
+	Protocol string    `json:"protocol"`
+	Src      string    `json:"src"`
+	Client   string    `json:"client"`
+	EmbSrc   string    `json:"embedded-src"`
+	Dsts     []string  `json:"destinations"`
+	Seen     time.Time `json:"seen"`
+}
+
+type snapshotPAT struct {
+	Protocol string `json:"protocol"`
+	Src      string `json:"src"`
+	Client   string `json:"client"`
+	Value    uint16 `json:"value"`
+}
+
+type snapshotPool struct {
+	Protocol string `json:"protocol"`
+	Alive    int    `json:"alive"`
+	Size     int    `json:"size"`
+}
+
+type snapshot struct {
+	Name        string                `json:"name"`
+	Version     string                `json:"version"`
+	Time        time.Time             `json:"time"`
+	Uptime      int                   `json:"uptime"`
+	Clients     []string              `json:"clients"`
+	ClientStats []clientStatus        `json:"client-stats"`
+	NAT         []snapshotNAT         `json:"nat"`
+	PAT         []snapshotPAT         `json:"pat"`
+	Pools       []snapshotPool        `json:"pools"`
+	Flows       int                   `json:"flows"`
+	MaxFlows    int                   `json:"max-flows"`
+	Mismatches  uint64                `json:"mismatches"`
+	Drops       map[string]uint64     `json:"drops"`
+	KernelDrops uint64                `json:"kernel-drops"`
+	Routines    []routine.Routine     `json:"routines"`
+	Sizes       *stat.SizeMonitor     `json:"sizes"`
+	Traffic     *stat.ProtocolCounter `json:"traffic"`
+	Monitor     *stat.TrafficMonitor  `json:"monitor,omitempty"`
+	Method      string                `json:"method"`
+	Fingerprint string                `json:"fingerprint"`
+	Drain       *drainStatus          `json:"drain,omitempty"`
+}
+
+// countAlive returns the number of ports or Ids which are still alive in the pool expiring after the timeout.
+func countAlive(pool []time.Time, timeout time.Duration, now time.Time) int {
+	n := 0
+	for _, last := range pool {
+		if !last.IsZero() && now.Sub(last) <= timeout {
+			n++
+		}
+	}
+
+	return n
+}
+
+// takeSnapshot returns a snapshot of the runtime state. Clients, NAT and PAT are taken together under their locks.
+func takeSnapshot() *snapshot {
+	now := time.Now()
+	s := &snapshot{
+		Name:        name,
+		Version:     versionInfo,
+		Time:        now,
+		Uptime:      int(now.Sub(startTime).Seconds()),
+		Clients:     make([]string, 0),
+		PAT:         make([]snapshotPAT, 0),
+		MaxFlows:    maxFlows,
+		Mismatches:  dropCount(dropMismatch),
+		Drops:       dropCountMap(),
+		KernelDrops: kernelDropCount(),
+		Routines:    routines.Routines(),
+		Sizes:       sizes,
+		Traffic:     traffic,
+		Monitor:     monitor,
+		Method:      crypt.Method().String(),
+		Fingerprint: fingerprint,
+		Drain:       drainProgress(),
+	}
+
+	clientsLock.RLock()
+
+	for addr := range clients {
+		s.Clients = append(s.Clients, addr)
+	}
+	s.ClientStats = clientStatuses()
+	conns := clientConns()
+
+	s.NAT = takeNAT()
+
+	patLock.RLock()
+
+	for q, value := range patMap {
+		s.PAT = append(s.PAT, snapshotPAT{
+			Protocol: q.protocol.String(),
+			Src:      q.src,
+			Client:   q.dst,
+			Value:    value,
+		})
+	}
+
+	s.Pools = []snapshotPool{
+		{Protocol: "TCP", Alive: countAlive(tcpPortPool, tcpTimeout, now), Size: len(tcpPortPool)},
+		{Protocol: "UDP", Alive: countAlive(udpPortPool, udpTimeout, now), Size: len(udpPortPool)},
+		{Protocol: "ICMPv4", Alive: countAlive(icmpv4IdPool, icmpv4Timeout, now), Size: len(icmpv4IdPool)},
+	}
+	s.Flows = countFlows()
+
+	patLock.RUnlock()
+	clientsLock.RUnlock()
+
+	fillFakeTCP(s.ClientStats, conns)
+
+	sort.Strings(s.Clients)
+	sort.Slice(s.PAT, func(i, j int) bool {
+		return s.PAT[i].Protocol+s.PAT[i].Client+s.PAT[i].Src < s.PAT[j].Protocol+s.PAT[j].Client+s.PAT[j].Src
+	})
+
+	return s
+}
+
+// takeNAT returns a snapshot of NAT sorted by protocols and sources.
+func takeNAT() []snapshotNAT {
+	result := make([]snapshotNAT, 0)
+
+	nat.forEach(func(guide pcap.NATGuide, ni *natIndicator) {
+		dsts := make([]string, 0)
+		ni.dstsLock.RLock()
+		for dst := range ni.dsts {
+			dsts = append(dsts, net.IP(dst[:]).String())
+		}
+		ni.dstsLock.RUnlock()
+		sort.Strings(dsts)
+
+		result = append(result, snapshotNAT{
+			Protocol: guide.Protocol.String(),
+			Src:      guide.Src,
+			Client:   ni.src.String(),
+			EmbSrc:   ni.embSrc.String(),
+			Dsts:     dsts,
+			Seen:     ni.lastSeen(),
+		})
+	})
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Protocol+result[i].Src < result[j].Protocol+result[j].Src
+	})
+
+	return result
+}
+
+// writeSnapshot writes the snapshot in the envelope, in which NAT, PAT and pools are in their own sections.
+func writeSnapshot(w io.Writer, s *snapshot) error {
+	writer, err := envelope.NewWriter(w, 0)
+	if err != nil {
+		return err
+	}
+
+	meta := *s
+	meta.NAT, meta.PAT, meta.Pools = nil, nil, nil
+
+	for _, section := range []struct {
+		t uint16
+		v interface{}
+	}{
+		{t: sectionSnapshot, v: meta},
+		{t: sectionNAT, v: s.NAT},
+		{t: sectionPAT, v: s.PAT},
+		{t: sectionPools, v: s.Pools},
+	} {
+		b, err := json.Marshal(section.v)
+		if err != nil {
+			return fmt.Errorf("marshal section %d: %w", section.t, err)
+		}
+
+		err = writer.WriteSection(section.t, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSnapshot returns the snapshot in the envelope. Sections added by newer versions are skipped. Sizes, traffic and
+// monitor are not read back, as they are only marshaled.
+func readSnapshot(r io.Reader) (*snapshot, error) {
+	reader, err := envelope.NewReader(r, sectionSnapshot, sectionNAT, sectionPAT, sectionPools)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &snapshot{}
+	for {
+		section, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		var v interface{}
+		switch section.Type {
+		case sectionSnapshot:
+			v = &struct {
+				*snapshot
+				Sizes   json.RawMessage `json:"sizes"`
+				Traffic json.RawMessage `json:"traffic"`
+				Monitor json.RawMessage `json:"monitor"`
+			}{snapshot: s}
+		case sectionNAT:
+			v = &s.NAT
+		case sectionPAT:
+			v = &s.PAT
+		case sectionPools:
+			v = &s.Pools
+		}
+
+		err = json.Unmarshal(section.Data, v)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal section %d: %w", section.Type, err)
+		}
+	}
+
+	return s, nil
+}
+
+func adminSnapshot(args []string) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", errors.New("usage: snapshot <path> [json|envelope]")
+	}
+
+	format := "json"
+	if len(args) > 1 {
+		format = args[1]
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	switch format {
+	case "json":
+		b, err = json.MarshalIndent(takeSnapshot(), "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("marshal: %w", err)
+		}
+	case "envelope":
+		var buf bytes.Buffer
+		err = writeSnapshot(&buf, takeSnapshot())
+		if err != nil {
+			return "", err
+		}
+		b = buf.Bytes()
+	default:
+		return "", fmt.Errorf("format %s not support", format)
+	}
+
+	err = ioutil.WriteFile(args[0], b, 0600)
+	if err != nil {
+		return "", fmt.Errorf("write: %w", err)
+	}
+
+	return fmt.Sprintf("Save snapshot to %s\n", args[0]), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/zhxie/ikago/internal/envelope"
+	"github.com/zhxie/ikago/internal/stat"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testSnapshot() *snapshot {
+	now := time.Unix(1600000000, 0).UTC()
+
+	return &snapshot{
+		Name:        "IkaGo-server",
+		Version:     "test",
+		Time:        now,
+		Uptime:      60,
+		Clients:     []string{"10.0.0.2:50000"},
+		ClientStats: []clientStatus{{Addr: "10.0.0.2:50000", Connect: now, Seen: now, InPackets: 1, InBytes: 100}},
+		NAT: []snapshotNAT{{
+			Protocol: "TCP",
+			Src:      "192.0.2.1:49152",
+			Client:   "10.0.0.2:50000",
+			EmbSrc:   "192.168.1.2:1234",
+			Dsts:     []string{"198.51.100.1:80"},
+			Seen:     now,
+		}},
+		PAT:        []snapshotPAT{{Protocol: "TCP", Src: "192.168.1.2:1234", Client: "10.0.0.2:50000", Value: 49152}},
+		Pools:      []snapshotPool{{Protocol: "TCP", Alive: 1, Size: 16384}},
+		Flows:      1,
+		Mismatches: 2,
+		Drops:      map[string]uint64{"mismatch": 2},
+		Sizes:      stat.NewSizeMonitor(),
+		Traffic:    stat.NewProtocolCounter(),
+		Method:     "aes-128-gcm",
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	want := testSnapshot()
+
+	var buf bytes.Buffer
+	err := writeSnapshot(&buf, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := readSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Statistics are not read back
+	want.Sizes, want.Traffic = nil, nil
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("read %+v, want %+v", s, want)
+	}
+}
+
+func TestSnapshotForwardCompatibility(t *testing.T) {
+	want := testSnapshot()
+
+	// A future writer adds fields to the snapshot section, and adds sections
+	meta := *want
+	meta.NAT, meta.PAT, meta.Pools = nil, nil, nil
+	b, err := json.Marshal(&struct {
+		*snapshot
+		Future string `json:"future"`
+	}{snapshot: &meta, Future: "future"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := envelope.NewWriter(&buf, 1<<31)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []struct {
+		t uint16
+		v interface{}
+	}{
+		{t: sectionPools + 1, v: "future"},
+		{t: sectionSnapshot, v: json.RawMessage(b)},
+		{t: sectionNAT, v: want.NAT},
+		{t: sectionPools + 2, v: []string{"future"}},
+		{t: sectionPAT, v: want.PAT},
+		{t: sectionPools, v: want.Pools},
+	} {
+		b, err := json.Marshal(section.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.WriteSection(section.t, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := readSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want.Sizes, want.Traffic = nil, nil
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("read %+v, want %+v", s, want)
+	}
+}
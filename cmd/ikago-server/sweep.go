@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"time"
+)
+
+// timeoutOf returns the duration after which idle ports or Ids of the protocol expire.
+func timeoutOf(t gopacket.LayerType) time.Duration {
+	switch t {
+	case layers.LayerTypeTCP:
+		return tcpTimeout
+	case layers.LayerTypeUDP:
+		return udpTimeout
+	case layers.LayerTypeICMPv4:
+		return icmpv4Timeout
+	default:
+		return keepAlive
+	}
+}
+
+// poolOf returns the pool of the protocol and the index of the port or Id in it.
+func poolOf(t gopacket.LayerType, value uint16) ([]time.Time, int) {
+	switch t {
+	case layers.LayerTypeTCP:
+		return tcpPortPool, int(convertFromPort(t, value))
+	case layers.LayerTypeUDP:
+		return udpPortPool, int(convertFromPort(t, value))
+	case layers.LayerTypeICMPv4:
+		return icmpv4IdPool, int(value)
+	default:
+		return nil, 0
+	}
+}
+
+// touch marks the port or Id of the protocol as used, so it will not be swept while a packet is in flight. patLock
+// must be held.
+func touch(t gopacket.LayerType, value uint16, now time.Time) {
+	pool, i := poolOf(t, value)
+	if pool != nil {
+		pool[i] = now
+	}
+}
+
+// isExpired returns if the port or Id of the protocol has not been used for its timeout. patLock must be held.
+func isExpired(t gopacket.LayerType, value uint16, now time.Time) bool {
+	pool, i := poolOf(t, value)
+	if pool == nil {
+		return false
+	}
+
+	return now.Sub(pool[i]) > timeoutOf(t)
+}
+
+// releasePool releases ports or Ids in the pool expired after the timeout so dist can distribute them again, and
+// returns how many are released. patLock must be held.
+func releasePool(pool []time.Time, timeout time.Duration, now time.Time) int {
+	n := 0
+	for i, last := range pool {
+		if !last.IsZero() && now.Sub(last) > timeout {
+			pool[i] = time.Time{}
+			expireFlow()
+			n++
+		}
+	}
+
+	return n
+}
+
+// sweepNAT removes NAT and PAT whose port or Id has been expired, and releases the port or Id. TCP flows removed are
+// reset in clients. It returns how many NAT, PAT and ports or Ids are reclaimed.
+func sweepNAT() (int, int, int) {
+	var natSize, patSize, poolSize int
+
+	now := time.Now()
+
+	// Shards of NAT are swept one by one
+	resets := make([]*natIndicator, 0)
+	natSize = nat.removeFunc(func(guide pcap.NATGuide, ni *natIndicator) bool {
+		patLock.RLock()
+		defer patLock.RUnlock()
+
+		if !isExpired(guide.Protocol, ni.value, now) {
+			return false
+		}
+		if guide.Protocol == layers.LayerTypeTCP {
+			resets = append(resets, ni)
+		}
+
+		return true
+	})
+	for _, ni := range resets {
+		resetFlow(ni)
+	}
+
+	patLock.Lock()
+	defer patLock.Unlock()
+
+	for q, value := range patMap {
+		if isExpired(q.protocol, value, now) {
+			delete(patMap, q)
+			patSize++
+		}
+	}
+
+	// Release ports and Ids after NAT and PAT, they are reused only if no mapping refers to them
+	poolSize += releasePool(tcpPortPool, tcpTimeout, now)
+	poolSize += releasePool(udpPortPool, udpTimeout, now)
+	poolSize += releasePool(icmpv4IdPool, icmpv4Timeout, now)
+
+	return natSize, patSize, poolSize
+}
+
+// sweepNATs sweeps NAT periodically.
+func sweepNATs() {
+	ticker := time.NewTicker(natSweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		natSize, patSize, poolSize := sweepNAT()
+		if natSize > 0 || patSize > 0 || poolSize > 0 {
+			log.Verbosef("Sweep %d NAT, %d PAT and %d ports or IDs\n", natSize, patSize, poolSize)
+		}
+	}
+}
+
+// sweepClients drops clients which are idle for the client timeout periodically.
+func sweepClients() {
+	ticker := time.NewTicker(clientTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		now := time.Now()
+		idles := make([]net.Conn, 0)
+		clientsLock.RLock()
+		for addr, conn := range clients {
+			if now.Sub(clientStats[addr].lastSeen()) > clientTimeout {
+				idles = append(idles, conn)
+			}
+		}
+		clientsLock.RUnlock()
+
+		for _, conn := range idles {
+			releaseClient(conn)
+			log.Infof("Drop idle client %s\n", conn.RemoteAddr().String())
+			publish(eventClientDisconnect, fmt.Sprintf("Drop idle client %s", conn.RemoteAddr()), map[string]string{"client": conn.RemoteAddr().String()})
+		}
+	}
+}
+
+// keepAliveClients sends keep-alives to clients periodically, so clients which are still alive reply and are never
+// swept as idle. Clients which do not negotiate keep-alives are skipped.
+func keepAliveClients() {
+	ticker := time.NewTicker(keepAliveInt)
+	defer ticker.Stop()
+
+	data := pcap.CreateKeepAlive(pcap.KeepAliveRequest)
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		conns := make([]net.Conn, 0)
+		clientsLock.RLock()
+		for _, conn := range clients {
+			if pcap.SupportsKeepAlive(conn) {
+				conns = append(conns, conn)
+			}
+		}
+		clientsLock.RUnlock()
+
+		for _, conn := range conns {
+			_, err := conn.Write(data)
+			if err != nil {
+				log.Verboseln(fmt.Errorf("keep alive client %s: %w", conn.RemoteAddr().String(), err))
+				continue
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+)
+
+// createFlowRST returns an embedded TCP RST from the last destination to the embedded source of the flow, in the
+// sequence the client expects so its stack accepts it. It returns nil if the flow has not seen any acknowledgement.
+func createFlowRST(ni *natIndicator) ([]byte, error) {
+	dst, ack := ni.lastTCP()
+	if dst == nil {
+		return nil, nil
+	}
+
+	embSrc, ok := ni.embSrc.(*net.TCPAddr)
+	if !ok {
+		return nil, nil
+	}
+
+	newTCPLayer := &layers.TCP{
+		SrcPort:    layers.TCPPort(dst.Port),
+		DstPort:    layers.TCPPort(embSrc.Port),
+		Seq:        ack,
+		DataOffset: 5,
+		RST:        true,
+	}
+
+	newIPv4Layer, err := pcap.CreateIPv4Layer(dst.IP, embSrc.IP, 0, 64, newTCPLayer)
+	if err != nil {
+		return nil, fmt.Errorf("create network layer: %w", err)
+	}
+
+	data, err := pcap.Serialize(newIPv4Layer, newTCPLayer)
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
+}
+
+// resetFlow sends an embedded TCP RST to the client of the torn down flow, so applications in the client fail the
+// connection immediately instead of waiting on a dead flow.
+func resetFlow(ni *natIndicator) {
+	if isDryRun {
+		return
+	}
+
+	data, err := createFlowRST(ni)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("create rst for flow %s: %w", ni.embSrc, err))
+		return
+	}
+	if data == nil {
+		return
+	}
+
+	_, err = ni.conn.Write(data)
+	if err != nil {
+		log.Verboseln(fmt.Errorf("write rst for flow %s to client %s: %w", ni.embSrc, ni.conn.RemoteAddr(), err))
+		return
+	}
+	addClientOut(ni.conn, len(data))
+
+	log.Verbosef("Reset a torn down flow: %s <- %s\n", ni.embSrc, ni.conn.RemoteAddr())
+}
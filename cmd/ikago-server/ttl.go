@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+)
+
+// timeExceededPayload is the size of the leading payload of the original datagram quoted in an ICMPv4 Time Exceeded.
+const timeExceededPayload = 8
+
+// createTimeExceeded returns an ICMPv4 Time Exceeded in transit from the IP to the source of the embedded packet, or
+// nil if the packet is an ICMPv4 error which is never replied with errors.
+func createTimeExceeded(indicator *pcap.PacketIndicator, srcIP net.IP) ([]byte, error) {
+	if indicator.TransportLayer().LayerType() == layers.LayerTypeICMPv4 && !indicator.ICMPv4Indicator().IsQuery() {
+		return nil, nil
+	}
+
+	// Original IPv4 header and leading payload
+	payload := indicator.NetworkPayload()
+	if len(payload) > timeExceededPayload {
+		payload = payload[:timeExceededPayload]
+	}
+	quote := make([]byte, 0, len(indicator.NetworkLayer().LayerContents())+len(payload))
+	quote = append(quote, indicator.NetworkLayer().LayerContents()...)
+	quote = append(quote, payload...)
+
+	newICMPv4Layer := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded),
+	}
+
+	newIPv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    srcIP,
+		DstIP:    indicator.SrcIP(),
+	}
+
+	data, err := pcap.Serialize(newIPv4Layer, newICMPv4Layer, gopacket.Payload(quote))
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/pcap"
+	"testing"
+)
+
+func TestHandleTTLExceeded(t *testing.T) {
+	conns := newRecordConns(1)
+	w := setupTestServer(t, conns)
+
+	query := createEmbUDP(t, embSrcOf(0), testDstAddr, 1, []byte("query"))
+	err := handleListen(append([]byte(nil), query...), conns[0], pcap.NewEmbDecoder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := w.count(); n != 0 {
+		t.Errorf("write %d frames to the upstream, expect 0", n)
+	}
+	payloads := conns[0].payloads()
+	if len(payloads) != 1 {
+		t.Fatalf("write %d payloads to the client, expect 1", len(payloads))
+	}
+
+	packet := gopacket.NewPacket(payloads[0], layers.LayerTypeIPv4, gopacket.Default)
+	ipv4Layer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		t.Fatal("missing ipv4 layer")
+	}
+	if !ipv4Layer.SrcIP.Equal(testUpIP) || !ipv4Layer.DstIP.Equal(embSrcOf(0).IP) {
+		t.Errorf("reply %s -> %s, expect %s -> %s", ipv4Layer.SrcIP, ipv4Layer.DstIP, testUpIP, embSrcOf(0).IP)
+	}
+	icmpv4Layer, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ok {
+		t.Fatal("missing icmpv4 layer")
+	}
+	if icmpv4Layer.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded) {
+		t.Errorf("reply %s, expect time exceeded", icmpv4Layer.TypeCode)
+	}
+
+	// The original IPv4 header and leading 8 Bytes of its payload are quoted
+	quote := query[:20+timeExceededPayload]
+	if !bytes.Equal(icmpv4Layer.Payload, quote) {
+		t.Errorf("quote %x, expect %x", icmpv4Layer.Payload, quote)
+	}
+}
+
+func TestCreateTimeExceededICMPv4Error(t *testing.T) {
+	// ICMPv4 errors are never replied with errors
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		TTL:      1,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    embSrcOf(0).IP,
+		DstIP:    testDstAddr.IP,
+	}
+	icmpv4Layer := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort),
+	}
+	data, err := pcap.Serialize(ipv4Layer, icmpv4Layer, gopacket.Payload(createEmbUDP(t, testDstAddr, embSrcOf(0), 64, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indicator, err := pcap.ParseEmbPacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := createTimeExceeded(indicator, testUpIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != nil {
+		t.Errorf("reply %x to an icmpv4 error, expect nothing", reply)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"time"
+)
+
+// upQueues holds packets from upstream for upstream workers. Packets between the same pair of addresses, including
+// fragments of a packet, are always queued in the same queue so they are handled in order. Packets of different pairs
+// may be handled out of order, even if they are sent to the same client, which is harmless as they belong to
+// different flows. Writes to the same client from different workers are serialized by the connection, so each payload
+// is written as a whole.
+var upQueues []chan pcap.ConnPacket
+
+// newUpQueues creates queues for the number of upstream workers.
+func newUpQueues(workers int) {
+	upQueues = make([]chan pcap.ConnPacket, workers)
+	for i := range upQueues {
+		upQueues[i] = make(chan pcap.ConnPacket, queueSize)
+	}
+}
+
+// upQueueOf returns the queue of the packet.
+func upQueueOf(cp pcap.ConnPacket) chan pcap.ConnPacket {
+	networkLayer := cp.Packet.NetworkLayer()
+	if networkLayer == nil {
+		return upQueues[0]
+	}
+
+	return upQueues[networkLayer.NetworkFlow().FastHash()%uint64(len(upQueues))]
+}
+
+// enqueueUp queues the packet from upstream without blocking, so reading from upstream never stalls. The packet is
+// dropped if the queue is full.
+func enqueueUp(cp pcap.ConnPacket) {
+	select {
+	case upQueueOf(cp) <- cp:
+	default:
+		drop(dropQueueFull, "", fmt.Sprintf("inbound packet in device %s in full queue", cp.Conn.LocalDev().Alias()))
+	}
+}
+
+// upQueued returns the number of packets queued in all upstream queues.
+func upQueued() int {
+	n := 0
+	for _, q := range upQueues {
+		n = n + len(q)
+	}
+
+	return n
+}
+
+// packetFields returns fields of the packet in logs.
+func packetFields(packet gopacket.Packet) log.Fields {
+	fields := log.Fields{"size": len(packet.Data())}
+	if packet.TransportLayer() != nil {
+		fields["protocol"] = packet.TransportLayer().LayerType().String()
+	}
+	if packet.NetworkLayer() != nil {
+		src, dst := packet.NetworkLayer().NetworkFlow().Endpoints()
+		fields["src"], fields["dst"] = src.String(), dst.String()
+	}
+
+	return fields
+}
+
+// goUpWorkers starts a worker handling packets from upstream for each upstream queue. Workers exit in closing, and
+// packets still queued are abandoned as handles are closing.
+func goUpWorkers() error {
+	for i, q := range upQueues {
+		q := q
+
+		err := routines.Go(fmt.Sprintf("handle upstream %d", i), func() {
+			for {
+				var cp pcap.ConnPacket
+				select {
+				case cp = <-q:
+				case <-quit:
+					return
+				}
+
+				t := cp.Packet.Metadata().Timestamp
+				if isStale(t) {
+					drop(dropStale, "", fmt.Sprintf("inbound packet in device %s waited %s", cp.Conn.LocalDev().Alias(), time.Now().Sub(t).Truncate(time.Millisecond)))
+					continue
+				}
+
+				err := handleUpstream(cp.Packet, cp.Conn)
+				if err != nil {
+					countError(errorHandleUpstream)
+					log.With(packetFields(cp.Packet)).Errorln(fmt.Errorf("handle upstream in device %s: %w", cp.Conn.LocalDev().Alias(), err))
+					log.Verboseln(cp.Packet)
+					if dumper != nil {
+						dumper.Dump(pcap.DumpUpstream, t, cp.Packet.Data())
+					}
+					continue
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
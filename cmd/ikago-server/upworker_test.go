@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/zhxie/ikago/internal/pcap"
+	"testing"
+	"time"
+)
+
+// waitFor waits until the condition is true for a second, and returns if it is true.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return true
+}
+
+func TestUpWorkersDropStale(t *testing.T) {
+	conns := newRecordConns(1)
+	w := setupTestServer(t, conns)
+
+	prevMaxAge, prevQuit, prevQueueSize := maxAge, quit, queueSize
+	maxAge = time.Second
+	quit = make(chan struct{})
+	queueSize = 8
+	newUpQueues(1)
+	defer func() {
+		// Workers read quit until they exit
+		close(quit)
+		leaks := routines.Wait(time.Second)
+		if len(leaks) != 0 {
+			t.Errorf("leak %d routines", len(leaks))
+		}
+		maxAge, quit, queueSize = prevMaxAge, prevQuit, prevQueueSize
+		upQueues = nil
+	}()
+
+	err := handleListen(createEmbUDP(t, embSrcOf(0), testDstAddr, 64, []byte("query")), conns[0], pcap.NewEmbDecoder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := createReply(t, w.written()[0], []byte("stale"))
+	fresh := createReply(t, w.written()[0], []byte("fresh"))
+
+	err = goUpWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The packet captured before the max age is dropped however late it is handled
+	stales := dropCount(dropStale)
+	enqueueUp(pcap.ConnPacket{Packet: newUpstreamPacketAt(stale, time.Now().Add(-2*maxAge)), Conn: upConn})
+	enqueueUp(pcap.ConnPacket{Packet: newUpstreamPacketAt(fresh, time.Now()), Conn: upConn})
+
+	if !waitFor(func() bool { return len(conns[0].payloads()) >= 1 }) {
+		t.Fatal("write no payloads to the client")
+	}
+	payloads := conns[0].payloads()
+	if len(payloads) != 1 {
+		t.Fatalf("write %d payloads to the client, expect 1", len(payloads))
+	}
+	indicator, err := pcap.ParseEmbPacket(payloads[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(indicator.Payload()) != "fresh" {
+		t.Errorf("write %q to the client, expect %q", indicator.Payload(), "fresh")
+	}
+	if n := dropCount(dropStale) - stales; n != 1 {
+		t.Errorf("drop %d stale packets, expect 1", n)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/pcap"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// queueSize is the number of packets each worker queues.
+	queueSize int
+	// queuePeak is the max number of packets ever queued in a queue, which is accessed atomically
+	queuePeak int64
+)
+
+// queues holds packets from clients for workers. Packets from a client are always queued in the same queue so they are
+// handled in order.
+var queues []chan pcap.ConnBytes
+
+// newQueues creates queues for the number of workers.
+func newQueues(workers int) {
+	queues = make([]chan pcap.ConnBytes, workers)
+	for i := range queues {
+		queues[i] = make(chan pcap.ConnBytes, queueSize)
+	}
+}
+
+// queueOf returns the queue of the client.
+func queueOf(conn net.Conn) chan pcap.ConnBytes {
+	h := fnv.New32a()
+	h.Write([]byte(conn.RemoteAddr().String()))
+
+	return queues[h.Sum32()%uint32(len(queues))]
+}
+
+// enqueue queues the packet from the client. By default it never blocks, so reading from the client never stalls, and
+// the packet is dropped if the queue is full. If the queue policy is block, it waits until the queue has room.
+func enqueue(cab pcap.ConnBytes) {
+	q := queueOf(cab.Conn)
+
+	if isQueueBlock {
+		q <- cab
+	} else {
+		select {
+		case q <- cab:
+		default:
+			client := cab.Conn.RemoteAddr().String()
+			drop(dropQueueFull, client, fmt.Sprintf("packet from client %s in full queue", client))
+			return
+		}
+	}
+
+	n := int64(len(q))
+	for {
+		peak := atomic.LoadInt64(&queuePeak)
+		if n <= peak || atomic.CompareAndSwapInt64(&queuePeak, peak, n) {
+			break
+		}
+	}
+}
+
+// peakQueued returns the max number of packets ever queued in a queue.
+func peakQueued() int {
+	return int(atomic.LoadInt64(&queuePeak))
+}
+
+// queued returns the number of packets queued in all queues.
+func queued() int {
+	n := 0
+	for _, q := range queues {
+		n = n + len(q)
+	}
+
+	return n
+}
+
+// closeQueues closes all queues so workers exit after handling queued packets.
+func closeQueues() {
+	for _, q := range queues {
+		close(q)
+	}
+}
+
+// goWorkers starts a worker handling packets from clients with the handler for each queue, which is handleListen
+// except in tests.
+func goWorkers(handle func(contents []byte, conn net.Conn, decoder *pcap.Decoder) error) error {
+	for i, q := range queues {
+		q := q
+		// Each worker decodes packets in its own decoder
+		decoder := pcap.NewEmbDecoder()
+
+		handlers.Add(1)
+		err := routines.Go(fmt.Sprintf("handle listen %d", i), func() {
+			defer handlers.Done()
+			defer exitListen()
+
+			// Packets are handled until the queue is closed, so queued packets are drained in closing
+			for cab := range q {
+				if isStale(cab.Time) {
+					drop(dropStale, cab.Conn.RemoteAddr().String(), fmt.Sprintf("outbound packet from client %s waited %s", cab.Conn.RemoteAddr().String(), time.Now().Sub(cab.Time).Truncate(time.Millisecond)))
+					continue
+				}
+
+				err := handle(cab.Bytes, cab.Conn, decoder)
+				if err != nil {
+					countError(errorHandleListen)
+					log.With(log.Fields{"client": cab.Conn.RemoteAddr().String(), "size": len(cab.Bytes)}).Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
+					log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
+					if dumper != nil {
+						dumper.Dump(pcap.DumpListen, cab.Time, cab.Bytes)
+					}
+					continue
+				}
+			}
+		})
+		if err != nil {
+			handlers.Done()
+			return err
+		}
+	}
+
+	return nil
+}
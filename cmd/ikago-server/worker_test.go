@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/zhxie/ikago/internal/pcap"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConn describes a connection from a client which is only used for its addresses.
+type testConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *testConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func newTestConns(n int) []net.Conn {
+	conns := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		conns = append(conns, &testConn{addr: &net.TCPAddr{IP: net.IPv4(10, 0, 1, byte(i+1)), Port: 50000 + i}})
+	}
+
+	return conns
+}
+
+// runWorkers runs the number of workers with the handler and queues the number of packets from each client to them in
+// turn. Each packet contains its index in the client.
+func runWorkers(workers, packets int, conns []net.Conn, handle func(contents []byte, conn net.Conn, decoder *pcap.Decoder) error) error {
+	queueSize = packets
+	isQueueBlock = true
+	defer func() {
+		queues = nil
+		isQueueBlock = false
+	}()
+
+	newQueues(workers)
+	err := goWorkers(handle)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < packets; i++ {
+		for _, conn := range conns {
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, uint32(i))
+			enqueue(pcap.ConnBytes{Bytes: b, Conn: conn})
+		}
+	}
+
+	closeQueues()
+	handlers.Wait()
+
+	return nil
+}
+
+func TestWorkersOrder(t *testing.T) {
+	const packets = 500
+	conns := newTestConns(16)
+
+	var lock sync.Mutex
+	handled := make(map[string][]uint32)
+	workers := make(map[string]map[*pcap.Decoder]bool)
+
+	err := runWorkers(4, packets, conns, func(contents []byte, conn net.Conn, decoder *pcap.Decoder) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		client := conn.RemoteAddr().String()
+		handled[client] = append(handled[client], binary.BigEndian.Uint32(contents))
+		if workers[client] == nil {
+			workers[client] = make(map[*pcap.Decoder]bool)
+		}
+		workers[client][decoder] = true
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoders := make(map[*pcap.Decoder]bool)
+	for _, conn := range conns {
+		client := conn.RemoteAddr().String()
+		if len(handled[client]) != packets {
+			t.Fatalf("client %s: handled %d packets, expect %d", client, len(handled[client]), packets)
+		}
+		for i, n := range handled[client] {
+			if n != uint32(i) {
+				t.Fatalf("client %s: packet %d handled at %d", client, n, i)
+			}
+		}
+		if len(workers[client]) != 1 {
+			t.Errorf("client %s: handled by %d workers, expect 1", client, len(workers[client]))
+		}
+		for decoder := range workers[client] {
+			decoders[decoder] = true
+		}
+	}
+	if len(decoders) < 2 {
+		t.Errorf("%d clients handled by %d workers, expect more", len(conns), len(decoders))
+	}
+}
+
+// BenchmarkWorkers handles packets from 4 clients in workers, each of which hashes the packet like decrypting.
+func BenchmarkWorkers(b *testing.B) {
+	conns := newTestConns(4)
+	payload := make([]byte, 1400)
+
+	for _, workers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(payload) * len(conns)))
+			b.ResetTimer()
+
+			err := runWorkers(workers, b.N, conns, func(contents []byte, conn net.Conn, decoder *pcap.Decoder) error {
+				for i := 0; i < 16; i++ {
+					sha256.Sum256(payload)
+				}
+
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWorkersDropStale(t *testing.T) {
+	conns := newTestConns(1)
+
+	prevMaxAge := maxAge
+	maxAge = time.Second
+	queueSize = 8
+	defer func() {
+		maxAge = prevMaxAge
+		queues = nil
+	}()
+
+	var lock sync.Mutex
+	handled := make([]string, 0)
+
+	newQueues(1)
+	err := goWorkers(func(contents []byte, conn net.Conn, decoder *pcap.Decoder) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		handled = append(handled, string(contents))
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The packet received before the max age is dropped however late it is handled, and packets without timestamps are
+	// never stale
+	stales := dropCount(dropStale)
+	enqueue(pcap.ConnBytes{Bytes: []byte("stale"), Conn: conns[0], Time: time.Now().Add(-2 * maxAge)})
+	enqueue(pcap.ConnBytes{Bytes: []byte("fresh"), Conn: conns[0], Time: time.Now()})
+	enqueue(pcap.ConnBytes{Bytes: []byte("untimed"), Conn: conns[0]})
+	closeQueues()
+	handlers.Wait()
+
+	if len(handled) != 2 || handled[0] != "fresh" || handled[1] != "untimed" {
+		t.Errorf("handle %v, expect [fresh untimed]", handled)
+	}
+	if n := dropCount(dropStale) - stales; n != 1 {
+		t.Errorf("drop %d stale packets, expect 1", n)
+	}
+}
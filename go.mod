@@ -1,6 +1,6 @@
 module github.com/zhxie/ikago
 
-go 1.13
+go 1.16
 
 require (
 	github.com/google/gopacket v1.1.17
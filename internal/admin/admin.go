@@ -0,0 +1,214 @@
+package admin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Handler describes the handler of a command. Arguments exclude the name of the command.
+type Handler func(args []string) (string, error)
+
+type command struct {
+	usage      string
+	handler    Handler
+	isMutating bool
+}
+
+// Admin describes an admin interface which serves commands in a Unix socket.
+type Admin struct {
+	lock          sync.RWMutex
+	path          string
+	listener      net.Listener
+	commands      map[string]*command
+	allowMutating bool
+	isClosed      bool
+}
+
+// NewAdmin returns a new admin interface. Mutating commands are refused unless they are allowed.
+func NewAdmin(allowMutating bool) *Admin {
+	admin := &Admin{
+		commands:      make(map[string]*command),
+		allowMutating: allowMutating,
+	}
+
+	admin.Register("help", "help", admin.help)
+
+	return admin
+}
+
+// Register registers a read-only command.
+func (admin *Admin) Register(name string, usage string, handler Handler) {
+	admin.register(name, usage, handler, false)
+}
+
+// RegisterMutating registers a command which may change the state.
+func (admin *Admin) RegisterMutating(name string, usage string, handler Handler) {
+	admin.register(name, usage, handler, true)
+}
+
+func (admin *Admin) register(name string, usage string, handler Handler, isMutating bool) {
+	admin.lock.Lock()
+	defer admin.lock.Unlock()
+
+	admin.commands[name] = &command{
+		usage:      usage,
+		handler:    handler,
+		isMutating: isMutating,
+	}
+}
+
+// Listen listens on the Unix socket in the given path.
+func (admin *Admin) Listen(path string) error {
+	// Remove stale socket
+	fi, err := os.Stat(path)
+	if err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s is not a socket", path)
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("remove: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	// Only the owner is allowed to access
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("chmod: %w", err)
+	}
+
+	admin.lock.Lock()
+	admin.path = path
+	admin.listener = listener
+	admin.lock.Unlock()
+
+	return nil
+}
+
+// Serve accepts connections and serves commands until the admin interface is closed.
+func (admin *Admin) Serve() error {
+	admin.lock.RLock()
+	listener := admin.listener
+	admin.lock.RUnlock()
+
+	if listener == nil {
+		return errors.New("not listening")
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			admin.lock.RLock()
+			isClosed := admin.isClosed
+			admin.lock.RUnlock()
+			if isClosed {
+				return nil
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+
+		go admin.serveConn(conn)
+	}
+}
+
+func (admin *Admin) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return
+		}
+
+		s, err := admin.Execute(fields[0], fields[1:])
+		if err != nil {
+			s = fmt.Sprintf("error: %s\n", err)
+		}
+		if s != "" && !strings.HasSuffix(s, "\n") {
+			s = s + "\n"
+		}
+
+		_, err = conn.Write([]byte(s))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Execute executes a command with arguments and returns its output.
+func (admin *Admin) Execute(name string, args []string) (string, error) {
+	admin.lock.RLock()
+	cmd, ok := admin.commands[name]
+	allowMutating := admin.allowMutating
+	admin.lock.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("unknown command %s", name)
+	}
+	if cmd.isMutating && !allowMutating {
+		return "", fmt.Errorf("command %s is not allowed in read-only mode", name)
+	}
+
+	return cmd.handler(args)
+}
+
+func (admin *Admin) help(args []string) (string, error) {
+	admin.lock.RLock()
+	defer admin.lock.RUnlock()
+
+	names := make([]string, 0)
+	for name := range admin.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sb := strings.Builder{}
+	for _, name := range names {
+		cmd := admin.commands[name]
+		if cmd.isMutating && !admin.allowMutating {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("%s\n", cmd.usage))
+	}
+
+	return sb.String(), nil
+}
+
+// Close closes the admin interface and removes the socket.
+func (admin *Admin) Close() error {
+	admin.lock.Lock()
+	defer admin.lock.Unlock()
+
+	admin.isClosed = true
+	if admin.listener == nil {
+		return nil
+	}
+
+	// The socket file is removed by the listener
+	return admin.listener.Close()
+}
+
+// Path returns the path of the Unix socket.
+func (admin *Admin) Path() string {
+	admin.lock.RLock()
+	defer admin.lock.RUnlock()
+
+	return admin.path
+}
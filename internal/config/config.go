@@ -7,40 +7,112 @@
 	"fmt"
 	"os"
 	"regexp"
+	"time"
 )
 
 // Config describes the configuration of IkaGo.
 type Config struct {
-	ListenDevs  []string  `json:"listen-devices"`
-	UpDev       string    `json:"upstream-device"`
-	Gateway     string    `json:"gateway"`
-	Mode        string    `json:"mode"`
-	Method      string    `json:"method"`
-	Password    string    `json:"password"`
-	Rule        bool      `json:"rule"`
-	Monitor     int       `json:"monitor"`
-	Verbose     bool      `json:"verbose"`
-	Log         string    `json:"log"`
-	MTU         int       `json:"mtu"`
-	KCP         bool      `json:"kcp"`
-	KCPConfig   KCPConfig `json:"kcp-tuning"`
-	Fragment    int       `json:"fragment"`
-	Port        int       `json:"port"`
-	Publish     string    `json:"publish"`
-	Sources     []string  `json:"sources"`
-	Server      string    `json:"server"`
-	Destination string    `json:"destination"`
+	ListenDevs      []string        `json:"listen-devices"`
+	ListenIPs       []string        `json:"listen-ips"`
+	UpDev           string          `json:"upstream-device"`
+	Gateway         string          `json:"gateway"`
+	Mode            string          `json:"mode"`
+	Method          string          `json:"method"`
+	Password        string          `json:"password"`
+	ExtraPasswords  []string        `json:"extra-passwords"`
+	Rule            bool            `json:"rule"`
+	NoFirewallRule  bool            `json:"no-firewall-rule"`
+	Monitor         int             `json:"monitor"`
+	Metrics         string          `json:"metrics"`
+	Verbose         bool            `json:"verbose"`
+	Log             string          `json:"log"`
+	LogJSON         bool            `json:"log-json"`
+	LogLevel        string          `json:"log-level"`
+	MTU             Bytes           `json:"mtu"`
+	KCP             bool            `json:"kcp"`
+	KCPConfig       KCPConfig       `json:"kcp-tuning"`
+	Disguise        bool            `json:"disguise"`
+	DisguiseConfig  DisguiseConfig  `json:"disguise-tuning"`
+	Padding         bool            `json:"padding"`
+	Bucket          bool            `json:"bucket"`
+	Fragment        Bytes           `json:"fragment"`
+	Port            int             `json:"port"`
+	Ports           []int           `json:"ports"`
+	Publish         string          `json:"publish"`
+	Sources         []string        `json:"sources"`
+	Server          string          `json:"server"`
+	Destination     string          `json:"destination"`
+	Admin           string          `json:"admin"`
+	AdminWrite      bool            `json:"admin-write"`
+	MaxFlows        int             `json:"max-flows"`
+	NAT             string          `json:"nat"`
+	FallbackUpDev   string          `json:"fallback-upstream-device"`
+	FallbackGateway string          `json:"fallback-gateway"`
+	UpstreamProbe   Duration        `json:"upstream-probe"`
+	GatewayRefresh  Duration        `json:"gateway-refresh"`
+	TTL             int             `json:"ttl"`
+	Exclusive       bool            `json:"exclusive"`
+	MinStrength     int             `json:"min-strength"`
+	Discovery       bool            `json:"discovery"`
+	Discover        bool            `json:"discover"`
+	MaxAge          Milliseconds    `json:"max-age"`
+	NATSweep        Duration        `json:"nat-sweep"`
+	TCPPorts        string          `json:"tcp-ports"`
+	UDPPorts        string          `json:"udp-ports"`
+	TCPTimeout      Duration        `json:"tcp-timeout"`
+	UDPTimeout      Duration        `json:"udp-timeout"`
+	ICMPTimeout     Duration        `json:"icmp-timeout"`
+	ClientTimeout   Duration        `json:"client-timeout"`
+	KeepAlive       Seconds         `json:"keepalive"`
+	User            string          `json:"user"`
+	KeepNetRaw      bool            `json:"keep-net-raw"`
+	RateLimit       Rate            `json:"rate-limit"`
+	RateLimits      map[string]Rate `json:"rate-limits"`
+	Hooks           []HookConfig    `json:"hooks"`
+	MaxClients      int             `json:"max-clients"`
+	EvictClients    bool            `json:"evict-clients"`
+	AllowNoHello    bool            `json:"allow-no-hello"`
+	ResetUnauth     bool            `json:"reset-unauthenticated"`
+	Socks           string          `json:"socks"`
+	HealthWindow    Duration        `json:"health-window"`
+	ListenWorkers   int             `json:"listen-workers"`
+	UpWorkers       int             `json:"upstream-workers"`
+	UpReaders       int             `json:"upstream-readers"`
+	QueueSize       int             `json:"queue-size"`
+	QueuePolicy     string          `json:"queue-policy"`
+	DryRun          bool            `json:"dry-run"`
+	Dump            string          `json:"dump"`
+	DumpInjected    bool            `json:"dump-injected"`
+	Allow           []string        `json:"allow"`
+	Deny            []string        `json:"deny"`
+	DenyRST         bool            `json:"deny-rst"`
+	AllowedClients  []string        `json:"allowed-clients"`
 }
 
 // NewConfig returns a new config.
 func NewConfig() *Config {
 	return &Config{
-		Mode:      "faketcp",
-		Method:    "plain",
-		MTU:       1500,
-		KCPConfig: *NewKCPConfig(),
-		Fragment:  1500,
-		Sources:   make([]string, 0),
+		Mode:           "faketcp",
+		Method:         "plain",
+		MTU:            1500,
+		KCPConfig:      *NewKCPConfig(),
+		DisguiseConfig: *NewDisguiseConfig(),
+		Fragment:       1500,
+		Sources:        make([]string, 0),
+		Ports:          make([]int, 0),
+		NAT:            "restricted",
+		MaxAge:         Milliseconds(300 * time.Millisecond),
+		NATSweep:       Duration(30 * time.Second),
+		TCPPorts:       "49152-65535",
+		UDPPorts:       "49152-65535",
+		TCPTimeout:     Duration(7440 * time.Second),
+		UDPTimeout:     Duration(300 * time.Second),
+		ICMPTimeout:    Duration(60 * time.Second),
+		RateLimits:     make(map[string]Rate),
+		Hooks:          make([]HookConfig, 0),
+		QueueSize:      1000,
+		QueuePolicy:    "drop",
+		UpReaders:      1,
 	}
 }
 
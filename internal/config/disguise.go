@@ -0,0 +1,21 @@
+package config
+
+// DisguiseConfig describes TCP options in handshakes disguising connections.
+type DisguiseConfig struct {
+	Window      int  `json:"window"`
+	MSS         int  `json:"mss"`
+	WindowScale int  `json:"wscale"`
+	SACK        bool `json:"sack"`
+	Timestamps  bool `json:"timestamps"`
+}
+
+// NewDisguiseConfig returns a new disguise config, which looks like handshakes of Linux in Ethernet.
+func NewDisguiseConfig() *DisguiseConfig {
+	return &DisguiseConfig{
+		Window:      64240,
+		MSS:         1460,
+		WindowScale: 7,
+		SACK:        true,
+		Timestamps:  true,
+	}
+}
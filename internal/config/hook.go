@@ -0,0 +1,9 @@
+package config
+
+// HookConfig describes a hook which sends events of the types to a command, a webhook or an event log.
+type HookConfig struct {
+	Events  []string `json:"events"`
+	Command string   `json:"command"`
+	Webhook string   `json:"webhook"`
+	File    string   `json:"file"`
+}
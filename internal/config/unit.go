@@ -0,0 +1,469 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size describes a size in bytes with units like "1500B", "10MB" and "1.5GiB". Bare numbers other than 0 are refused as
+// their units are ambiguous.
+type Size int
+
+// Bytes describes a size of options taking bare numbers in bytes before units, which still accepts them.
+type Bytes Size
+
+var sizeUnits = map[string]float64{
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+var unitRegexp = regexp.MustCompile(`^\s*([0-9]+(?:\.[0-9]+)?)\s*([a-zA-Zµ/]*)\s*$`)
+
+// ParseSize returns the size parsed from a string.
+func ParseSize(s string) (Size, error) {
+	return parseSize(s, 0)
+}
+
+// parseSize returns the size parsed from a string, in which bare numbers are in the unit, or refused if the unit is 0.
+func parseSize(s string, bare Size) (Size, error) {
+	matches := unitRegexp.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+
+	if matches[2] == "" {
+		n, err := strconv.Atoi(matches[1])
+		if err != nil || (n != 0 && bare == 0) {
+			return 0, fmt.Errorf("missing unit in size %s", s)
+		}
+
+		return Size(n) * bare, nil
+	}
+
+	unit, ok := sizeUnits[strings.ToLower(matches[2])]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %s in size %s", matches[2], s)
+	}
+
+	n, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse: %w", err)
+	}
+	n = n * unit
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("size %s out of range", s)
+	}
+
+	return Size(math.Round(n)), nil
+}
+
+// unmarshalSize returns the size unmarshaled from JSON, in which bare numbers are in the unit, or refused if the unit
+// is 0.
+func unmarshalSize(b []byte, bare Size) (Size, error) {
+	var n int
+	err := json.Unmarshal(b, &n)
+	if err == nil {
+		if n != 0 && bare == 0 {
+			return 0, fmt.Errorf("missing unit in size %d", n)
+		}
+
+		return Size(n) * bare, nil
+	}
+
+	var str string
+	err = json.Unmarshal(b, &str)
+	if err != nil {
+		return 0, errors.New("size must be a string")
+	}
+
+	return parseSize(str, bare)
+}
+
+func (s Size) String() string {
+	for _, unit := range []string{"GiB", "MiB", "KiB", "GB", "MB", "KB"} {
+		n := int(sizeUnits[strings.ToLower(unit)])
+		if s != 0 && int(s)%n == 0 {
+			return fmt.Sprintf("%d%s", int(s)/n, unit)
+		}
+	}
+
+	return fmt.Sprintf("%dB", int(s))
+}
+
+// Set sets the size from a flag.
+func (s *Size) Set(value string) error {
+	size, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+
+	*s = size
+
+	return nil
+}
+
+func (s Size) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Size) UnmarshalJSON(b []byte) error {
+	size, err := unmarshalSize(b, 0)
+	if err != nil {
+		return err
+	}
+
+	*s = size
+
+	return nil
+}
+
+// SizeFlag defines a size flag with the name, default value and usage.
+func SizeFlag(name string, value Size, usage string) *Size {
+	p := new(Size)
+	*p = value
+	flag.Var(p, name, usage)
+
+	return p
+}
+
+func (s Bytes) String() string {
+	return Size(s).String()
+}
+
+// Set sets the size from a flag.
+func (s *Bytes) Set(value string) error {
+	size, err := parseSize(value, 1)
+	if err != nil {
+		return err
+	}
+
+	*s = Bytes(size)
+
+	return nil
+}
+
+func (s Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Bytes) UnmarshalJSON(b []byte) error {
+	size, err := unmarshalSize(b, 1)
+	if err != nil {
+		return err
+	}
+
+	*s = Bytes(size)
+
+	return nil
+}
+
+// BytesFlag defines a size flag of options taking bare numbers in bytes with the name, default value and usage.
+func BytesFlag(name string, value Bytes, usage string) *Bytes {
+	p := new(Bytes)
+	*p = value
+	flag.Var(p, name, usage)
+
+	return p
+}
+
+// Rate describes a rate in bytes per second with units like "100Mbps", "1MB/s" and "512KiB/s". Bare numbers other
+// than 0 are refused as their units are ambiguous.
+type Rate int
+
+var rateUnits = map[string]float64{
+	"bps":   1.0 / 8,
+	"kbps":  1e3 / 8,
+	"Kbps":  1e3 / 8,
+	"Mbps":  1e6 / 8,
+	"Gbps":  1e9 / 8,
+	"B/s":   1,
+	"kB/s":  1e3,
+	"KB/s":  1e3,
+	"MB/s":  1e6,
+	"GB/s":  1e9,
+	"KiB/s": 1 << 10,
+	"MiB/s": 1 << 20,
+	"GiB/s": 1 << 30,
+}
+
+// ParseRate returns the rate parsed from a string.
+func ParseRate(s string) (Rate, error) {
+	matches := unitRegexp.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid rate %s", s)
+	}
+
+	n, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse: %w", err)
+	}
+	if matches[2] == "" {
+		if n != 0 {
+			return 0, fmt.Errorf("missing unit in rate %s", s)
+		}
+
+		return 0, nil
+	}
+
+	unit, ok := rateUnits[matches[2]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %s in rate %s", matches[2], s)
+	}
+	n = n * unit
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("rate %s out of range", s)
+	}
+
+	return Rate(math.Round(n)), nil
+}
+
+func (r Rate) String() string {
+	for _, unit := range []string{"Gbps", "Mbps", "kbps", "GiB/s", "MiB/s", "KiB/s"} {
+		n := rateUnits[unit]
+		if r != 0 && math.Mod(float64(r), n) == 0 {
+			return fmt.Sprintf("%d%s", int(float64(r)/n), unit)
+		}
+	}
+
+	return fmt.Sprintf("%dB/s", int(r))
+}
+
+// Set sets the rate from a flag.
+func (r *Rate) Set(value string) error {
+	rate, err := ParseRate(value)
+	if err != nil {
+		return err
+	}
+
+	*r = rate
+
+	return nil
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	var n int
+	err := json.Unmarshal(b, &n)
+	if err == nil {
+		if n != 0 {
+			return fmt.Errorf("missing unit in rate %d", n)
+		}
+
+		*r = 0
+		return nil
+	}
+
+	var str string
+	err = json.Unmarshal(b, &str)
+	if err != nil {
+		return errors.New("rate must be a string")
+	}
+
+	return r.Set(str)
+}
+
+// RateFlag defines a rate flag with the name, default value and usage.
+func RateFlag(name string, value Rate, usage string) *Rate {
+	p := new(Rate)
+	*p = value
+	flag.Var(p, name, usage)
+
+	return p
+}
+
+// Duration describes a duration like "300ms", "30s" and "5m". Bare numbers other than 0 are refused as their units are
+// ambiguous.
+type Duration time.Duration
+
+// Milliseconds describes a duration of options taking bare numbers in milliseconds before units, which still accepts
+// them.
+type Milliseconds Duration
+
+// Seconds describes a duration of options taking bare numbers in seconds before units, which still accepts them.
+type Seconds Duration
+
+// ParseDuration returns the duration parsed from a string.
+func ParseDuration(s string) (Duration, error) {
+	return parseDuration(s, 0)
+}
+
+// parseDuration returns the duration parsed from a string, in which bare numbers are in the unit, or refused if the
+// unit is 0.
+func parseDuration(s string, bare time.Duration) (Duration, error) {
+	s = strings.TrimSpace(s)
+
+	n, err := strconv.Atoi(s)
+	if err == nil {
+		if n != 0 && bare == 0 {
+			return 0, fmt.Errorf("missing unit in duration %s", s)
+		}
+
+		return Duration(time.Duration(n) * bare), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %s", s)
+	}
+
+	return Duration(d), nil
+}
+
+// unmarshalDuration returns the duration unmarshaled from JSON, in which bare numbers are in the unit, or refused if
+// the unit is 0.
+func unmarshalDuration(b []byte, bare time.Duration) (Duration, error) {
+	var n int
+	err := json.Unmarshal(b, &n)
+	if err == nil {
+		if n != 0 && bare == 0 {
+			return 0, fmt.Errorf("missing unit in duration %d", n)
+		}
+
+		return Duration(time.Duration(n) * bare), nil
+	}
+
+	var str string
+	err = json.Unmarshal(b, &str)
+	if err != nil {
+		return 0, errors.New("duration must be a string")
+	}
+
+	return parseDuration(str, bare)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set sets the duration from a flag.
+func (d *Duration) Set(value string) error {
+	duration, err := ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = duration
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	duration, err := unmarshalDuration(b, 0)
+	if err != nil {
+		return err
+	}
+
+	*d = duration
+
+	return nil
+}
+
+// DurationFlag defines a duration flag with the name, default value and usage.
+func DurationFlag(name string, value Duration, usage string) *Duration {
+	p := new(Duration)
+	*p = value
+	flag.Var(p, name, usage)
+
+	return p
+}
+
+func (d Milliseconds) String() string {
+	return time.Duration(d).String()
+}
+
+// Set sets the duration from a flag.
+func (d *Milliseconds) Set(value string) error {
+	duration, err := parseDuration(value, time.Millisecond)
+	if err != nil {
+		return err
+	}
+
+	*d = Milliseconds(duration)
+
+	return nil
+}
+
+func (d Milliseconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Milliseconds) UnmarshalJSON(b []byte) error {
+	duration, err := unmarshalDuration(b, time.Millisecond)
+	if err != nil {
+		return err
+	}
+
+	*d = Milliseconds(duration)
+
+	return nil
+}
+
+// MillisecondsFlag defines a duration flag of options taking bare numbers in milliseconds with the name, default value
+// and usage.
+func MillisecondsFlag(name string, value Milliseconds, usage string) *Milliseconds {
+	p := new(Milliseconds)
+	*p = value
+	flag.Var(p, name, usage)
+
+	return p
+}
+
+func (d Seconds) String() string {
+	return time.Duration(d).String()
+}
+
+// Set sets the duration from a flag.
+func (d *Seconds) Set(value string) error {
+	duration, err := parseDuration(value, time.Second)
+	if err != nil {
+		return err
+	}
+
+	*d = Seconds(duration)
+
+	return nil
+}
+
+func (d Seconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Seconds) UnmarshalJSON(b []byte) error {
+	duration, err := unmarshalDuration(b, time.Second)
+	if err != nil {
+		return err
+	}
+
+	*d = Seconds(duration)
+
+	return nil
+}
+
+// SecondsFlag defines a duration flag of options taking bare numbers in seconds with the name, default value and
+// usage.
+func SecondsFlag(name string, value Seconds, usage string) *Seconds {
+	p := new(Seconds)
+	*p = value
+	flag.Var(p, name, usage)
+
+	return p
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalUnits(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		isErr bool
+		want  Config
+	}{
+		{name: "legacy bare numbers", json: `{"mtu": 1400, "max-age": 300, "keepalive": 20}`,
+			want: Config{MTU: 1400, MaxAge: Milliseconds(300 * time.Millisecond), KeepAlive: Seconds(20 * time.Second)}},
+		{name: "legacy units", json: `{"mtu": "1.5KiB", "max-age": "1s", "keepalive": "500ms"}`,
+			want: Config{MTU: 1536, MaxAge: Milliseconds(time.Second), KeepAlive: Seconds(500 * time.Millisecond)}},
+		{name: "units", json: `{"client-timeout": "5m", "rate-limit": "100Mbps", "rate-limits": {"192.168.1.2": "1MiB/s"}}`,
+			want: Config{ClientTimeout: Duration(5 * time.Minute), RateLimit: 12500000, RateLimits: map[string]Rate{"192.168.1.2": 1 << 20}}},
+		{name: "bare zeros", json: `{"client-timeout": 0, "rate-limit": 0, "nat-sweep": "0"}`, want: Config{}},
+		{name: "bare duration", json: `{"client-timeout": 30}`, isErr: true},
+		{name: "bare rate", json: `{"rate-limit": 1000}`, isErr: true},
+		{name: "bare rate string", json: `{"rate-limit": "1000"}`, isErr: true},
+		{name: "size as rate", json: `{"rate-limit": "1MB"}`, isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cfg Config
+			err := json.Unmarshal([]byte(test.json), &cfg)
+			if test.isErr {
+				if err == nil {
+					t.Fatal("unmarshal without error")
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.MTU != test.want.MTU || cfg.MaxAge != test.want.MaxAge || cfg.KeepAlive != test.want.KeepAlive ||
+				cfg.ClientTimeout != test.want.ClientTimeout || cfg.RateLimit != test.want.RateLimit ||
+				len(cfg.RateLimits) != len(test.want.RateLimits) {
+				t.Fatalf("unmarshal %+v, expect %+v", cfg, test.want)
+			}
+			for addr, rate := range test.want.RateLimits {
+				if cfg.RateLimits[addr] != rate {
+					t.Fatalf("rate limit of %s %s, expect %s", addr, cfg.RateLimits[addr], rate)
+				}
+			}
+		})
+	}
+}
+
+func TestRateString(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "100Mbps", want: "100Mbps"},
+		{s: "1MB/s", want: "8Mbps"},
+		{s: "1MiB/s", want: "1MiB/s"},
+		{s: "3B/s", want: "3B/s"},
+		{s: "0", want: "0B/s"},
+	}
+
+	for _, test := range tests {
+		r, err := ParseRate(test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.String() != test.want {
+			t.Fatalf("rate %s printed as %s, expect %s", test.s, r, test.want)
+		}
+
+		// Printed rates parse back
+		back, err := ParseRate(r.String())
+		if err != nil || back != r {
+			t.Fatalf("rate %s parsed back as %s: %v", r, back, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// sealTo appends a random nonce and the sealed data to the buffer.
+func sealTo(aead cipher.AEAD, dst, data []byte) ([]byte, error) {
+	size := aead.NonceSize()
+
+	n := len(dst)
+	if cap(dst)-n < size {
+		dst = append(dst, make([]byte, size)...)
+	} else {
+		dst = dst[:n+size]
+	}
+	nonce := dst[n:]
+
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	return aead.Seal(dst, nonce, data, nil), nil
+}
+
+// openTo appends the opened data to the buffer.
+func openTo(aead cipher.AEAD, dst, data []byte) ([]byte, error) {
+	size := aead.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("missing nonce")
+	}
+	nonce := data[:size]
+
+	result, err := aead.Open(dst, nonce, data[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	return result, nil
+}
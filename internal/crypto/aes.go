@@ -3,7 +3,6 @@
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"errors"
 	"fmt"
 )
 
@@ -78,10 +77,16 @@ func (c *AESCFBCrypt) Cost() int {
 	return 0
 }
 
+func (c *AESCFBCrypt) Strength() int {
+	// AES-CFB is not authenticated
+	return 0
+}
+
 // AESGCMCrypt describes an AES-GCM crypt.
 type AESGCMCrypt struct {
-	block cipher.Block
-	aead  cipher.AEAD
+	block   cipher.Block
+	aead    cipher.AEAD
+	keySize int
 }
 
 // CreateAESGCMCrypt returns an AES-GCM crypt by given key.
@@ -99,36 +104,26 @@ func CreateAESGCMCrypt(key []byte) (*AESGCMCrypt, error) {
 	}
 
 	return &AESGCMCrypt{
-		block: block,
-		aead:  aead,
+		block:   block,
+		aead:    aead,
+		keySize: len(key),
 	}, nil
 }
 
 func (c *AESGCMCrypt) Encrypt(data []byte) ([]byte, error) {
-	nonce, err := GenerateNonce(c.aead.NonceSize())
-	if err != nil {
-		return nil, fmt.Errorf("generate nonce: %w", err)
-	}
-
-	result := c.aead.Seal(nil, nonce, data, nil)
-	result = append(nonce, result...)
+	return sealTo(c.aead, nil, data)
+}
 
-	return result, nil
+func (c *AESGCMCrypt) EncryptTo(dst, data []byte) ([]byte, error) {
+	return sealTo(c.aead, dst, data)
 }
 
 func (c *AESGCMCrypt) Decrypt(data []byte) ([]byte, error) {
-	size := c.aead.NonceSize()
-	if len(data) < size {
-		return nil, errors.New("missing nonce")
-	}
-	nonce := data[:size]
-
-	result, err := c.aead.Open(nil, nonce, data[size:], nil)
-	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
-	}
+	return openTo(c.aead, nil, data)
+}
 
-	return result, nil
+func (c *AESGCMCrypt) DecryptTo(dst, data []byte) ([]byte, error) {
+	return openTo(c.aead, dst, data)
 }
 
 func (c *AESGCMCrypt) Method() Method {
@@ -138,3 +133,7 @@ func (c *AESGCMCrypt) Method() Method {
 func (c *AESGCMCrypt) Cost() int {
 	return c.aead.NonceSize() + 16
 }
+
+func (c *AESGCMCrypt) Strength() int {
+	return c.keySize * 8
+}
@@ -2,7 +2,6 @@
 
 import (
 	"crypto/cipher"
-	"errors"
 	"fmt"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/poly1305"
@@ -25,30 +24,19 @@ func CreateChaCha20Poly1305Crypt(key []byte) (*ChaCha20Poly1305Crypt, error) {
 }
 
 func (c *ChaCha20Poly1305Crypt) Encrypt(data []byte) ([]byte, error) {
-	nonce, err := GenerateNonce(c.aead.NonceSize())
-	if err != nil {
-		return nil, fmt.Errorf("generate nonce: %w", err)
-	}
-
-	result := c.aead.Seal(nil, nonce, data, nil)
-	result = append(nonce, result...)
+	return sealTo(c.aead, nil, data)
+}
 
-	return result, nil
+func (c *ChaCha20Poly1305Crypt) EncryptTo(dst, data []byte) ([]byte, error) {
+	return sealTo(c.aead, dst, data)
 }
 
 func (c *ChaCha20Poly1305Crypt) Decrypt(data []byte) ([]byte, error) {
-	size := c.aead.NonceSize()
-	if len(data) < size {
-		return nil, errors.New("missing nonce")
-	}
-	nonce := data[:size]
-
-	result, err := c.aead.Open(nil, nonce, data[size:], nil)
-	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
-	}
+	return openTo(c.aead, nil, data)
+}
 
-	return result, nil
+func (c *ChaCha20Poly1305Crypt) DecryptTo(dst, data []byte) ([]byte, error) {
+	return openTo(c.aead, dst, data)
 }
 
 func (c *ChaCha20Poly1305Crypt) Method() Method {
@@ -59,6 +47,10 @@ func (c *ChaCha20Poly1305Crypt) Cost() int {
 	return c.aead.NonceSize() + poly1305.TagSize
 }
 
+func (c *ChaCha20Poly1305Crypt) Strength() int {
+	return chacha20poly1305.KeySize * 8
+}
+
 // XChaCha20Poly1305Crypt describes an XChaCha20-Poly1305 crypt.
 type XChaCha20Poly1305Crypt struct {
 	aead cipher.AEAD
@@ -76,30 +68,19 @@ func CreateXChaCha20Poly1305Crypt(key []byte) (*XChaCha20Poly1305Crypt, error) {
 }
 
 func (c *XChaCha20Poly1305Crypt) Encrypt(data []byte) ([]byte, error) {
-	nonce, err := GenerateNonce(c.aead.NonceSize())
-	if err != nil {
-		return nil, fmt.Errorf("generate nonce: %w", err)
-	}
-
-	result := c.aead.Seal(nil, nonce, data, nil)
-	result = append(nonce, result...)
+	return sealTo(c.aead, nil, data)
+}
 
-	return result, nil
+func (c *XChaCha20Poly1305Crypt) EncryptTo(dst, data []byte) ([]byte, error) {
+	return sealTo(c.aead, dst, data)
 }
 
 func (c *XChaCha20Poly1305Crypt) Decrypt(data []byte) ([]byte, error) {
-	size := c.aead.NonceSize()
-	if len(data) < size {
-		return nil, errors.New("missing nonce")
-	}
-	nonce := data[:size]
-
-	result, err := c.aead.Open(nil, nonce, data[size:], nil)
-	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
-	}
+	return openTo(c.aead, nil, data)
+}
 
-	return result, nil
+func (c *XChaCha20Poly1305Crypt) DecryptTo(dst, data []byte) ([]byte, error) {
+	return openTo(c.aead, dst, data)
 }
 
 func (c *XChaCha20Poly1305Crypt) Method() Method {
@@ -109,3 +90,7 @@ func (c *XChaCha20Poly1305Crypt) Method() Method {
 func (c *XChaCha20Poly1305Crypt) Cost() int {
 	return c.aead.NonceSize() + poly1305.TagSize
 }
+
+func (c *XChaCha20Poly1305Crypt) Strength() int {
+	return chacha20poly1305.KeySize * 8
+}
@@ -49,6 +49,8 @@ type Crypt interface {
 	Method() Method
 	// Cost returns the size of cost.
 	Cost() int
+	// Strength returns the strength of crypt in bits. Crypts without authentication are considered as 0 bits.
+	Strength() int
 }
 
 // StreamCrypt describes a crypt which can be used in stream encryption, which means the plaintext and the ciphertext have a same size.
@@ -69,6 +71,46 @@ type NoCopyCrypt interface {
 	DecryptNoCopy([]byte) error
 }
 
+// BufferCrypt describes a crypt which can append the encrypted and decrypted data to given buffers, so buffers can be
+// reused between packets.
+type BufferCrypt interface {
+	Crypt
+	// EncryptTo appends the encrypted data to the buffer and returns the updated buffer.
+	EncryptTo(dst, data []byte) ([]byte, error)
+	// DecryptTo appends the decrypted data to the buffer and returns the updated buffer.
+	DecryptTo(dst, data []byte) ([]byte, error)
+}
+
+// EncryptTo appends the encrypted data to the buffer. Crypts which are not buffer crypts encrypt in a new buffer first.
+func EncryptTo(c Crypt, dst, data []byte) ([]byte, error) {
+	bc, ok := c.(BufferCrypt)
+	if !ok {
+		result, err := c.Encrypt(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(dst, result...), nil
+	}
+
+	return bc.EncryptTo(dst, data)
+}
+
+// DecryptTo appends the decrypted data to the buffer. Crypts which are not buffer crypts decrypt in a new buffer first.
+func DecryptTo(c Crypt, dst, data []byte) ([]byte, error) {
+	bc, ok := c.(BufferCrypt)
+	if !ok {
+		result, err := c.Decrypt(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(dst, result...), nil
+	}
+
+	return bc.DecryptTo(dst, data)
+}
+
 // ParseCrypt returns a crypt by given method and password.
 func ParseCrypt(method, password string) (Crypt, error) {
 	var (
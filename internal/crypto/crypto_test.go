@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testMethods = []string{"plain", "aes-128-gcm", "chacha20-poly1305", "xchacha20-poly1305"}
+
+func TestEncryptTo(t *testing.T) {
+	data := []byte("payload")
+
+	for _, method := range testMethods {
+		c, err := ParseCrypt(method, "ikago")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Data is appended to the buffer
+		prefix := []byte("prefix")
+		encrypted, err := EncryptTo(c, append([]byte(nil), prefix...), data)
+		if err != nil {
+			t.Fatalf("%s: encrypt: %v", method, err)
+		}
+		if !bytes.HasPrefix(encrypted, prefix) {
+			t.Fatalf("%s: encrypt without prefix", method)
+		}
+
+		decrypted, err := DecryptTo(c, append([]byte(nil), prefix...), encrypted[len(prefix):])
+		if err != nil {
+			t.Fatalf("%s: decrypt: %v", method, err)
+		}
+		if !bytes.Equal(decrypted, append(prefix, data...)) {
+			t.Errorf("%s: decrypt %q, expect %q", method, decrypted, append(prefix, data...))
+		}
+	}
+}
+
+// BenchmarkEncrypt encrypts payloads in new buffers and in a reused buffer.
+func BenchmarkEncrypt(b *testing.B) {
+	data := make([]byte, 1400)
+
+	for _, method := range testMethods {
+		c, err := ParseCrypt(method, "ikago")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(method+" new", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+
+			for i := 0; i < b.N; i++ {
+				_, err := c.Encrypt(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(method+" reused", func(b *testing.B) {
+			buffer := make([]byte, 0, 2048)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+
+			for i := 0; i < b.N; i++ {
+				_, err := EncryptTo(c, buffer[:0], data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecrypt decrypts payloads in new buffers and in a reused buffer.
+func BenchmarkDecrypt(b *testing.B) {
+	for _, method := range testMethods {
+		c, err := ParseCrypt(method, "ikago")
+		if err != nil {
+			b.Fatal(err)
+		}
+		data, err := c.Encrypt(make([]byte, 1400))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(method+" new", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+
+			for i := 0; i < b.N; i++ {
+				_, err := c.Decrypt(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(method+" reused", func(b *testing.B) {
+			buffer := make([]byte, 0, 2048)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+
+			for i := 0; i < b.N; i++ {
+				_, err := DecryptTo(c, buffer[:0], data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
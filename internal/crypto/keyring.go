@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Keyring describes a crypt of multiple keys in the same method for rotating keys. It decrypts with any of the keys,
+// and encrypts with the key which decrypts lastly, or the primary key before anything is decrypted.
+type Keyring struct {
+	crypts []Crypt
+	index  int32
+}
+
+// CreateKeyring returns a keyring of the primary crypt and other crypts. Crypts must be in the same method, which cannot
+// be plain.
+func CreateKeyring(primary Crypt, others ...Crypt) (*Keyring, error) {
+	if primary.Method() == MethodPlain {
+		return nil, errors.New("method plain not support")
+	}
+	for _, c := range others {
+		if c.Method() != primary.Method() {
+			return nil, fmt.Errorf("method %s mismatch with %s", c.Method(), primary.Method())
+		}
+	}
+
+	crypts := make([]Crypt, 0, len(others)+1)
+	crypts = append(crypts, primary)
+	crypts = append(crypts, others...)
+
+	return &Keyring{crypts: crypts}, nil
+}
+
+// Clone returns a keyring of the same keys which has decrypted nothing, so each peer can be served with its own key.
+func (k *Keyring) Clone() *Keyring {
+	return &Keyring{crypts: k.crypts}
+}
+
+// Match returns the index of the key which decrypts lastly, where 0 is the primary key.
+func (k *Keyring) Match() int {
+	return int(atomic.LoadInt32(&k.index))
+}
+
+func (k *Keyring) Encrypt(data []byte) ([]byte, error) {
+	return k.crypts[atomic.LoadInt32(&k.index)].Encrypt(data)
+}
+
+// Decrypt tries all keys whether any key has decrypted the data or not, so the time of decryption does not reveal which
+// key matches.
+func (k *Keyring) Decrypt(data []byte) ([]byte, error) {
+	var (
+		result []byte
+		match  = -1
+		err    error
+	)
+
+	for i, c := range k.crypts {
+		r, e := c.Decrypt(data)
+		if e != nil {
+			err = e
+			continue
+		}
+		if match < 0 {
+			result, match = r, i
+		}
+	}
+	if match < 0 {
+		return nil, err
+	}
+
+	atomic.StoreInt32(&k.index, int32(match))
+
+	return result, nil
+}
+
+func (k *Keyring) Method() Method {
+	return k.crypts[0].Method()
+}
+
+func (k *Keyring) Cost() int {
+	return k.crypts[0].Cost()
+}
+
+func (k *Keyring) Strength() int {
+	return k.crypts[0].Strength()
+}
+
+// CloneCrypt returns a clone of the crypt if it is a keyring, or the crypt itself.
+func CloneCrypt(c Crypt) Crypt {
+	k, ok := c.(*Keyring)
+	if !ok {
+		return c
+	}
+
+	return k.Clone()
+}
@@ -21,6 +21,10 @@ func (c *PlainCrypt) Encrypt(data []byte) ([]byte, error) {
 	return result, nil
 }
 
+func (c *PlainCrypt) EncryptTo(dst, data []byte) ([]byte, error) {
+	return append(dst, data...), nil
+}
+
 func (c *PlainCrypt) EncryptInPlace(_ []byte) error {
 	return nil
 }
@@ -37,6 +41,10 @@ func (c *PlainCrypt) Decrypt(data []byte) ([]byte, error) {
 	return result, nil
 }
 
+func (c *PlainCrypt) DecryptTo(dst, data []byte) ([]byte, error) {
+	return append(dst, data...), nil
+}
+
 func (c *PlainCrypt) DecryptInPlace(_ []byte) error {
 	return nil
 }
@@ -52,3 +60,7 @@ func (c *PlainCrypt) Method() Method {
 func (c *PlainCrypt) Cost() int {
 	return 0
 }
+
+func (c *PlainCrypt) Strength() int {
+	return 0
+}
@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// selfTestVector is the known plaintext used in the self-test.
+var selfTestVector = []byte("IkaGo self-test vector 0123456789abcdef")
+
+// fingerprintSize is the size of a fingerprint in bytes.
+const fingerprintSize = 4
+
+// SelfTest encrypts and decrypts a known vector and returns an error if the crypt does not round-trip.
+func SelfTest(c Crypt) error {
+	plaintext := make([]byte, len(selfTestVector))
+	copy(plaintext, selfTestVector)
+
+	ciphertext, err := c.Encrypt(plaintext)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	if len(ciphertext) != len(selfTestVector)+c.Cost() {
+		return fmt.Errorf("ciphertext size %d mismatch, expect %d", len(ciphertext), len(selfTestVector)+c.Cost())
+	}
+	if c.Method() != MethodPlain && bytes.Contains(ciphertext, selfTestVector) {
+		return errors.New("ciphertext contains plaintext")
+	}
+
+	result, err := c.Decrypt(ciphertext)
+	if err != nil {
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	if !bytes.Equal(result, selfTestVector) {
+		return errors.New("round trip mismatch")
+	}
+
+	return nil
+}
+
+// Fingerprint returns a short hash of the key derived from the method and password. The key cannot be recovered from
+// the fingerprint, which makes it safe to be compared between clients and servers.
+func Fingerprint(method, password string) string {
+	method = strings.ToLower(method)
+	if method == "plain" {
+		return ""
+	}
+
+	h := sha256.New()
+	h.Write([]byte("ikago fingerprint\x00"))
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write(DeriveKey(password, 32))
+
+	return hex.EncodeToString(h.Sum(nil)[:fingerprintSize])
+}
@@ -0,0 +1,239 @@
+package discovery
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/crypto"
+	"io"
+	"net"
+	"time"
+)
+
+// Port is the well-known UDP port for discovery.
+const Port = 18080
+
+const (
+	probeMagic    = "IKAGO-PROBE"
+	responseMagic = "IKAGO-REPLY"
+	nonceSize     = 16
+	macSize       = 16
+	timestampSize = 8
+	maxClockSkew  = 30 * time.Second
+	maxDatagram   = 1500
+)
+
+// Response describes a response from a server.
+type Response struct {
+	// IP is the address of the server, which is the source of the response.
+	IP net.IP `json:"-"`
+	// Port is the listen port of the server.
+	Port uint16 `json:"port"`
+	// Fingerprint is the fingerprint of the key of the server.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Key returns the key for signing probes and responses derived from the password.
+func Key(password string) []byte {
+	h := sha256.New()
+	h.Write([]byte("ikago discovery\x00"))
+	h.Write(crypto.DeriveKey(password, 32))
+
+	return h.Sum(nil)
+}
+
+func sign(key []byte, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		h.Write(part)
+	}
+
+	return h.Sum(nil)[:macSize]
+}
+
+// createProbe returns a probe signed by the key and its nonce.
+func createProbe(key []byte, t time.Time) ([]byte, []byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	timestamp := make([]byte, timestampSize)
+	binary.BigEndian.PutUint64(timestamp, uint64(t.Unix()))
+
+	b := make([]byte, 0)
+	b = append(b, probeMagic...)
+	b = append(b, timestamp...)
+	b = append(b, nonce...)
+	b = append(b, sign(key, []byte(probeMagic), timestamp, nonce)...)
+
+	return b, nonce, nil
+}
+
+// parseProbe verifies a probe and returns its nonce.
+func parseProbe(key []byte, b []byte, now time.Time) ([]byte, error) {
+	if len(b) != len(probeMagic)+timestampSize+nonceSize+macSize || !bytes.HasPrefix(b, []byte(probeMagic)) {
+		return nil, errors.New("not a probe")
+	}
+
+	b = b[len(probeMagic):]
+	timestamp := b[:timestampSize]
+	nonce := b[timestampSize : timestampSize+nonceSize]
+	mac := b[timestampSize+nonceSize:]
+
+	if !hmac.Equal(mac, sign(key, []byte(probeMagic), timestamp, nonce)) {
+		return nil, errors.New("signature mismatch")
+	}
+
+	t := time.Unix(int64(binary.BigEndian.Uint64(timestamp)), 0)
+	if t.Sub(now) > maxClockSkew || now.Sub(t) > maxClockSkew {
+		return nil, fmt.Errorf("probe at %s expired", t.Format(time.RFC3339))
+	}
+
+	return nonce, nil
+}
+
+// createResponse returns a response to the probe with the nonce signed by the key.
+func createResponse(key []byte, nonce []byte, resp *Response) ([]byte, error) {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+
+	b := make([]byte, 0)
+	b = append(b, responseMagic...)
+	b = append(b, sign(key, []byte(responseMagic), nonce, payload)...)
+	b = append(b, payload...)
+
+	return b, nil
+}
+
+// parseResponse verifies a response to the probe with the nonce.
+func parseResponse(key []byte, nonce []byte, b []byte) (*Response, error) {
+	if len(b) < len(responseMagic)+macSize || !bytes.HasPrefix(b, []byte(responseMagic)) {
+		return nil, errors.New("not a response")
+	}
+
+	b = b[len(responseMagic):]
+	mac := b[:macSize]
+	payload := b[macSize:]
+
+	if !hmac.Equal(mac, sign(key, []byte(responseMagic), nonce, payload)) {
+		return nil, errors.New("signature mismatch")
+	}
+
+	resp := &Response{}
+	err := json.Unmarshal(payload, resp)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return resp, nil
+}
+
+// Responder answers signed probes in the LAN. Probes which are not signed by the same key are ignored silently, so
+// nothing is revealed to unauthenticated probers.
+type Responder struct {
+	conn *net.UDPConn
+	key  []byte
+	resp Response
+}
+
+// Listen returns a responder which listens on the port and answers with the listen port and the fingerprint.
+func Listen(port int, key []byte, listenPort uint16, fingerprint string) (*Responder, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	return &Responder{
+		conn: conn,
+		key:  key,
+		resp: Response{
+			Port:        listenPort,
+			Fingerprint: fingerprint,
+		},
+	}, nil
+}
+
+// Serve answers probes until the responder is closed.
+func (r *Responder) Serve() error {
+	b := make([]byte, maxDatagram)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(b)
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+
+		nonce, err := parseProbe(r.key, b[:n], time.Now())
+		if err != nil {
+			continue
+		}
+
+		data, err := createResponse(r.key, nonce, &r.resp)
+		if err != nil {
+			return fmt.Errorf("create response: %w", err)
+		}
+
+		// The prober may be gone
+		_, _ = r.conn.WriteToUDP(data, addr)
+	}
+}
+
+// Close closes the responder.
+func (r *Responder) Close() error {
+	return r.conn.Close()
+}
+
+// Discover broadcasts a probe signed by the key to the port and returns responses received before the timeout.
+func Discover(port int, key []byte, timeout time.Duration) ([]*Response, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	defer conn.Close()
+
+	probe, nonce, err := createProbe(key, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("create probe: %w", err)
+	}
+
+	_, err = conn.WriteToUDP(probe, &net.UDPAddr{IP: net.IPv4bcast, Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	result := make([]*Response, 0)
+	b := make([]byte, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("read: %w", err)
+		}
+
+		resp, err := parseResponse(key, nonce, b[:n])
+		if err != nil {
+			continue
+		}
+		resp.IP = addr.IP
+
+		result = append(result, resp)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,195 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Magic is the magic number in the front of each envelope.
+const Magic = "IKGO"
+
+// Major is the major version of envelopes written. Readers reject envelopes in higher major versions, which change the
+// layout of sections.
+const Major = 1
+
+// Minor is the minor version of envelopes written. Envelopes in higher minor versions are readable, as they only add
+// sections or feature bits.
+const Minor = 0
+
+// headerLength is the length of the header, which is the magic number, the major and minor versions and feature bits.
+const headerLength = len(Magic) + 1 + 1 + 4
+
+// sectionHeaderLength is the length of the header of a section, which is the type and the length of the section.
+const sectionHeaderLength = 2 + 4
+
+// crcLength is the length of the CRC following each section.
+const crcLength = 4
+
+// MaxSectionSize is the max size of a section.
+const MaxSectionSize = 64 * 1024 * 1024
+
+// ErrMagic is returned when reading data which is not an envelope.
+var ErrMagic = errors.New("not an envelope")
+
+// Header describes the header of an envelope.
+type Header struct {
+	Major    uint8
+	Minor    uint8
+	Features uint32
+}
+
+func (h Header) String() string {
+	return fmt.Sprintf("%d.%d", h.Major, h.Minor)
+}
+
+// Section describes a section in an envelope.
+type Section struct {
+	Type uint16
+	Data []byte
+}
+
+// Writer writes an envelope in sections.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the header of an envelope in the current version with the feature bits, and returns a writer
+// writing sections after it.
+func NewWriter(w io.Writer, features uint32) (*Writer, error) {
+	err := writeHeader(w, Header{Major: Major, Minor: Minor, Features: features})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{w: w}, nil
+}
+
+// AppendWriter returns a writer appending sections to an envelope whose header is already written.
+func AppendWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func writeHeader(w io.Writer, h Header) error {
+	b := make([]byte, headerLength)
+	copy(b, Magic)
+	b[len(Magic)] = h.Major
+	b[len(Magic)+1] = h.Minor
+	binary.BigEndian.PutUint32(b[len(Magic)+2:], h.Features)
+
+	_, err := w.Write(b)
+	if err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+
+	return nil
+}
+
+// WriteSection writes a section of the type. Each section is written at once, so sections are never interleaved.
+func (w *Writer) WriteSection(t uint16, data []byte) error {
+	if len(data) > MaxSectionSize {
+		return fmt.Errorf("section size %d out of range", len(data))
+	}
+
+	b := make([]byte, sectionHeaderLength+len(data)+crcLength)
+	binary.BigEndian.PutUint16(b, t)
+	binary.BigEndian.PutUint32(b[2:], uint32(len(data)))
+	copy(b[sectionHeaderLength:], data)
+	binary.BigEndian.PutUint32(b[sectionHeaderLength+len(data):], crc32.ChecksumIEEE(b[:sectionHeaderLength+len(data)]))
+
+	_, err := w.w.Write(b)
+	if err != nil {
+		return fmt.Errorf("write section %d: %w", t, err)
+	}
+
+	return nil
+}
+
+// Reader reads sections of known types from an envelope.
+type Reader struct {
+	r       io.Reader
+	header  Header
+	known   map[uint16]bool
+	skipped int
+}
+
+// NewReader reads the header of an envelope and returns a reader reading sections of the known types after it. It
+// returns an error if the envelope is in a higher major version.
+func NewReader(r io.Reader, known ...uint16) (*Reader, error) {
+	b := make([]byte, headerLength)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if !bytes.Equal(b[:len(Magic)], []byte(Magic)) {
+		return nil, ErrMagic
+	}
+
+	h := Header{
+		Major:    b[len(Magic)],
+		Minor:    b[len(Magic)+1],
+		Features: binary.BigEndian.Uint32(b[len(Magic)+2:]),
+	}
+	if h.Major > Major {
+		return nil, fmt.Errorf("version %s not support, which is written by a newer version (supports up to %d.x)", h, Major)
+	}
+
+	reader := &Reader{r: r, header: h, known: make(map[uint16]bool)}
+	for _, t := range known {
+		reader.known[t] = true
+	}
+
+	return reader, nil
+}
+
+// Header returns the header of the envelope.
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Next returns the next section of known types. Sections of unknown types, like those added by newer versions, are
+// skipped. It returns io.EOF at the end of the envelope, and io.ErrUnexpectedEOF if the envelope is truncated.
+func (r *Reader) Next() (Section, error) {
+	for {
+		b := make([]byte, sectionHeaderLength)
+		_, err := io.ReadFull(r.r, b)
+		if err != nil {
+			return Section{}, err
+		}
+
+		t := binary.BigEndian.Uint16(b)
+		length := binary.BigEndian.Uint32(b[2:])
+		if length > MaxSectionSize {
+			return Section{}, fmt.Errorf("section %d size %d out of range", t, length)
+		}
+
+		b = append(b, make([]byte, int(length)+crcLength)...)
+		_, err = io.ReadFull(r.r, b[sectionHeaderLength:])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Section{}, err
+		}
+
+		end := sectionHeaderLength + int(length)
+		if crc32.ChecksumIEEE(b[:end]) != binary.BigEndian.Uint32(b[end:]) {
+			return Section{}, fmt.Errorf("section %d: crc mismatch", t)
+		}
+
+		if !r.known[t] {
+			r.skipped++
+			continue
+		}
+
+		return Section{Type: t, Data: b[sectionHeaderLength:end]}, nil
+	}
+}
+
+// Skipped returns the number of sections of unknown types skipped.
+func (r *Reader) Skipped() int {
+	return r.skipped
+}
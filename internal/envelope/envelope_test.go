@@ -0,0 +1,241 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	sectionA = 1
+	sectionB = 2
+	// sectionFuture is a section type only known by a future writer.
+	sectionFuture = 100
+)
+
+// writeFuture writes an envelope like a future writer in the version with extra sections and feature bits.
+func writeFuture(t *testing.T, major, minor uint8) []byte {
+	var buf bytes.Buffer
+	err := writeHeader(&buf, Header{Major: major, Minor: minor, Features: 0x80000001})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := AppendWriter(&buf)
+	for _, s := range []Section{
+		{Type: sectionFuture, Data: []byte("prologue")},
+		{Type: sectionA, Data: []byte("a")},
+		{Type: sectionFuture, Data: bytes.Repeat([]byte{0xff}, 1000)},
+		{Type: sectionB, Data: []byte("b")},
+		{Type: sectionFuture + 1, Data: nil},
+	} {
+		err := w.WriteSection(s.Type, s.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func readAll(r *Reader) ([]Section, error) {
+	sections := make([]Section, 0)
+	for {
+		s, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				return sections, nil
+			}
+			return sections, err
+		}
+		sections = append(sections, s)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Section{
+		{Type: sectionA, Data: []byte(`{"name":"IkaGo"}`)},
+		{Type: sectionB, Data: []byte{}},
+		{Type: sectionA, Data: bytes.Repeat([]byte{0}, 70000)},
+	}
+	for _, s := range want {
+		err := w.WriteSection(s.Type, s.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Sections appended later are read as a part of the envelope
+	err = AppendWriter(&buf).WriteSection(sectionB, []byte("appended"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, Section{Type: sectionB, Data: []byte("appended")})
+
+	r, err := NewReader(&buf, sectionA, sectionB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := r.Header(); h.Major != Major || h.Minor != Minor || h.Features != 3 {
+		t.Errorf("header %+v, want %d.%d with features 3", h, Major, Minor)
+	}
+
+	sections, err := readAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != len(want) {
+		t.Fatalf("read %d sections, want %d", len(sections), len(want))
+	}
+	for i, s := range sections {
+		if s.Type != want[i].Type || !bytes.Equal(s.Data, want[i].Data) {
+			t.Errorf("section %d is type %d of %d bytes, want type %d of %d bytes", i, s.Type, len(s.Data), want[i].Type, len(want[i].Data))
+		}
+	}
+	if r.Skipped() != 0 {
+		t.Errorf("skipped %d sections, want 0", r.Skipped())
+	}
+}
+
+func TestForwardCompatibility(t *testing.T) {
+	tests := []struct {
+		name  string
+		major uint8
+		minor uint8
+	}{
+		{name: "same minor", major: Major, minor: Minor},
+		{name: "newer minor", major: Major, minor: Minor + 1},
+		{name: "newest minor", major: Major, minor: 255},
+		{name: "older major", major: Major - 1, minor: 7},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(writeFuture(t, test.major, test.minor)), sectionA, sectionB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := r.Header(); h.Minor != test.minor || h.Features != 0x80000001 {
+				t.Errorf("header %+v, want minor %d with features 0x80000001", h, test.minor)
+			}
+
+			sections, err := readAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sections) != 2 || string(sections[0].Data) != "a" || string(sections[1].Data) != "b" {
+				t.Errorf("read %v, want sections a and b", sections)
+			}
+			if r.Skipped() != 3 {
+				t.Errorf("skipped %d sections, want 3", r.Skipped())
+			}
+		})
+	}
+}
+
+func TestNewerMajor(t *testing.T) {
+	_, err := NewReader(bytes.NewReader(writeFuture(t, Major+1, 0)), sectionA, sectionB)
+	if err == nil {
+		t.Fatal("read envelope in a newer major version")
+	}
+	if !strings.Contains(err.Error(), "newer version") {
+		t.Errorf("error %q does not tell the envelope is written by a newer version", err)
+	}
+}
+
+func TestMagic(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "json", data: []byte(`{"name": "IkaGo", "version": "1"}`)},
+		{name: "zeros", data: make([]byte, headerLength)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewReader(bytes.NewReader(test.data))
+			if !errors.Is(err, ErrMagic) {
+				t.Errorf("error %v, want %v", err, ErrMagic)
+			}
+		})
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	data := writeFuture(t, Major, Minor)
+
+	// Flip a bit in the data of section a, which is the second section
+	offset := headerLength + sectionHeaderLength + len("prologue") + crcLength + sectionHeaderLength
+	if data[offset] != 'a' {
+		t.Fatalf("byte %d is %q, want 'a'", offset, data[offset])
+	}
+	data[offset] ^= 0x20
+
+	r, err := NewReader(bytes.NewReader(data), sectionA, sectionB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Next()
+	if err == nil || !strings.Contains(err.Error(), "crc mismatch") {
+		t.Errorf("error %v, want crc mismatch", err)
+	}
+}
+
+func TestOversizedSection(t *testing.T) {
+	data := writeFuture(t, Major, Minor)
+	binary.BigEndian.PutUint32(data[headerLength+2:], MaxSectionSize+1)
+
+	r, err := NewReader(bytes.NewReader(data), sectionA, sectionB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Next()
+	if err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("error %v, want out of range", err)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	data := writeFuture(t, Major, Minor)
+
+	// Truncating in the header fails creating the reader
+	for i := 1; i < headerLength; i++ {
+		_, err := NewReader(bytes.NewReader(data[:i]))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("truncated at %d: error %v, want %v", i, err, io.ErrUnexpectedEOF)
+		}
+	}
+
+	// Truncating in any section fails at the section, but never at section boundaries
+	boundaries := make(map[int]bool)
+	for offset := headerLength; offset < len(data); {
+		boundaries[offset] = true
+		offset = offset + sectionHeaderLength + int(binary.BigEndian.Uint32(data[offset+2:])) + crcLength
+	}
+
+	for i := headerLength; i < len(data); i++ {
+		r, err := NewReader(bytes.NewReader(data[:i]), sectionA, sectionB)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = readAll(r)
+		if boundaries[i] {
+			if err != nil {
+				t.Errorf("truncated at boundary %d: error %v", i, err)
+			}
+		} else if err != io.ErrUnexpectedEOF {
+			t.Errorf("truncated at %d: error %v, want %v", i, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package event
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// All subscribes sinks to all types of events.
+const All = "*"
+
+// Event describes a significant event.
+type Event struct {
+	Type    string            `json:"type"`
+	Time    time.Time         `json:"time"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Sink describes a destination of events.
+type Sink interface {
+	// Send sends the event. It may be called concurrently.
+	Send(Event) error
+	// String returns the description of the sink.
+	String() string
+}
+
+// Bus describes a bus which dispatches events to sinks in the background. Publishing never blocks, and events are
+// dropped if the queue is full.
+type Bus struct {
+	// dropped is accessed atomically and must be first to be aligned on 32-bit platforms
+	dropped uint64
+	lock    sync.RWMutex
+	sinks   map[string][]Sink
+	queue   chan Event
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// NewBus returns a new bus which queues at most size events.
+func NewBus(size int) *Bus {
+	return &Bus{
+		sinks: make(map[string][]Sink),
+		queue: make(chan Event, size),
+		quit:  make(chan struct{}),
+	}
+}
+
+// Subscribe subscribes the sink to events of the type, or all events if the type is All.
+func (bus *Bus) Subscribe(t string, sink Sink) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.sinks[t] = append(bus.sinks[t], sink)
+}
+
+// Publish publishes an event of the type.
+func (bus *Bus) Publish(t string, message string, fields map[string]string) {
+	e := Event{
+		Type:    t,
+		Time:    time.Now(),
+		Message: message,
+		Fields:  fields,
+	}
+
+	select {
+	case bus.queue <- e:
+	default:
+		atomic.AddUint64(&bus.dropped, 1)
+	}
+}
+
+// Dropped returns the number of events dropped because the queue is full.
+func (bus *Bus) Dropped() uint64 {
+	return atomic.LoadUint64(&bus.dropped)
+}
+
+// Run dispatches events until the bus is closed. Each event is sent to each sink in a new goroutine.
+func (bus *Bus) Run() {
+	for {
+		select {
+		case e := <-bus.queue:
+			bus.dispatch(e)
+		case <-bus.quit:
+			return
+		}
+	}
+}
+
+func (bus *Bus) dispatch(e Event) {
+	bus.lock.RLock()
+	sinks := make([]Sink, 0, len(bus.sinks[e.Type])+len(bus.sinks[All]))
+	sinks = append(sinks, bus.sinks[e.Type]...)
+	sinks = append(sinks, bus.sinks[All]...)
+	bus.lock.RUnlock()
+
+	for _, sink := range sinks {
+		sink := sink
+		go func() {
+			err := sink.Send(e)
+			if err != nil {
+				log.Errorln(fmt.Errorf("send event %s to %s: %w", e.Type, sink, err))
+			}
+		}()
+	}
+}
+
+// Close stops dispatching. Queued events are abandoned.
+func (bus *Bus) Close() {
+	bus.once.Do(func() {
+		close(bus.quit)
+	})
+}
@@ -0,0 +1,147 @@
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeSink records events sent to it.
+type fakeSink struct {
+	name   string
+	events chan Event
+}
+
+func newFakeSink(name string) *fakeSink {
+	return &fakeSink{name: name, events: make(chan Event, 16)}
+}
+
+func (sink *fakeSink) Send(e Event) error {
+	sink.events <- e
+
+	return nil
+}
+
+func (sink *fakeSink) String() string {
+	return sink.name
+}
+
+// receive returns types of events sent to the sink in the duration.
+func (sink *fakeSink) receive(d time.Duration) []string {
+	types := make([]string, 0)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case e := <-sink.events:
+			types = append(types, e.Type)
+		case <-timer.C:
+			return types
+		}
+	}
+}
+
+func TestBusDropped(t *testing.T) {
+	bus := NewBus(2)
+	defer bus.Close()
+
+	// Publishing never blocks even if nothing dispatches events
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			bus.Publish("a", "a", nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked")
+	}
+
+	if n := bus.Dropped(); n != 3 {
+		t.Errorf("drop %d events, want 3", n)
+	}
+
+	// Queued events are dispatched later
+	sink := newFakeSink("sink")
+	bus.Subscribe(All, sink)
+	go bus.Run()
+
+	types := sink.receive(100 * time.Millisecond)
+	if len(types) != 2 {
+		t.Errorf("receive %d events, want 2", len(types))
+	}
+}
+
+func TestBusSubscribe(t *testing.T) {
+	bus := NewBus(8)
+	defer bus.Close()
+
+	a, b, all := newFakeSink("a"), newFakeSink("b"), newFakeSink("all")
+	bus.Subscribe("a", a)
+	bus.Subscribe("b", b)
+	bus.Subscribe(All, all)
+	go bus.Run()
+
+	bus.Publish("a", "a", nil)
+	bus.Publish("b", "b", nil)
+	bus.Publish("c", "c", nil)
+
+	tests := []struct {
+		sink *fakeSink
+		want []string
+	}{
+		{a, []string{"a"}},
+		{b, []string{"b"}},
+		{all, []string{"a", "b", "c"}},
+	}
+
+	for _, tt := range tests {
+		types := tt.sink.receive(100 * time.Millisecond)
+		if !equalTypes(types, tt.want) {
+			t.Errorf("sink %s receive %v, want %v", tt.sink, types, tt.want)
+		}
+	}
+	if n := bus.Dropped(); n != 0 {
+		t.Errorf("drop %d events, want 0", n)
+	}
+}
+
+func TestBusClose(t *testing.T) {
+	bus := NewBus(8)
+
+	done := make(chan struct{})
+	go func() {
+		bus.Run()
+		close(done)
+	}()
+
+	bus.Close()
+	bus.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run after closing")
+	}
+}
+
+// equalTypes returns if types are the same regardless of order, since sinks are sent concurrently.
+func equalTypes(types, want []string) bool {
+	if len(types) != len(want) {
+		return false
+	}
+
+	counts := make(map[string]int)
+	for _, t := range types {
+		counts[t]++
+	}
+	for _, t := range want {
+		counts[t]--
+		if counts[t] < 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,239 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/envelope"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandTimeout is the max duration of a command.
+const CommandTimeout = 10 * time.Second
+
+// MaxCommands is the max number of running commands of a sink.
+const MaxCommands = 4
+
+// WebhookTimeout is the timeout of each request to a webhook.
+const WebhookTimeout = 5 * time.Second
+
+// MaxWebhooks is the max number of events being posted by a sink.
+const MaxWebhooks = 4
+
+// WebhookRetries is the number of retries after a request to a webhook fails.
+const WebhookRetries = 3
+
+// LogSection is the type of sections of events in event logs.
+const LogSection = 1
+
+// webhookBackoff is the duration before the first retry, which is doubled on each retry.
+const webhookBackoff = time.Second
+
+// CommandSink describes a sink which executes a command with the event in JSON on stdin.
+type CommandSink struct {
+	name string
+	args []string
+	sem  chan struct{}
+}
+
+// NewCommandSink returns a new command sink. The command is split by spaces into the name and arguments, and is not
+// run in a shell.
+func NewCommandSink(command string) (*CommandSink, error) {
+	fields := strings.Fields(command)
+	if len(fields) <= 0 {
+		return nil, errors.New("missing command")
+	}
+
+	return &CommandSink{
+		name: fields[0],
+		args: fields[1:],
+		sem:  make(chan struct{}, MaxCommands),
+	}, nil
+}
+
+func (sink *CommandSink) Send(e Event) error {
+	select {
+	case sink.sem <- struct{}{}:
+		defer func() {
+			<-sink.sem
+		}()
+	default:
+		return fmt.Errorf("too many running commands (%d)", MaxCommands)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, sink.name, sink.args...)
+	cmd.Stdin = bytes.NewReader(b)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func (sink *CommandSink) String() string {
+	return fmt.Sprintf("command %s", sink.name)
+}
+
+// WebhookSink describes a sink which posts the event in JSON to a URL.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	sem    chan struct{}
+}
+
+// NewWebhookSink returns a new webhook sink.
+func NewWebhookSink(url string) (*WebhookSink, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid url %s", url)
+	}
+
+	return &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: WebhookTimeout},
+		sem:    make(chan struct{}, MaxWebhooks),
+	}, nil
+}
+
+func (sink *WebhookSink) Send(e Event) error {
+	select {
+	case sink.sem <- struct{}{}:
+		defer func() {
+			<-sink.sem
+		}()
+	default:
+		return fmt.Errorf("too many pending posts (%d)", MaxWebhooks)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	backoff := webhookBackoff
+	for i := 0; ; i++ {
+		err = sink.post(b)
+		if err == nil || i >= WebhookRetries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff = backoff * 2
+	}
+}
+
+func (sink *WebhookSink) post(b []byte) error {
+	resp, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (sink *WebhookSink) String() string {
+	return fmt.Sprintf("webhook %s", sink.url)
+}
+
+// FileSink describes a sink which appends the event in JSON to an event log in the envelope.
+type FileSink struct {
+	path string
+	lock sync.Mutex
+	w    *envelope.Writer
+}
+
+// NewFileSink returns a new file sink. The event log is created if it does not exist, or appended to if it is written
+// by a compatible version.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("stat: %w", err)
+	}
+
+	var w *envelope.Writer
+	if info.Size() <= 0 {
+		w, err = envelope.NewWriter(file, 0)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else {
+		_, err = envelope.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		w = envelope.AppendWriter(file)
+	}
+
+	return &FileSink{path: path, w: w}, nil
+}
+
+func (sink *FileSink) Send(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	return sink.w.WriteSection(LogSection, b)
+}
+
+func (sink *FileSink) String() string {
+	return fmt.Sprintf("file %s", sink.path)
+}
+
+// ReadLog returns events in the event log. Sections added by newer versions are skipped.
+func ReadLog(r io.Reader) ([]Event, error) {
+	reader, err := envelope.NewReader(r, LogSection)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0)
+	for {
+		section, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return events, nil
+			}
+			return events, err
+		}
+
+		var e Event
+		err = json.Unmarshal(section.Data, &e)
+		if err != nil {
+			return events, fmt.Errorf("unmarshal: %w", err)
+		}
+		events = append(events, e)
+	}
+}
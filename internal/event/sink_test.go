@@ -0,0 +1,95 @@
+package event
+
+import (
+	"github.com/zhxie/ikago/internal/envelope"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events")
+
+	want := []Event{
+		{Type: "client-connect", Time: time.Unix(1, 0).UTC(), Message: "connect", Fields: map[string]string{"client": "10.0.0.2:50000"}},
+		{Type: "rst", Time: time.Unix(2, 0).UTC(), Message: "rst"},
+		{Type: "client-disconnect", Time: time.Unix(3, 0).UTC(), Message: "disconnect"},
+	}
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range want[:2] {
+		err := sink.Send(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A future version appends a section this version does not know
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = envelope.AppendWriter(file).WriteSection(LogSection+1, []byte("future"))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening appends to the event log instead of writing another header
+	sink, err = NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Send(want[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	events, err := ReadLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(want) {
+		t.Fatalf("read %d events, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		if e.Type != want[i].Type || !e.Time.Equal(want[i].Time) || e.Message != want[i].Message || e.Fields["client"] != want[i].Fields["client"] {
+			t.Errorf("event %d is %+v, want %+v", i, e, want[i])
+		}
+	}
+}
+
+func TestFileSinkNotEnvelope(t *testing.T) {
+	file, err := ioutil.TempFile("", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("{\"type\": \"rst\"}\n")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewFileSink(file.Name())
+	if err == nil {
+		t.Error("append to a file which is not an event log")
+	}
+}
@@ -0,0 +1,16 @@
+package exec
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// IsCarrierUp returns if the carrier of the interface is up.
+func IsCarrierUp(inter string) (bool, error) {
+	switch t := runtime.GOOS; t {
+	case "linux":
+		return isCarrierUp(inter)
+	default:
+		return false, fmt.Errorf("os %s not support", t)
+	}
+}
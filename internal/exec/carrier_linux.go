@@ -0,0 +1,17 @@
+package exec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+func isCarrierUp(inter string) (bool, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/carrier", inter))
+	if err != nil {
+		// Carrier cannot be read if the device is administratively down or removed
+		return false, nil
+	}
+
+	return strings.TrimSpace(string(b)) == "1", nil
+}
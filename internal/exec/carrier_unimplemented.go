@@ -0,0 +1,7 @@
+// +build !linux
+
+package exec
+
+func isCarrierUp(_ string) (bool, error) {
+	return true, nil
+}
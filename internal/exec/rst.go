@@ -0,0 +1,62 @@
+package exec
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+)
+
+// AddRSTFirewallRule adds a rule for firewall dropping outgoing TCP RST from the port, which the OS sends when no
+// socket is listening on the port.
+func AddRSTFirewallRule(port uint16) error {
+	switch t := runtime.GOOS; t {
+	case "linux", "windows":
+		return addRSTFirewallRule(port)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+}
+
+// RemoveRSTFirewallRule removes the rule added by AddRSTFirewallRule.
+func RemoveRSTFirewallRule(port uint16) error {
+	switch t := runtime.GOOS; t {
+	case "linux", "windows":
+		return removeRSTFirewallRule(port)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+}
+
+// RSTFirewallRuleRemover removes rules added by AddRSTFirewallRule from a process started with privileges of the
+// caller, so the rules can still be removed after the caller drops privileges, or exits unexpectedly.
+type RSTFirewallRuleRemover struct {
+	stdin io.WriteCloser
+	cmd   *exec.Cmd
+}
+
+// StartRSTFirewallRuleRemover starts a process removing rules of the ports when the remover is closed or the caller
+// exits.
+func StartRSTFirewallRuleRemover(ports []uint16) (*RSTFirewallRuleRemover, error) {
+	switch t := runtime.GOOS; t {
+	case "linux":
+		return startRSTFirewallRuleRemover(ports)
+	default:
+		return nil, fmt.Errorf("os %s not support", t)
+	}
+}
+
+// Close removes the rules and waits for the process to exit.
+func (r *RSTFirewallRuleRemover) Close() error {
+	err := r.stdin.Close()
+	if err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	err = r.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("wait: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package exec
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func rstFirewallRule(port uint16) []string {
+	return []string{"OUTPUT", "-p", "tcp", "--sport", strconv.Itoa(int(port)), "--tcp-flags", "RST", "RST", "-j", "DROP"}
+}
+
+func addRSTFirewallRule(port uint16) error {
+	routeCmd := exec.Command("iptables", append([]string{"-A"}, rstFirewallRule(port)...)...)
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec iptables: %w", err)
+	}
+
+	return nil
+}
+
+func removeRSTFirewallRule(port uint16) error {
+	routeCmd := exec.Command("iptables", append([]string{"-D"}, rstFirewallRule(port)...)...)
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec iptables: %w", err)
+	}
+
+	return nil
+}
+
+// startRSTFirewallRuleRemover starts a shell which waits for its stdin to be closed, and then removes the rules. The
+// shell is in its own process group, so it outlives signals from the terminal to the caller.
+func startRSTFirewallRuleRemover(ports []uint16) (*RSTFirewallRuleRemover, error) {
+	script := []string{"cat > /dev/null"}
+	for _, port := range ports {
+		script = append(script, "iptables -D "+strings.Join(rstFirewallRule(port), " "))
+	}
+
+	cmd := exec.Command("sh", "-c", strings.Join(script, "; "))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("pipe: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("exec sh: %w", err)
+	}
+
+	return &RSTFirewallRuleRemover{stdin: stdin, cmd: cmd}, nil
+}
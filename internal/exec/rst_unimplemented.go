@@ -0,0 +1,15 @@
+// +build !linux,!windows
+
+package exec
+
+func addRSTFirewallRule(_ uint16) error {
+	return nil
+}
+
+func removeRSTFirewallRule(_ uint16) error {
+	return nil
+}
+
+func startRSTFirewallRuleRemover(_ []uint16) (*RSTFirewallRuleRemover, error) {
+	return nil, nil
+}
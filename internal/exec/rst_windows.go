@@ -0,0 +1,36 @@
+package exec
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func rstFirewallRuleName(port uint16) string {
+	return fmt.Sprintf("name=IkaGo-server-%d", port)
+}
+
+// addRSTFirewallRule blocks all outgoing TCP from the port because Windows Firewall cannot match TCP flags. Packets
+// sent by IkaGo are injected below the firewall and are not affected.
+func addRSTFirewallRule(port uint16) error {
+	routeCmd := exec.Command("netsh", "advfirewall", "firewall", "add", "rule", rstFirewallRuleName(port), "protocol=TCP", "dir=out", fmt.Sprintf("localport=%d", port), "action=block")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec netsh: %w", err)
+	}
+
+	return nil
+}
+
+func removeRSTFirewallRule(port uint16) error {
+	routeCmd := exec.Command("netsh", "advfirewall", "firewall", "delete", "rule", rstFirewallRuleName(port))
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec netsh: %w", err)
+	}
+
+	return nil
+}
+
+func startRSTFirewallRuleRemover(_ []uint16) (*RSTFirewallRuleRemover, error) {
+	return nil, nil
+}
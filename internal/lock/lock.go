@@ -0,0 +1,74 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ErrLocked describes the lock is held by another process.
+var ErrLocked = errors.New("locked by another process")
+
+// Lock describes a lock file which prevents multiple processes from running with the same resource.
+type Lock struct {
+	path string
+	file *os.File
+}
+
+// Acquire acquires the lock file in the given path.
+func Acquire(path string) (*Lock, error) {
+	file, err := acquire(path)
+	if err != nil {
+		if errors.Is(err, ErrLocked) {
+			b, _ := ioutil.ReadFile(path)
+			pid := strings.TrimSpace(string(b))
+			if pid != "" {
+				return nil, fmt.Errorf("%w (process %s)", ErrLocked, pid)
+			}
+		}
+
+		return nil, err
+	}
+
+	// Record the process
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteString(fmt.Sprintf("%d\n", os.Getpid()))
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write: %w", err)
+	}
+
+	return &Lock{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// Release releases the lock and removes the lock file.
+func (l *Lock) Release() error {
+	// Remove before closing so no other process can lock a file which is going to be removed
+	err := os.Remove(l.path)
+	closeErr := l.file.Close()
+	if err != nil {
+		// Files cannot be removed while opened in Windows
+		err = os.Remove(l.path)
+	}
+	// Files left after dropping privileges are reused by the next process, as the lock is released with the file
+	if err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+		return fmt.Errorf("remove: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("close: %w", closeErr)
+	}
+
+	return nil
+}
+
+// Path returns the path of the lock file.
+func (l *Lock) Path() string {
+	return l.path
+}
@@ -0,0 +1,31 @@
+// +build !linux,!darwin,!freebsd
+
+package lock
+
+import (
+	"fmt"
+	"os"
+)
+
+// Dir returns the directory for lock files.
+func Dir() string {
+	return os.TempDir()
+}
+
+func acquire(path string) (*os.File, error) {
+	// Remove the stale lock, which fails if the lock is still held by another process in Windows
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, ErrLocked
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	return file, nil
+}
@@ -0,0 +1,64 @@
+// +build linux darwin freebsd
+
+package lock
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// accessWrite is W_OK of access(2).
+const accessWrite = 0x2
+
+// Dir returns the directory for lock files, which is the runtime directory of the system if it is writable, so lock
+// files never live in world-writable directories.
+func Dir() string {
+	for _, dir := range []string{"/run", "/var/run"} {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		if syscall.Access(dir, accessWrite) == nil {
+			return dir
+		}
+	}
+
+	return os.TempDir()
+}
+
+func acquire(path string) (*os.File, error) {
+	// Never follow symbolic links planted in the path
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	// Files of other users are never truncated
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("stat: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok && int(stat.Uid) != os.Geteuid() {
+		file.Close()
+		return nil, fmt.Errorf("%s is owned by user %d", path, stat.Uid)
+	}
+
+	// The lock is released by the system even if the process crashes
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("flock: %w", err)
+	}
+
+	return file, nil
+}
@@ -0,0 +1,70 @@
+// +build linux darwin freebsd
+
+package lock
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ikago-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	err = ioutil.WriteFile(target, []byte("keep"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ikago.lock")
+	err = os.Symlink(target, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Acquire(path)
+	if err == nil {
+		t.Fatal("acquire a symbolic link")
+	}
+	b, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "keep" {
+		t.Fatalf("target truncated to %q", b)
+	}
+}
+
+func TestAcquireLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ikago-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ikago.lock")
+	l, err := Acquire(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Acquire(path)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("acquire error %v, expect %v", err, ErrLocked)
+	}
+
+	err = l.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Fatalf("lock file left: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package log
+
+import "fmt"
+
+// Entry describes a logger attaching fields to every message, like the client or the device a handler works for.
+// Fields are only printed in JSON logs.
+type Entry struct {
+	fields Fields
+}
+
+// With returns an entry attaching the fields to messages.
+func With(fields Fields) *Entry {
+	return &Entry{fields: fields}
+}
+
+// With returns an entry attaching fields of the entry and the fields to messages.
+func (e *Entry) With(fields Fields) *Entry {
+	m := make(Fields, len(e.fields)+len(fields))
+	for k, v := range e.fields {
+		m[k] = v
+	}
+	for k, v := range fields {
+		m[k] = v
+	}
+
+	return &Entry{fields: m}
+}
+
+// Verbosef prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of
+// fmt.Printf.
+func (e *Entry) Verbosef(format string, v ...interface{}) {
+	printLevel(outLogger, LevelVerbose, fmt.Sprintf(format, v...), e.fields)
+}
+
+// Verboseln prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of
+// fmt.Println.
+func (e *Entry) Verboseln(v ...interface{}) {
+	printLevel(outLogger, LevelVerbose, fmt.Sprintln(v...), e.fields)
+}
+
+// Infof prints message to the stdout. Arguments are handled in the manner of fmt.Printf.
+func (e *Entry) Infof(format string, v ...interface{}) {
+	printLevel(outLogger, LevelInfo, fmt.Sprintf(format, v...), e.fields)
+}
+
+// Infoln prints message to the stdout. Arguments are handled in the manner of fmt.Println.
+func (e *Entry) Infoln(v ...interface{}) {
+	printLevel(outLogger, LevelInfo, fmt.Sprintln(v...), e.fields)
+}
+
+// Errorf prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
+func (e *Entry) Errorf(format string, v ...interface{}) {
+	printLevel(errLogger, LevelError, fmt.Sprintf(format, v...), e.fields)
+}
+
+// Errorln prints message to the stderr. Arguments are handled in the manner of fmt.Println.
+func (e *Entry) Errorln(v ...interface{}) {
+	printLevel(errLogger, LevelError, fmt.Sprintln(v...), e.fields)
+}
@@ -1,19 +1,76 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
 const warnLogFileSize int64 = 200 * 1024 * 1024
 
+// Level describes the level of messages.
+type Level int
+
+const (
+	// LevelVerbose describes verbose messages, like packets forwarded.
+	LevelVerbose Level = iota
+	// LevelInfo describes messages of the state.
+	LevelInfo
+	// LevelError describes error messages.
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelVerbose:
+		return "verbose"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("%d", l)
+	}
+}
+
+// ParseLevel returns the level parsed from a string like "verbose", "info" or "error".
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "verbose":
+		return LevelVerbose, nil
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, fmt.Errorf("level %s not support", s)
+	}
+}
+
+// Formatter describes the format of messages.
+type Formatter int
+
+const (
+	// FormatterText formats messages as they are.
+	FormatterText Formatter = iota
+	// FormatterJSON formats messages as JSON objects, one per line, with fields of level, time, message and fields of
+	// the message.
+	FormatterJSON
+)
+
 var (
-	allowVerbose bool
+	level  Level
+	isJSON bool
 )
 
+// Fields describes structured key/values of a message, which are kept as discrete fields in JSON logs.
+type Fields map[string]interface{}
+
 var (
 	outLogger *logger
 	errLogger *logger
@@ -25,7 +82,9 @@ type logger struct {
 	out  io.Writer
 }
 
-func (l *logger) output(s string) error {
+func (l *logger) output(level Level, s string, fields Fields) error {
+	s = formatMessage(level, s, fields)
+
 	l.lock.Lock()
 	_, err := l.out.Write([]byte(s))
 	l.lock.Unlock()
@@ -37,15 +96,95 @@ func (l *logger) output(s string) error {
 	return err
 }
 
+// outputLog prints message to the log file only.
+func outputLog(level Level, s string, fields Fields) {
+	if logLogger != nil {
+		logLogger.Output(2, formatMessage(level, s, fields))
+	}
+}
+
+// formatMessage returns the message as a JSON object in a line if JSON logs are enabled.
+func formatMessage(level Level, s string, fields Fields) string {
+	if !isJSON {
+		return s
+	}
+
+	m := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		m[k] = v
+	}
+	m["level"] = level.String()
+	m["time"] = time.Now().Format(time.RFC3339Nano)
+	m["message"] = strings.TrimRight(s, "\n")
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{
+			"level":   level.String(),
+			"time":    m["time"].(string),
+			"message": m["message"].(string),
+		})
+	}
+
+	return string(b) + "\n"
+}
+
 func init() {
-	allowVerbose = false
+	level = LevelInfo
 	outLogger = &logger{out: os.Stdout}
 	errLogger = &logger{out: os.Stderr}
 }
 
+// SetOutput sets writers of messages printed to the stdout and the stderr instead.
+func SetOutput(out, err io.Writer) {
+	outLogger.lock.Lock()
+	outLogger.out = out
+	outLogger.lock.Unlock()
+
+	errLogger.lock.Lock()
+	errLogger.out = err
+	errLogger.lock.Unlock()
+}
+
+// SetLevel sets the min level of messages printed to the stdout and the stderr. Messages of all levels are printed to
+// the log file.
+func SetLevel(l Level) {
+	level = l
+}
+
 // SetVerbose sets the state if verbose message is allowed to print.
 func SetVerbose(allow bool) {
-	allowVerbose = allow
+	if allow {
+		SetLevel(LevelVerbose)
+	} else if level == LevelVerbose {
+		SetLevel(LevelInfo)
+	}
+}
+
+// SetFormatter sets the format of messages.
+func SetFormatter(f Formatter) {
+	isJSON = f == FormatterJSON
+	if logLogger != nil {
+		logLogger.SetFlags(logFlags())
+	}
+}
+
+// SetJSON sets the state if messages are printed as JSON objects, one per line, with fields of level, time and message.
+func SetJSON(json bool) {
+	if json {
+		SetFormatter(FormatterJSON)
+	} else {
+		SetFormatter(FormatterText)
+	}
+}
+
+func logFlags() int {
+	// JSON logs carry their own time
+	if isJSON {
+		return 0
+	}
+
+	return log.LstdFlags
 }
 
 // SetLog sets the path of log file.
@@ -65,7 +204,7 @@ func SetLog(path string) error {
 			Infof("The log file is too large. You may delete %s manually to save disk space.\n", path)
 		}
 
-		logLogger = log.New(file, "", log.LstdFlags)
+		logLogger = log.New(file, "", logFlags())
 	}
 
 	return nil
@@ -73,68 +212,66 @@ func SetLog(path string) error {
 
 // Verbosef prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of fmt.Printf.
 func Verbosef(format string, v ...interface{}) {
-	s := fmt.Sprintf(format, v...)
-
-	if allowVerbose {
-		outLogger.output(s)
-	}
-	if !allowVerbose && logLogger != nil {
-		logLogger.Output(2, s)
-	}
+	verbose(fmt.Sprintf(format, v...), nil)
 }
 
 // Verbose prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of fmt.Print.
 func Verbose(v ...interface{}) {
-	s := fmt.Sprint(v...)
-
-	if allowVerbose {
-		outLogger.output(s)
-	}
-	if !allowVerbose && logLogger != nil {
-		logLogger.Output(2, s)
-	}
+	verbose(fmt.Sprint(v...), nil)
 }
 
 // Verboseln prints message to the stdout if verbose message is allowed to print. Arguments are handled in the manner of fmt.Println.
 func Verboseln(v ...interface{}) {
-	s := fmt.Sprintln(v...)
+	verbose(fmt.Sprintln(v...), nil)
+}
 
-	if allowVerbose {
-		outLogger.output(s)
-	}
-	if !allowVerbose && logLogger != nil {
-		logLogger.Output(2, s)
+// VerboseWith prints message with the fields to the stdout if verbose message is allowed to print. Arguments are
+// handled in the manner of fmt.Printf, and the fields are only printed in JSON logs.
+func VerboseWith(fields Fields, format string, v ...interface{}) {
+	verbose(fmt.Sprintf(format, v...), fields)
+}
+
+func verbose(s string, fields Fields) {
+	printLevel(outLogger, LevelVerbose, s, fields)
+}
+
+// printLevel prints message to the logger if the level is allowed to print, or to the log file only.
+func printLevel(l *logger, lv Level, s string, fields Fields) {
+	if lv >= level {
+		l.output(lv, s, fields)
+	} else {
+		outputLog(lv, s, fields)
 	}
 }
 
 // Infof prints message to the stdout. Arguments are handled in the manner of fmt.Printf.
 func Infof(format string, v ...interface{}) {
-	outLogger.output(fmt.Sprintf(format, v...))
+	printLevel(outLogger, LevelInfo, fmt.Sprintf(format, v...), nil)
 }
 
 // Info prints message to the stdout. Arguments are handled in the manner of fmt.Print.
 func Info(v ...interface{}) {
-	outLogger.output(fmt.Sprint(v...))
+	printLevel(outLogger, LevelInfo, fmt.Sprint(v...), nil)
 }
 
 // Infoln prints message to the stdout. Arguments are handled in the manner of fmt.Println.
 func Infoln(v ...interface{}) {
-	outLogger.output(fmt.Sprintln(v...))
+	printLevel(outLogger, LevelInfo, fmt.Sprintln(v...), nil)
 }
 
 // Errorf prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
 func Errorf(format string, v ...interface{}) {
-	errLogger.output(fmt.Sprintf(format, v...))
+	printLevel(errLogger, LevelError, fmt.Sprintf(format, v...), nil)
 }
 
 // Error prints message to the stderr. Arguments are handled in the manner of fmt.Print.
 func Error(v ...interface{}) {
-	errLogger.output(fmt.Sprint(v...))
+	printLevel(errLogger, LevelError, fmt.Sprint(v...), nil)
 }
 
 // Errorln prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
 func Errorln(v ...interface{}) {
-	errLogger.output(fmt.Sprintln(v...))
+	printLevel(errLogger, LevelError, fmt.Sprintln(v...), nil)
 }
 
 // Fatalf prints message to the stderr, and ends with os.Exit(1). Arguments are handled in the manner of fmt.Printf.
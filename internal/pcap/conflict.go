@@ -0,0 +1,87 @@
+package pcap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"io"
+	"net"
+	"time"
+)
+
+// instanceToken is a random token of the process which is hidden in initial sequence numbers of handshake replies.
+var instanceToken []byte
+
+func init() {
+	instanceToken = make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, instanceToken)
+	if err != nil {
+		binary.BigEndian.PutUint64(instanceToken, uint64(time.Now().UnixNano()))
+	}
+}
+
+// deriveISN returns the initial sequence number of a handshake reply to the client.
+func deriveISN(client *net.TCPAddr, seq uint32) uint32 {
+	h := hmac.New(sha256.New, instanceToken)
+	h.Write(client.IP.To16())
+
+	b := make([]byte, 6)
+	binary.BigEndian.PutUint16(b, uint16(client.Port))
+	binary.BigEndian.PutUint32(b[2:], seq)
+	h.Write(b)
+
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+// ConflictDetector detects handshake replies sent by other instances on a device.
+type ConflictDetector struct {
+	conn  *RawConn
+	ports []uint16
+}
+
+// DetectConflict returns a conflict detector which watches handshake replies from the ports in the device.
+func DetectConflict(dev *Device, ports []uint16) (*ConflictDetector, error) {
+	conn, err := CreateRawConn(dev, dev, RestrictFilter(dev, "src", fmt.Sprintf("tcp && %s && tcp[tcpflags] & (tcp-syn|tcp-ack) == (tcp-syn|tcp-ack)", PortsFilter("src", ports))))
+	if err != nil {
+		return nil, fmt.Errorf("create raw connection: %w", err)
+	}
+
+	return &ConflictDetector{
+		conn:  conn,
+		ports: ports,
+	}, nil
+}
+
+// Next blocks until a handshake reply not sent by this process is detected and returns the client of the reply.
+func (d *ConflictDetector) Next() (net.Addr, error) {
+	for {
+		packet, err := d.conn.ReadPacket()
+		if err != nil {
+			return nil, fmt.Errorf("read device %s: %w", d.conn.LocalDev().Alias(), err)
+		}
+
+		indicator, err := ParsePacket(packet)
+		if err != nil {
+			continue
+		}
+		if indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeTCP {
+			continue
+		}
+		if !indicator.IsSYN() || !indicator.IsACK() {
+			continue
+		}
+
+		client := indicator.Dst().(*net.TCPAddr)
+		if indicator.TCPLayer().Seq != deriveISN(client, indicator.TCPLayer().Ack-1) {
+			return client, nil
+		}
+	}
+}
+
+// Close closes the conflict detector.
+func (d *ConflictDetector) Close() error {
+	return d.conn.Close()
+}
@@ -0,0 +1,157 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// decodedLayers holds layers of a packet decoded by a decoder.
+type decodedLayers struct {
+	ethernet layers.Ethernet
+	loopback layers.Loopback
+	dot1Q    layers.Dot1Q
+	ipv4     layers.IPv4
+	tcp      layers.TCP
+	udp      layers.UDP
+	icmpv4   layers.ICMPv4
+	payload  gopacket.Payload
+}
+
+// Decoder is a decoder decodes common packets into preallocated layers without creating packets, and falls back to
+// ParsePacket for others. It is not safe to be used concurrently, and should be kept by each connection or worker.
+type Decoder struct {
+	first   gopacket.LayerType
+	emb     bool
+	layers  decodedLayers
+	ipv6    layers.IPv6
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+}
+
+// NewDecoder returns a decoder decoding packets beginning with the layer type.
+func NewDecoder(first gopacket.LayerType) *Decoder {
+	d := &Decoder{
+		first:   first,
+		decoded: make([]gopacket.LayerType, 0, 8),
+	}
+	d.parser = gopacket.NewDecodingLayerParser(first,
+		&d.layers.ethernet,
+		&d.layers.loopback,
+		&d.layers.dot1Q,
+		&d.layers.ipv4,
+		&d.ipv6,
+		&d.layers.tcp,
+		&d.layers.udp,
+		&d.layers.icmpv4,
+		&d.layers.payload,
+	)
+
+	return d
+}
+
+// NewEmbDecoder returns a decoder decoding embedded packets used in transmission between client and server.
+func NewEmbDecoder() *Decoder {
+	d := NewDecoder(layers.LayerTypeIPv4)
+	d.emb = true
+
+	return d
+}
+
+// Decode decodes the contents and returns a packet indicator. The packet indicator shares no layer with the decoder, so
+// it can be kept after decoding other packets.
+func (d *Decoder) Decode(contents []byte) (*PacketIndicator, error) {
+	// Any unsupported layer, like a fragment, DNS or ARP, or malformed contents are left to the slow path
+	err := d.parser.DecodeLayers(contents, &d.decoded)
+	if err != nil {
+		if !d.keepPayload(err) {
+			return d.slow(contents)
+		}
+	}
+
+	var (
+		linkLayer        gopacket.Layer
+		dot1QLayer       *layers.Dot1Q
+		networkLayer     gopacket.Layer
+		transportLayer   gopacket.Layer
+		applicationLayer gopacket.ApplicationLayer
+	)
+
+	l := new(decodedLayers)
+	for i, t := range d.decoded {
+		// Stacked layers are overwritten in decoding
+		for _, prev := range d.decoded[:i] {
+			if prev == t {
+				return d.slow(contents)
+			}
+		}
+
+		switch t {
+		case layers.LayerTypeEthernet:
+			l.ethernet = d.layers.ethernet
+			linkLayer = &l.ethernet
+		case layers.LayerTypeLoopback:
+			l.loopback = d.layers.loopback
+			linkLayer = &l.loopback
+		case layers.LayerTypeDot1Q:
+			l.dot1Q = d.layers.dot1Q
+			dot1QLayer = &l.dot1Q
+		case layers.LayerTypeIPv4:
+			if d.emb && d.layers.ipv4.Version != 4 {
+				return d.slow(contents)
+			}
+			l.ipv4 = d.layers.ipv4
+			l.ipv4.Options = append([]layers.IPv4Option(nil), d.layers.ipv4.Options...)
+			networkLayer = &l.ipv4
+		case layers.LayerTypeTCP:
+			l.tcp = d.layers.tcp
+			l.tcp.Options = append([]layers.TCPOption(nil), d.layers.tcp.Options...)
+			transportLayer = &l.tcp
+		case layers.LayerTypeUDP:
+			l.udp = d.layers.udp
+			transportLayer = &l.udp
+		case layers.LayerTypeICMPv4:
+			l.icmpv4 = d.layers.icmpv4
+			transportLayer = &l.icmpv4
+		case gopacket.LayerTypePayload:
+			l.payload = d.layers.payload
+			applicationLayer = &l.payload
+		default:
+			return d.slow(contents)
+		}
+	}
+	if networkLayer == nil || transportLayer == nil {
+		return d.slow(contents)
+	}
+
+	return newPacketIndicator(len(contents), linkLayer, dot1QLayer, networkLayer, transportLayer, applicationLayer)
+}
+
+// keepPayload keeps the rest of the contents as a payload if decoding stopped at an application layer other than DNS,
+// like TLS of a tunnel on port 443, and returns if it is kept.
+func (d *Decoder) keepPayload(err error) bool {
+	t, ok := err.(gopacket.UnsupportedLayerType)
+	if !ok || gopacket.LayerType(t) == layers.LayerTypeDNS || len(d.decoded) == 0 {
+		return false
+	}
+
+	switch d.decoded[len(d.decoded)-1] {
+	case layers.LayerTypeTCP:
+		d.layers.payload = d.layers.tcp.Payload
+	case layers.LayerTypeUDP:
+		d.layers.payload = d.layers.udp.Payload
+	default:
+		return false
+	}
+	d.decoded = append(d.decoded, gopacket.LayerTypePayload)
+
+	return true
+}
+
+// slow parses the contents by creating a packet.
+func (d *Decoder) slow(contents []byte) (*PacketIndicator, error) {
+	if d.emb {
+		return ParseEmbPacket(contents)
+	}
+
+	return ParsePacket(gopacket.NewPacket(contents, d.first, gopacket.NoCopy))
+}
@@ -0,0 +1,123 @@
+package pcap
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"testing"
+)
+
+// createTestFrame returns an Ethernet frame from the destination to the upstream device with the transport layer.
+func createTestFrame(tb testing.TB, transportLayer gopacket.TransportLayer, payload []byte) []byte {
+	ipv4Layer, err := CreateIPv4Layer(testDestinationIP, testUpstreamIP, 1234, 64, transportLayer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ethernetLayer, err := CreateEthernetLayer(testGatewayHardwareAddr, testUpstreamHardwareAddr, ipv4Layer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	data, err := Serialize(ethernetLayer, ipv4Layer, transportLayer.(gopacket.SerializableLayer), gopacket.Payload(payload))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return data
+}
+
+func TestDecoder(t *testing.T) {
+	tcpLayer := CreateTCPLayer(8443, 40000, 100, 200)
+	tcpLayer.PSH = true
+	tcpLayer.ACK = true
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"tcp", createTestFrame(t, tcpLayer, []byte("payload"))},
+		{"tls", createTestFrame(t, CreateTCPLayer(443, 40000, 100, 200), []byte("payload"))},
+		{"udp", createTestFrame(t, CreateUDPLayer(8000, 40000), []byte("payload"))},
+		{"udp without payload", createTestFrame(t, CreateUDPLayer(8000, 40000), nil)},
+		{"dns", createTestFrame(t, CreateUDPLayer(53, 40000), []byte{0, 1, 0x81, 0x80, 0, 0, 0, 0, 0, 0, 0, 0})},
+	}
+
+	d := NewDecoder(layers.LayerTypeEthernet)
+	for _, tt := range tests {
+		fast, err := d.Decode(tt.frame)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tt.name, err)
+		}
+		slow, err := ParsePacket(gopacket.NewPacket(tt.frame, layers.LayerTypeEthernet, gopacket.Default))
+		if err != nil {
+			t.Fatalf("%s: parse: %v", tt.name, err)
+		}
+
+		if fast.LinkLayerType() != slow.LinkLayerType() || fast.TransportProtocol() != slow.TransportProtocol() {
+			t.Errorf("%s: decode %s over %s, expect %s over %s", tt.name, fast.TransportProtocol(), fast.LinkLayerType(), slow.TransportProtocol(), slow.LinkLayerType())
+		}
+		if fast.Src().String() != slow.Src().String() || fast.Dst().String() != slow.Dst().String() {
+			t.Errorf("%s: decode %s -> %s, expect %s -> %s", tt.name, fast.Src(), fast.Dst(), slow.Src(), slow.Dst())
+		}
+		if !bytes.Equal(fast.Payload(), slow.Payload()) || fast.Size() != slow.Size() {
+			t.Errorf("%s: decode payload %q in %d bytes, expect %q in %d bytes", tt.name, fast.Payload(), fast.Size(), slow.Payload(), slow.Size())
+		}
+	}
+
+	// Indicators are kept after decoding other packets
+	first, err := d.Decode(tests[0].frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Decode(tests[1].frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.TransportProtocol() != layers.LayerTypeTCP || first.SrcPort() != 8443 || !bytes.Equal(first.Payload(), []byte("payload")) {
+		t.Errorf("decode %s from port %d, expect TCP from port 8443", first.TransportProtocol(), first.SrcPort())
+	}
+}
+
+// BenchmarkParsePacket parses frames in the fast path with a decoder and in the slow path by creating packets.
+func BenchmarkParsePacket(b *testing.B) {
+	tcpLayer := CreateTCPLayer(8443, 40000, 100, 200)
+	tcpLayer.ACK = true
+
+	frames := []struct {
+		name  string
+		frame []byte
+	}{
+		{"tcp", createTestFrame(b, tcpLayer, make([]byte, 1400))},
+		{"tls", createTestFrame(b, CreateTCPLayer(443, 40000, 100, 200), make([]byte, 1400))},
+		{"udp", createTestFrame(b, CreateUDPLayer(8000, 40000), make([]byte, 1400))},
+	}
+
+	for _, f := range frames {
+		frame := f.frame
+
+		b.Run(f.name+" fast", func(b *testing.B) {
+			d := NewDecoder(layers.LayerTypeEthernet)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+
+			for i := 0; i < b.N; i++ {
+				_, err := d.Decode(frame)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(f.name+" slow", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+
+			for i := 0; i < b.N; i++ {
+				_, err := ParsePacket(gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.NoCopy))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
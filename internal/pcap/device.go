@@ -11,6 +11,7 @@
 	"github.com/zhxie/ikago/internal/log"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,8 +20,20 @@ type Device struct {
 	name         string
 	alias        string
 	ipAddrs      []*net.IPNet
-	hardwareAddr net.HardwareAddr
+	hardwareAddr atomic.Value
 	isLoop       bool
+	mtu          int
+	// isRestricted is true if the device is restricted to some of its IP addresses.
+	isRestricted bool
+}
+
+// NewDevice returns a device which is not found in the system, like devices in which packets replayed from files are
+// captured.
+func NewDevice(alias string, ipAddrs []*net.IPNet, hardwareAddr net.HardwareAddr, isLoop bool) *Device {
+	dev := &Device{alias: alias, ipAddrs: ipAddrs, isLoop: isLoop}
+	dev.hardwareAddr.Store(hardwareAddr)
+
+	return dev
 }
 
 // Name returns the pcap name of the device.
@@ -40,7 +53,18 @@ func (dev *Device) IPAddrs() []*net.IPNet {
 
 // HardwareAddr returns the hardware address of the device.
 func (dev *Device) HardwareAddr() net.HardwareAddr {
-	return dev.hardwareAddr
+	addr, _ := dev.hardwareAddr.Load().(net.HardwareAddr)
+
+	return addr
+}
+
+// SetHardwareAddr updates the hardware address of the device, like when the gateway is replaced, and returns if the
+// address changes.
+func (dev *Device) SetHardwareAddr(addr net.HardwareAddr) bool {
+	old := dev.HardwareAddr()
+	dev.hardwareAddr.Store(addr)
+
+	return old.String() != addr.String()
 }
 
 // IsLoop returns if the device is a loopback device.
@@ -48,6 +72,48 @@ func (dev *Device) IsLoop() bool {
 	return dev.isLoop
 }
 
+// MTU returns the MTU of the device, or 0 if it is unknown.
+func (dev *Device) MTU() int {
+	return dev.mtu
+}
+
+// FitMTU returns the MTU if it fits in the device, or the MTU of the device.
+func (dev *Device) FitMTU(mtu int) int {
+	if dev.mtu > 0 && dev.mtu < mtu {
+		return dev.mtu
+	}
+
+	return mtu
+}
+
+// Restrict returns a copy of the device restricted to the IP addresses, or nil if the device has none of them. Packets
+// to other IP addresses of the device are ignored in connections on the restricted device.
+func (dev *Device) Restrict(ips []net.IP) *Device {
+	addrs := make([]*net.IPNet, 0)
+	for _, a := range dev.ipAddrs {
+		for _, ip := range ips {
+			if a.IP.Equal(ip) {
+				addrs = append(addrs, a)
+				break
+			}
+		}
+	}
+	if len(addrs) <= 0 {
+		return nil
+	}
+
+	d := *dev
+	d.ipAddrs = addrs
+	d.isRestricted = true
+
+	return &d
+}
+
+// IsRestricted returns if the device is restricted to some of its IP addresses.
+func (dev *Device) IsRestricted() bool {
+	return dev.isRestricted
+}
+
 // IPAddr returns the first IP address of the device.
 func (dev *Device) IPAddr() *net.IPNet {
 	if len(dev.ipAddrs) > 0 {
@@ -57,11 +123,20 @@ func (dev *Device) IPAddr() *net.IPNet {
 	return nil
 }
 
+// CheckAddr returns an error if the device has no IPv4 address, which is required for sending packets from the device.
+func (dev *Device) CheckAddr() error {
+	if dev.IPAddr() == nil {
+		return fmt.Errorf("device %s has no IPv4 address", dev.Alias())
+	}
+
+	return nil
+}
+
 func (dev Device) String() string {
 	var result string
 
-	if dev.hardwareAddr != nil {
-		result = dev.alias + " [" + dev.hardwareAddr.String() + "]: "
+	if dev.HardwareAddr() != nil {
+		result = dev.alias + " [" + dev.HardwareAddr().String() + "]: "
 	} else {
 		result = dev.alias + ": "
 	}
@@ -130,7 +205,9 @@ func FindAllDevs() ([]*Device, error) {
 			as = append(as, ipnet)
 		}
 
-		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, isLoop: isLoop})
+		dev := &Device{alias: inter.Name, ipAddrs: as, isLoop: isLoop, mtu: inter.MTU}
+		dev.hardwareAddr.Store(inter.HardwareAddr)
+		t = append(t, dev)
 	}
 
 	// Enumerate pcap devices
@@ -278,7 +355,10 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 
 	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
 
-	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: ethernetPacket.DstMAC}, nil
+	gatewayDev := &Device{alias: "Gateway", ipAddrs: addrs}
+	gatewayDev.hardwareAddr.Store(ethernetPacket.DstMAC)
+
+	return gatewayDev, nil
 }
 
 // FindListenDevs returns all valid pcap devices for listening.
@@ -351,12 +431,13 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 			for _, a := range upDev.ipAddrs {
 				if a.Contains(gatewayDev.ipAddrs[0].IP) {
 					newUpDev = &Device{
-						name:         upDev.name,
-						alias:        upDev.alias,
-						ipAddrs:      append(make([]*net.IPNet, 0), a),
-						hardwareAddr: upDev.hardwareAddr,
-						isLoop:       upDev.isLoop,
+						name:    upDev.name,
+						alias:   upDev.alias,
+						ipAddrs: append(make([]*net.IPNet, 0), a),
+						isLoop:  upDev.isLoop,
+						mtu:     upDev.mtu,
 					}
+					newUpDev.hardwareAddr.Store(upDev.HardwareAddr())
 					break
 				}
 			}
@@ -389,12 +470,13 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 						continue
 					}
 					upDev = &Device{
-						name:         dev.name,
-						alias:        dev.alias,
-						ipAddrs:      append(make([]*net.IPNet, 0), a),
-						hardwareAddr: dev.hardwareAddr,
-						isLoop:       dev.isLoop,
+						name:    dev.name,
+						alias:   dev.alias,
+						ipAddrs: append(make([]*net.IPNet, 0), a),
+						isLoop:  dev.isLoop,
+						mtu:     dev.mtu,
 					}
+					upDev.hardwareAddr.Store(dev.HardwareAddr())
 					break
 				}
 			}
@@ -0,0 +1,28 @@
+package pcap
+
+import "testing"
+
+func TestFitMTU(t *testing.T) {
+	tests := []struct {
+		name   string
+		devMTU int
+		mtu    int
+		expect int
+	}{
+		{name: "unknown", devMTU: 0, mtu: 1500, expect: 1500},
+		{name: "fit", devMTU: 1500, mtu: 1400, expect: 1400},
+		{name: "equal", devMTU: 1500, mtu: 1500, expect: 1500},
+		{name: "larger", devMTU: 1500, mtu: 9000, expect: 1500},
+		{name: "tunnel", devMTU: 1280, mtu: 1500, expect: 1280},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dev := &Device{mtu: test.devMTU}
+			mtu := dev.FitMTU(test.mtu)
+			if mtu != test.expect {
+				t.Errorf("fit %d in %d: %d, expect %d", test.mtu, test.devMTU, mtu, test.expect)
+			}
+		})
+	}
+}
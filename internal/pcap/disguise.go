@@ -0,0 +1,138 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"time"
+)
+
+// Disguise describes TCP options in handshakes, which make connections look like real TCP connections to inspections.
+// The options are only camouflage, windows are never honored in flow control.
+type Disguise struct {
+	// Window is the window in handshakes.
+	Window uint16
+	// MSS is the max segment size, which is omitted if it is 0.
+	MSS uint16
+	// WindowScale is the shift count of window scale, which is omitted if it is negative.
+	WindowScale int
+	// SACKPermitted permits selective acknowledgments.
+	SACKPermitted bool
+	// Timestamps carries timestamps.
+	Timestamps bool
+}
+
+// disguise is the disguise of handshakes, handshakes carry options of the default disguise if it is nil.
+var disguise *Disguise
+
+// defaultDisguise carries options of handshakes of Linux, except timestamps which real stacks carry in every segment.
+var defaultDisguise = &Disguise{
+	Window:        64240,
+	MSS:           1460,
+	WindowScale:   7,
+	SACKPermitted: true,
+}
+
+// currentDisguise returns the disguise of handshakes in use.
+func currentDisguise() *Disguise {
+	d := disguise
+	if d == nil {
+		return defaultDisguise
+	}
+
+	return d
+}
+
+// SetDisguise sets the disguise of handshakes of new connections and listeners. It must be called before connections
+// are opened.
+func SetDisguise(d *Disguise) {
+	disguise = d
+}
+
+// disguiseTCPLayer puts the window and options of the disguise in a handshake. A SYN+ACK replying to the SYN carries
+// only options the SYN carries like real TCP stacks, and the SYN is nil if the handshake is a SYN.
+func disguiseTCPLayer(layer *layers.TCP, syn *layers.TCP) {
+	d := currentDisguise()
+
+	var (
+		hasMSS, hasWindowScale, hasSACKPermitted bool
+		tsEcr                                    []byte
+	)
+	if syn != nil {
+		for _, option := range syn.Options {
+			switch option.OptionType {
+			case layers.TCPOptionKindMSS:
+				hasMSS = true
+			case layers.TCPOptionKindWindowScale:
+				hasWindowScale = true
+			case layers.TCPOptionKindSACKPermitted:
+				hasSACKPermitted = true
+			case layers.TCPOptionKindTimestamps:
+				if len(option.OptionData) == 8 {
+					tsEcr = option.OptionData[:4]
+				}
+			}
+		}
+	}
+
+	layer.Window = d.Window
+
+	// Options are in the order of Linux
+	if d.MSS > 0 && (syn == nil || hasMSS) {
+		data := make([]byte, 2)
+		binary.BigEndian.PutUint16(data, d.MSS)
+		layer.Options = append(layer.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindMSS,
+			OptionLength: 4,
+			OptionData:   data,
+		})
+	}
+	if d.SACKPermitted && (syn == nil || hasSACKPermitted) {
+		layer.Options = append(layer.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindSACKPermitted,
+			OptionLength: 2,
+		})
+	}
+	if d.Timestamps && (syn == nil || tsEcr != nil) {
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint32(data, uint32(time.Now().UnixNano()/int64(time.Millisecond)))
+		copy(data[4:], tsEcr)
+		layer.Options = append(layer.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindTimestamps,
+			OptionLength: 10,
+			OptionData:   data,
+		})
+	}
+	if d.WindowScale >= 0 && (syn == nil || hasWindowScale) {
+		layer.Options = append(layer.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindNop,
+			OptionLength: 1,
+		}, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindWindowScale,
+			OptionLength: 3,
+			OptionData:   []byte{byte(d.WindowScale)},
+		})
+	}
+}
+
+// windowShift returns the shift count of windows to the peer after a handshake, which is the window scale of the
+// disguise if the handshake from the peer carries window scale, or 0. Handshakes to the peer always carry window scale
+// of the disguise if the SYN from the peer does.
+func windowShift(peer *layers.TCP) uint {
+	d := currentDisguise()
+	if d.WindowScale <= 0 || !hasOption(peer, layers.TCPOptionKindWindowScale) {
+		return 0
+	}
+
+	return uint(d.WindowScale)
+}
+
+// hasOption returns if the TCP layer carries the option.
+func hasOption(layer *layers.TCP, kind layers.TCPOptionKind) bool {
+	for _, option := range layer.Options {
+		if option.OptionType == kind {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,175 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zhxie/ikago/internal/log"
+	"os"
+	"sync"
+	"time"
+)
+
+// dumpQueueSize is the number of packets queued for writing to the dump file.
+const dumpQueueSize = 256
+
+// DumpInterface describes where a dumped packet comes from, which is written as an interface in the dump file.
+type DumpInterface int
+
+const (
+	// DumpListen describes embedded packets from clients.
+	DumpListen DumpInterface = iota
+	// DumpUpstream describes packets from upstream.
+	DumpUpstream
+	// DumpInjected describes packets injected to upstream.
+	DumpInjected
+	dumpInterfaces
+)
+
+func (i DumpInterface) String() string {
+	switch i {
+	case DumpListen:
+		return "listen"
+	case DumpUpstream:
+		return "upstream"
+	case DumpInjected:
+		return "injected"
+	default:
+		return fmt.Sprintf("%d", i)
+	}
+}
+
+type dumpPacket struct {
+	intf DumpInterface
+	t    time.Time
+	data []byte
+}
+
+// Dumper describes a writer of packets to a pcapng file for debugging. Packets are written in a routine so dumping
+// never blocks handling, and are dropped if the queue is full.
+type Dumper struct {
+	file     *os.File
+	writer   *pcapgo.NgWriter
+	lock     sync.RWMutex
+	isClosed bool
+	queue    chan dumpPacket
+	done     chan struct{}
+}
+
+// NewDumper returns a dumper writing to the file in the path. Packets from and injected to upstream are in the link
+// type, and embedded packets are in raw IP.
+func NewDumper(path string, linkType layers.LinkType) (*Dumper, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	intf := pcapgo.DefaultNgInterface
+	intf.Name = DumpListen.String()
+	intf.LinkType = layers.LinkTypeRaw
+
+	writer, err := pcapgo.NewNgWriterInterface(file, intf, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("create writer: %w", err)
+	}
+	for _, i := range []DumpInterface{DumpUpstream, DumpInjected} {
+		intf := pcapgo.DefaultNgInterface
+		intf.Name = i.String()
+		intf.LinkType = linkType
+
+		_, err := writer.AddInterface(intf)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("add interface %s: %w", i, err)
+		}
+	}
+
+	d := &Dumper{
+		file:   file,
+		writer: writer,
+		queue:  make(chan dumpPacket, dumpQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go d.run()
+
+	return d, nil
+}
+
+func (d *Dumper) run() {
+	defer close(d.done)
+
+	var isFailed bool
+	for p := range d.queue {
+		// Packets are drained but not written after the file fails
+		if isFailed {
+			continue
+		}
+
+		err := d.writer.WritePacket(gopacket.CaptureInfo{
+			Timestamp:      p.t,
+			CaptureLength:  len(p.data),
+			Length:         len(p.data),
+			InterfaceIndex: int(p.intf),
+		}, p.data)
+		if err == nil && len(d.queue) <= 0 {
+			// Flush when idle so the file is usable even if the program crashes
+			err = d.writer.Flush()
+		}
+		if err != nil {
+			log.Errorln(fmt.Errorf("dump: %w", err))
+			isFailed = true
+		}
+	}
+}
+
+// Dump queues a copy of the packet from the interface received or sent at the time. It never blocks, and the packet
+// is dropped if the queue is full.
+func (d *Dumper) Dump(intf DumpInterface, t time.Time, data []byte) {
+	if intf < 0 || intf >= dumpInterfaces {
+		return
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	b := make([]byte, len(data))
+	copy(b, data)
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	// Packets dumped after closing are ignored
+	if d.isClosed {
+		return
+	}
+
+	select {
+	case d.queue <- dumpPacket{intf: intf, t: t, data: b}:
+	default:
+	}
+}
+
+// Close writes queued packets, and flushes and closes the file.
+func (d *Dumper) Close() error {
+	d.lock.Lock()
+	if d.isClosed {
+		d.lock.Unlock()
+		return nil
+	}
+	d.isClosed = true
+	close(d.queue)
+	d.lock.Unlock()
+
+	<-d.done
+
+	err := d.writer.Flush()
+	if err != nil {
+		d.file.Close()
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	return d.file.Close()
+}
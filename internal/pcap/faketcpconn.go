@@ -1,6 +1,10 @@
 package pcap
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -9,16 +13,233 @@
 	"github.com/zhxie/ikago/internal/config"
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/log"
-	"math"
+	"io"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type clientIndicator struct {
+	// seen is accessed atomically and must be first to be aligned on 32-bit platforms
+	seen  int64
 	crypt crypto.Crypt
-	seq   uint32
-	ack   uint32
+	// seq and ack are guarded by the lock of the connection, as they are used in both reading and writing.
+	seq      uint32
+	ack      uint32
+	frames   *frameBuffer
+	features Feature
+	// counter is the counter of the next payload sent to the client.
+	counter uint64
+	replay  replayWindow
+	// port is the local port the client connects to.
+	port uint16
+	// synSeq is the TCP Seq of the SYN from the client.
+	synSeq uint32
+	// isReplied is true if the handshake reply to the SYN has been sent.
+	isReplied     bool
+	isEstablished bool
+	// helloDeadline is the time before which the client must authenticate with a hello.
+	helloDeadline   time.Time
+	isAuthenticated bool
+	// isAuthorized is true if the first payload from the client has been accepted by the auth function.
+	isAuthorized bool
+	// helloNonce is the nonce of the hello sent to the server or received from the client, and helloSeq is its TCP Seq.
+	helloNonce []byte
+	helloSeq   uint32
+	// hello is packets of the hello sent to the server, which are retransmitted until the server answers.
+	hello [][]byte
+	// isNegotiated is true if features have been negotiated with the server, payloads to the server are pending before.
+	isNegotiated bool
+	pending      [][]byte
+	// unread is the size of payloads from the client since the last segment to it, which shrinks the window.
+	unread int
+	// windowShift is the shift count of windows to the client negotiated in the handshake.
+	windowShift uint
+	// outOfWindow is the number of consecutive segments from the client out of the window.
+	outOfWindow int
+	// id is the IPv4 Id of the next packet sent to the client, which starts randomly in each client so Ids do not
+	// reveal traffic of other clients.
+	id uint16
+	// connect is the time when the client connects.
+	connect time.Time
+}
+
+// randomId returns a random initial IPv4 Id.
+func randomId() uint16 {
+	b := make([]byte, 2)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return uint16(time.Now().UnixNano())
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+// touch records the client is seen now.
+func (client *clientIndicator) touch() {
+	atomic.StoreInt64(&client.seen, time.Now().UnixNano())
+}
+
+// isIdle returns if the client has not been seen for the timeout.
+func (client *clientIndicator) isIdle(timeout time.Duration, now time.Time) bool {
+	return now.UnixNano()-atomic.LoadInt64(&client.seen) > int64(timeout)
+}
+
+// seqWindow is the max distance a segment may be ahead of the expected sequence number, which is a few segments. Gaps
+// left by lost segments are usually smaller, so segments further ahead are dropped before decryption.
+const seqWindow = 8 * MaxEthernetMTU
+
+// maxOutOfWindow is the number of consecutive segments out of the window after which segments are handled again, so
+// connections recover from long losses once payloads authenticate.
+const maxOutOfWindow = 16
+
+const (
+	segmentNew = iota
+	segmentBehind
+	segmentOutOfWindow
+)
+
+// classify returns the kind of a segment with the sequence number. Segments at or ahead of the expected sequence number
+// within the window are new, as lost segments are never retransmitted. Segments behind the ack are retransmitted,
+// replayed or reordered. The ack never advances here, so forged segments can not desynchronize the client. lock of
+// the connection must be held.
+func (client *clientIndicator) classify(seq uint32) int {
+	if seqAfter(client.ack, seq) {
+		return segmentBehind
+	}
+
+	// Segments continuing a frame are ahead of the ack
+	expected := client.ack
+	if client.frames.isPending() {
+		expected = client.frames.nextSeq
+	}
+	if seqAfter(seq, expected+seqWindow) {
+		client.outOfWindow++
+		if client.outOfWindow <= maxOutOfWindow {
+			return segmentOutOfWindow
+		}
+	}
+
+	return segmentNew
+}
+
+// accept advances the ack of the client past a segment with the sequence number and the length whose payload is
+// authenticated. Sequence numbers are compared with wraparound. lock of the connection must be held.
+func (client *clientIndicator) accept(seq uint32, length int) {
+	client.outOfWindow = 0
+
+	// Segments of a frame are accepted at once in the last segment, so the window shrinks with all of them
+	end := seq + uint32(length)
+	if seqAfter(end, client.ack) {
+		client.unread = client.unread + int(end-client.ack)
+		client.ack = end
+	}
+}
+
+// receiveWindow is the size of the pseudo receive buffer advertised in windows to clients.
+const receiveWindow = 65535
+
+// minReceiveWindow is the min size of the pseudo receive buffer, so the window never closes.
+const minReceiveWindow = 8192
+
+// window returns the window advertised to the client, which shrinks with payloads from the client like the receive
+// buffer of real TCP stacks and grows back once a segment is sent. Windows are scaled if window scale is negotiated in
+// the handshake. lock of the connection must be held.
+func (client *clientIndicator) window() uint16 {
+	w := receiveWindow - client.unread
+	if w < minReceiveWindow {
+		w = minReceiveWindow
+	}
+
+	return uint16(w >> client.windowShift)
+}
+
+// seqAfter returns if the sequence number a is after b in serial number arithmetic.
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// clientTimeout is the duration after which idle clients of connections are evicted.
+var clientTimeout int64
+
+// SetClientTimeout sets the duration after which idle clients are evicted when new clients connect. Clients never
+// expire if it is 0.
+func SetClientTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&clientTimeout, int64(timeout))
+}
+
+// maxClients is the max number of clients of connections serving multiple clients.
+var maxClients int64
+
+// isEvictingClients is 1 if the least recently seen client is evicted for new clients when clients are full.
+var isEvictingClients uint32
+
+// SetMaxClients sets the max number of clients of connections serving multiple clients. New clients are refused if
+// clients are full, or the least recently seen client is evicted for them if evict. Clients are unlimited if it is 0.
+func SetMaxClients(max int, evict bool) {
+	atomic.StoreInt64(&maxClients, int64(max))
+	if evict {
+		atomic.StoreUint32(&isEvictingClients, 1)
+	} else {
+		atomic.StoreUint32(&isEvictingClients, 0)
+	}
+}
+
+// disconnectFunc is called when a client of connections serving multiple clients disconnects.
+var disconnectFunc func(addr net.Addr)
+
+// SetDisconnectFunc sets the function called when a client of connections serving multiple clients disconnects with
+// TCP FIN or RST. It must be called before connections are opened.
+func SetDisconnectFunc(f func(addr net.Addr)) {
+	disconnectFunc = f
+}
+
+// acceptFunc decides if a new client of connections serving clients should be accepted.
+var acceptFunc func(src net.Addr) bool
+
+// SetAcceptFunc sets the function deciding if a new client of connections serving multiple clients and UDP listeners
+// should be accepted. Refused clients are dropped before any state is created for them. It must be called before
+// connections are opened.
+func SetAcceptFunc(f func(src net.Addr) bool) {
+	acceptFunc = f
+}
+
+// authFunc is called with the first payload from a client of connections serving clients.
+var authFunc func(src net.Addr, firstPayload []byte) bool
+
+// SetAuthFunc sets the function called with the first decrypted payload from a client of connections serving clients,
+// after the hello if any. The client is dropped if it returns false, or its payloads are read as usual. It must be
+// called before connections are opened.
+func SetAuthFunc(f func(src net.Addr, firstPayload []byte) bool) {
+	authFunc = f
+}
+
+// frameFunc is called with the size of each frame carrying payloads in connections.
+var frameFunc func(isWrite bool, size int)
+
+// SetFrameFunc sets the function called with the size of each frame carrying payloads written or read in connections
+// and UDP listeners, which is the packet on the wire in FakeTCP, or the datagram in UDP. Frames of handshakes and
+// hellos are not included. It must be called before connections are opened.
+func SetFrameFunc(f func(isWrite bool, size int)) {
+	frameFunc = f
+}
+
+// countFrame calls the frame function with the size of the frame if any.
+func countFrame(isWrite bool, size int) {
+	if frameFunc != nil {
+		frameFunc(isWrite, size)
+	}
+}
+
+// decryptFailures is the number of payloads failed to decrypt in all connections, which is accessed atomically.
+var decryptFailures uint64
+
+// DecryptFailures returns the number of payloads failed to decrypt in all connections and listeners.
+func DecryptFailures() uint64 {
+	return atomic.LoadUint64(&decryptFailures)
 }
 
 const establishDeadline = 3 * time.Second
@@ -26,6 +247,9 @@ type clientIndicator struct {
 
 // FakeTCPConn is a packet pcap network connection add fake TCP header to all traffic.
 type FakeTCPConn struct {
+	// replays and duplicates are accessed atomically and must be first to be aligned on 32-bit platforms
+	replays       uint64
+	duplicates    uint64
 	lock          sync.Mutex
 	conn          *RawConn
 	defrag        Defragmenter
@@ -37,18 +261,24 @@ type FakeTCPConn struct {
 	isConnected   bool
 	isReconnected bool
 	isClosed      bool
+	// isExpired is 1 if the only client is expired, which is accessed atomically.
+	isExpired     uint32
 	clientsLock   sync.RWMutex
 	clients       map[string]*clientIndicator
-	id            uint16
 	readDeadline  time.Time
 	writeDeadline time.Time
+	listener      *FakeTCPListener
+	maxFrameSize  int
+	features      Feature
 }
 
 func newConn() *FakeTCPConn {
 	conn := &FakeTCPConn{
-		defrag:  NewEasyDefragmenter(),
-		mtu:     MaxEthernetMTU,
-		clients: make(map[string]*clientIndicator),
+		defrag:       NewEasyDefragmenter(),
+		mtu:          MaxEthernetMTU,
+		clients:      make(map[string]*clientIndicator),
+		maxFrameSize: MaxFrameSize,
+		features:     Features(),
 	}
 	conn.defrag.SetDeadline(keepFragments)
 	return conn
@@ -115,7 +345,7 @@ func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 		return nil, fmt.Errorf("parse filter %s: %w", dstIP, err)
 	}
 
-	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcAddr.Port, filter, filter2))
+	rawConn, err := CreateRawConn(srcDev, dstDev, VLANFilter(RestrictFilter(srcDev, "dst", fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcAddr.Port, filter, filter2))))
 	if err != nil {
 		return nil, fmt.Errorf("create raw connection: %w", err)
 	}
@@ -130,14 +360,10 @@ func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 	return conn, nil
 }
 
-func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
-	addrs := make([]*net.TCPAddr, 0)
-	for _, ip := range srcDev.IPAddrs() {
-		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(srcPort)})
-	}
-	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
+func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPorts []uint16, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+	srcAddrs := multiTCPAddr(srcDev, srcPorts)
 
-	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && dst port %d", srcPort))
+	rawConn, err := CreateRawConn(srcDev, dstDev, VLANFilter(RestrictFilter(srcDev, "dst", fmt.Sprintf("tcp && %s", PortsFilter("dst", srcPorts)))))
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -148,7 +374,7 @@ func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto
 	}
 
 	conn := newConn()
-	conn.srcPort = srcPort
+	conn.srcPort = srcPorts[0]
 	conn.crypt = crypt
 	conn.mtu = mtu
 	conn.conn = rawConn
@@ -156,6 +382,18 @@ func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto
 	return conn, nil
 }
 
+// multiTCPAddr returns addresses of the device in the ports.
+func multiTCPAddr(dev *Device, ports []uint16) addr.MultiTCPAddr {
+	addrs := make([]*net.TCPAddr, 0)
+	for _, ip := range dev.IPAddrs() {
+		for _, port := range ports {
+			addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(port)})
+		}
+	}
+
+	return addr.MultiTCPAddr{Addrs: addrs}
+}
+
 func (c *FakeTCPConn) Read(b []byte) (n int, err error) {
 	n, _, err = c.ReadFrom(b)
 
@@ -179,8 +417,11 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	if !ok {
 		// Initial TCP Seq
 		client = &clientIndicator{
-			crypt: c.crypt,
-			seq:   0,
+			crypt:   c.crypt,
+			seq:     0,
+			frames:  newFrameBuffer(c.maxFrameSize),
+			id:      randomId(),
+			connect: time.Now(),
 		}
 
 		// Map client
@@ -190,13 +431,14 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	}
 
 	// Create layers
-	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, c.id, 128, c.RemoteDev().HardwareAddr())
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, client.id, 128, c.RemoteDev().HardwareAddr())
 	if err != nil {
 		return err
 	}
 
 	// Make TCP layer SYN
 	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, false)
+	disguiseTCPLayer(transportLayer.(*layers.TCP), nil)
 
 	// Serialize layers
 	data, err := Serialize(linkLayer, networkLayer, transportLayer)
@@ -215,7 +457,7 @@ func (c *FakeTCPConn) handshakeSYN() error {
 
 	// IPv4 Id
 	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
-		c.id++
+		client.id++
 	}
 
 	srcAddr := &net.TCPAddr{
@@ -228,42 +470,116 @@ func (c *FakeTCPConn) handshakeSYN() error {
 }
 
 func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
-	var (
-		err               error
-		newTransportLayer gopacket.SerializableLayer
-		newNetworkLayer   gopacket.SerializableLayer
-		newLinkLayer      gopacket.SerializableLayer
-	)
-
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	// Client
 	c.clientsLock.RLock()
-	client, ok := c.clients[indicator.Src().String()]
+	client, isMapped := c.clients[indicator.Src().String()]
 	c.clientsLock.RUnlock()
-	if !ok {
+	if isMapped && client.isEstablished && client.synSeq == indicator.TCPLayer().Seq {
+		// The SYN is retransmitted and arrives after the handshake ACK, which may have carried data already
+		log.Verbosef("Ignore retransmitted TCP SYN: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
+		client.touch()
+		return nil
+	}
+	if isMapped && client.isReplied && !client.isEstablished && client.synSeq == indicator.TCPLayer().Seq {
+		// The SYN+ACK is lost, reply it again without resetting the client
+		log.Verbosef("Reply retransmitted TCP SYN: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
+		client.touch()
+		return c.writeSYNACK(indicator, client, deriveISN(indicator.Src().(*net.TCPAddr), client.synSeq))
+	}
+
+	if !isMapped {
+		if acceptFunc != nil && !acceptFunc(indicator.Src()) {
+			log.Verbosef("Refuse TCP SYN: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
+			return nil
+		}
+
 		// Initial TCP Seq
 		client = &clientIndicator{
-			crypt: c.crypt,
-			seq:   0,
+			crypt:   crypto.CloneCrypt(c.crypt),
+			seq:     0,
+			frames:  newFrameBuffer(c.maxFrameSize),
+			id:      randomId(),
+			connect: time.Now(),
 		}
 
 		// Map client
 		c.clientsLock.Lock()
+		c.evictIdleClients()
+		if !c.makeRoom() {
+			c.clientsLock.Unlock()
+			log.Verbosef("Refuse TCP SYN over %d clients: %s -> %s\n", atomic.LoadInt64(&maxClients), indicator.Src().String(), indicator.Dst().String())
+			return nil
+		}
 		c.clients[indicator.Src().String()] = client
 		c.clientsLock.Unlock()
 	}
+	client.touch()
+	client.port = indicator.DstPort()
+	client.synSeq = indicator.TCPLayer().Seq
+	client.isEstablished = false
 	client.ack = indicator.TCPLayer().Seq + 1
 
+	// Initial TCP Seq, which is derived so handshake replies from other instances can be recognized
+	client.seq = deriveISN(indicator.Src().(*net.TCPAddr), indicator.TCPLayer().Seq)
+
+	// Frames from the previous connection will never complete
+	client.frames.reset()
+
+	// Counters restart in a new connection
+	client.counter = 0
+	client.replay.reset()
+
+	// Features are negotiated in the hello, the first payload is decided by its contents
+	client.features = 0
+	client.helloNonce = nil
+	client.isAuthenticated = false
+
+	// Expire the client if it does not authenticate in time
+	if atomic.LoadUint32(&isRequiringHello) != 0 {
+		src := indicator.Src().(*net.TCPAddr)
+		deadline := time.Now().Add(waitHello)
+		client.helloDeadline = deadline
+		time.AfterFunc(waitHello, func() {
+			c.expireHello(src, client, deadline)
+		})
+	}
+	client.isAuthorized = authFunc == nil
+
+	client.isReplied = false
+	err := c.writeSYNACK(indicator, client, client.seq)
+	if err != nil {
+		return err
+	}
+	client.isReplied = true
+
+	// TCP Seq
+	client.seq++
+
+	return nil
+}
+
+// writeSYNACK writes a handshake reply with the initial sequence number to the client. lock must be held.
+func (c *FakeTCPConn) writeSYNACK(indicator *PacketIndicator, client *clientIndicator, isn uint32) error {
+	var (
+		err               error
+		newTransportLayer gopacket.SerializableLayer
+		newNetworkLayer   gopacket.SerializableLayer
+		newLinkLayer      gopacket.SerializableLayer
+	)
+
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 64, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), isn, client.synSeq+1, c.conn, indicator.SrcIP(), client.id, 64, indicator.SrcHardwareAddr())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
 	// Make TCP layer SYN & ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), true, false, true)
+	disguiseTCPLayer(newTransportLayer.(*layers.TCP), indicator.TCPLayer())
+	client.windowShift = windowShift(indicator.TCPLayer())
 
 	// Serialize layers
 	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
@@ -277,12 +593,9 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 		return fmt.Errorf("write: %w", err)
 	}
 
-	// TCP Seq
-	client.seq++
-
 	// IPv4 Id
 	if newNetworkLayer.LayerType() == layers.LayerTypeIPv4 {
-		c.id++
+		client.id++
 	}
 
 	srcAddr := &net.TCPAddr{
@@ -315,9 +628,23 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 
 	// TCP Ack
 	client.ack = indicator.TCPLayer().Seq + 1
+	client.windowShift = windowShift(indicator.TCPLayer())
+
+	// Frames from the previous connection will never complete
+	client.frames.reset()
+
+	// Counters restart in a new connection
+	client.counter = 0
+	client.replay.reset()
+
+	// Features are negotiated in the hello, payloads are pending until the server answers
+	client.features = 0
+	client.isNegotiated = false
+	client.hello = nil
+	client.helloNonce = nil
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 128, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), client.id, 128, indicator.SrcHardwareAddr())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
@@ -339,7 +666,7 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 
 	// IPv4 Id
 	if newNetworkLayer.LayerType() == layers.LayerTypeIPv4 {
-		c.id++
+		client.id++
 	}
 
 	srcAddr := &net.TCPAddr{
@@ -348,6 +675,102 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 	}
 	log.Verbosef("Send TCP ACK: %s -> %s\n", srcAddr.String(), indicator.Src().String())
 
+	// Authenticate and negotiate features
+	if c.features.Has(FeatureHello) {
+		hello, err := createHello(c.features)
+		if err != nil {
+			return fmt.Errorf("create hello: %w", err)
+		}
+
+		seq := client.seq
+		packets, err := c.writeFeatures(hello, client, 0, indicator.SrcIP(), indicator.SrcPort())
+		if err != nil {
+			return fmt.Errorf("write hello: %w", err)
+		}
+		client.helloNonce = hello[12 : 12+helloNonceLength]
+		client.helloSeq = seq
+		client.hello = packets
+
+		log.Verbosef("Send hello: %s -> %s\n", srcAddr.String(), indicator.Src().String())
+
+		nonce := client.helloNonce
+		deadline := time.Now().Add(waitHello)
+		time.AfterFunc(helloRetransmit, func() {
+			c.retransmitHello(client, nonce, deadline)
+		})
+	} else {
+		// Connections without hello negotiate no features
+		err = c.negotiate(client, 0)
+		if err != nil {
+			return fmt.Errorf("server %s: %w", indicator.Src().String(), err)
+		}
+	}
+
+	return nil
+}
+
+// maxPending is the max number of payloads pending until features are negotiated with the server.
+const maxPending = 64
+
+// retransmitHello retransmits the hello with the nonce until the server answers it, and falls back to no features
+// after the deadline, as servers of older versions never answer.
+func (c *FakeTCPConn) retransmitHello(client *clientIndicator, nonce []byte, deadline time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if client.isNegotiated || !bytes.Equal(client.helloNonce, nonce) {
+		return
+	}
+
+	if time.Now().After(deadline) {
+		log.Infof("Server %s does not answer the hello, fall back to no features\n", c.RemoteAddr().String())
+
+		err := c.negotiate(client, 0)
+		if err != nil {
+			log.Errorln(fmt.Errorf("negotiate with server %s: %w", c.RemoteAddr().String(), err))
+		}
+
+		return
+	}
+
+	for _, packet := range client.hello {
+		_, err := c.conn.Write(packet)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("retransmit hello: %w", err))
+			break
+		}
+	}
+	log.Verbosef("Retransmit hello: %s -> %s\n", c.LocalAddr().String(), c.RemoteAddr().String())
+
+	time.AfterFunc(helloRetransmit, func() {
+		c.retransmitHello(client, nonce, deadline)
+	})
+}
+
+// negotiate applies the features negotiated with the server and writes pending payloads. Servers which do not support
+// strict features are forgotten. lock must be held.
+func (c *FakeTCPConn) negotiate(client *clientIndicator, features Feature) error {
+	pending := client.pending
+	client.pending = nil
+	client.hello = nil
+
+	err := checkFeatures(c.features, features)
+	if err != nil {
+		c.forgetClient(c.RemoteAddr().String())
+		return err
+	}
+
+	client.features = features
+	client.isNegotiated = true
+	log.Verbosef("Negotiate features with server %s: %s\n", c.RemoteAddr().String(), client.features)
+
+	for _, p := range pending {
+		err = c.write(p, client, c.dstAddr.IP, uint16(c.dstAddr.Port))
+		if err != nil {
+			return fmt.Errorf("write pending: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -376,6 +799,7 @@ type tuple struct {
 				ch <- tuple{err: fmt.Errorf("parse packet: %w", err)}
 				return
 			}
+			c.conn.ObserveVLAN(indicator)
 
 			// Handle fragments
 			indicator, err = c.defrag.Append(indicator)
@@ -402,11 +826,16 @@ type tuple struct {
 
 	tu := <-ch
 	if tu.err != nil {
+		// The client is expired and the connection is closed
+		if atomic.LoadUint32(&c.isExpired) != 0 {
+			tu.err = io.EOF
+		}
+
 		return 0, nil, &net.OpError{
 			Op:     "read",
 			Net:    "pcap",
 			Source: c.LocalAddr(),
-			Err:    err,
+			Err:    tu.err,
 		}
 	}
 
@@ -433,7 +862,34 @@ type tuple struct {
 	}
 
 	// Check TCP flags
-	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP && c.isPassive() {
+		if indicator.IsRST() || indicator.IsFIN() {
+			if indicator.IsRST() {
+				log.Infof("Receive TCP RST: %s -> %s\n", addr.String(), indicator.Dst().String())
+			} else {
+				log.Infof("Receive TCP FIN: %s -> %s\n", addr.String(), indicator.Dst().String())
+			}
+
+			c.forgetClient(addr.String())
+
+			// Connections with multiple clients keep serving others
+			if c.listener == nil {
+				if disconnectFunc != nil {
+					disconnectFunc(addr)
+				}
+
+				return 0, addr, nil
+			}
+
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    io.EOF,
+			}
+		}
+	} else if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
 		if indicator.IsRST() {
 			log.Errorf("Receive TCP RST: %s <- %s\n", indicator.Dst().String(), addr.String())
 
@@ -491,6 +947,11 @@ type tuple struct {
 		}
 	}
 
+	// Complete handshake, the ACK may carry data which is handled below
+	if c.isPassive() && indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP && indicator.IsACK() {
+		c.establish(addr.String(), indicator)
+	}
+
 	if indicator.Payload() == nil {
 		return 0, addr, nil
 	}
@@ -508,18 +969,81 @@ type tuple struct {
 			Err:    fmt.Errorf("client %s unauthorized", addr.String()),
 		}
 	}
+	client.touch()
 
-	// TCP Ack, always use the expected one
-	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
-		expectedAck := indicator.TCPLayer().Seq + uint32(len(indicator.Payload()))
-		if expectedAck > client.ack || (math.MaxUint32-indicator.TCPLayer().Seq < uint32(len(indicator.Payload()))) {
-			client.ack = expectedAck
+	// TCP Seq, the ack only advances once the payload is authenticated
+	isTCP := indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP
+	segment := segmentNew
+	c.lock.Lock()
+	features := client.features
+	isHelloAgain := false
+	if isTCP {
+		ack := client.ack
+		segment = client.classify(indicator.TCPLayer().Seq)
+		isHelloAgain = c.isPassive() && segment == segmentBehind && client.helloNonce != nil && indicator.TCPLayer().Seq == client.helloSeq
+		c.lock.Unlock()
+
+		if segment == segmentOutOfWindow {
+			log.Verbosef("Drop out of window TCP segment %d from %s (ack %d)\n", indicator.TCPLayer().Seq, addr.String(), ack)
+			return 0, addr, nil
+		}
+	} else {
+		c.lock.Unlock()
+	}
+
+	// Answer the retransmitted hello again, as the answer may be lost
+	if isHelloAgain {
+		log.Verbosef("Receive retransmitted hello: %s -> %s\n", addr.String(), indicator.Dst().String())
+
+		c.lock.Lock()
+		err = c.writeHelloReply(client, indicator.SrcIP(), indicator.SrcPort())
+		c.lock.Unlock()
+		if err != nil {
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("write hello reply: %w", err),
+			}
+		}
+
+		return 0, addr, nil
+	}
+
+	// Reassemble frames
+	payload := indicator.Payload()
+	if features.Has(FeatureFrame) && isTCP && segment == segmentBehind {
+		// Segments behind never join the frame in reassembly, and only whole frames can be authenticated
+		if !indicator.TCPLayer().PSH || !isWholeFrame(payload) {
+			c.dropDuplicate(indicator, addr)
+			return 0, addr, nil
+		}
+		payload = payload[frameHeaderLength:]
+	} else if features.Has(FeatureFrame) && isTCP {
+		payload, err = client.frames.append(indicator.TCPLayer().Seq, indicator.TCPLayer().PSH, payload)
+		if err != nil {
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("reassemble: %w", err),
+			}
+		}
+		if payload == nil {
+			// Incomplete frame
+			return 0, addr, nil
 		}
 	}
 
 	// Decrypt
-	contents, err := client.crypt.Decrypt(indicator.Payload())
+	buffer := acquireBuffer()
+	defer releaseBuffer(buffer)
+
+	contents, err := crypto.DecryptTo(client.crypt, *buffer, payload)
 	if err != nil {
+		atomic.AddUint64(&decryptFailures, 1)
 		return 0, addr, &net.OpError{
 			Op:     "read",
 			Net:    "pcap",
@@ -529,106 +1053,235 @@ type tuple struct {
 		}
 	}
 
-	copy(p, contents)
-
-	return len(contents), addr, err
-}
+	// Unpad
+	if features.Has(FeatureBucket) {
+		contents, err = unpadBucket(contents)
+		if err != nil {
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("unpad bucket: %w", err),
+			}
+		}
+	}
+	if features.Has(FeaturePadding) {
+		contents, err = unpad(contents)
+		if err != nil {
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("unpad: %w", err),
+			}
+		}
+	}
 
-func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	var (
-		dstIP   net.IP
-		dstPort uint16
-	)
+	// Reject replays
+	if features.Has(FeatureCounter) {
+		var counter uint64
 
-	ch := make(chan error)
+		counter, contents, err = parseCounter(contents)
+		if err != nil {
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("parse counter: %w", err),
+			}
+		}
+		if !client.replay.accept(counter) {
+			replays := atomic.AddUint64(&c.replays, 1)
+			log.Verbosef("Drop replayed payload %d from %s (%d replays)\n", counter, addr.String(), replays)
 
-	switch t := addr.(type) {
-	case *net.TCPAddr:
-		dstIP = addr.(*net.TCPAddr).IP
-		dstPort = uint16(addr.(*net.TCPAddr).Port)
-	case *net.UDPAddr:
-		dstIP = addr.(*net.UDPAddr).IP
-		dstPort = uint16(addr.(*net.UDPAddr).Port)
-	default:
-		return 0, &net.OpError{
-			Op:     "write",
-			Net:    "pcap",
-			Source: c.LocalAddr(),
-			Addr:   addr,
-			Err:    fmt.Errorf("type %T not support", t),
+			return 0, addr, nil
 		}
 	}
 
-	go func() {
-		var (
-			transportLayer gopacket.SerializableLayer
-			networkLayer   gopacket.SerializableLayer
-			linkLayer      gopacket.SerializableLayer
-			fragments      [][]byte
-		)
-
-		c.lock.Lock()
-		defer c.lock.Unlock()
+	// Drop duplicates, segments behind the ack with fresh counters are reordered instead
+	if segment == segmentBehind && !features.Has(FeatureCounter) {
+		c.dropDuplicate(indicator, addr)
+		return 0, addr, nil
+	}
 
-		// Client
-		c.clientsLock.RLock()
-		client, ok := c.clients[addr.String()]
-		c.clientsLock.RUnlock()
-		if !ok {
-			ch <- fmt.Errorf("client %s unrecognized", addr.String())
-			return
-		}
+	// Authenticate, the first payload from a	// Authenticate, the first payload from a pending client must be a hello unless the client does not support it
+	if c.isPassive() && !client.isAuthenticated {
+		if isHello(contents) {
+			err = c.acceptHello(client, contents, indicator)
+			if err != nil {
+				return 0, addr, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    err,
+				}
+			}
+			log.Verbosef("Receive hello: %s -> %s\n", addr.String(), indicator.Dst().String())
 
-		// Create layers
-		transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, c.id, 128, c.conn.RemoteDev().HardwareAddr())
-		if err != nil {
-			ch <- fmt.Errorf("create layers: %w", err)
-			return
+			return 0, addr, nil
 		}
-
-		// Encrypt
-		contents, err := client.crypt.Encrypt(p)
-		if err != nil {
-			ch <- fmt.Errorf("encrypt: %w", err)
-			return
+		if atomic.LoadUint32(&isRequiringHello) != 0 {
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("%w: hello required", ErrUnauthenticated),
+			}
 		}
 
-		// Fragment
-		fragments, err = CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), contents, c.mtu)
+		// Clients without hello are served without features like before
+		err = checkFeatures(c.features, 0)
 		if err != nil {
-			ch <- fmt.Errorf("fragment: %w", err)
-			return
+			c.forgetClient(addr.String())
+
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("client %s: %w", addr.String(), err),
+			}
 		}
 
-		// Write packet data
-		for _, frag := range fragments {
-			_, err := c.conn.Write(frag)
+		c.lock.Lock()
+		client.isAuthenticated = true
+		c.lock.Unlock()
+		log.Verbosef("Negotiate features with client %s: %s\n", addr.String(), Feature(0))
+	}
+
+	// Negotiate, the first payload from the server answers the hello
+	if !c.isPassive() {
+		c.lock.Lock()
+		if !client.isNegotiated {
+			var negotiated Feature
+
+			negotiated, err = verifyHelloReply(contents, client.helloNonce)
+			if err == nil {
+				if isTCP {
+					client.accept(indicator.TCPLayer().Seq, len(indicator.Payload()))
+				}
+				err = c.negotiate(client, c.features&negotiated)
+			}
+			c.lock.Unlock()
 			if err != nil {
-				ch <- fmt.Errorf("write: %w", err)
-				return
+				return 0, addr, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    fmt.Errorf("negotiate: %w", err),
+				}
 			}
+			log.Verbosef("Receive hello reply: %s <- %s\n", indicator.Dst().String(), addr.String())
+
+			return 0, addr, nil
 		}
+		c.lock.Unlock()
+	}
+
+	// Authorize, the first payload is checked before the client is trusted
+	if c.isPassive() && !client.isAuthorized {
+		if !authFunc(addr, contents) {
+			log.Infof("Reject unauthorized client %s\n", addr.String())
+
+			c.forgetClient(addr.String())
 
-		// TCP Seq
-		client.seq = client.seq + uint32(len(contents))
+			// Connections with multiple clients keep serving others
+			if c.listener == nil {
+				if disconnectFunc != nil {
+					disconnectFunc(addr)
+				}
+
+				return 0, addr, nil
+			}
 
-		// IPv4 Id
-		if networkLayer.LayerType() == layers.LayerTypeIPv4 {
-			switch transportLayer.LayerType() {
-			case layers.LayerTypeTCP:
-				c.id = c.id + uint16(len(fragments))
-			default:
-				c.id++
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    io.EOF,
 			}
 		}
 
-		ch <- nil
-		return
+		c.lock.Lock()
+		client.isAuthorized = true
+		c.lock.Unlock()
+	}
+
+	// TCP Ack
+	if isTCP {
+		c.lock.Lock()
+		client.accept(indicator.TCPLayer().Seq, len(indicator.Payload()))
+		c.lock.Unlock()
+	}
+	countFrame(false, indicator.Size())
+
+	copy(p, contents)
+
+	return len(contents), addr, err
+}
+
+func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	var (
+		dstIP   net.IP
+		dstPort uint16
+	)
+
+	ch := make(chan error)
+
+	switch t := addr.(type) {
+	case *net.TCPAddr:
+		dstIP = addr.(*net.TCPAddr).IP
+		dstPort = uint16(addr.(*net.TCPAddr).Port)
+	case *net.UDPAddr:
+		dstIP = addr.(*net.UDPAddr).IP
+		dstPort = uint16(addr.(*net.UDPAddr).Port)
+	default:
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("type %T not support", t),
+		}
+	}
+
+	go func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		// Client
+		c.clientsLock.RLock()
+		client, ok := c.clients[addr.String()]
+		c.clientsLock.RUnlock()
+		if !ok {
+			ch <- fmt.Errorf("client %s unrecognized", addr.String())
+			return
+		}
+
+		// Payloads are pending until features are negotiated with the server
+		if !c.isPassive() && !client.isNegotiated {
+			if len(client.pending) >= maxPending {
+				ch <- errors.New("too many payloads pending negotiation")
+				return
+			}
+			client.pending = append(client.pending, append([]byte(nil), p...))
+			ch <- nil
+			return
+		}
+
+		ch <- c.write(p, client, dstIP, dstPort)
 	}()
 	// Timeout
 	if !c.writeDeadline.IsZero() {
 		go func() {
-			duration := c.readDeadline.Sub(time.Now())
+			duration := c.writeDeadline.Sub(time.Now())
 			if duration > 0 {
 				time.Sleep(duration)
 			}
@@ -650,9 +1303,118 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return len(p), nil
 }
 
+// write writes contents to the client with the negotiated features. lock must be held.
+func (c *FakeTCPConn) write(p []byte, client *clientIndicator, dstIP net.IP, dstPort uint16) error {
+	fragments, err := c.writeFeatures(p, client, client.features, dstIP, dstPort)
+	if err != nil {
+		return err
+	}
+
+	for _, frag := range fragments {
+		countFrame(true, len(frag))
+	}
+
+	return nil
+}
+
+// writeFeatures writes contents to the client with the features, and returns packets written. lock must be held.
+func (c *FakeTCPConn) writeFeatures(p []byte, client *clientIndicator, features Feature, dstIP net.IP, dstPort uint16) ([][]byte, error) {
+	var (
+		transportLayer gopacket.SerializableLayer
+		networkLayer   gopacket.SerializableLayer
+		linkLayer      gopacket.SerializableLayer
+		fragments      [][]byte
+	)
+
+	// Reply on the port the client connects to
+	srcPort := c.srcPort
+	if client.port != 0 {
+		srcPort = client.port
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, client.id, 128, c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return nil, fmt.Errorf("create layers: %w", err)
+	}
+	transportLayer.(*layers.TCP).Window = client.window()
+	client.unread = 0
+
+	// Counter
+	contents := p
+	if features.Has(FeatureCounter) {
+		contents = prefixCounter(client.counter, contents)
+		client.counter++
+	}
+
+	// Pad
+	if features.Has(FeaturePadding) {
+		contents = pad(contents)
+	}
+	if features.Has(FeatureBucket) {
+		contents = padBucket(contents, c.mtu)
+	}
+
+	// Encrypt, leaving room for the length prefix of the frame
+	buffer := acquireBuffer()
+	defer releaseBuffer(buffer)
+
+	b := *buffer
+	isFrame := features.Has(FeatureFrame)
+	if isFrame {
+		b = b[:frameHeaderLength]
+	}
+	contents, err = crypto.EncryptTo(client.crypt, b, contents)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+
+	// Frame
+	if isFrame {
+		err = putFrameHeader(contents)
+		if err != nil {
+			return nil, fmt.Errorf("frame: %w", err)
+		}
+	}
+
+	// Fragment
+	fragments, err = CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), contents, c.mtu)
+	if err != nil {
+		return nil, fmt.Errorf("fragment: %w", err)
+	}
+
+	// Write packet data
+	for _, frag := range fragments {
+		_, err := c.conn.Write(frag)
+		if err != nil {
+			return nil, fmt.Errorf("write: %w", err)
+		}
+	}
+
+	// TCP Seq
+	client.seq = client.seq + uint32(len(contents))
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		switch transportLayer.LayerType() {
+		case layers.LayerTypeTCP:
+			client.id = client.id + uint16(len(fragments))
+		default:
+			client.id++
+		}
+	}
+
+	return fragments, nil
+}
+
 func (c *FakeTCPConn) Close() error {
 	c.isClosed = true
 
+	// Forget the client in the listener so it can connect again
+	if c.listener != nil {
+		c.listener.forget(c.RemoteAddr().String(), c)
+	}
+
 	err := c.conn.Close()
 	if err != nil {
 		return &net.OpError{
@@ -666,6 +1428,299 @@ func (c *FakeTCPConn) Close() error {
 	return nil
 }
 
+// dropDuplicate drops the retransmitted or replayed segment of the indicator.
+func (c *FakeTCPConn) dropDuplicate(indicator *PacketIndicator, addr net.Addr) {
+	duplicates := atomic.AddUint64(&c.duplicates, 1)
+	log.Verbosef("Drop duplicate TCP segment %d from %s (%d duplicates)\n", indicator.TCPLayer().Seq, addr.String(), duplicates)
+}
+
+// acceptHello authenticates the client with the hello, negotiates features and answers it. Clients which do not
+// support strict features are forgotten.
+func (c *FakeTCPConn) acceptHello(client *clientIndicator, contents []byte, indicator *PacketIndicator) error {
+	addr := indicator.Src().String()
+
+	nonce, remote, err := verifyHello(contents)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnauthenticated, err)
+	}
+
+	features := c.features & remote
+	err = checkFeatures(c.features, features)
+	if err != nil {
+		c.forgetClient(addr)
+		return fmt.Errorf("client %s: %w", addr, err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	client.isAuthenticated = true
+	client.helloNonce = nonce
+	if indicator.TCPLayer() != nil {
+		client.helloSeq = indicator.TCPLayer().Seq
+		client.accept(indicator.TCPLayer().Seq, len(indicator.Payload()))
+	}
+	client.features = features
+	log.Verbosef("Negotiate features with client %s: %s\n", addr, client.features)
+
+	err = c.writeHelloReply(client, indicator.SrcIP(), indicator.SrcPort())
+	if err != nil {
+		return fmt.Errorf("write hello reply: %w", err)
+	}
+
+	return nil
+}
+
+// writeHelloReply answers the hello from the client with the negotiated features. The answer is written without
+// features, as the client has not learnt them. lock must be held.
+func (c *FakeTCPConn) writeHelloReply(client *clientIndicator, dstIP net.IP, dstPort uint16) error {
+	_, err := c.writeFeatures(createHelloReply(client.helloNonce, client.features), client, 0, dstIP, dstPort)
+
+	return err
+}
+
+// establish marks the client established if the segment acknowledges the handshake.
+func (c *FakeTCPConn) establish(addr string, indicator *PacketIndicator) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr]
+	c.clientsLock.RUnlock()
+	if !ok || client.isEstablished || indicator.TCPLayer().Seq != client.synSeq+1 {
+		return
+	}
+
+	client.isEstablished = true
+
+	if len(indicator.Payload()) > 0 {
+		log.Verbosef("Receive TCP ACK with %d Bytes: %s -> %s\n", len(indicator.Payload()), addr, indicator.Dst().String())
+	} else {
+		log.Verbosef("Receive TCP ACK: %s -> %s\n", addr, indicator.Dst().String())
+	}
+}
+
+// isResettingUnauthenticated is 1 if clients expired for not authenticating are answered with TCP RST.
+var isResettingUnauthenticated uint32
+
+// SetResetUnauthenticated sets if clients expired for not authenticating in time are answered with TCP RST, so they
+// fail immediately instead of retransmitting to a connection which is gone.
+func SetResetUnauthenticated(reset bool) {
+	if reset {
+		atomic.StoreUint32(&isResettingUnauthenticated, 1)
+	} else {
+		atomic.StoreUint32(&isResettingUnauthenticated, 0)
+	}
+}
+
+// expireHello removes the client if it has not authenticated since the handshake with the deadline, and answers it
+// with TCP RST if enabled. Connections serving only the client are closed, and reading from them returns io.EOF.
+func (c *FakeTCPConn) expireHello(src *net.TCPAddr, client *clientIndicator, deadline time.Time) {
+	addr := src.String()
+
+	c.lock.Lock()
+	isPending := !client.isAuthenticated && client.helloDeadline.Equal(deadline)
+	c.lock.Unlock()
+	if !isPending {
+		return
+	}
+
+	c.clientsLock.Lock()
+	cur, ok := c.clients[addr]
+	if ok && cur == client {
+		delete(c.clients, addr)
+	}
+	c.clientsLock.Unlock()
+	if !ok || cur != client {
+		return
+	}
+
+	log.Verbosef("Expire unauthenticated client %s\n", addr)
+
+	if atomic.LoadUint32(&isResettingUnauthenticated) != 0 {
+		c.lock.Lock()
+		err := c.writeRST(client, src)
+		c.lock.Unlock()
+		if err != nil {
+			log.Verboseln(fmt.Errorf("reset unauthenticated client %s: %w", addr, err))
+		} else {
+			log.Verbosef("Send TCP RST: %s <- %s\n", addr, &net.TCPAddr{IP: c.LocalDev().IPAddr().IP, Port: int(client.port)})
+		}
+	}
+
+	if c.listener != nil {
+		atomic.StoreUint32(&c.isExpired, 1)
+		c.Close()
+	}
+}
+
+// writeRST writes a TCP RST to the client in its sequence. lock must be held.
+func (c *FakeTCPConn) writeRST(client *clientIndicator, dst *net.TCPAddr) error {
+	// Reply on the port the client connects to
+	srcPort := c.srcPort
+	if client.port != 0 {
+		srcPort = client.port
+	}
+
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(srcPort, uint16(dst.Port), client.seq, client.ack, c.conn, dst.IP, client.id, 64, c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+	FlagTCPLayer(transportLayer.(*layers.TCP), false, false, true)
+	transportLayer.(*layers.TCP).RST = true
+
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		client.id++
+	}
+
+	return nil
+}
+
+// isPassive returns if the connection serves clients instead of connecting to a server.
+func (c *FakeTCPConn) isPassive() bool {
+	return c.listener != nil || c.dstAddr == nil
+}
+
+// forgetClient removes the client so its packets are unauthorized until it handshakes again.
+func (c *FakeTCPConn) forgetClient(addr string) {
+	c.clientsLock.Lock()
+	defer c.clientsLock.Unlock()
+
+	delete(c.clients, addr)
+}
+
+// evictIdleClients removes clients which are idle for the client timeout. clientsLock must be held.
+func (c *FakeTCPConn) evictIdleClients() {
+	timeout := time.Duration(atomic.LoadInt64(&clientTimeout))
+	if timeout <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for addr, client := range c.clients {
+		if client.isIdle(timeout, now) {
+			delete(c.clients, addr)
+			log.Verbosef("Evict idle client %s\n", addr)
+		}
+	}
+}
+
+// makeRoom returns if a new client can be mapped, and evicts the least recently seen client if clients are full and
+// evicting is enabled. clientsLock must be held.
+func (c *FakeTCPConn) makeRoom() bool {
+	max := atomic.LoadInt64(&maxClients)
+	if max <= 0 || int64(len(c.clients)) < max {
+		return true
+	}
+	if atomic.LoadUint32(&isEvictingClients) == 0 {
+		return false
+	}
+
+	var (
+		lru  string
+		seen int64
+	)
+	for addr, client := range c.clients {
+		s := atomic.LoadInt64(&client.seen)
+		if lru == "" || s < seen {
+			lru, seen = addr, s
+		}
+	}
+	delete(c.clients, lru)
+	log.Infof("Evict client %s over %d clients\n", lru, max)
+
+	return true
+}
+
+// SetMaxFrameSize sets the max size of a frame. Partial frames larger than the size are dropped.
+func (c *FakeTCPConn) SetMaxFrameSize(size int) {
+	c.maxFrameSize = size
+
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+
+	for _, client := range c.clients {
+		client.frames = newFrameBuffer(size)
+	}
+}
+
+// FakeTCPClient describes a snapshot of a client of a FakeTCP connection.
+type FakeTCPClient struct {
+	Addr          string    `json:"address"`
+	Connect       time.Time `json:"connect"`
+	Seen          time.Time `json:"seen"`
+	Seq           uint32    `json:"seq"`
+	Ack           uint32    `json:"ack"`
+	IsEstablished bool      `json:"established"`
+	Features      string    `json:"features"`
+}
+
+// Clients returns snapshots of all clients of the connection sorted by addresses.
+func (c *FakeTCPConn) Clients() []FakeTCPClient {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+
+	result := make([]FakeTCPClient, 0, len(c.clients))
+	for addr, client := range c.clients {
+		result = append(result, FakeTCPClient{
+			Addr:          addr,
+			Connect:       client.connect,
+			Seen:          time.Unix(0, atomic.LoadInt64(&client.seen)),
+			Seq:           client.seq,
+			Ack:           client.ack,
+			IsEstablished: client.isEstablished,
+			Features:      client.features.String(),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Addr < result[j].Addr
+	})
+
+	return result
+}
+
+// Negotiated returns features negotiated with the peer of the connection, or none if the connection has no peer or
+// is not connected.
+func (c *FakeTCPConn) Negotiated() Feature {
+	if c.dstAddr == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+
+	client, ok := c.clients[c.dstAddr.String()]
+	if !ok {
+		return 0
+	}
+
+	return client.features
+}
+
+// Stats returns the numbers of packets received and dropped by the kernel or the interface in the handle of the
+// connection.
+func (c *FakeTCPConn) Stats() (received, dropped int, err error) {
+	return c.conn.Stats()
+}
+
 // LocalDev returns the local device.
 func (c *FakeTCPConn) LocalDev() *Device {
 	return c.conn.LocalDev()
@@ -735,22 +1790,22 @@ func (c *FakeTCPConn) Reconnect() error {
 
 // FakeTCPListener is a pcap network listener in FakeTCP network.
 type FakeTCPListener struct {
-	conn    *RawConn
-	srcPort uint16
-	crypt   crypto.Crypt
-	mtu     int
-	clients map[string]net.Conn
+	conn         *RawConn
+	srcPorts     []uint16
+	crypt        crypto.Crypt
+	mtu          int
+	clientsLock  sync.RWMutex
+	clients      map[string]net.Conn
+	maxFrameSize int
+	features     Feature
+	accept       func(addr net.Addr) bool
 }
 
-// ListenFakeTCP announces on the local network address in FakeTCP network.
-func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPListener, error) {
-	addrs := make([]*net.TCPAddr, 0)
-	for _, ip := range srcDev.IPAddrs() {
-		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(srcPort)})
-	}
-	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
+// ListenFakeTCP announces on the local network address in the ports in FakeTCP network.
+func ListenFakeTCP(srcDev, dstDev *Device, srcPorts []uint16, crypt crypto.Crypt, mtu int) (*FakeTCPListener, error) {
+	srcAddrs := multiTCPAddr(srcDev, srcPorts)
 
-	conn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && dst port %d", srcPort))
+	conn, err := CreateRawConn(srcDev, dstDev, VLANFilter(RestrictFilter(srcDev, "dst", fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && %s", PortsFilter("dst", srcPorts)))))
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -761,11 +1816,13 @@ func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, m
 	}
 
 	listener := &FakeTCPListener{
-		conn:    conn,
-		srcPort: srcPort,
-		crypt:   crypt,
-		mtu:     mtu,
-		clients: make(map[string]net.Conn),
+		conn:         conn,
+		srcPorts:     srcPorts,
+		crypt:        crypt,
+		mtu:          mtu,
+		clients:      make(map[string]net.Conn),
+		maxFrameSize: MaxFrameSize,
+		features:     Features(),
 	}
 
 	return listener, nil
@@ -793,13 +1850,20 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
+	l.clientsLock.RLock()
 	_, ok := l.clients[indicator.Src().String()]
+	l.clientsLock.RUnlock()
 	if ok {
 		// Duplicate
 		return nil, nil
 	}
+	if l.accept != nil && !l.accept(indicator.Src()) {
+		log.Verbosef("Refuse TCP SYN: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
+		return nil, nil
+	}
 
-	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
+	// Serve the client on the port it connects to
+	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), indicator.DstPort(), indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -810,15 +1874,23 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
+	conn.maxFrameSize = l.maxFrameSize
+	conn.features = l.features
+	conn.conn.ObserveVLAN(indicator)
 	conn.clients[indicator.Src().String()] = &clientIndicator{
-		crypt: l.crypt,
-		seq:   0,
-		ack:   0,
+		crypt:   crypto.CloneCrypt(l.crypt),
+		seq:     0,
+		ack:     0,
+		frames:  newFrameBuffer(l.maxFrameSize),
+		id:      randomId(),
+		connect: time.Now(),
 	}
+	conn.listener = l
 
 	// Handshaking with client (SYN+ACK)
 	err = conn.handshakeSYNACK(indicator)
 	if err != nil {
+		conn.Close()
 		return nil, &net.OpError{
 			Op:     "handshake",
 			Net:    "pcap",
@@ -829,11 +1901,34 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 	}
 
 	// Map client
+	l.clientsLock.Lock()
 	l.clients[indicator.Src().String()] = conn
+	l.clientsLock.Unlock()
 
 	return conn, nil
 }
 
+// SetMaxFrameSize sets the max size of a frame from clients. Partial frames larger than the size are dropped.
+func (l *FakeTCPListener) SetMaxFrameSize(size int) {
+	l.maxFrameSize = size
+}
+
+// SetAcceptFunc sets the function deciding if a SYN from the address should be accepted. Refused SYNs are dropped
+// without replying.
+func (l *FakeTCPListener) SetAcceptFunc(f func(addr net.Addr) bool) {
+	l.accept = f
+}
+
+func (l *FakeTCPListener) forget(addr string, conn net.Conn) {
+	l.clientsLock.Lock()
+	defer l.clientsLock.Unlock()
+
+	c, ok := l.clients[addr]
+	if ok && c == conn {
+		delete(l.clients, addr)
+	}
+}
+
 func (l *FakeTCPListener) Close() error {
 	err := l.conn.Close()
 	if err != nil {
@@ -856,7 +1951,7 @@ func (l *FakeTCPListener) Dev() *Device {
 func (l *FakeTCPListener) Addr() net.Addr {
 	return &net.TCPAddr{
 		IP:   l.Dev().IPAddr().IP,
-		Port: int(l.srcPort),
+		Port: int(l.srcPorts[0]),
 	}
 }
 
@@ -895,8 +1990,8 @@ func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 }
 
 // ListenFakeTCPWithKCP listens for incoming packets addressed to the local address in the FakeTCP network with KCP support.
-func ListenFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int, config *config.KCPConfig) (*kcp.Listener, error) {
-	conn, err := listenFakeTCPMulticast(srcDev, dstDev, srcPort, crypt, mtu)
+func ListenFakeTCPWithKCP(srcDev, dstDev *Device, srcPorts []uint16, crypt crypto.Crypt, mtu int, config *config.KCPConfig) (*kcp.Listener, error) {
+	conn, err := listenFakeTCPMulticast(srcDev, dstDev, srcPorts, crypt, mtu)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,1092 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Handshakes in tests are logged in info
+	log.SetLevel(log.LevelError)
+
+	os.Exit(m.Run())
+}
+
+// testLink is a link between connections in tests. Packets written to the link are read from it in order, with the
+// time they are written as capture timestamps unless pushed at a time.
+type testLink struct {
+	lock    sync.Mutex
+	packets [][]byte
+	times   []time.Time
+	// tap records packets written to the link if it is not nil.
+	tap *testTap
+}
+
+// testTap records packets written to links in order.
+type testTap struct {
+	lock    sync.Mutex
+	packets [][]byte
+}
+
+func (tap *testTap) record(b []byte) {
+	tap.lock.Lock()
+	defer tap.lock.Unlock()
+
+	tap.packets = append(tap.packets, b)
+}
+
+func (l *testLink) Write(b []byte) (int, error) {
+	l.push(b)
+
+	return len(b), nil
+}
+
+func (l *testLink) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	b, t := l.popAt()
+	if b == nil {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	return b, gopacket.CaptureInfo{Timestamp: t, CaptureLength: len(b), Length: len(b)}, nil
+}
+
+func (l *testLink) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (l *testLink) push(b []byte) {
+	l.pushAt(b, time.Now())
+}
+
+// pushAt pushes the packet captured at the time.
+func (l *testLink) pushAt(b []byte, t time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	l.packets = append(l.packets, packet)
+	l.times = append(l.times, t)
+	if l.tap != nil {
+		l.tap.record(packet)
+	}
+}
+
+func (l *testLink) pop() []byte {
+	b, _ := l.popAt()
+
+	return b
+}
+
+// popAt pops the packet and the time it is captured.
+func (l *testLink) popAt() ([]byte, time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.packets) <= 0 {
+		return nil, time.Time{}
+	}
+	b, t := l.packets[0], l.times[0]
+	l.packets, l.times = l.packets[1:], l.times[1:]
+
+	return b, t
+}
+
+func (l *testLink) len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return len(l.packets)
+}
+
+var (
+	testServerAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 443}
+	testClientAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 50000}
+)
+
+func newTestDevice(alias string, ip net.IP, hardwareAddr net.HardwareAddr) *Device {
+	return NewDevice(alias, []*net.IPNet{{IP: ip, Mask: net.CIDRMask(24, 32)}}, hardwareAddr, false)
+}
+
+// testPair is a client and a server of FakeTCP connected with links.
+type testPair struct {
+	client *FakeTCPConn
+	server *FakeTCPConn
+	// up is the link from the client to the server, and down is the reverse.
+	up   *testLink
+	down *testLink
+}
+
+func newTestPair(t *testing.T, clientFeatures, serverFeatures Feature) *testPair {
+	serverDev := newTestDevice("server", testServerAddr.IP, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01})
+	clientDev := newTestDevice("client", testClientAddr.IP, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02})
+
+	tp := &testPair{up: &testLink{}, down: &testLink{}}
+
+	crypt, err := crypto.ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp.client = newConn()
+	tp.client.conn = &RawConn{srcDev: clientDev, dstDev: serverDev, source: tp.down, sink: tp.up}
+	tp.client.srcPort = uint16(testClientAddr.Port)
+	tp.client.dstAddr = testServerAddr
+	tp.client.crypt = crypt
+	tp.client.features = clientFeatures
+	tp.client.appear = time.Now()
+
+	tp.server = newConn()
+	tp.server.conn = &RawConn{srcDev: serverDev, dstDev: clientDev, source: tp.up, sink: tp.down}
+	tp.server.srcPort = uint16(testServerAddr.Port)
+	tp.server.crypt = crypt
+	tp.server.features = serverFeatures
+
+	return tp
+}
+
+// readServer reads a packet from the client in the server.
+func (tp *testPair) readServer(t *testing.T) ([]byte, error) {
+	b := make([]byte, MaxMTU)
+	n, _, err := tp.server.ReadFrom(b)
+
+	return b[:n], err
+}
+
+// readClient reads a packet from the server in the client.
+func (tp *testPair) readClient(t *testing.T) ([]byte, error) {
+	b := make([]byte, MaxMTU)
+	n, _, err := tp.client.ReadFrom(b)
+
+	return b[:n], err
+}
+
+// handshake connects the client to the server, and reads all packets of the handshake in both sides.
+func (tp *testPair) handshake(t *testing.T) {
+	err := tp.client.handshakeSYN()
+	if err != nil {
+		t.Fatalf("handshake syn: %v", err)
+	}
+
+	tp.flush(t)
+}
+
+// flush reads packets in both sides until no packet is in flight, and fails if any reading fails.
+func (tp *testPair) flush(t *testing.T) {
+	for tp.up.len() > 0 || tp.down.len() > 0 {
+		for tp.up.len() > 0 {
+			_, err := tp.readServer(t)
+			if err != nil {
+				t.Fatalf("server read: %v", err)
+			}
+		}
+		for tp.down.len() > 0 {
+			_, err := tp.readClient(t)
+			if err != nil {
+				t.Fatalf("client read: %v", err)
+			}
+		}
+	}
+}
+
+// serverClient returns the client in the server.
+func (tp *testPair) serverClient(t *testing.T) *clientIndicator {
+	tp.server.clientsLock.RLock()
+	defer tp.server.clientsLock.RUnlock()
+
+	client, ok := tp.server.clients[testClientAddr.String()]
+	if !ok {
+		t.Fatal("client not found in server")
+	}
+
+	return client
+}
+
+// send writes the payload from the client and returns the segment sent.
+func (tp *testPair) send(t *testing.T, payload []byte) []byte {
+	_, err := tp.client.Write(payload)
+	if err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	if tp.up.len() != 1 {
+		t.Fatalf("client writes %d segments, expect 1", tp.up.len())
+	}
+
+	return tp.up.pop()
+}
+
+// forge returns the segment with the sequence number and the payload replaced.
+func forge(t *testing.T, segment []byte, seq uint32, payload []byte) []byte {
+	packet := gopacket.NewPacket(segment, layers.LayerTypeEthernet, gopacket.Default)
+	ethernetLayer := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcpLayer := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+
+	tcpLayer.Seq = seq
+	err := tcpLayer.SetNetworkLayerForChecksum(ipv4Layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ethernetLayer, ipv4Layer, tcpLayer, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+func tcpSeqOf(segment []byte) uint32 {
+	packet := gopacket.NewPacket(segment, layers.LayerTypeEthernet, gopacket.Default)
+
+	return packet.Layer(layers.LayerTypeTCP).(*layers.TCP).Seq
+}
+
+func tcpPayloadOf(segment []byte) []byte {
+	packet := gopacket.NewPacket(segment, layers.LayerTypeEthernet, gopacket.Default)
+
+	return packet.Layer(layers.LayerTypeTCP).(*layers.TCP).Payload
+}
+
+// testFeatureSets are features of tests with and without counters, which decide how segments behind are handled.
+var testFeatureSets = []struct {
+	name     string
+	features Feature
+}{
+	{name: "default", features: DefaultFeatures},
+	{name: "without counter", features: DefaultFeatures &^ FeatureCounter},
+}
+
+func TestFakeTCPConnRetransmitted(t *testing.T) {
+	for _, fs := range testFeatureSets {
+		t.Run(fs.name, func(t *testing.T) {
+			tp := newTestPair(t, fs.features, fs.features)
+			tp.handshake(t)
+
+			payload := []byte("retransmitted")
+			segment := tp.send(t, payload)
+			tp.up.push(segment)
+			tp.up.push(segment)
+
+			b, err := tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, payload) {
+				t.Fatalf("read %q, expect %q", b, payload)
+			}
+			ack := tp.serverClient(t).ack
+
+			b, err = tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != 0 {
+				t.Fatalf("read retransmitted %q", b)
+			}
+			if tp.serverClient(t).ack != ack {
+				t.Fatalf("ack changes from %d to %d", ack, tp.serverClient(t).ack)
+			}
+			if tp.server.replays+tp.server.duplicates != 1 {
+				t.Fatalf("%d replays and %d duplicates, expect 1 in total", tp.server.replays, tp.server.duplicates)
+			}
+		})
+	}
+}
+
+func TestFakeTCPConnReplayed(t *testing.T) {
+	for _, fs := range testFeatureSets {
+		t.Run(fs.name, func(t *testing.T) {
+			tp := newTestPair(t, fs.features, fs.features)
+			tp.handshake(t)
+
+			// The segment is replayed after later segments
+			payload := []byte("replayed")
+			segment := tp.send(t, payload)
+			later := tp.send(t, []byte("later"))
+			tp.up.push(segment)
+			tp.up.push(later)
+			tp.up.push(segment)
+
+			n := 0
+			for tp.up.len() > 0 {
+				b, err := tp.readServer(t)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Equal(b, payload) {
+					n++
+				}
+			}
+			if n != 1 {
+				t.Fatalf("read %d times, expect 1", n)
+			}
+		})
+	}
+}
+
+func TestFakeTCPConnReordered(t *testing.T) {
+	for _, fs := range testFeatureSets {
+		t.Run(fs.name, func(t *testing.T) {
+			tp := newTestPair(t, fs.features, fs.features)
+			tp.handshake(t)
+
+			first, second := []byte("first"), []byte("second")
+			segment1 := tp.send(t, first)
+			segment2 := tp.send(t, second)
+			tp.up.push(segment2)
+			tp.up.push(segment1)
+
+			b, err := tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, second) {
+				t.Fatalf("read %q, expect %q", b, second)
+			}
+
+			// Reordered segments are only recognized with counters
+			b, err = tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fs.features.Has(FeatureCounter) && !bytes.Equal(b, first) {
+				t.Fatalf("read %q, expect %q", b, first)
+			}
+			if !fs.features.Has(FeatureCounter) && len(b) != 0 {
+				t.Fatalf("read %q behind the ack", b)
+			}
+
+			// The ack is after both
+			end := tcpSeqOf(segment2) + uint32(len(tcpPayloadOf(segment2)))
+			if tp.serverClient(t).ack != end {
+				t.Fatalf("ack %d, expect %d", tp.serverClient(t).ack, end)
+			}
+		})
+	}
+}
+
+func TestFakeTCPConnForged(t *testing.T) {
+	tests := []struct {
+		name string
+		// offset is the offset of the forged segment from the expected sequence number.
+		offset uint32
+		// isDecrypted is true if the forged segment is decrypted before dropped.
+		isDecrypted bool
+	}{
+		{name: "in order", offset: 0, isDecrypted: true},
+		{name: "in window", offset: 1000, isDecrypted: true},
+		{name: "out of window", offset: seqWindow + 1000, isDecrypted: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestPair(t, DefaultFeatures, DefaultFeatures)
+			tp.handshake(t)
+
+			payload := []byte("genuine")
+			segment := tp.send(t, payload)
+			ack := tp.serverClient(t).ack
+
+			// Forged payloads are in the same size with a genuine one
+			garbage := make([]byte, len(tcpPayloadOf(segment)))
+			copy(garbage, tcpPayloadOf(segment))
+			garbage[len(garbage)-1] ^= 0xff
+			tp.up.push(forge(t, segment, ack+tt.offset, garbage))
+
+			failures := DecryptFailures()
+			_, err := tp.readServer(t)
+			if tt.isDecrypted && err == nil {
+				t.Fatal("read forged segment without error")
+			}
+			if !tt.isDecrypted && err != nil {
+				t.Fatal(err)
+			}
+			if isDecrypted := DecryptFailures() != failures; isDecrypted != tt.isDecrypted {
+				t.Fatalf("forged segment decrypted %t, expect %t", isDecrypted, tt.isDecrypted)
+			}
+			if tp.serverClient(t).ack != ack {
+				t.Fatalf("ack changes from %d to %d", ack, tp.serverClient(t).ack)
+			}
+
+			// The genuine segment is still accepted
+			tp.up.push(segment)
+			b, err := tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, payload) {
+				t.Fatalf("read %q, expect %q", b, payload)
+			}
+		})
+	}
+}
+
+func TestFakeTCPConnDuplicateSYN(t *testing.T) {
+	tests := []struct {
+		name string
+		// isEstablished is true if the SYN is duplicated after the handshake completes.
+		isEstablished bool
+		// offset is the offset of the sequence number of the duplicated SYN from the original one.
+		offset uint32
+		// isReset is true if the duplicated SYN starts a new connection.
+		isReset bool
+	}{
+		{name: "same before established", isEstablished: false, offset: 0, isReset: false},
+		{name: "same after established", isEstablished: true, offset: 0, isReset: false},
+		{name: "different after established", isEstablished: true, offset: 12345, isReset: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestPair(t, DefaultFeatures, DefaultFeatures)
+
+			err := tp.client.handshakeSYN()
+			if err != nil {
+				t.Fatal(err)
+			}
+			syn := tp.up.pop()
+			tp.up.push(syn)
+			_, err = tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			synACK := tp.down.pop()
+
+			if tt.isEstablished {
+				tp.down.push(synACK)
+				tp.flush(t)
+
+				// Data advances the ack
+				tp.up.push(tp.send(t, []byte("established")))
+				_, err = tp.readServer(t)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			client := tp.serverClient(t)
+			seq, ack := client.seq, client.ack
+
+			tp.up.push(forge(t, syn, tcpSeqOf(syn)+tt.offset, nil))
+			_, err = tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cur := tp.serverClient(t)
+			if tt.isReset {
+				if cur.ack != tcpSeqOf(syn)+tt.offset+1 {
+					t.Fatalf("ack %d, expect %d of the new connection", cur.ack, tcpSeqOf(syn)+tt.offset+1)
+				}
+
+				return
+			}
+			if cur != client || cur.seq != seq || cur.ack != ack {
+				t.Fatalf("client resets from seq %d ack %d to seq %d ack %d", seq, ack, cur.seq, cur.ack)
+			}
+
+			// The SYN+ACK is replied again in the same sequence number before the handshake completes
+			if !tt.isEstablished {
+				if tp.down.len() != 1 {
+					t.Fatalf("reply %d segments, expect 1", tp.down.len())
+				}
+				if s := tcpSeqOf(tp.down.pop()); s != tcpSeqOf(synACK) {
+					t.Fatalf("reply seq %d, expect %d", s, tcpSeqOf(synACK))
+				}
+
+				return
+			}
+
+			// The session keeps serving
+			payload := []byte("continued")
+			tp.up.push(tp.send(t, payload))
+			b, err := tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, payload) {
+				t.Fatalf("read %q, expect %q", b, payload)
+			}
+		})
+	}
+}
+
+func TestFakeTCPConnACKWithData(t *testing.T) {
+	tests := []struct {
+		name string
+		// synBefore and synAfter are true if the SYN is retransmitted before or after the ACK carrying data.
+		synBefore bool
+		synAfter  bool
+	}{
+		{name: "without retransmitted SYN"},
+		{name: "after retransmitted SYN", synBefore: true},
+		{name: "before retransmitted SYN", synAfter: true},
+	}
+
+	featureSets := []struct {
+		name     string
+		features Feature
+	}{
+		{name: "with hello", features: DefaultFeatures},
+		{name: "without hello", features: DefaultFeatures &^ FeatureHello},
+	}
+
+	for _, fs := range featureSets {
+		for _, tt := range tests {
+			fs, tt := fs, tt
+
+			t.Run(fs.name+" "+tt.name, func(t *testing.T) {
+				tp := newTestPair(t, fs.features, fs.features)
+
+				err := tp.client.handshakeSYN()
+				if err != nil {
+					t.Fatal(err)
+				}
+				syn := tp.up.pop()
+				tp.up.push(syn)
+				_, err = tp.readServer(t)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.synBefore {
+					tp.up.push(syn)
+					_, err = tp.readServer(t)
+					if err != nil {
+						t.Fatal(err)
+					}
+					tp.down.pop()
+				}
+				_, err = tp.readClient(t)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// The first payload is piggybacked on the ACK, which is the hello if supported, and payloads are pending
+				// until the hello is answered
+				payload := []byte("piggybacked")
+				_, err = tp.client.Write(payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ack := tp.up.pop()
+				first := tp.up.pop()
+				rest := tp.up.pop()
+				tp.up.push(forge(t, ack, tcpSeqOf(ack), tcpPayloadOf(first)))
+				if rest != nil {
+					tp.up.push(rest)
+				}
+
+				var read [][]byte
+				for tp.up.len() > 0 || tp.down.len() > 0 {
+					for tp.up.len() > 0 {
+						b, err := tp.readServer(t)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if len(b) > 0 {
+							read = append(read, b)
+						}
+					}
+					for tp.down.len() > 0 {
+						_, err := tp.readClient(t)
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				if tt.synAfter {
+					tp.up.push(syn)
+					_, err = tp.readServer(t)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if tp.down.len() != 0 {
+						t.Fatalf("reply %d segments to the retransmitted SYN, expect 0", tp.down.len())
+					}
+				}
+				if len(read) != 1 || !bytes.Equal(read[0], payload) {
+					t.Fatalf("read %d payloads, expect %q once", len(read), payload)
+				}
+
+				client := tp.serverClient(t)
+				if !client.isEstablished || !client.isAuthenticated {
+					t.Fatalf("client established %t and authenticated %t", client.isEstablished, client.isAuthenticated)
+				}
+
+				// The ack covers the ACK with data, so the next payload is in order
+				payload = []byte("next")
+				tp.up.push(tp.send(t, payload))
+				b, err := tp.readServer(t)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, payload) {
+					t.Fatalf("read %q, expect %q", b, payload)
+				}
+			})
+		}
+	}
+}
+
+// ipv4LengthOf returns the length of the IPv4 packet in the frame.
+func ipv4LengthOf(frame []byte) int {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+
+	return int(packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4).Length)
+}
+
+func TestFakeTCPConnMTU(t *testing.T) {
+	tests := []struct {
+		name string
+		mtu  int
+		size int
+	}{
+		{name: "split", mtu: 1500, size: 4000},
+		{name: "fit", mtu: 1500, size: 1000},
+		{name: "small", mtu: 576, size: 4000},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tp := newTestPair(t, DefaultFeatures, DefaultFeatures)
+			tp.client.mtu = test.mtu
+			tp.server.mtu = test.mtu
+			tp.handshake(t)
+
+			payload := make([]byte, test.size)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+
+			// From the server to the client, like packets from upstream, and the reverse
+			for _, dir := range []struct {
+				name  string
+				write func() error
+				link  *testLink
+				read  func(*testing.T) ([]byte, error)
+			}{
+				{
+					name: "down",
+					write: func() error {
+						_, err := tp.server.WriteTo(payload, testClientAddr)
+						return err
+					},
+					link: tp.down,
+					read: tp.readClient,
+				},
+				{
+					name: "up",
+					write: func() error {
+						_, err := tp.client.Write(payload)
+						return err
+					},
+					link: tp.up,
+					read: tp.readServer,
+				},
+			} {
+				err := dir.write()
+				if err != nil {
+					t.Fatalf("%s: write: %v", dir.name, err)
+				}
+
+				segments := make([][]byte, 0)
+				for dir.link.len() > 0 {
+					segments = append(segments, dir.link.pop())
+				}
+				if test.size > test.mtu && len(segments) < 2 {
+					t.Errorf("%s: %d bytes in %d segments, expect split", dir.name, test.size, len(segments))
+				}
+				for i, segment := range segments {
+					if length := ipv4LengthOf(segment); length > test.mtu {
+						t.Errorf("%s: segment %d is %d bytes, expect at most %d", dir.name, i, length, test.mtu)
+					}
+					dir.link.push(segment)
+				}
+
+				var b []byte
+				for dir.link.len() > 0 {
+					b, err = dir.read(t)
+					if err != nil {
+						t.Fatalf("%s: read: %v", dir.name, err)
+					}
+				}
+				if !bytes.Equal(b, payload) {
+					t.Errorf("%s: read %d bytes, expect %d bytes", dir.name, len(b), len(payload))
+				}
+			}
+		})
+	}
+}
+
+func TestSupportsKeepAlive(t *testing.T) {
+	tests := []struct {
+		name           string
+		serverFeatures Feature
+		isSupported    bool
+	}{
+		{name: "negotiated", serverFeatures: DefaultFeatures, isSupported: true},
+		{name: "not negotiated", serverFeatures: DefaultFeatures &^ FeatureKeepAlive, isSupported: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tp := newTestPair(t, DefaultFeatures, test.serverFeatures)
+			if SupportsKeepAlive(tp.client) {
+				t.Fatal("keep-alives supported before connected")
+			}
+
+			tp.handshake(t)
+			if isSupported := SupportsKeepAlive(tp.client); isSupported != test.isSupported {
+				t.Fatalf("keep-alives supported %t, expect %t", isSupported, test.isSupported)
+			}
+		})
+	}
+
+	// Connections other than FakeTCP never support keep-alives
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	if SupportsKeepAlive(conn) {
+		t.Fatal("keep-alives supported in a pipe")
+	}
+}
+
+func TestFakeTCPConnRequireHello(t *testing.T) {
+	SetRequireHello(true)
+	defer SetRequireHello(false)
+
+	tests := []struct {
+		name            string
+		clientFeatures  Feature
+		isAuthenticated bool
+	}{
+		{name: "with hello", clientFeatures: DefaultFeatures, isAuthenticated: true},
+		{name: "without hello", clientFeatures: DefaultFeatures &^ FeatureHello, isAuthenticated: false},
+		{name: "old", clientFeatures: 0, isAuthenticated: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tp := newTestPair(t, test.clientFeatures, DefaultFeatures)
+			tp.handshake(t)
+
+			client := tp.serverClient(t)
+			if client.helloDeadline.IsZero() {
+				t.Fatal("client never expires")
+			}
+
+			payload := []byte("first")
+			tp.up.push(tp.send(t, payload))
+			b, err := tp.readServer(t)
+			if !test.isAuthenticated {
+				if !errors.Is(err, ErrUnauthenticated) {
+					t.Fatalf("read error %v, expect %v", err, ErrUnauthenticated)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, payload) {
+				t.Fatalf("read %q, expect %q", b, payload)
+			}
+		})
+	}
+}
+
+func TestFakeTCPConnHandshakeWithoutFeatures(t *testing.T) {
+	tp := newTestPair(t, DefaultFeatures|FeaturePadding, DefaultFeatures|FeaturePadding)
+
+	err := tp.client.handshakeSYN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn := tp.up.pop()
+	tp.up.push(syn)
+	_, err = tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synACK := tp.down.pop()
+
+	// Features never appear in handshakes
+	for _, segment := range [][]byte{syn, synACK} {
+		packet := gopacket.NewPacket(segment, layers.LayerTypeEthernet, gopacket.Default)
+		tcpLayer := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		for _, option := range tcpLayer.Options {
+			switch option.OptionType {
+			case layers.TCPOptionKindEndList, layers.TCPOptionKindNop, layers.TCPOptionKindMSS, layers.TCPOptionKindWindowScale,
+				layers.TCPOptionKindSACKPermitted, layers.TCPOptionKindTimestamps:
+			default:
+				t.Fatalf("handshake with TCP option %s", option.OptionType)
+			}
+		}
+	}
+}
+
+func tcpLayerOf(segment []byte) *layers.TCP {
+	packet := gopacket.NewPacket(segment, layers.LayerTypeEthernet, gopacket.Default)
+
+	return packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+}
+
+func TestFakeTCPConnHandshakeSeqAck(t *testing.T) {
+	tp := newTestPair(t, DefaultFeatures&^FeatureHello, DefaultFeatures&^FeatureHello)
+
+	err := tp.client.handshakeSYN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syn := tp.up.pop()
+	tp.up.push(syn)
+	_, err = tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synACK := tp.down.pop()
+	tp.down.push(synACK)
+	_, err = tp.readClient(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := tcpLayerOf(tp.up.pop())
+
+	// The SYN+ACK carries options of Linux without a disguise
+	synLayer, synACKLayer := tcpLayerOf(syn), tcpLayerOf(synACK)
+	for _, kind := range []layers.TCPOptionKind{layers.TCPOptionKindMSS, layers.TCPOptionKindSACKPermitted, layers.TCPOptionKindWindowScale} {
+		if !hasOption(synACKLayer, kind) {
+			t.Errorf("SYN+ACK without TCP option %s", kind)
+		}
+	}
+	if synACKLayer.Ack != synLayer.Seq+1 {
+		t.Fatalf("SYN+ACK ack %d, expect %d", synACKLayer.Ack, synLayer.Seq+1)
+	}
+	if ack.Seq != synLayer.Seq+1 || ack.Ack != synACKLayer.Seq+1 {
+		t.Fatalf("ACK seq %d ack %d, expect %d %d", ack.Seq, ack.Ack, synLayer.Seq+1, synACKLayer.Seq+1)
+	}
+
+	// Data follows the handshake
+	payload := []byte("request")
+	segment := tp.send(t, payload)
+	data := tcpLayerOf(segment)
+	if data.Seq != synLayer.Seq+1 || data.Ack != synACKLayer.Seq+1 {
+		t.Fatalf("data seq %d ack %d, expect %d %d", data.Seq, data.Ack, synLayer.Seq+1, synACKLayer.Seq+1)
+	}
+	tp.up.push(segment)
+	b, err := tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatalf("read %q, expect %q", b, payload)
+	}
+
+	_, err = tp.server.WriteTo([]byte("response"), testClientAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment = tp.down.pop()
+	reply := tcpLayerOf(segment)
+	if reply.Seq != synACKLayer.Seq+1 || reply.Ack != data.Seq+uint32(len(data.Payload)) {
+		t.Fatalf("reply seq %d ack %d, expect %d %d", reply.Seq, reply.Ack, synACKLayer.Seq+1, data.Seq+uint32(len(data.Payload)))
+	}
+	if reply.Window != uint16((receiveWindow-len(data.Payload))>>uint(defaultDisguise.WindowScale)) {
+		t.Errorf("reply window %d, expect %d scaled", reply.Window, receiveWindow-len(data.Payload))
+	}
+	tp.down.push(segment)
+	_, err = tp.readClient(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := tcpLayerOf(tp.send(t, []byte("next")))
+	if next.Seq != data.Seq+uint32(len(data.Payload)) || next.Ack != reply.Seq+uint32(len(reply.Payload)) {
+		t.Fatalf("next seq %d ack %d, expect %d %d", next.Seq, next.Ack, data.Seq+uint32(len(data.Payload)), reply.Seq+uint32(len(reply.Payload)))
+	}
+}
+
+func TestFakeTCPConnHelloRetransmitted(t *testing.T) {
+	tp := newTestPair(t, DefaultFeatures, DefaultFeatures)
+
+	err := tp.client.handshakeSYN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tp.readClient(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The answer to the hello is lost
+	for tp.up.len() > 0 {
+		_, err = tp.readServer(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tp.down.pop() == nil {
+		t.Fatal("hello not answered")
+	}
+
+	// Payloads are pending until the hello is answered
+	payload := []byte("pending")
+	_, err = tp.client.Write(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp.up.len() != 0 {
+		t.Fatalf("client writes %d segments before negotiation, expect 0", tp.up.len())
+	}
+
+	tp.client.lock.Lock()
+	client := tp.client.clients[testServerAddr.String()]
+	nonce := client.helloNonce
+	tp.client.lock.Unlock()
+	tp.client.retransmitHello(client, nonce, time.Now().Add(waitHello))
+
+	// The server answers the retransmitted hello again
+	_, err = tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tp.readClient(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := tp.client.Negotiated(); f != DefaultFeatures {
+		t.Fatalf("client negotiates %s, expect %s", f, DefaultFeatures)
+	}
+
+	b, err := tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatalf("read %q, expect %q", b, payload)
+	}
+}
+
+func TestFakeTCPConnHelloFallback(t *testing.T) {
+	tp := newTestPair(t, DefaultFeatures, DefaultFeatures)
+
+	err := tp.client.handshakeSYN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tp.readClient(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server never sees the hello, like servers of older versions ignoring it
+	_, err = tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.up.pop()
+
+	payload := []byte("pending")
+	_, err = tp.client.Write(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp.client.lock.Lock()
+	client := tp.client.clients[testServerAddr.String()]
+	nonce := client.helloNonce
+	tp.client.lock.Unlock()
+	tp.client.retransmitHello(client, nonce, time.Now().Add(-time.Second))
+
+	if f := tp.client.Negotiated(); f != 0 {
+		t.Fatalf("client negotiates %s, expect %s", f, Feature(0))
+	}
+	b, err := tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatalf("read %q, expect %q", b, payload)
+	}
+}
+
+func TestFakeTCPConnExpireHello(t *testing.T) {
+	tests := []struct {
+		name    string
+		isReset bool
+	}{
+		{name: "silent", isReset: false},
+		{name: "reset", isReset: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetRequireHello(true)
+			defer SetRequireHello(false)
+			SetResetUnauthenticated(test.isReset)
+			defer SetResetUnauthenticated(false)
+
+			tp := newTestPair(t, DefaultFeatures, DefaultFeatures)
+
+			// The client never sends the hello
+			err := tp.client.handshakeSYN()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			synACK := tp.down.pop()
+
+			client := tp.serverClient(t)
+			tp.server.expireHello(testClientAddr, client, client.helloDeadline)
+
+			tp.server.clientsLock.RLock()
+			_, isMapped := tp.server.clients[testClientAddr.String()]
+			tp.server.clientsLock.RUnlock()
+			if isMapped {
+				t.Fatal("expired client still mapped")
+			}
+
+			if !test.isReset {
+				if tp.down.len() != 0 {
+					t.Fatalf("reply %d segments, expect 0", tp.down.len())
+				}
+
+				return
+			}
+			if tp.down.len() != 1 {
+				t.Fatalf("reply %d segments, expect 1", tp.down.len())
+			}
+			packet := gopacket.NewPacket(tp.down.pop(), layers.LayerTypeEthernet, gopacket.Default)
+			tcpLayer := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if !tcpLayer.RST {
+				t.Fatal("reply without RST")
+			}
+			if tcpLayer.Seq != tcpSeqOf(synACK)+1 || int(tcpLayer.DstPort) != testClientAddr.Port {
+				t.Fatalf("RST seq %d to port %d, expect seq %d to port %d", tcpLayer.Seq, tcpLayer.DstPort, tcpSeqOf(synACK)+1, testClientAddr.Port)
+			}
+		})
+	}
+}
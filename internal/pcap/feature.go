@@ -0,0 +1,130 @@
+package pcap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Feature describes wire-affecting features negotiated in the encrypted hello after handshakes, so they are never
+// visible on the wire.
+type Feature uint32
+
+const (
+	// FeatureFrame prefixes each encrypted payload with its length so payloads split across segments can be
+	// reassembled.
+	FeatureFrame Feature = 1 << iota
+	// FeaturePadding pads each payload with random bytes before encryption.
+	FeaturePadding
+	// FeatureCounter prefixes each payload with an increasing counter before encryption so replayed payloads can be
+	// rejected.
+	FeatureCounter
+	// FeatureHello sends an encrypted hello carrying features after handshakes, which is answered by the server with
+	// the negotiated features. Other features are only negotiated with it.
+	FeatureHello
+	// FeatureBucket pads each payload to a multiple of the bucket size before encryption, so sizes of embedded packets
+	// are hidden.
+	FeatureBucket
+	// FeatureKeepAlive accepts keep-alives between payloads. Keep-alives are only sent to peers negotiating the feature,
+	// as peers without it treat them as malformed packets.
+	FeatureKeepAlive
+)
+
+// DefaultFeatures are features enabled by default.
+const DefaultFeatures = FeatureFrame | FeatureCounter | FeatureHello | FeatureKeepAlive
+
+// strictFeatures are features which must be supported by peers if enabled, negotiations with peers which do not
+// support them fail.
+const strictFeatures = FeatureBucket
+
+// isRequiringHello is 1 if listeners refuse payloads from clients which do not authenticate with a hello, which is
+// accessed atomically.
+var isRequiringHello uint32
+
+// SetRequireHello sets if listeners require clients to authenticate with a hello, so clients are never served without
+// authentication, and unauthenticated clients are expired after handshakes.
+func SetRequireHello(require bool) {
+	if require {
+		atomic.StoreUint32(&isRequiringHello, 1)
+	} else {
+		atomic.StoreUint32(&isRequiringHello, 0)
+	}
+}
+
+// featureNames are registered features and their names. A feature must be registered before it is put on the wire.
+var featureNames = map[Feature]string{
+	FeatureFrame:     "frame",
+	FeaturePadding:   "padding",
+	FeatureCounter:   "counter",
+	FeatureHello:     "hello",
+	FeatureBucket:    "bucket",
+	FeatureKeepAlive: "keepalive",
+}
+
+// enabledFeatures are features advertised by new connections and listeners.
+var enabledFeatures = uint32(DefaultFeatures)
+
+// SetFeatures sets features advertised by new connections and listeners.
+func SetFeatures(f Feature) error {
+	for i := 0; i < 32; i++ {
+		bit := Feature(1 << i)
+		if f&bit == 0 {
+			continue
+		}
+		_, ok := featureNames[bit]
+		if !ok {
+			return fmt.Errorf("feature %d not support", bit)
+		}
+	}
+
+	atomic.StoreUint32(&enabledFeatures, uint32(f))
+
+	return nil
+}
+
+// Features returns features advertised by new connections and listeners.
+func Features() Feature {
+	return Feature(atomic.LoadUint32(&enabledFeatures))
+}
+
+// ParseFeature returns the feature by its name.
+func ParseFeature(s string) (Feature, error) {
+	for f, name := range featureNames {
+		if name == strings.ToLower(s) {
+			return f, nil
+		}
+	}
+
+	return 0, fmt.Errorf("feature %s not support", s)
+}
+
+// Has returns if all of the given features are enabled.
+func (f Feature) Has(feature Feature) bool {
+	return f&feature == feature
+}
+
+func (f Feature) String() string {
+	names := make([]string, 0)
+	for bit, name := range featureNames {
+		if f&bit != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) <= 0 {
+		return "none"
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// checkFeatures returns an error if the negotiated features miss any strict feature enabled locally.
+func checkFeatures(local, negotiated Feature) error {
+	missing := local & strictFeatures &^ negotiated
+	if missing != 0 {
+		return fmt.Errorf("feature %s not support by peer", missing)
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package pcap
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// featureCombinations returns all combinations of registered features. The empty combination behaves like peers before
+// features, and clients without hello negotiate no features.
+func featureCombinations() []Feature {
+	var registered Feature
+	for f := range featureNames {
+		registered = registered | f
+	}
+
+	combinations := make([]Feature, 0)
+	for f := Feature(0); f <= registered; f++ {
+		if f&^registered == 0 {
+			combinations = append(combinations, f)
+		}
+	}
+
+	return combinations
+}
+
+func featureCombinationName(f Feature) string {
+	if f == 0 {
+		return "old"
+	}
+
+	return fmt.Sprintf("new(%s)", f)
+}
+
+// TestFeatureMatrix runs every combination of clients against every combination of servers. Negotiations fail only if
+// a strict feature is missing, and payloads are exchanged in both directions otherwise.
+func TestFeatureMatrix(t *testing.T) {
+	combinations := featureCombinations()
+
+	for _, clientFeatures := range combinations {
+		for _, serverFeatures := range combinations {
+			clientFeatures, serverFeatures := clientFeatures, serverFeatures
+
+			name := fmt.Sprintf("%s client to %s server", featureCombinationName(clientFeatures), featureCombinationName(serverFeatures))
+			t.Run(name, func(t *testing.T) {
+				testFeatures(t, clientFeatures, serverFeatures)
+			})
+		}
+	}
+}
+
+func testFeatures(t *testing.T, clientFeatures, serverFeatures Feature) {
+	tp := newTestPair(t, clientFeatures, serverFeatures)
+
+	// Features are only negotiated in the hello
+	negotiated := Feature(0)
+	if clientFeatures.Has(FeatureHello) {
+		negotiated = clientFeatures & serverFeatures
+	}
+	isServerRefused := checkFeatures(serverFeatures, negotiated) != nil
+	isClientRefused := checkFeatures(clientFeatures, negotiated) != nil
+
+	err := tp.client.handshakeSYN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tp.readServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients without hello refuse servers missing their strict features right after handshakes
+	_, err = tp.readClient(t)
+	if !clientFeatures.Has(FeatureHello) && isClientRefused {
+		if err == nil {
+			t.Fatal("client refuses false, expect true")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Server refuses clients missing its strict features in the hello or the first payload
+	if !clientFeatures.Has(FeatureHello) {
+		_, err = tp.client.Write([]byte("first"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for tp.up.len() > 0 {
+		var b []byte
+
+		b, err = tp.readServer(t)
+		if err != nil {
+			break
+		}
+		if len(b) > 0 && !bytes.Equal(b, []byte("first")) {
+			t.Fatalf("server reads %q, expect %q", b, "first")
+		}
+	}
+	if isServerRefused != (err != nil) {
+		t.Fatalf("server refuses %t, expect %t: %v", err != nil, isServerRefused, err)
+	}
+	if isServerRefused {
+		return
+	}
+
+	// Client refuses servers missing its strict features in the answer to the hello
+	if clientFeatures.Has(FeatureHello) {
+		_, err = tp.readClient(t)
+		if isClientRefused != (err != nil) {
+			t.Fatalf("client refuses %t, expect %t: %v", err != nil, isClientRefused, err)
+		}
+		if isClientRefused {
+			return
+		}
+	}
+
+	tp.flush(t)
+
+	if f := tp.serverClient(t).features; f != negotiated {
+		t.Fatalf("server negotiates %s, expect %s", f, negotiated)
+	}
+	if f := tp.client.clients[testServerAddr.String()].features; f != negotiated {
+		t.Fatalf("client negotiates %s, expect %s", f, negotiated)
+	}
+
+	// Client to server
+	payloads := [][]byte{[]byte("ping")}
+	if negotiated.Has(FeatureFrame) {
+		// Frames split across segments
+		payloads = append(payloads, bytes.Repeat([]byte("framed"), 1000))
+	}
+	for _, payload := range payloads {
+		_, err = tp.client.Write(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var read [][]byte
+		for tp.up.len() > 0 {
+			b, err := tp.readServer(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) > 0 {
+				read = append(read, b)
+			}
+		}
+		if len(read) != 1 || !bytes.Equal(read[0], payload) {
+			t.Fatalf("server reads %d payloads, expect %d Bytes once", len(read), len(payload))
+		}
+	}
+
+	// Server to client
+	payload := []byte("pong")
+	_, err = tp.server.WriteTo(payload, testClientAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tp.readClient(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Fatalf("client reads %q, expect %q", b, payload)
+	}
+}
@@ -8,12 +8,16 @@
 	"github.com/google/gopacket/layers"
 	"github.com/zhxie/ikago/internal/log"
 	"sort"
+	"sync"
 	"time"
 )
 
 type fragFlow struct {
-	id  uint16
-	src string
+	source   string
+	src      string
+	dst      string
+	id       uint16
+	protocol layers.IPProtocol
 }
 
 type fragIndicator struct {
@@ -89,6 +93,11 @@ func (indicator *fragIndicator) concatenate() (*PacketIndicator, error) {
 	if indicator.frags[0].LinkLayer() == nil {
 		data, err = Serialize(newNetworkLayer.(gopacket.SerializableLayer),
 			gopacket.Payload(contents))
+	} else if indicator.frags[0].Dot1QLayer() != nil {
+		data, err = Serialize(indicator.frags[0].LinkLayer().(gopacket.SerializableLayer),
+			indicator.frags[0].Dot1QLayer(),
+			newNetworkLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(contents))
 	} else {
 		data, err = Serialize(indicator.frags[0].LinkLayer().(gopacket.SerializableLayer),
 			newNetworkLayer.(gopacket.SerializableLayer),
@@ -127,15 +136,18 @@ type Defragmenter interface {
 	SetDeadline(t time.Duration)
 }
 
-// EasyDefragmenter is a machine defragments packets which also accepts non-standard packets.
+// EasyDefragmenter is a machine defragments packets which also accepts non-standard packets. Fragments are keyed by
+// the source, destination, Id and protocol, and are dropped if they are not completed before the deadline.
 type EasyDefragmenter struct {
-	frags    map[fragFlow]*fragIndicator
-	deadline time.Duration
+	lock      sync.Mutex
+	frags     map[fragFlow]*fragIndicator
+	deadline  time.Duration
+	lastSweep time.Time
 }
 
 // NewEasyDefragmenter returns a new easy defragmenter.
 func NewEasyDefragmenter() *EasyDefragmenter {
-	return &EasyDefragmenter{frags: make(map[fragFlow]*fragIndicator)}
+	return &EasyDefragmenter{frags: make(map[fragFlow]*fragIndicator), lastSweep: time.Now()}
 }
 
 func (defrag *EasyDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator, error) {
@@ -146,16 +158,36 @@ func (defrag *EasyDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator,
 
 // AppendOriginal adds a fragment to the defragmenter and returns packets with and without defragmentation.
 func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketIndicator, []*PacketIndicator, error) {
+	return defrag.append("", ind)
+}
+
+// AppendFrom adds a fragment received from the source like the address of a client to the defragmenter. Fragments from
+// different sources are never concatenated.
+func (defrag *EasyDefragmenter) AppendFrom(source string, ind *PacketIndicator) (*PacketIndicator, error) {
+	indicator, _, err := defrag.append(source, ind)
+
+	return indicator, err
+}
+
+func (defrag *EasyDefragmenter) append(source string, ind *PacketIndicator) (*PacketIndicator, []*PacketIndicator, error) {
 	if !ind.IsFrag() {
 		return ind, append(make([]*PacketIndicator, 0), ind), nil
 	}
 
+	defrag.lock.Lock()
+	defer defrag.lock.Unlock()
+
+	defrag.sweep()
+
 	flow := fragFlow{
-		id:  ind.NetworkId(),
-		src: ind.SrcIP().String(),
+		source:   source,
+		src:      ind.SrcIP().String(),
+		dst:      ind.DstIP().String(),
+		id:       ind.NetworkId(),
+		protocol: ind.IPv4Layer().Protocol,
 	}
 	fragIndicator, ok := defrag.frags[flow]
-	if !ok || fragIndicator == nil {
+	if !ok {
 		fragIndicator = newFragIndicator()
 		defrag.frags[flow] = fragIndicator
 	}
@@ -174,7 +206,7 @@ func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketInd
 	}
 
 	// Remove completed fragments
-	defrag.frags[flow] = nil
+	delete(defrag.frags, flow)
 
 	// Concatenate fragments
 	indicator, err := fragIndicator.concatenate()
@@ -185,7 +217,30 @@ func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketInd
 	return indicator, fragIndicator.frags, nil
 }
 
+// sweep drops fragments which are not completed before the deadline. It runs at most once per deadline.
+func (defrag *EasyDefragmenter) sweep() {
+	if defrag.deadline <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(defrag.lastSweep) < defrag.deadline {
+		return
+	}
+	defrag.lastSweep = now
+
+	for flow, indicator := range defrag.frags {
+		if now.Sub(indicator.lastSeen) > defrag.deadline {
+			log.Verbosef("Drop incomplete fragments %d from %s to %s\n", flow.id, flow.src, flow.dst)
+			delete(defrag.frags, flow)
+		}
+	}
+}
+
 func (defrag *EasyDefragmenter) SetDeadline(t time.Duration) {
+	defrag.lock.Lock()
+	defer defrag.lock.Unlock()
+
 	defrag.deadline = t
 }
 
@@ -402,6 +457,9 @@ func CreateTCPSegmentPackets(linkLayer gopacket.Layer, networkLayer gopacket.Net
 			newTCPLayer = &tempTCPLayer
 			newTCPLayer.Seq = newTCPLayer.Seq + uint32(i)
 
+			// Only push the last segment
+			newTCPLayer.PSH = tcpLayer.PSH && i+length >= len(payload)
+
 			// Set network layer for transport layer
 			err = newTCPLayer.SetNetworkLayerForChecksum(newNetworkLayer)
 			if err != nil {
@@ -414,7 +472,7 @@ func CreateTCPSegmentPackets(linkLayer gopacket.Layer, networkLayer gopacket.Net
 			} else {
 				data, err = Serialize(linkLayer.(gopacket.SerializableLayer),
 					newNetworkLayer.(gopacket.SerializableLayer),
-					tcpLayer,
+					newTCPLayer,
 					payload[i:i+length])
 			}
 			if err != nil {
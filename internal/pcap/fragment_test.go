@@ -0,0 +1,196 @@
+package pcap
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	testEmbSrcIP = net.IPv4(192, 168, 1, 2).To4()
+	testEmbDstIP = net.IPv4(198, 51, 100, 1).To4()
+)
+
+// createUDPFragments returns an embedded UDP datagram with the payload from port 40000 to port 8000 in two IPv4
+// fragments, which are split after the first 24 bytes of the UDP datagram.
+func createUDPFragments(t *testing.T, id uint16, payload []byte) [][]byte {
+	udpLayer := &layers.UDP{SrcPort: 40000, DstPort: 8000}
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		Id:       id,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    testEmbSrcIP,
+		DstIP:    testEmbDstIP,
+	}
+	err := udpLayer.SetNetworkLayerForChecksum(ipv4Layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	datagram, err := Serialize(udpLayer, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datagram) <= 24 {
+		t.Fatalf("datagram of %d bytes is too short to fragment", len(datagram))
+	}
+
+	first := *ipv4Layer
+	first.Flags = layers.IPv4MoreFragments
+	firstData, err := Serialize(&first, gopacket.Payload(datagram[:24]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := *ipv4Layer
+	second.FragOffset = 24 / 8
+	secondData, err := Serialize(&second, gopacket.Payload(datagram[24:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return [][]byte{firstData, secondData}
+}
+
+// appendFragments appends fragments from the source to the defragmenter, and returns the packet once it is completed.
+func appendFragments(t *testing.T, defrag *EasyDefragmenter, source string, frags [][]byte) *PacketIndicator {
+	var result *PacketIndicator
+	for i, frag := range frags {
+		ind, err := ParseEmbPacket(frag)
+		if err != nil {
+			t.Fatalf("parse fragment %d: %v", i, err)
+		}
+
+		result, err = defrag.AppendFrom(source, ind)
+		if err != nil {
+			t.Fatalf("append fragment %d: %v", i, err)
+		}
+		if result != nil && i < len(frags)-1 {
+			t.Fatalf("completed at fragment %d of %d", i, len(frags))
+		}
+	}
+
+	return result
+}
+
+func checkUDPDatagram(t *testing.T, ind *PacketIndicator, payload []byte) {
+	if ind == nil {
+		t.Fatal("fragments not completed")
+	}
+	if ind.IsFrag() {
+		t.Error("reassembled packet is a fragment")
+	}
+	if ind.UDPLayer() == nil {
+		t.Fatal("reassembled packet is not UDP")
+	}
+	if !ind.SrcIP().Equal(testEmbSrcIP) || ind.SrcPort() != 40000 || !ind.DstIP().Equal(testEmbDstIP) || ind.DstPort() != 8000 {
+		t.Errorf("reassembled packet is %s -> %s", ind.Src(), ind.Dst())
+	}
+	if !bytes.Equal(ind.Payload(), payload) {
+		t.Errorf("reassembled payload is %q, expect %q", ind.Payload(), payload)
+	}
+}
+
+func TestEasyDefragmenter(t *testing.T) {
+	payload := []byte("a UDP datagram larger than the path MTU")
+	frags := createUDPFragments(t, 1, payload)
+
+	tests := []struct {
+		name  string
+		frags [][]byte
+	}{
+		{name: "in order", frags: frags},
+		{name: "reversed", frags: [][]byte{frags[1], frags[0]}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defrag := NewEasyDefragmenter()
+			checkUDPDatagram(t, appendFragments(t, defrag, "", test.frags), payload)
+			if len(defrag.frags) != 0 {
+				t.Errorf("%d entries left after completed", len(defrag.frags))
+			}
+		})
+	}
+}
+
+func TestEasyDefragmenterNotFragment(t *testing.T) {
+	udpLayer := CreateUDPLayer(40000, 8000)
+	ipv4Layer, err := CreateIPv4Layer(testEmbSrcIP, testEmbDstIP, 1, 64, udpLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Serialize(ipv4Layer, udpLayer, gopacket.Payload("whole"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkUDPDatagram(t, appendFragments(t, NewEasyDefragmenter(), "", [][]byte{data}), []byte("whole"))
+}
+
+func TestEasyDefragmenterInterleaved(t *testing.T) {
+	defrag := NewEasyDefragmenter()
+	a := createUDPFragments(t, 1, []byte("the first datagram in fragments"))
+	b := createUDPFragments(t, 2, []byte("the second datagram in fragments"))
+
+	if ind := appendFragments(t, defrag, "", a[:1]); ind != nil {
+		t.Fatal("completed with the first fragment")
+	}
+	if ind := appendFragments(t, defrag, "", b[:1]); ind != nil {
+		t.Fatal("completed with the first fragment")
+	}
+	checkUDPDatagram(t, appendFragments(t, defrag, "", b[1:]), []byte("the second datagram in fragments"))
+	checkUDPDatagram(t, appendFragments(t, defrag, "", a[1:]), []byte("the first datagram in fragments"))
+}
+
+func TestEasyDefragmenterSources(t *testing.T) {
+	defrag := NewEasyDefragmenter()
+	payload := []byte("datagrams from clients sharing addresses")
+	frags := createUDPFragments(t, 1, payload)
+
+	// Fragments from different clients are never concatenated
+	if ind := appendFragments(t, defrag, "10.0.0.2:50000", frags[:1]); ind != nil {
+		t.Fatal("completed with the first fragment")
+	}
+	if ind := appendFragments(t, defrag, "10.0.0.3:50000", frags[1:]); ind != nil {
+		t.Fatal("completed with fragments from another client")
+	}
+	if len(defrag.frags) != 2 {
+		t.Errorf("%d entries, expect 2", len(defrag.frags))
+	}
+
+	checkUDPDatagram(t, appendFragments(t, defrag, "10.0.0.2:50000", frags[1:]), payload)
+}
+
+func TestEasyDefragmenterDeadline(t *testing.T) {
+	defrag := NewEasyDefragmenter()
+	defrag.SetDeadline(10 * time.Millisecond)
+
+	payload := []byte("a datagram whose last fragment is lost")
+	frags := createUDPFragments(t, 1, payload)
+	if ind := appendFragments(t, defrag, "", frags[:1]); ind != nil {
+		t.Fatal("completed with the first fragment")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The incomplete entry is expired by the next fragment of another datagram
+	other := createUDPFragments(t, 2, []byte("another datagram in fragments"))
+	if ind := appendFragments(t, defrag, "", other[:1]); ind != nil {
+		t.Fatal("completed with the first fragment")
+	}
+	if len(defrag.frags) != 1 {
+		t.Errorf("%d entries, expect the expired entry dropped", len(defrag.frags))
+	}
+
+	// A late fragment of the expired datagram never completes it
+	if ind := appendFragments(t, defrag, "", frags[1:]); ind != nil {
+		t.Error("completed with a fragment of an expired datagram")
+	}
+	checkUDPDatagram(t, appendFragments(t, defrag, "", other[1:]), []byte("another datagram in fragments"))
+}
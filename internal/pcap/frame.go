@@ -0,0 +1,142 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/zhxie/ikago/internal/log"
+	"math"
+	"time"
+)
+
+// frameHeaderLength is the length of the length prefix of a frame.
+const frameHeaderLength = 2
+
+// MaxFrameSize is the max size of a frame including its length prefix.
+const MaxFrameSize = frameHeaderLength + math.MaxUint16
+
+const keepFrames = 30 * time.Second
+
+// putFrameHeader puts the length prefix in the front of a frame whose contents follow the room of the prefix.
+func putFrameHeader(b []byte) error {
+	size := len(b) - frameHeaderLength
+	if size > math.MaxUint16 {
+		return fmt.Errorf("frame size %d out of range", size)
+	}
+
+	binary.BigEndian.PutUint16(b, uint16(size))
+
+	return nil
+}
+
+// isWholeFrame returns if the segment carries exactly one frame.
+func isWholeFrame(b []byte) bool {
+	if len(b) < frameHeaderLength {
+		return false
+	}
+
+	return int(binary.BigEndian.Uint16(b)) == len(b)-frameHeaderLength
+}
+
+// frameBuffer is a buffer reassembles frames from TCP segments.
+type frameBuffer struct {
+	buffer    []byte
+	max       int
+	nextSeq   uint32
+	isStarted bool
+	isSynced  bool
+	appear    time.Time
+}
+
+func newFrameBuffer(max int) *frameBuffer {
+	if max <= 0 || max > MaxFrameSize {
+		max = MaxFrameSize
+	}
+
+	return &frameBuffer{
+		max:      max,
+		isSynced: true,
+	}
+}
+
+func (fb *frameBuffer) reset() {
+	fb.buffer = nil
+	fb.isStarted = false
+	fb.isSynced = true
+}
+
+// isPending returns if a frame is partially buffered.
+func (fb *frameBuffer) isPending() bool {
+	return len(fb.buffer) > 0
+}
+
+func (fb *frameBuffer) drop(psh bool) int {
+	n := len(fb.buffer)
+
+	// Wait for the end of a frame before starting a new one
+	fb.buffer = nil
+	fb.isSynced = psh
+
+	return n
+}
+
+// append appends a segment to the buffer and returns a completed frame without its length prefix, or nil if the frame
+// is incomplete. A frame is always ended with a segment with PSH.
+func (fb *frameBuffer) append(seq uint32, psh bool, payload []byte) ([]byte, error) {
+	if len(payload) <= 0 {
+		return nil, nil
+	}
+
+	isContinuous := fb.isSynced && (!fb.isStarted || seq == fb.nextSeq)
+	fb.isStarted = true
+	fb.nextSeq = seq + uint32(len(payload))
+
+	// Discard stale frame
+	if isContinuous && len(fb.buffer) > 0 && time.Now().Sub(fb.appear) > keepFrames {
+		isContinuous = false
+	}
+
+	if !isContinuous {
+		n := fb.drop(psh)
+
+		// A segment carries a whole frame is still acceptable
+		if psh && isWholeFrame(payload) {
+			if n > 0 {
+				log.Verbosef("Drop %d Bytes of incomplete frame\n", n)
+			}
+
+			return payload[frameHeaderLength:], nil
+		}
+
+		return nil, fmt.Errorf("discontinuous segment, drop %d Bytes", n+len(payload))
+	}
+
+	if len(fb.buffer) <= 0 {
+		fb.appear = time.Now()
+	}
+	fb.buffer = append(fb.buffer, payload...)
+
+	if len(fb.buffer) >= frameHeaderLength {
+		length := frameHeaderLength + int(binary.BigEndian.Uint16(fb.buffer))
+		if length > fb.max {
+			n := fb.drop(psh)
+			return nil, fmt.Errorf("frame size %d out of range, drop %d Bytes", length, n)
+		}
+		if len(fb.buffer) > length {
+			n := fb.drop(psh)
+			return nil, fmt.Errorf("frame overflow, drop %d Bytes", n)
+		}
+		if len(fb.buffer) == length {
+			contents := fb.buffer[frameHeaderLength:]
+			fb.buffer = nil
+
+			return contents, nil
+		}
+	}
+
+	if psh {
+		n := fb.drop(psh)
+		return nil, fmt.Errorf("incomplete frame, drop %d Bytes", n)
+	}
+
+	return nil, nil
+}
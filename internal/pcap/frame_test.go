@@ -0,0 +1,145 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// frame returns the contents prefixed with the length prefix as a frame.
+func frame(contents []byte) []byte {
+	b := make([]byte, frameHeaderLength+len(contents))
+	binary.BigEndian.PutUint16(b, uint16(len(contents)))
+	copy(b[frameHeaderLength:], contents)
+
+	return b
+}
+
+// frameStep is a segment appended to the frame buffer, or a reset of the buffer.
+type frameStep struct {
+	// isReset is true if the buffer is reset before the segment, like in a reconnect.
+	isReset bool
+	seq     uint32
+	psh     bool
+	payload []byte
+	// expect is the frame completed by the segment, or nil.
+	expect []byte
+	isErr  bool
+}
+
+func TestFrameBufferAppend(t *testing.T) {
+	contents := []byte("contents of a frame")
+	f := frame(contents)
+	next := frame([]byte("next"))
+
+	tests := []struct {
+		name  string
+		max   int
+		steps []frameStep
+	}{
+		{
+			name: "whole",
+			steps: []frameStep{
+				{seq: 100, psh: true, payload: f, expect: contents},
+			},
+		},
+		{
+			name: "split inside the length prefix",
+			steps: []frameStep{
+				{seq: 100, payload: f[:1]},
+				{seq: 101, psh: true, payload: f[1:], expect: contents},
+			},
+		},
+		{
+			name: "split at the end of the length prefix",
+			steps: []frameStep{
+				{seq: 100, payload: f[:frameHeaderLength]},
+				{seq: 100 + frameHeaderLength, psh: true, payload: f[frameHeaderLength:], expect: contents},
+			},
+		},
+		{
+			name: "split at a byte boundary",
+			steps: []frameStep{
+				{seq: 100, payload: f[:7]},
+				{seq: 107, payload: f[7:8]},
+				{seq: 108, psh: true, payload: f[8:], expect: contents},
+			},
+		},
+		{
+			name: "split across sequence number wraparound",
+			steps: []frameStep{
+				{seq: 0xfffffffe, payload: f[:5]},
+				{seq: 3, psh: true, payload: f[5:], expect: contents},
+			},
+		},
+		{
+			name: "length prefix over max",
+			max:  16,
+			steps: []frameStep{
+				{seq: 100, payload: f[:4], isErr: true},
+				// The rest of the oversized frame is dropped until its end
+				{seq: 104, psh: true, payload: f[4:], isErr: true},
+				{seq: 100 + uint32(len(f)), psh: true, payload: next, expect: []byte("next")},
+			},
+		},
+		{
+			name: "overflow",
+			steps: []frameStep{
+				{seq: 100, psh: true, payload: append(append([]byte{}, f...), 0), isErr: true},
+				{seq: 101 + uint32(len(f)), psh: true, payload: next, expect: []byte("next")},
+			},
+		},
+		{
+			name: "discontinuous",
+			steps: []frameStep{
+				{seq: 100, payload: f[:5]},
+				// The segment in between is lost
+				{seq: 110, psh: true, payload: f[10:], isErr: true},
+				{seq: 100 + uint32(len(f)), psh: true, payload: next, expect: []byte("next")},
+			},
+		},
+		{
+			name: "whole after discontinuous",
+			steps: []frameStep{
+				{seq: 100, payload: f[:5]},
+				{seq: 200, psh: true, payload: next, expect: []byte("next")},
+			},
+		},
+		{
+			name: "incomplete with push",
+			steps: []frameStep{
+				{seq: 100, psh: true, payload: f[:5], isErr: true},
+				{seq: 105, psh: true, payload: next, expect: []byte("next")},
+			},
+		},
+		{
+			name: "reset across a reconnect",
+			steps: []frameStep{
+				{seq: 100, payload: f[:5]},
+				// The new connection starts in another sequence number with a frame split
+				{isReset: true, seq: 5000, payload: f[:3]},
+				{seq: 5003, psh: true, payload: f[3:], expect: contents},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFrameBuffer(tt.max)
+
+			for i, step := range tt.steps {
+				if step.isReset {
+					fb.reset()
+				}
+
+				b, err := fb.append(step.seq, step.psh, step.payload)
+				if step.isErr != (err != nil) {
+					t.Fatalf("step %d: error %v, expect error %t", i, err, step.isErr)
+				}
+				if !bytes.Equal(b, step.expect) {
+					t.Fatalf("step %d: frame %q, expect %q", i, b, step.expect)
+				}
+			}
+		})
+	}
+}
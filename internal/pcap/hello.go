@@ -0,0 +1,133 @@
+package pcap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrUnauthenticated is returned when reading payloads from a client which has not sent a valid hello.
+var ErrUnauthenticated = errors.New("client unauthenticated")
+
+// helloMagic is the magic prefixing a hello from a client.
+var helloMagic = []byte("IKGH")
+
+// helloReplyMagic is the magic prefixing the answer to a hello from the server.
+var helloReplyMagic = []byte("IKGR")
+
+// helloNonceLength is the length of the random nonce in a hello.
+const helloNonceLength = 16
+
+// helloLength is the length of a hello or its answer, including the magic, the timestamp in nanoseconds, the nonce and
+// the features.
+const helloLength = 4 + 8 + helloNonceLength + 4
+
+// helloSkew is the max difference between the timestamp in a hello and the local time.
+const helloSkew = 30 * time.Second
+
+// waitHello is the duration for clients to authenticate after handshakes before being expired, and for servers to
+// answer hellos before clients fall back to no features.
+const waitHello = 10 * time.Second
+
+// helloRetransmit is the interval of retransmitting a hello which has not been answered.
+const helloRetransmit = time.Second
+
+// createHello returns a hello advertising the features with the current time and a random nonce.
+func createHello(features Feature) ([]byte, error) {
+	nonce := make([]byte, helloNonceLength)
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("nonce: %w", err)
+	}
+
+	return marshalHello(helloMagic, nonce, features), nil
+}
+
+// createHelloReply returns the answer to a hello with the nonce, carrying the negotiated features.
+func createHelloReply(nonce []byte, features Feature) []byte {
+	return marshalHello(helloReplyMagic, nonce, features)
+}
+
+func marshalHello(magic, nonce []byte, features Feature) []byte {
+	b := make([]byte, helloLength)
+	copy(b, magic)
+	binary.BigEndian.PutUint64(b[4:], uint64(time.Now().UnixNano()))
+	copy(b[12:], nonce)
+	binary.BigEndian.PutUint32(b[12+helloNonceLength:], uint32(features))
+
+	return b
+}
+
+// isHello returns if the contents look like a hello, so they can be told from payloads of clients without hello.
+func isHello(b []byte) bool {
+	return len(b) == helloLength && bytes.Equal(b[:4], helloMagic)
+}
+
+// parseHello returns the nonce and the features in a fresh hello or its answer with the magic.
+func parseHello(magic, b []byte) ([]byte, Feature, error) {
+	if len(b) != helloLength || !bytes.Equal(b[:4], magic) {
+		return nil, 0, errors.New("invalid hello")
+	}
+
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(b[4:])))
+	now := time.Now()
+	if t.Before(now.Add(-helloSkew)) || t.After(now.Add(helloSkew)) {
+		return nil, 0, fmt.Errorf("hello at %s out of range", t.Format(time.RFC3339))
+	}
+
+	nonce := append([]byte(nil), b[12:12+helloNonceLength]...)
+	features := Feature(binary.BigEndian.Uint32(b[12+helloNonceLength:]))
+
+	return nonce, features, nil
+}
+
+var (
+	helloNoncesLock sync.Mutex
+	helloNonces     = make(map[string]time.Time)
+)
+
+// verifyHello returns the nonce and the features advertised in a fresh hello. A nonce is accepted only once so hellos
+// captured from other connections cannot be replayed.
+func verifyHello(b []byte) ([]byte, Feature, error) {
+	nonce, features, err := parseHello(helloMagic, b)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	helloNoncesLock.Lock()
+	defer helloNoncesLock.Unlock()
+
+	// Nonces older than the skew cannot be replayed anyway
+	now := time.Now()
+	for nonce, seen := range helloNonces {
+		if now.Sub(seen) > 2*helloSkew {
+			delete(helloNonces, nonce)
+		}
+	}
+
+	_, ok := helloNonces[string(nonce)]
+	if ok {
+		return nil, 0, errors.New("replayed hello")
+	}
+	helloNonces[string(nonce)] = now
+
+	return nonce, features, nil
+}
+
+// verifyHelloReply returns the features in the answer to the hello with the nonce.
+func verifyHelloReply(b, nonce []byte) (Feature, error) {
+	replyNonce, features, err := parseHello(helloReplyMagic, b)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(replyNonce, nonce) {
+		return 0, errors.New("hello reply to another hello")
+	}
+
+	return features, nil
+}
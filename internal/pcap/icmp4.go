@@ -23,23 +23,11 @@ func ParseICMPv4Layer(layer *layers.ICMPv4) (*ICMPv4Indicator, error) {
 		embTransportLayer gopacket.Layer
 	)
 
-	switch t := layer.TypeCode.Type(); t {
-	case layers.ICMPv4TypeEchoReply,
-		layers.ICMPv4TypeEchoRequest,
-		layers.ICMPv4TypeRouterAdvertisement,
-		layers.ICMPv4TypeRouterSolicitation,
-		layers.ICMPv4TypeTimestampRequest,
-		layers.ICMPv4TypeTimestampReply,
-		layers.ICMPv4TypeInfoRequest,
-		layers.ICMPv4TypeInfoReply,
-		layers.ICMPv4TypeAddressMaskRequest,
-		layers.ICMPv4TypeAddressMaskReply:
-		break
-	case layers.ICMPv4TypeDestinationUnreachable,
-		layers.ICMPv4TypeSourceQuench,
-		layers.ICMPv4TypeRedirect,
-		layers.ICMPv4TypeTimeExceeded,
-		layers.ICMPv4TypeParameterProblem:
+	isQuery, err := isICMPv4Query(layer.TypeCode.Type())
+	if err != nil {
+		return nil, err
+	}
+	if !isQuery {
 		// Parse IPv4 header and 8 bytes content
 		packet := gopacket.NewPacket(layer.Payload, layers.LayerTypeIPv4, gopacket.NoCopy)
 		if len(packet.Layers()) <= 0 {
@@ -68,13 +56,16 @@ func ParseICMPv4Layer(layer *layers.ICMPv4) (*ICMPv4Indicator, error) {
 		// Parse transport layer
 		embTransportLayer = packet.Layers()[1]
 		switch t := embTransportLayer.LayerType(); t {
-		case layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4:
+		case layers.LayerTypeTCP, layers.LayerTypeUDP:
 			break
+		case layers.LayerTypeICMPv4:
+			_, err := isICMPv4Query(embTransportLayer.(*layers.ICMPv4).TypeCode.Type())
+			if err != nil {
+				return nil, err
+			}
 		default:
 			return nil, fmt.Errorf("transport layer type %s not support", t)
 		}
-	default:
-		return nil, fmt.Errorf("icmpv4 type %d not support", t)
 	}
 
 	return &ICMPv4Indicator{
@@ -84,6 +75,31 @@ func ParseICMPv4Layer(layer *layers.ICMPv4) (*ICMPv4Indicator, error) {
 	}, nil
 }
 
+// isICMPv4Query returns if the ICMPv4 type is a query, or an error. Queries are types carrying an Identifier, which
+// are echo, timestamp, information and address mask requests and replies. Router advertisements and solicitations carry
+// no Identifier and are never routed, so they are not supported.
+func isICMPv4Query(t uint8) (bool, error) {
+	switch t {
+	case layers.ICMPv4TypeEchoReply,
+		layers.ICMPv4TypeEchoRequest,
+		layers.ICMPv4TypeTimestampRequest,
+		layers.ICMPv4TypeTimestampReply,
+		layers.ICMPv4TypeInfoRequest,
+		layers.ICMPv4TypeInfoReply,
+		layers.ICMPv4TypeAddressMaskRequest,
+		layers.ICMPv4TypeAddressMaskReply:
+		return true, nil
+	case layers.ICMPv4TypeDestinationUnreachable,
+		layers.ICMPv4TypeSourceQuench,
+		layers.ICMPv4TypeRedirect,
+		layers.ICMPv4TypeTimeExceeded,
+		layers.ICMPv4TypeParameterProblem:
+		return false, nil
+	default:
+		return false, fmt.Errorf("icmpv4 type %d not support", t)
+	}
+}
+
 // NewPureICMPv4Layer returns an new ICMPv4 layer copied from the original ICMPv4 layer without any encapped layers.
 func (indicator *ICMPv4Indicator) NewPureICMPv4Layer() *layers.ICMPv4 {
 	return &layers.ICMPv4{
@@ -100,27 +116,12 @@ func (indicator *ICMPv4Indicator) ICMPv4Layer() *layers.ICMPv4 {
 
 // IsQuery returns if the ICMPv4 layer is a query.
 func (indicator *ICMPv4Indicator) IsQuery() bool {
-	switch t := indicator.layer.TypeCode.Type(); t {
-	case layers.ICMPv4TypeEchoReply,
-		layers.ICMPv4TypeEchoRequest,
-		layers.ICMPv4TypeRouterAdvertisement,
-		layers.ICMPv4TypeRouterSolicitation,
-		layers.ICMPv4TypeTimestampRequest,
-		layers.ICMPv4TypeTimestampReply,
-		layers.ICMPv4TypeInfoRequest,
-		layers.ICMPv4TypeInfoReply,
-		layers.ICMPv4TypeAddressMaskRequest,
-		layers.ICMPv4TypeAddressMaskReply:
-		return true
-	case layers.ICMPv4TypeDestinationUnreachable,
-		layers.ICMPv4TypeSourceQuench,
-		layers.ICMPv4TypeRedirect,
-		layers.ICMPv4TypeTimeExceeded,
-		layers.ICMPv4TypeParameterProblem:
-		return false
-	default:
-		panic(fmt.Errorf("icmpv4 type %d not support", t))
+	isQuery, err := isICMPv4Query(indicator.layer.TypeCode.Type())
+	if err != nil {
+		panic(err)
 	}
+
+	return isQuery
 }
 
 // Id returns the ICMPv4 Id.
@@ -221,27 +222,12 @@ func (indicator *ICMPv4Indicator) EmbDstPort() uint16 {
 
 // IsEmbQuery returns if the embedded ICMPv4 layer is a query.
 func (indicator *ICMPv4Indicator) IsEmbQuery() bool {
-	switch t := indicator.EmbICMPv4Layer().TypeCode.Type(); t {
-	case layers.ICMPv4TypeEchoReply,
-		layers.ICMPv4TypeEchoRequest,
-		layers.ICMPv4TypeRouterAdvertisement,
-		layers.ICMPv4TypeRouterSolicitation,
-		layers.ICMPv4TypeTimestampRequest,
-		layers.ICMPv4TypeTimestampReply,
-		layers.ICMPv4TypeInfoRequest,
-		layers.ICMPv4TypeInfoReply,
-		layers.ICMPv4TypeAddressMaskRequest,
-		layers.ICMPv4TypeAddressMaskReply:
-		return true
-	case layers.ICMPv4TypeDestinationUnreachable,
-		layers.ICMPv4TypeSourceQuench,
-		layers.ICMPv4TypeRedirect,
-		layers.ICMPv4TypeTimeExceeded,
-		layers.ICMPv4TypeParameterProblem:
-		return false
-	default:
-		panic(fmt.Errorf("icmpv4 type %d not support", t))
+	isQuery, err := isICMPv4Query(indicator.EmbICMPv4Layer().TypeCode.Type())
+	if err != nil {
+		panic(err)
 	}
+
+	return isQuery
 }
 
 // EmbSrc returns the embedded source.
@@ -0,0 +1,45 @@
+package pcap
+
+import "net"
+
+// KeepAliveType describes the type of a keep-alive.
+type KeepAliveType byte
+
+const (
+	// KeepAliveRequest is a keep-alive expecting a reply from the peer.
+	KeepAliveRequest KeepAliveType = iota + 1
+	// KeepAliveReply is a keep-alive replying to a request.
+	KeepAliveReply
+)
+
+// CreateKeepAlive returns contents of a keep-alive carried in connections between client and server like embedded
+// packets. A keep-alive is a single type byte, which is never a valid embedded packet.
+func CreateKeepAlive(t KeepAliveType) []byte {
+	return []byte{byte(t)}
+}
+
+// ParseKeepAlive returns the type of the keep-alive, or 0 if the contents are not a keep-alive.
+func ParseKeepAlive(contents []byte) KeepAliveType {
+	if len(contents) != 1 {
+		return 0
+	}
+
+	switch t := KeepAliveType(contents[0]); t {
+	case KeepAliveRequest, KeepAliveReply:
+		return t
+	default:
+		return 0
+	}
+}
+
+// SupportsKeepAlive returns if keep-alives can be sent in the connection. Only FakeTCP connections whose peer negotiates
+// FeatureKeepAlive accept them, as other connections, like TCP whose payloads are parsed as a stream and UDP which
+// negotiates no features, cannot tell keep-alives from embedded packets of older peers.
+func SupportsKeepAlive(conn net.Conn) bool {
+	c, ok := conn.(*FakeTCPConn)
+	if !ok {
+		return false
+	}
+
+	return c.Negotiated().Has(FeatureKeepAlive)
+}
@@ -129,11 +129,53 @@ func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.
 	return ethernetLayer, nil
 }
 
+// VLANEthernet is an Ethernet layer followed by an 802.1Q VLAN tag.
+type VLANEthernet struct {
+	layers.Ethernet
+	Dot1Q layers.Dot1Q
+}
+
+// SerializeTo writes the serialized form of the VLAN tag and the Ethernet layer into the serialize buffer.
+func (layer *VLANEthernet) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	err := layer.Dot1Q.SerializeTo(b, opts)
+	if err != nil {
+		return err
+	}
+
+	return layer.Ethernet.SerializeTo(b, opts)
+}
+
+// CreateVLANEthernetLayer returns an Ethernet layer with an 802.1Q VLAN tag.
+func CreateVLANEthernetLayer(srcMAC, dstMAC net.HardwareAddr, vlan uint16, networkLayer gopacket.NetworkLayer) (*VLANEthernet, error) {
+	ethernetLayer, err := CreateEthernetLayer(srcMAC, dstMAC, networkLayer)
+	if err != nil {
+		return nil, err
+	}
+
+	layer := &VLANEthernet{
+		Ethernet: *ethernetLayer,
+		Dot1Q: layers.Dot1Q{
+			VLANIdentifier: vlan,
+			Type:           ethernetLayer.EthernetType,
+		},
+	}
+	layer.Ethernet.EthernetType = layers.EthernetTypeDot1Q
+
+	return layer, nil
+}
+
 // Serialize serializes layers to byte array.
 func Serialize(layers ...gopacket.SerializableLayer) ([]byte, error) {
+	return SerializeTo(nil, layers...)
+}
+
+// SerializeTo serializes layers to the buffer, or a new buffer if the buffer is nil, like Serialize.
+func SerializeTo(buffer gopacket.SerializeBuffer, layers ...gopacket.SerializableLayer) ([]byte, error) {
 	// Recalculate checksum and length
 	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
-	buffer := gopacket.NewSerializeBuffer()
+	if buffer == nil {
+		buffer = gopacket.NewSerializeBuffer()
+	}
 
 	err := gopacket.SerializeLayers(buffer, options, layers...)
 	if err != nil {
@@ -160,10 +202,6 @@ func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
 // CreateLayers return layers of transmission between client and server.
 func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP net.IP, id uint16, hop uint8,
 	dstHardwareAddr net.HardwareAddr) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
-	var (
-		linkLayerType gopacket.LayerType
-	)
-
 	// Create transport layer
 	transportLayer = CreateTCPLayer(srcPort, dstPort, seq, ack)
 
@@ -173,25 +211,35 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 		return nil, nil, nil, fmt.Errorf("create network layer: %w", err)
 	}
 
-	// Decide Loopback or Ethernet
-	if conn.IsLoop() {
-		linkLayerType = layers.LayerTypeLoopback
-	} else {
-		linkLayerType = layers.LayerTypeEthernet
-	}
-
 	// Create new link layer
-	switch linkLayerType {
-	case layers.LayerTypeLoopback:
-		linkLayer, err = CreateLoopbackLayer(networkLayer.(gopacket.NetworkLayer))
-	case layers.LayerTypeEthernet:
-		linkLayer, err = CreateEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, networkLayer.(gopacket.NetworkLayer))
-	default:
-		return nil, nil, nil, fmt.Errorf("link layer type %s not support", linkLayerType)
-	}
+	layer, err := CreateLinkLayer(conn, dstHardwareAddr, networkLayer.(gopacket.NetworkLayer))
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("create link layer: %w", err)
 	}
 
-	return transportLayer, networkLayer, linkLayer, nil
+	return transportLayer, networkLayer, layer.(gopacket.SerializableLayer), nil
+}
+
+// CreateLinkLayer returns a link layer of the connection to the hardware address. Ethernet frames are tagged with the
+// VLAN identifier observed in the connection.
+func CreateLinkLayer(conn *RawConn, dstHardwareAddr net.HardwareAddr, networkLayer gopacket.NetworkLayer) (gopacket.Layer, error) {
+	if conn.IsLoop() {
+		// Loopback devices are in Ethernet with zero hardware addresses in Linux
+		if conn.LinkType() == layers.LinkTypeEthernet {
+			zero := make(net.HardwareAddr, 6)
+
+			return CreateEthernetLayer(zero, zero, networkLayer)
+		}
+
+		// Loopback
+		return CreateLoopbackLayer(networkLayer)
+	}
+
+	// Ethernet
+	vlan := conn.VLAN()
+	if vlan > 0 {
+		return CreateVLANEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, vlan, networkLayer)
+	}
+
+	return CreateEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, networkLayer)
 }
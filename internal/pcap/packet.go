@@ -7,6 +7,7 @@
 	"github.com/google/gopacket/layers"
 	"github.com/zhxie/ikago/internal/addr"
 	"net"
+	"time"
 )
 
 // ConnPacket describes a packet and its connection.
@@ -23,6 +24,18 @@ type ConnBytes struct {
 	Bytes []byte
 	// Conn is the connection of the bytes.
 	Conn net.Conn
+	// Time is the time the bytes are received.
+	Time time.Time
+}
+
+// CaptureTime returns the time the packet is captured, or the current time if the packet has no capture timestamp.
+func CaptureTime(packet gopacket.Packet) time.Time {
+	t := packet.Metadata().Timestamp
+	if t.IsZero() {
+		return time.Now()
+	}
+
+	return t
 }
 
 // NATGuide describes simplified information about a NAT.
@@ -35,8 +48,9 @@ type NATGuide struct {
 
 // PacketIndicator indicates a packet.
 type PacketIndicator struct {
-	packet           gopacket.Packet
+	size             int
 	linkLayer        gopacket.Layer
+	dot1QLayer       *layers.Dot1Q
 	networkLayer     gopacket.Layer
 	transportLayer   gopacket.Layer
 	icmpv4Indicator  *ICMPv4Indicator
@@ -54,6 +68,11 @@ func (indicator *PacketIndicator) LinkLayerType() gopacket.LayerType {
 	return indicator.linkLayer.LayerType()
 }
 
+// Dot1QLayer returns the 802.1Q VLAN tag, or nil if the packet is untagged.
+func (indicator *PacketIndicator) Dot1QLayer() *layers.Dot1Q {
+	return indicator.dot1QLayer
+}
+
 // SrcHardwareAddr returns the source hardware address.
 func (indicator *PacketIndicator) SrcHardwareAddr() net.HardwareAddr {
 	switch t := indicator.LinkLayerType(); t {
@@ -454,18 +473,17 @@ func (indicator *PacketIndicator) MTU() int {
 
 // Size returns the size of the packet.
 func (indicator *PacketIndicator) Size() int {
-	return len(indicator.packet.Data())
+	return indicator.size
 }
 
 // ParsePacket parses a packet and returns a packet indicator.
 func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	var (
 		linkLayer        gopacket.Layer
+		dot1QLayer       *layers.Dot1Q
 		networkLayer     gopacket.Layer
 		transportLayer   gopacket.Layer
-		icmpv4Indicator  *ICMPv4Indicator
 		applicationLayer gopacket.ApplicationLayer
-		dnsIndicator     *DNSIndicator
 	)
 
 	// Parse packet
@@ -483,6 +501,7 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		}
 
 		return &PacketIndicator{
+			size:             len(packet.Data()),
 			networkLayer:     networkLayer,
 			transportLayer:   nil,
 			icmpv4Indicator:  nil,
@@ -501,6 +520,19 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		}
 	}
 	applicationLayer = packet.ApplicationLayer()
+	if layer := packet.Layer(layers.LayerTypeDot1Q); layer != nil {
+		dot1QLayer = layer.(*layers.Dot1Q)
+	}
+
+	return newPacketIndicator(len(packet.Data()), linkLayer, dot1QLayer, networkLayer, transportLayer, applicationLayer)
+}
+
+// newPacketIndicator checks layers of a packet and returns a packet indicator.
+func newPacketIndicator(size int, linkLayer gopacket.Layer, dot1QLayer *layers.Dot1Q, networkLayer, transportLayer gopacket.Layer, applicationLayer gopacket.ApplicationLayer) (*PacketIndicator, error) {
+	var (
+		icmpv4Indicator *ICMPv4Indicator
+		dnsIndicator    *DNSIndicator
+	)
 
 	// Parse link layer
 	if linkLayer != nil {
@@ -510,7 +542,20 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		case layers.LayerTypeEthernet:
 			ethernetLayer := linkLayer.(*layers.Ethernet)
 
-			_, err := parseEthernetType(ethernetLayer.EthernetType)
+			t := ethernetLayer.EthernetType
+			if t == layers.EthernetTypeDot1Q {
+				// Strip the VLAN tag
+				if dot1QLayer == nil {
+					return nil, errors.New("missing dot1q layer")
+				}
+
+				t = dot1QLayer.Type
+				if t == layers.EthernetTypeDot1Q || t == layers.EthernetTypeQinQ {
+					return nil, errors.New("stacked vlan not support")
+				}
+			}
+
+			_, err := parseEthernetType(t)
 			if err != nil {
 				return nil, err
 			}
@@ -558,8 +603,9 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	}
 
 	return &PacketIndicator{
-		packet:           packet,
+		size:             size,
 		linkLayer:        linkLayer,
+		dot1QLayer:       dot1QLayer,
 		networkLayer:     networkLayer,
 		transportLayer:   transportLayer,
 		icmpv4Indicator:  icmpv4Indicator,
@@ -570,6 +616,11 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 
 // ParseEmbPacket parses an embedded packet used in transmission between client and server without link layer.
 func ParseEmbPacket(contents []byte) (*PacketIndicator, error) {
+	// IPv6 including ICMPv6 is not supported, which would be mistaken as a malformed IPv4 packet
+	if len(contents) > 0 && contents[0]>>4 == 6 {
+		return nil, fmt.Errorf("network layer type %s not support", layers.LayerTypeIPv6)
+	}
+
 	// Guess network layer type
 	packet := gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.NoCopy)
 	networkLayer := packet.NetworkLayer()
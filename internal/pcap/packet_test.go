@@ -0,0 +1,165 @@
+package pcap
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"net"
+	"testing"
+)
+
+var (
+	testUpstreamHardwareAddr = net.HardwareAddr{0x02, 0, 0, 0, 0x01, 0x01}
+	testGatewayHardwareAddr  = net.HardwareAddr{0x02, 0, 0, 0, 0x01, 0xfe}
+	testUpstreamIP           = net.IPv4(192, 168, 1, 2).To4()
+	testDestinationIP        = net.IPv4(8, 8, 8, 8).To4()
+)
+
+// newTestUpstreamConn returns a connection of the upstream device reading packets from the link.
+func newTestUpstreamConn(link *testLink) *RawConn {
+	upDev := newTestDevice("upstream", testUpstreamIP, testUpstreamHardwareAddr)
+	gatewayDev := newTestDevice("gateway", net.IPv4(192, 168, 1, 254).To4(), testGatewayHardwareAddr)
+
+	return &RawConn{srcDev: upDev, dstDev: gatewayDev, source: link, sink: link}
+}
+
+// createTaggedReply returns frames of an UDP reply from the destination to the upstream device tagged with the VLAN
+// identifier, which are fragmented if the fragment size is not 0.
+func createTaggedReply(t *testing.T, vlan uint16, payload []byte, fragment int) [][]byte {
+	udpLayer := CreateUDPLayer(8000, 40000)
+	ipv4Layer, err := CreateIPv4Layer(testDestinationIP, testUpstreamIP, 1234, 64, udpLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkLayer, err := CreateVLANEthernetLayer(testGatewayHardwareAddr, testUpstreamHardwareAddr, vlan, ipv4Layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fragment <= 0 {
+		data, err := Serialize(linkLayer, ipv4Layer, udpLayer, gopacket.Payload(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return [][]byte{data}
+	}
+
+	frags, err := CreateFragmentPackets(linkLayer, ipv4Layer, udpLayer, payload, fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return frags
+}
+
+func TestParseVLANTaggedReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		fragment int
+	}{
+		{name: "whole"},
+		{name: "fragmented", fragment: 576},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte("reply"), 200)
+			frames := createTaggedReply(t, 100, payload, tt.fragment)
+			if tt.fragment > 0 && len(frames) < 2 {
+				t.Fatalf("%d fragments, expect more than 1", len(frames))
+			}
+
+			link := &testLink{}
+			conn := newTestUpstreamConn(link)
+			defrag := NewEasyDefragmenter()
+
+			var indicator *PacketIndicator
+			for _, frame := range frames {
+				link.push(frame)
+				packet, err := conn.ReadPacket()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				ind, err := ParsePacket(packet)
+				if err != nil {
+					t.Fatalf("parse packet: %v", err)
+				}
+				if ind.Dot1QLayer() == nil || ind.Dot1QLayer().VLANIdentifier != 100 {
+					t.Fatal("VLAN tag missing")
+				}
+
+				indicator, err = defrag.Append(ind)
+				if err != nil {
+					t.Fatalf("defrag: %v", err)
+				}
+			}
+			if indicator == nil {
+				t.Fatal("reply incomplete")
+			}
+
+			if indicator.Dot1QLayer() == nil || indicator.Dot1QLayer().VLANIdentifier != 100 {
+				t.Fatal("VLAN tag missing after defrag")
+			}
+			if !indicator.SrcIP().Equal(testDestinationIP) || !indicator.DstIP().Equal(testUpstreamIP) {
+				t.Fatalf("addresses %s -> %s", indicator.SrcIP(), indicator.DstIP())
+			}
+			if indicator.NATProtocol() != layers.LayerTypeUDP || indicator.SrcPort() != 8000 || indicator.DstPort() != 40000 {
+				t.Fatalf("%s ports %d -> %d", indicator.NATProtocol(), indicator.SrcPort(), indicator.DstPort())
+			}
+			if !bytes.Equal(indicator.Payload(), payload) {
+				t.Fatalf("payload in %d Bytes, expect %d Bytes", len(indicator.Payload()), len(payload))
+			}
+
+			// Responses are tagged once the tag is observed
+			if !conn.ObserveVLAN(indicator) || conn.VLAN() != 100 {
+				t.Fatalf("observe VLAN %d, expect 100", conn.VLAN())
+			}
+			linkLayer, err := CreateLinkLayer(conn, testGatewayHardwareAddr, indicator.NetworkLayer().(gopacket.NetworkLayer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			vlanLayer, ok := linkLayer.(*VLANEthernet)
+			if !ok || vlanLayer.Dot1Q.VLANIdentifier != 100 {
+				t.Fatalf("response link layer %T untagged", linkLayer)
+			}
+		})
+	}
+}
+
+func TestVLANFilter(t *testing.T) {
+	filter := VLANFilter("ip && udp && src port 8000")
+
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, maxSnapLen, filter)
+	if err != nil {
+		t.Skipf("compile filter %s: %v", filter, err)
+	}
+
+	for _, vlan := range []uint16{0, 100} {
+		var data []byte
+		if vlan > 0 {
+			data = createTaggedReply(t, vlan, []byte("reply"), 0)[0]
+		} else {
+			udpLayer := CreateUDPLayer(8000, 40000)
+			ipv4Layer, err := CreateIPv4Layer(testDestinationIP, testUpstreamIP, 1234, 64, udpLayer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ethernetLayer, err := CreateEthernetLayer(testGatewayHardwareAddr, testUpstreamHardwareAddr, ipv4Layer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err = Serialize(ethernetLayer, ipv4Layer, udpLayer, gopacket.Payload("reply"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+		if !bpf.Matches(ci, data) {
+			t.Errorf("filter %s does not match reply in VLAN %d", filter, vlan)
+		}
+	}
+}
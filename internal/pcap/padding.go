@@ -0,0 +1,89 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// maxPadding is the max length of random padding.
+const maxPadding = 64
+
+// bucketSize is the size of buckets which payloads are padded to multiples of.
+const bucketSize = 128
+
+// bucketTrailerLength is the length of the trailer carrying the length of bucket padding.
+const bucketTrailerLength = 2
+
+// paddingBytes is the number of bytes of padding in all connections, which is accessed atomically.
+var paddingBytes uint64
+
+// PaddingBytes returns the number of bytes of padding added to payloads in all connections and listeners, including
+// lengths of padding.
+func PaddingBytes() uint64 {
+	return atomic.LoadUint64(&paddingBytes)
+}
+
+// pad appends random bytes and the length of them to contents.
+func pad(contents []byte) []byte {
+	n := rand.Intn(maxPadding + 1)
+
+	b := make([]byte, len(contents)+n+1)
+	copy(b, contents)
+	rand.Read(b[len(contents) : len(contents)+n])
+	b[len(b)-1] = byte(n)
+	atomic.AddUint64(&paddingBytes, uint64(n+1))
+
+	return b
+}
+
+// unpad removes padding from contents.
+func unpad(b []byte) ([]byte, error) {
+	if len(b) <= 0 {
+		return nil, errors.New("missing padding")
+	}
+
+	n := int(b[len(b)-1])
+	if n > maxPadding || n+1 > len(b) {
+		return nil, fmt.Errorf("padding %d out of range", n)
+	}
+
+	return b[:len(b)-n-1], nil
+}
+
+// padBucket appends random bytes and the length of them to contents, so the length is a multiple of the bucket size no
+// larger than the max size. Contents are only appended with the length if they reach the max size.
+func padBucket(contents []byte, max int) []byte {
+	size := (len(contents) + bucketTrailerLength + bucketSize - 1) / bucketSize * bucketSize
+	if size > max {
+		size = max
+	}
+	if size < len(contents)+bucketTrailerLength {
+		size = len(contents) + bucketTrailerLength
+	}
+	n := size - len(contents) - bucketTrailerLength
+
+	b := make([]byte, size)
+	copy(b, contents)
+	rand.Read(b[len(contents) : len(contents)+n])
+	binary.BigEndian.PutUint16(b[size-bucketTrailerLength:], uint16(n))
+	atomic.AddUint64(&paddingBytes, uint64(n+bucketTrailerLength))
+
+	return b
+}
+
+// unpadBucket removes bucket padding from contents.
+func unpadBucket(b []byte) ([]byte, error) {
+	if len(b) < bucketTrailerLength {
+		return nil, errors.New("missing bucket padding")
+	}
+
+	n := int(binary.BigEndian.Uint16(b[len(b)-bucketTrailerLength:]))
+	if n+bucketTrailerLength > len(b) {
+		return nil, fmt.Errorf("bucket padding %d out of range", n)
+	}
+
+	return b[:len(b)-n-bucketTrailerLength], nil
+}
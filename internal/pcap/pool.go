@@ -0,0 +1,42 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"sync"
+)
+
+var serializeBuffers = sync.Pool{
+	New: func() interface{} {
+		return gopacket.NewSerializeBuffer()
+	},
+}
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, IPv4MaxSize)
+		return &b
+	},
+}
+
+// AcquireSerializeBuffer returns a serialize buffer from the pool.
+func AcquireSerializeBuffer() gopacket.SerializeBuffer {
+	return serializeBuffers.Get().(gopacket.SerializeBuffer)
+}
+
+// ReleaseSerializeBuffer clears the serialize buffer and puts it back to the pool. Bytes of the buffer must not be used
+// after releasing.
+func ReleaseSerializeBuffer(buffer gopacket.SerializeBuffer) {
+	buffer.Clear()
+	serializeBuffers.Put(buffer)
+}
+
+// acquireBuffer returns an empty buffer from the pool.
+func acquireBuffer() *[]byte {
+	return buffers.Get().(*[]byte)
+}
+
+// releaseBuffer puts the buffer back to the pool.
+func releaseBuffer(b *[]byte) {
+	*b = (*b)[:0]
+	buffers.Put(b)
+}
@@ -0,0 +1,111 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"net"
+	"time"
+)
+
+// probeReadTimeout is the timeout of each read in probing, after which the deadline of probing is checked.
+const probeReadTimeout = 100 * time.Millisecond
+
+// ProbeGateway sends an ARP request to the gateway of the connection from its local device, and returns an error if
+// the gateway does not reply before the timeout. Connections to loopback devices are never probed.
+func ProbeGateway(conn *RawConn, timeout time.Duration) error {
+	if conn.IsLoop() {
+		return nil
+	}
+
+	_, err := requestARP(conn, conn.RemoteDev().HardwareAddr(), timeout)
+
+	return err
+}
+
+// ResolveGateway broadcasts an ARP request for the gateway of the connection from its local device, and returns the
+// hardware address in the reply, so a replaced gateway of the same IP address can be found.
+func ResolveGateway(conn *RawConn, timeout time.Duration) (net.HardwareAddr, error) {
+	if conn.IsLoop() {
+		return conn.RemoteDev().HardwareAddr(), nil
+	}
+
+	return requestARP(conn, layers.EthernetBroadcast, timeout)
+}
+
+// requestARP sends an ARP request for the gateway of the connection to the hardware address, and returns the hardware
+// address of the gateway in the reply.
+func requestARP(conn *RawConn, dstHardwareAddr net.HardwareAddr, timeout time.Duration) (net.HardwareAddr, error) {
+	srcIP := conn.LocalDev().IPAddr().IP.To4()
+	dstIP := conn.RemoteDev().IPAddr().IP.To4()
+	if srcIP == nil || dstIP == nil {
+		return nil, errors.New("ipv4 address not found")
+	}
+
+	handle, err := openLive(conn.LocalDev().Name(), 128, false, probeReadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("open device %s: %w", conn.LocalDev().Alias(), err)
+	}
+	defer handle.Close()
+
+	err = handle.SetBPFFilter(VLANFilter(fmt.Sprintf("arp && arp[6:2] = 2 && arp src host %s", dstIP)))
+	if err != nil {
+		return nil, fmt.Errorf("set filter: %w", err)
+	}
+
+	// ARP request is tagged as other frames in the connection
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       conn.LocalDev().HardwareAddr(),
+		DstMAC:       dstHardwareAddr,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arpLayer := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   conn.LocalDev().HardwareAddr(),
+		SourceProtAddress: srcIP,
+		DstHwAddress:      make(net.HardwareAddr, 6),
+		DstProtAddress:    dstIP,
+	}
+
+	var data []byte
+	vlan := conn.VLAN()
+	if vlan > 0 {
+		ethernetLayer.EthernetType = layers.EthernetTypeDot1Q
+		data, err = Serialize(ethernetLayer, &layers.Dot1Q{VLANIdentifier: vlan, Type: layers.EthernetTypeARP}, arpLayer)
+	} else {
+		data, err = Serialize(ethernetLayer, arpLayer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	err = handle.WritePacketData(data)
+	if err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		d, _, err := handle.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+
+		packet := gopacket.NewPacket(d, handle.LinkType(), gopacket.NoCopy)
+		reply, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+		if ok {
+			return net.HardwareAddr(reply.SourceHwAddress), nil
+		}
+	}
+
+	return nil, errors.New("timeout")
+}
@@ -1,8 +1,22 @@
 package pcap
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zhxie/ikago/internal/privilege"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type timeoutError struct {
@@ -27,20 +41,53 @@ func (err *timeoutError) Timeout() bool {
 // maxSnapLen is the max size of each packet in pcap raw conn.
 const maxSnapLen = 65535
 
+// ngMagic is the magic number of the section header block in pcapng files.
+const ngMagic = 0x0a0d0d0a
+
+// packetSource is a source of packets read in connections, which is the handle of the connection usually.
+type packetSource interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
 // RawConn is a raw network connection.
 type RawConn struct {
 	srcDev *Device
 	dstDev *Device
 	handle *pcap.Handle
-	buffer []byte
+	source packetSource
+	sink   io.Writer
+	file   io.Closer
+	vlan   uint32
+	// dev and filter are kept for re-opening live handles.
+	dev    string
+	filter string
+	// lock guards the handle from being queried after closing or replaced in re-opening.
+	lock     sync.RWMutex
+	isClosed bool
 }
 
 func newRawConn() *RawConn {
-	return &RawConn{buffer: make([]byte, maxSnapLen)}
+	return &RawConn{}
+}
+
+// openLive opens a live handle of the device, with privileges kept after dropping them if any.
+func openLive(dev string, snaplen int32, promisc bool, timeout time.Duration) (*pcap.Handle, error) {
+	var handle *pcap.Handle
+	err := privilege.Do(func() error {
+		var err error
+		handle, err = pcap.OpenLive(dev, snaplen, promisc, timeout)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return handle, nil
 }
 
 func createPureRawConn(dev, filter string) (*RawConn, error) {
-	handle, err := pcap.OpenLive(dev, maxSnapLen, true, pcap.BlockForever)
+	handle, err := openLive(dev, maxSnapLen, true, pcap.BlockForever)
 	if err != nil {
 		return nil, err
 	}
@@ -52,10 +99,24 @@ func createPureRawConn(dev, filter string) (*RawConn, error) {
 
 	conn := newRawConn()
 	conn.handle = handle
+	conn.source = handle
+	conn.dev = dev
+	conn.filter = filter
 
 	return conn, nil
 }
 
+// LinkTypeOf returns the link type of the device.
+func LinkTypeOf(dev *Device) (layers.LinkType, error) {
+	handle, err := openLive(dev.Name(), 128, false, pcap.BlockForever)
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Close()
+
+	return handle.LinkType(), nil
+}
+
 // CreateRawConn creates a raw connection between devices with BPF filter.
 func CreateRawConn(srcDev, dstDev *Device, filter string) (*RawConn, error) {
 	conn, err := createPureRawConn(srcDev.Name(), filter)
@@ -69,8 +130,103 @@ func CreateRawConn(srcDev, dstDev *Device, filter string) (*RawConn, error) {
 	return conn, nil
 }
 
+// CreateReplayRawConn creates a raw connection between devices which reads packets from the pcap file in the path with
+// BPF filter instead of a live device, for testing and offline analysis. Packets written to the connection are written
+// to the writer, or discarded if the writer is nil. Reading returns io.EOF after all packets in the file are read. Files
+// in pcap or pcapng are replayed without libpcap if the filter is empty.
+func CreateReplayRawConn(srcDev, dstDev *Device, path, filter string, w io.Writer) (*RawConn, error) {
+	if w == nil {
+		w = ioutil.Discard
+	}
+
+	conn := newRawConn()
+	if filter == "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		source, err := newFileSource(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+
+		conn.file = file
+		conn.source = source
+	} else {
+		handle, err := pcap.OpenOffline(path)
+		if err != nil {
+			return nil, err
+		}
+
+		err = handle.SetBPFFilter(filter)
+		if err != nil {
+			handle.Close()
+			return nil, err
+		}
+
+		conn.handle = handle
+		conn.source = handle
+	}
+	conn.sink = w
+	conn.srcDev = srcDev
+	conn.dstDev = dstDev
+
+	return conn, nil
+}
+
+// newFileSource returns a source of packets in the pcap or pcapng file.
+func newFileSource(file io.Reader) (packetSource, error) {
+	r := bufio.NewReader(file)
+
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("read magic: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(magic) == ngMagic {
+		source, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		return source, nil
+	}
+
+	source, err := pcapgo.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+// currentSource returns the source of packets currently in use.
+func (c *RawConn) currentSource() packetSource {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.source
+}
+
+// readPacketData reads the data of a packet from the source, and keeps reading from the new source if the handle is
+// replaced in re-opening.
+func (c *RawConn) readPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		source := c.currentSource()
+
+		d, ci, err := source.ZeroCopyReadPacketData()
+		if err != nil && c.currentSource() != source {
+			continue
+		}
+
+		return d, ci, err
+	}
+}
+
 func (c *RawConn) Read(b []byte) (n int, err error) {
-	d, _, err := c.handle.ZeroCopyReadPacketData()
+	d, _, err := c.readPacketData()
 	if err != nil {
 		return 0, err
 	}
@@ -80,22 +236,31 @@ func (c *RawConn) Read(b []byte) (n int, err error) {
 	return len(d), nil
 }
 
-// ReadPacket reads packet from the connection.
+// ReadPacket reads packet from the connection. The capture info of the packet, including the capture timestamp, is
+// kept in its metadata.
 func (c *RawConn) ReadPacket() (gopacket.Packet, error) {
-	n, err := c.Read(c.buffer)
+	d, ci, err := c.readPacketData()
 	if err != nil {
 		return nil, err
 	}
 
-	b := make([]byte, n)
-	copy(b, c.buffer[:n])
+	b := make([]byte, len(d))
+	copy(b, d)
 
-	packet := gopacket.NewPacket(b, c.handle.LinkType(), gopacket.NoCopy)
+	packet := gopacket.NewPacket(b, c.LinkType(), gopacket.NoCopy)
+	packet.Metadata().CaptureInfo = ci
 
 	return packet, nil
 }
 
 func (c *RawConn) Write(b []byte) (n int, err error) {
+	if c.sink != nil {
+		return c.sink.Write(b)
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	err = c.handle.WritePacketData(b)
 	if err != nil {
 		return 0, err
@@ -105,11 +270,78 @@ func (c *RawConn) Write(b []byte) (n int, err error) {
 }
 
 func (c *RawConn) Close() error {
-	c.handle.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.isClosed {
+		return nil
+	}
+	c.isClosed = true
+	if c.handle != nil {
+		c.handle.Close()
+	}
+	if c.file != nil {
+		c.file.Close()
+	}
+
+	return nil
+}
+
+// Reopen opens the device of the live connection again with the same filter and replaces the handle, so a device
+// which is reset can be read from and written to again. Readers blocked in the old handle return an error.
+func (c *RawConn) Reopen() error {
+	if c.dev == "" {
+		return errors.New("not a live capture")
+	}
+
+	handle, err := openLive(c.dev, maxSnapLen, true, pcap.BlockForever)
+	if err != nil {
+		return err
+	}
+
+	err = handle.SetBPFFilter(c.filter)
+	if err != nil {
+		handle.Close()
+		return err
+	}
+
+	c.lock.Lock()
+	if c.isClosed {
+		c.lock.Unlock()
+		handle.Close()
+		return errors.New("closed")
+	}
+	old := c.handle
+	c.handle = handle
+	c.source = handle
+	c.lock.Unlock()
+
+	old.Close()
 
 	return nil
 }
 
+// Stats returns the numbers of packets received and dropped by the kernel or the interface in the connection since it
+// is created.
+func (c *RawConn) Stats() (received, dropped int, err error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.isClosed {
+		return 0, 0, errors.New("closed")
+	}
+	if c.handle == nil {
+		return 0, 0, errors.New("not a capture")
+	}
+
+	stats, err := c.handle.Stats()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return stats.PacketsReceived, stats.PacketsDropped + stats.PacketsIfDropped, nil
+}
+
 // LocalDev returns the local device.
 func (c *RawConn) LocalDev() *Device {
 	return c.srcDev
@@ -120,11 +352,80 @@ func (c *RawConn) RemoteDev() *Device {
 	return c.dstDev
 }
 
+// LinkType returns the link type of the connection.
+func (c *RawConn) LinkType() layers.LinkType {
+	return c.currentSource().LinkType()
+}
+
 // IsLoop returns if the connection is to a loopback device.
 func (c *RawConn) IsLoop() bool {
 	return c.dstDev.IsLoop()
 }
 
+// SetVLAN sets the VLAN identifier observed in the connection. An identifier of 0 means untagged.
+func (c *RawConn) SetVLAN(id uint16) {
+	atomic.StoreUint32(&c.vlan, uint32(id))
+}
+
+// VLAN returns the VLAN identifier observed in the connection, or 0 if frames are untagged.
+func (c *RawConn) VLAN() uint16 {
+	return uint16(atomic.LoadUint32(&c.vlan))
+}
+
+// ObserveVLAN records the VLAN identifier of the packet read from the connection, and returns if the identifier
+// changes. Untagged packets reset the identifier to 0.
+func (c *RawConn) ObserveVLAN(indicator *PacketIndicator) bool {
+	var id uint16
+	if indicator.Dot1QLayer() != nil {
+		id = indicator.Dot1QLayer().VLANIdentifier
+	}
+
+	return atomic.SwapUint32(&c.vlan, uint32(id)) != uint32(id)
+}
+
+// PortsFilter returns a BPF filter which matches any of the ports in the direction, like "dst port 443".
+func PortsFilter(dir string, ports []uint16) string {
+	filters := make([]string, 0)
+	for _, port := range ports {
+		filters = append(filters, fmt.Sprintf("%s port %d", dir, port))
+	}
+	if len(filters) == 1 {
+		return filters[0]
+	}
+
+	return fmt.Sprintf("(%s)", strings.Join(filters, " || "))
+}
+
+// RestrictFilter returns a BPF filter which also matches the IP addresses of the device in the direction if the device
+// is restricted, like "(tcp) && (dst host 192.168.1.1)".
+func RestrictFilter(dev *Device, dir, filter string) string {
+	if !dev.IsRestricted() {
+		return filter
+	}
+
+	filters := make([]string, 0)
+	for _, ip := range dev.IPAddrs() {
+		filters = append(filters, fmt.Sprintf("%s host %s", dir, ip.IP))
+	}
+
+	return fmt.Sprintf("(%s) && (%s)", filter, strings.Join(filters, " || "))
+}
+
+// VLANFilter returns a BPF filter which also matches frames with an 802.1Q VLAN tag.
+func VLANFilter(filter string) string {
+	return fmt.Sprintf("(%s) || (vlan && (%s))", filter, filter)
+}
+
+// PartitionFilter returns a BPF filter which matches the part of the index in IPv4 packets partitioned into parts by
+// their pair of addresses, so fragments and packets of a flow are always in the same part.
+func PartitionFilter(filter string, parts, index int) string {
+	if parts <= 1 {
+		return filter
+	}
+
+	return fmt.Sprintf("(%s) && ip && ((ip[12:4] + ip[16:4]) %% %d = %d)", filter, parts, index)
+}
+
 // Reader is a reader reads packets from a pcap file.
 type Reader struct {
 	handle *pcap.Handle
@@ -0,0 +1,289 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/zhxie/ikago/internal/crypto"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordLink describes a link which records packets written to it.
+type recordLink struct {
+	link    io.Writer
+	packets [][]byte
+}
+
+func (l *recordLink) Write(b []byte) (int, error) {
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	l.packets = append(l.packets, packet)
+
+	return l.link.Write(b)
+}
+
+// writeCapture writes packets to a capture file in the directory in pcap or pcapng, and returns the path of the file.
+// Each packet is captured a millisecond after the previous one.
+func writeCapture(t *testing.T, dir string, ng bool, packets [][]byte) string {
+	path := filepath.Join(dir, "capture.pcap")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var write func(gopacket.CaptureInfo, []byte) error
+	if ng {
+		w, err := pcapgo.NewNgWriter(file, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			err := w.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}()
+		write = w.WritePacket
+	} else {
+		w := pcapgo.NewWriter(file)
+		err := w.WriteFileHeader(maxSnapLen, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write = w.WritePacket
+	}
+
+	for i, packet := range packets {
+		err := write(gopacket.CaptureInfo{
+			Timestamp:     time.Unix(1600000000, 0).Add(time.Duration(i) * time.Millisecond),
+			CaptureLength: len(packet),
+			Length:        len(packet),
+		}, packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+var testCaptureFormats = []struct {
+	name string
+	ng   bool
+}{
+	{name: "pcap", ng: false},
+	{name: "pcapng", ng: true},
+}
+
+func TestReplayRawConn(t *testing.T) {
+	packets := make([][]byte, 0)
+	for _, payload := range []string{"first", "second", "third"} {
+		packets = append(packets, createTaggedReply(t, 0, []byte(payload), 0)...)
+	}
+
+	for _, format := range testCaptureFormats {
+		t.Run(format.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ikago")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := writeCapture(t, dir, format.ng, packets)
+
+			var buf bytes.Buffer
+			conn, err := CreateReplayRawConn(NewDevice("upstream", nil, nil, false), NewDevice("gateway", nil, nil, false), path, "", &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if conn.LinkType() != layers.LinkTypeEthernet {
+				t.Errorf("link type %s, expect %s", conn.LinkType(), layers.LinkTypeEthernet)
+			}
+
+			for i, want := range packets {
+				packet, err := conn.ReadPacket()
+				if err != nil {
+					t.Fatalf("read packet %d: %v", i, err)
+				}
+				if !bytes.Equal(packet.Data(), want) {
+					t.Errorf("packet %d is %x, expect %x", i, packet.Data(), want)
+				}
+				ts := time.Unix(1600000000, 0).Add(time.Duration(i) * time.Millisecond)
+				if !packet.Metadata().Timestamp.Equal(ts) {
+					t.Errorf("packet %d is captured at %s, expect %s", i, packet.Metadata().Timestamp, ts)
+				}
+			}
+
+			_, err = conn.ReadPacket()
+			if err != io.EOF {
+				t.Errorf("read after the end: %v, expect %v", err, io.EOF)
+			}
+
+			_, err = conn.Write([]byte("written"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != "written" {
+				t.Errorf("write %q, expect %q", buf.String(), "written")
+			}
+
+			_, _, err = conn.Stats()
+			if err == nil {
+				t.Error("stats of a replay")
+			}
+		})
+	}
+}
+
+// captureClientSession captures packets the client writes in a session sending the payloads to the server, and returns
+// the path of the capture file in the directory.
+func captureClientSession(t *testing.T, dir string, features Feature, payloads [][]byte) string {
+	tp := newTestPair(t, features, features)
+	recorder := &recordLink{link: tp.up}
+	tp.client.conn.sink = recorder
+
+	tp.handshake(t)
+
+	for _, payload := range payloads {
+		_, err := tp.client.Write(payload)
+		if err != nil {
+			t.Fatalf("client write: %v", err)
+		}
+		tp.flush(t)
+	}
+
+	return writeCapture(t, dir, false, recorder.packets)
+}
+
+// replayServer replays the capture file against a new server, and returns payloads read until the end of the file or
+// an error.
+func replayServer(t *testing.T, path string, features Feature, down *testLink) ([][]byte, error) {
+	serverDev := newTestDevice("server", testServerAddr.IP, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01})
+	clientDev := newTestDevice("client", testClientAddr.IP, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02})
+	conn, err := CreateReplayRawConn(serverDev, clientDev, path, "", down)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crypt, err := crypto.ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newConn()
+	server.conn = conn
+	server.srcPort = uint16(testServerAddr.Port)
+	server.crypt = crypt
+	server.features = features
+	defer server.Close()
+
+	read := make([][]byte, 0)
+	for {
+		b := make([]byte, MaxMTU)
+		n, _, err := server.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return read, nil
+			}
+			return read, err
+		}
+		if n > 0 {
+			read = append(read, b[:n])
+		}
+	}
+}
+
+func TestReplayClientSession(t *testing.T) {
+	payloads := [][]byte{[]byte("first"), []byte("second"), bytes.Repeat([]byte{'x'}, 1000)}
+
+	dir, err := ioutil.TempDir("", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	features := DefaultFeatures &^ FeatureHello
+	path := captureClientSession(t, dir, features, payloads)
+
+	down := &testLink{}
+	read, err := replayServer(t, path, features, down)
+	if err != nil {
+		t.Fatalf("server read: %v", err)
+	}
+	if len(read) != len(payloads) {
+		t.Fatalf("read %d payloads, expect %d", len(read), len(payloads))
+	}
+	for i, payload := range payloads {
+		if !bytes.Equal(read[i], payload) {
+			t.Errorf("payload %d is %q, expect %q", i, read[i], payload)
+		}
+	}
+	if down.len() <= 0 {
+		t.Error("server does not reply the replayed handshake")
+	}
+}
+
+func TestReplayClientSessionHello(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := captureClientSession(t, dir, DefaultFeatures, [][]byte{[]byte("first")})
+
+	// The hello in the session is accepted once by the server capturing the session
+	read, err := replayServer(t, path, DefaultFeatures, &testLink{})
+	if !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("server read: %v, expect %v", err, ErrUnauthenticated)
+	}
+	if len(read) != 0 {
+		t.Errorf("read %d payloads from a replayed session, expect 0", len(read))
+	}
+}
+
+func TestRawConnCaptureTime(t *testing.T) {
+	link := &testLink{}
+	conn := newTestUpstreamConn(link)
+
+	captured := time.Unix(1600000000, 123456000)
+	link.pushAt(createTaggedReply(t, 0, []byte("stale"), 0)[0], captured)
+	link.push(createTaggedReply(t, 0, []byte("fresh"), 0)[0])
+
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := packet.Metadata().Timestamp; !ts.Equal(captured) {
+		t.Errorf("read packet captured at %s, want %s", ts, captured)
+	}
+	if ts := CaptureTime(packet); !ts.Equal(captured) {
+		t.Errorf("capture time %s, want %s", ts, captured)
+	}
+
+	packet, err = conn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Now().Sub(packet.Metadata().Timestamp); d < 0 || d > time.Second {
+		t.Errorf("read packet captured %s ago, want now", d)
+	}
+
+	// Packets without capture timestamps are taken as captured now
+	packet = gopacket.NewPacket(packet.Data(), layers.LayerTypeEthernet, gopacket.Default)
+	before := time.Now()
+	if ts := CaptureTime(packet); ts.Before(before) || ts.Sub(before) > time.Second {
+		t.Errorf("capture time %s without timestamp, want now", ts)
+	}
+}
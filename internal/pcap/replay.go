@@ -0,0 +1,104 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// counterLength is the length of the counter prefixed to contents.
+const counterLength = 8
+
+// replayWindowSize is the number of counters tracked behind the latest one.
+const replayWindowSize = 1024
+
+// prefixCounter prefixes contents with the counter.
+func prefixCounter(counter uint64, contents []byte) []byte {
+	b := make([]byte, counterLength+len(contents))
+	binary.BigEndian.PutUint64(b, counter)
+	copy(b[counterLength:], contents)
+
+	return b
+}
+
+// parseCounter returns the counter prefixed to contents and the rest of them.
+func parseCounter(b []byte) (uint64, []byte, error) {
+	if len(b) < counterLength {
+		return 0, nil, errors.New("missing counter")
+	}
+
+	return binary.BigEndian.Uint64(b), b[counterLength:], nil
+}
+
+// replayWindow is a sliding window rejects counters which are too old or already seen.
+type replayWindow struct {
+	lock sync.Mutex
+	// latest is the latest counter plus 1, so 0 means no counter is seen.
+	latest uint64
+	bitmap [replayWindowSize / 64]uint64
+}
+
+// reset forgets all seen counters.
+func (w *replayWindow) reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.latest = 0
+	w.bitmap = [replayWindowSize / 64]uint64{}
+}
+
+// accept returns if the counter is fresh and records it.
+func (w *replayWindow) accept(counter uint64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	next := counter + 1
+	if next == 0 {
+		// Counters never wrap
+		return false
+	}
+
+	// Slide forward
+	if next > w.latest {
+		shift := next - w.latest
+		if shift >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := w.latest; i < next; i++ {
+				w.clear(i)
+			}
+		}
+		w.latest = next
+		w.set(counter)
+
+		return true
+	}
+
+	// Too old
+	if w.latest-next >= replayWindowSize {
+		return false
+	}
+
+	// Seen
+	if w.isSet(counter) {
+		return false
+	}
+	w.set(counter)
+
+	return true
+}
+
+func (w *replayWindow) set(counter uint64) {
+	i := counter % replayWindowSize
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+func (w *replayWindow) clear(counter uint64) {
+	i := counter % replayWindowSize
+	w.bitmap[i/64] &^= 1 << (i % 64)
+}
+
+func (w *replayWindow) isSet(counter uint64) bool {
+	i := counter % replayWindowSize
+	return w.bitmap[i/64]&(1<<(i%64)) != 0
+}
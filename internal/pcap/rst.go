@@ -0,0 +1,60 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// RSTDetector detects TCP RST sent from a port in a device. IkaGo never sends RST, so they are sent by the OS which
+// has no socket listening on the port, and will reset connections with clients.
+type RSTDetector struct {
+	conn  *RawConn
+	ports map[uint16]bool
+}
+
+// DetectRST returns a RST detector which watches TCP RST from the ports in the device.
+func DetectRST(dev *Device, ports []uint16) (*RSTDetector, error) {
+	conn, err := CreateRawConn(dev, dev, RestrictFilter(dev, "src", fmt.Sprintf("tcp && %s && tcp[tcpflags] & tcp-rst != 0", PortsFilter("src", ports))))
+	if err != nil {
+		return nil, fmt.Errorf("create raw connection: %w", err)
+	}
+
+	d := &RSTDetector{
+		conn:  conn,
+		ports: make(map[uint16]bool),
+	}
+	for _, port := range ports {
+		d.ports[port] = true
+	}
+
+	return d, nil
+}
+
+// Next blocks until a TCP RST is detected and returns the client of the RST.
+func (d *RSTDetector) Next() (net.Addr, error) {
+	for {
+		packet, err := d.conn.ReadPacket()
+		if err != nil {
+			return nil, fmt.Errorf("read device %s: %w", d.conn.LocalDev().Alias(), err)
+		}
+
+		indicator, err := ParsePacket(packet)
+		if err != nil {
+			continue
+		}
+		if indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeTCP {
+			continue
+		}
+		if !indicator.IsRST() || !d.ports[indicator.SrcPort()] {
+			continue
+		}
+
+		return indicator.Dst(), nil
+	}
+}
+
+// Close closes the RST detector.
+func (d *RSTDetector) Close() error {
+	return d.conn.Close()
+}
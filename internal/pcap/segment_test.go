@@ -0,0 +1,228 @@
+package pcap
+
+import (
+	"flag"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var isUpdate = flag.Bool("update", false, "Update fixtures in testdata.")
+
+// Fixtures of segments in an exchange between a client and a server. Segments before advertising pseudo receive
+// windows are kept to show the change.
+var (
+	segmentsBefore = filepath.Join("testdata", "faketcp-before.pcap")
+	segmentsAfter  = filepath.Join("testdata", "faketcp-after.pcap")
+)
+
+// segmentFields describes fields of a segment which are visible to observers and are not random.
+type segmentFields struct {
+	isUp       bool
+	flags      string
+	window     uint16
+	hasPayload bool
+}
+
+func (f segmentFields) String() string {
+	dir := "down"
+	if f.isUp {
+		dir = "up"
+	}
+
+	return fmt.Sprintf("%s [%s] win %d payload %t", dir, f.flags, f.window, f.hasPayload)
+}
+
+func fieldsOf(t *testing.T, segment []byte) segmentFields {
+	packet := gopacket.NewPacket(segment, layers.LayerTypeEthernet, gopacket.Default)
+	tcpLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		t.Fatal("missing tcp layer")
+	}
+
+	flags := make([]string, 0)
+	for _, flag := range []struct {
+		name string
+		on   bool
+	}{
+		{"SYN", tcpLayer.SYN},
+		{"FIN", tcpLayer.FIN},
+		{"RST", tcpLayer.RST},
+		{"PSH", tcpLayer.PSH},
+		{"ACK", tcpLayer.ACK},
+	} {
+		if flag.on {
+			flags = append(flags, flag.name)
+		}
+	}
+
+	return segmentFields{
+		isUp:       uint16(tcpLayer.DstPort) == uint16(testServerAddr.Port),
+		flags:      strings.Join(flags, " "),
+		window:     tcpLayer.Window,
+		hasPayload: len(tcpLayer.Payload) > 0,
+	}
+}
+
+func payloadLen(segment []byte) int {
+	payload := gopacket.NewPacket(segment, layers.LayerTypeEthernet, gopacket.Default).ApplicationLayer()
+	if payload == nil {
+		return 0
+	}
+
+	return len(payload.Payload())
+}
+
+// exchangeSegments returns segments of a handshake followed by requests and responses, some of which are over the
+// MTU, and the number of segments in the handshake.
+func exchangeSegments(t *testing.T) ([][]byte, int) {
+	tp := newTestPair(t, DefaultFeatures, DefaultFeatures)
+	tap := &testTap{}
+	tp.up.tap, tp.down.tap = tap, tap
+
+	tp.handshake(t)
+	n := len(tap.packets)
+
+	for _, size := range []int{1000, 1000, 1000, 4000} {
+		_, err := tp.client.Write(make([]byte, size))
+		if err != nil {
+			t.Fatalf("client write: %v", err)
+		}
+		tp.flush(t)
+	}
+	for _, size := range []int{100, 4000} {
+		_, err := tp.server.WriteTo(make([]byte, size), testClientAddr)
+		if err != nil {
+			t.Fatalf("server write: %v", err)
+		}
+		tp.flush(t)
+	}
+	_, err := tp.client.Write(make([]byte, 100))
+	if err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	tp.flush(t)
+
+	return tap.packets, n
+}
+
+func writeSegments(t *testing.T, path string, segments [][]byte) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	w := pcapgo.NewWriter(file)
+	err = w.WriteFileHeader(MaxMTU, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, segment := range segments {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Unix(1600000000, 0).Add(time.Duration(i) * time.Millisecond),
+			CaptureLength: len(segment),
+			Length:        len(segment),
+		}
+		err = w.WritePacket(ci, segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readSegments(t *testing.T, path string) [][]byte {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	r, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments := make([][]byte, 0)
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		segments = append(segments, data)
+	}
+
+	return segments
+}
+
+// TestFakeTCPConnSegmentFixture locks in flags and windows of segments in the fixture. Run it with -update to update
+// the fixture after changing segments on purpose.
+func TestFakeTCPConnSegmentFixture(t *testing.T) {
+	segments, _ := exchangeSegments(t)
+	if *isUpdate {
+		writeSegments(t, segmentsAfter, segments)
+	}
+
+	want := readSegments(t, segmentsAfter)
+	if len(segments) != len(want) {
+		t.Fatalf("exchange %d segments, want %d", len(segments), len(want))
+	}
+	for i, segment := range segments {
+		got, want := fieldsOf(t, segment), fieldsOf(t, want[i])
+		if got != want {
+			t.Errorf("segment %d is %s, want %s", i, got, want)
+		}
+	}
+}
+
+// TestFakeTCPConnSegmentFixtureChange verifies segments after the handshake differ only in windows from before
+// advertising pseudo receive windows, where data segments advertise a constant window, and that PSH is set in the last
+// segment of each payload. Handshakes have changed since, so they are not compared.
+func TestFakeTCPConnSegmentFixtureChange(t *testing.T) {
+	segments, n := exchangeSegments(t)
+	n = len(segments) - n
+
+	before, after := readSegments(t, segmentsBefore), readSegments(t, segmentsAfter)
+	if len(before) < n || len(after) < n {
+		t.Fatalf("%d segments before, %d segments after, want at least %d", len(before), len(after), n)
+	}
+	before, after = before[len(before)-n:], after[len(after)-n:]
+
+	// Segments of a payload but the last are full, and payloads in the exchange are not multiples of the full size
+	full := 0
+	for _, segment := range after {
+		if l := payloadLen(segment); l > full {
+			full = l
+		}
+	}
+
+	windows := make(map[uint16]bool)
+	for i := range after {
+		b, a := fieldsOf(t, before[i]), fieldsOf(t, after[i])
+		if b.isUp != a.isUp || b.flags != a.flags || b.hasPayload != a.hasPayload {
+			t.Errorf("segment %d is %s, %s before", i, a, b)
+		}
+		if !a.hasPayload {
+			continue
+		}
+
+		if b.window != 65535 {
+			t.Errorf("segment %d advertised window %d before, want 65535", i, b.window)
+		}
+		windows[a.window] = true
+
+		isLast := payloadLen(after[i]) < full
+		if isLast != strings.Contains(a.flags, "PSH") {
+			t.Errorf("segment %d is %s, want PSH only in the last segment of a payload", i, a)
+		}
+	}
+	if len(windows) < 2 {
+		t.Errorf("data segments advertise windows %v, want changing windows", windows)
+	}
+}
@@ -5,6 +5,8 @@
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +19,8 @@ type TCPConn struct {
 	destick *Desticker
 	stash   [][]byte
 	stashId int
+	// writeLock serializes writes, as a payload interleaved with another one in the stream can never be desticked.
+	writeLock sync.Mutex
 }
 
 func newTCPConn() *TCPConn {
@@ -73,6 +77,7 @@ func (c *TCPConn) Read(b []byte) (n int, err error) {
 
 		dp, err := c.crypt.Decrypt(c.buffer[:n])
 		if err != nil {
+			atomic.AddUint64(&decryptFailures, 1)
 			return 0, &net.OpError{
 				Op:     "read",
 				Net:    "pcap",
@@ -111,6 +116,9 @@ func (c *TCPConn) Read(b []byte) (n int, err error) {
 }
 
 func (c *TCPConn) Write(b []byte) (n int, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
 	// Encrypt
 	contents, err := c.crypt.Encrypt(b)
 	if err != nil {
@@ -186,7 +194,7 @@ func (l *TCPListener) Accept() (net.Conn, error) {
 
 	tcpConn := newTCPConn()
 	tcpConn.conn = conn
-	tcpConn.crypt = l.crypt
+	tcpConn.crypt = crypto.CloneCrypt(l.crypt)
 
 	return tcpConn, nil
 }
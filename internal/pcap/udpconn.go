@@ -0,0 +1,322 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpQueueSize is the number of datagrams queued for each client of a UDP listener.
+const udpQueueSize = 1000
+
+// udpAcceptSize is the number of new clients queued for accepting in a UDP listener.
+const udpAcceptSize = 16
+
+// errUDPClosed is returned when reading from or writing to a closed UDP connection.
+var errUDPClosed = errors.New("use of closed connection")
+
+// UDPConn is a connection carrying each packet in an encrypted UDP datagram.
+type UDPConn struct {
+	conn     *net.UDPConn
+	crypt    crypto.Crypt
+	buffer   []byte
+	listener *UDPListener
+	addr     *net.UDPAddr
+	ch       chan []byte
+	once     sync.Once
+	quit     chan struct{}
+}
+
+// DialUDP acts like DialUDP for pcap networks.
+func DialUDP(dev *Device, srcPort uint16, dstAddr *net.UDPAddr, crypt crypto.Crypt) (*UDPConn, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	conn, err := net.DialUDP("udp4", srcAddr, dstAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	log.Infof("Connect to server %s\n", dstAddr.String())
+
+	return &UDPConn{
+		conn:   conn,
+		crypt:  crypt,
+		buffer: make([]byte, 65535),
+		quit:   make(chan struct{}),
+	}, nil
+}
+
+func (c *UDPConn) Read(b []byte) (n int, err error) {
+	var contents []byte
+
+	if c.listener != nil {
+		// Datagrams are decrypted by the listener
+		select {
+		case contents = <-c.ch:
+		case <-c.quit:
+			return 0, errUDPClosed
+		}
+	} else {
+		n, err = c.conn.Read(c.buffer)
+		if err != nil {
+			return 0, err
+		}
+
+		contents, err = c.crypt.Decrypt(c.buffer[:n])
+		if err != nil {
+			atomic.AddUint64(&decryptFailures, 1)
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    fmt.Errorf("decrypt: %w", err),
+			}
+		}
+		countFrame(false, n)
+	}
+
+	return copy(b, contents), nil
+}
+
+func (c *UDPConn) Write(b []byte) (n int, err error) {
+	// Encrypt
+	contents, err := c.crypt.Encrypt(b)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	if c.listener != nil {
+		select {
+		case <-c.quit:
+			return 0, errUDPClosed
+		default:
+		}
+
+		_, err = c.conn.WriteToUDP(contents, c.addr)
+	} else {
+		_, err = c.conn.Write(contents)
+	}
+	if err != nil {
+		return 0, err
+	}
+	countFrame(true, len(contents))
+
+	return len(b), nil
+}
+
+func (c *UDPConn) Close() error {
+	c.once.Do(func() {
+		close(c.quit)
+	})
+
+	// Forget the client in the listener so it can connect again
+	if c.listener != nil {
+		c.listener.forget(c)
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *UDPConn) RemoteAddr() net.Addr {
+	if c.listener != nil {
+		return c.addr
+	}
+
+	return c.conn.RemoteAddr()
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	if c.listener != nil {
+		return nil
+	}
+
+	return c.conn.SetDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	if c.listener != nil {
+		return nil
+	}
+
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return nil
+	}
+
+	return c.conn.SetWriteDeadline(t)
+}
+
+// UDPListener is a listener which accepts a connection for each client address sending valid datagrams.
+type UDPListener struct {
+	conn    *net.UDPConn
+	crypt   crypto.Crypt
+	lock    sync.Mutex
+	clients map[string]*UDPConn
+	accept  chan *UDPConn
+	once    sync.Once
+	quit    chan struct{}
+}
+
+// ListenUDP acts like ListenUDP for pcap networks.
+func ListenUDP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*UDPListener, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp4", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+
+	l := &UDPListener{
+		conn:    conn,
+		crypt:   crypt,
+		clients: make(map[string]*UDPConn),
+		accept:  make(chan *UDPConn, udpAcceptSize),
+		quit:    make(chan struct{}),
+	}
+	go l.read()
+
+	return l, nil
+}
+
+// read dispatches datagrams to connections of clients until the listener is closed.
+func (l *UDPListener) read() {
+	b := make([]byte, 65535)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(b)
+		if err != nil {
+			select {
+			case <-l.quit:
+				return
+			default:
+			}
+			log.Verboseln(fmt.Errorf("read udp: %w", err))
+			continue
+		}
+
+		l.lock.Lock()
+		c, ok := l.clients[addr.String()]
+		l.lock.Unlock()
+		if !ok && acceptFunc != nil && !acceptFunc(addr) {
+			log.Verbosef("Drop a datagram from %s: client refused\n", addr)
+			continue
+		}
+
+		// Datagrams not from the client are dropped without creating connections
+		var crypt crypto.Crypt
+		if ok {
+			crypt = c.crypt
+		} else {
+			crypt = crypto.CloneCrypt(l.crypt)
+		}
+		contents, err := crypt.Decrypt(b[:n])
+		if err != nil {
+			atomic.AddUint64(&decryptFailures, 1)
+			log.Verboseln(fmt.Errorf("decrypt datagram from %s: %w", addr, err))
+			continue
+		}
+
+		if !ok {
+			l.lock.Lock()
+			if authFunc != nil && !authFunc(addr, contents) {
+				l.lock.Unlock()
+				log.Verbosef("Drop a datagram from %s: client unauthorized\n", addr)
+				continue
+			}
+
+			c = &UDPConn{
+				conn:     l.conn,
+				crypt:    crypt,
+				listener: l,
+				addr:     addr,
+				ch:       make(chan []byte, udpQueueSize),
+				quit:     make(chan struct{}),
+			}
+
+			select {
+			case l.accept <- c:
+				l.clients[addr.String()] = c
+			default:
+				l.lock.Unlock()
+				log.Verbosef("Drop a datagram from %s: too many clients to accept\n", addr)
+				continue
+			}
+			l.lock.Unlock()
+		}
+
+		countFrame(false, n)
+
+		select {
+		case c.ch <- contents:
+		default:
+			log.Verbosef("Drop a datagram from %s: queue is full\n", addr)
+		}
+	}
+}
+
+// forget removes the connection so datagrams from its address create a new connection.
+func (l *UDPListener) forget(c *UDPConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.clients[c.addr.String()] == c {
+		delete(l.clients, c.addr.String())
+	}
+}
+
+func (l *UDPListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.quit:
+		return nil, errUDPClosed
+	}
+}
+
+func (l *UDPListener) Close() error {
+	l.once.Do(func() {
+		close(l.quit)
+	})
+
+	return l.conn.Close()
+}
+
+func (l *UDPListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,92 @@
+// +build linux
+
+package privilege
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	capNetRaw               = 13
+	linuxCapabilityVersion3 = 0x20080522
+	prCapAmbient            = 47
+	prCapAmbientRaise       = 2
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// dropKeepingNetRaw drops privileges with the function, and keeps CAP_NET_RAW in a thread running functions in Do.
+// Capabilities belong to threads in Linux and cannot be set for all threads with cgo, so the thread is locked and never
+// runs other routines, and threads created later never inherit the capability from it.
+func dropKeepingNetRaw(set func() error) error {
+	funcs := make(chan func())
+	result := make(chan error)
+
+	go func() {
+		// The thread exits with the routine if it fails, instead of running other routines
+		runtime.LockOSThread()
+
+		err := keepNetRaw(set)
+		result <- err
+		if err != nil {
+			return
+		}
+
+		for f := range funcs {
+			f()
+		}
+	}()
+
+	err := <-result
+	if err != nil {
+		return err
+	}
+	setKeeper(funcs)
+
+	return nil
+}
+
+// keepNetRaw drops privileges with the function, and restores CAP_NET_RAW in the calling thread.
+func keepNetRaw(set func() error) error {
+	// Permitted capabilities of the thread are kept when switching from root
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_KEEPCAPS, 1, 0)
+	if errno != 0 {
+		return fmt.Errorf("keep capabilities: %w", errno)
+	}
+
+	err := set()
+	if err != nil {
+		return err
+	}
+
+	header := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{{
+		effective:   1 << capNetRaw,
+		permitted:   1 << capNetRaw,
+		inheritable: 1 << capNetRaw,
+	}}
+	_, _, errno = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("set capabilities: %w", errno)
+	}
+
+	// Programs executed by the thread also keep the capability
+	_, _, errno = syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientRaise, capNetRaw, 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("raise ambient capabilities: %w", errno)
+	}
+
+	return nil
+}
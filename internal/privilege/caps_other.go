@@ -0,0 +1,13 @@
+// +build darwin freebsd
+
+package privilege
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func dropKeepingNetRaw(_ func() error) error {
+	// Capabilities are only in Linux, grant the user access to /dev/bpf* instead
+	return fmt.Errorf("os %s not support", runtime.GOOS)
+}
@@ -0,0 +1,89 @@
+package privilege
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// User describes an unprivileged user to run as.
+type User struct {
+	Name string
+	Uid  int
+	Gid  int
+}
+
+// Lookup returns the user with the given name.
+func Lookup(name string) (*User, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup: %w", err)
+	}
+
+	// Windows uses SIDs which cannot be switched to
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("parse uid %s: %w", u.Uid, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("parse gid %s: %w", u.Gid, err)
+	}
+
+	return &User{
+		Name: name,
+		Uid:  uid,
+		Gid:  gid,
+	}, nil
+}
+
+// Chown changes the owner of the file in the path to the user, so the file can still be written and removed after
+// dropping privileges.
+func (u *User) Chown(path string) error {
+	err := os.Chown(path, u.Uid, u.Gid)
+	if err != nil {
+		return fmt.Errorf("chown: %w", err)
+	}
+
+	return nil
+}
+
+// Drop switches the process to the user and clears supplementary groups. Handles which are opened before keep working,
+// but handles requiring privileges cannot be opened any more, unless CAP_NET_RAW is kept for opening them in Do.
+func Drop(u *User, keepNetRaw bool) error {
+	return drop(u, keepNetRaw)
+}
+
+var (
+	keeperLock sync.RWMutex
+	// keeper runs functions with privileges kept after dropping them. It is nil if nothing is kept.
+	keeper chan<- func()
+)
+
+// Do runs the function with privileges kept after dropping them, like opening handles. It runs the function in place if
+// privileges are not dropped or nothing is kept.
+func Do(f func() error) error {
+	keeperLock.RLock()
+	k := keeper
+	keeperLock.RUnlock()
+
+	if k == nil {
+		return f()
+	}
+
+	result := make(chan error)
+	k <- func() {
+		result <- f()
+	}
+
+	return <-result
+}
+
+func setKeeper(k chan<- func()) {
+	keeperLock.Lock()
+	defer keeperLock.Unlock()
+
+	keeper = k
+}
@@ -0,0 +1,13 @@
+// +build !linux,!darwin,!freebsd
+
+package privilege
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func drop(_ *User, _ bool) error {
+	// Processes in Windows cannot switch to other users
+	return fmt.Errorf("os %s not support", runtime.GOOS)
+}
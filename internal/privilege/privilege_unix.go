@@ -0,0 +1,46 @@
+// +build linux darwin freebsd
+
+package privilege
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+func drop(u *User, keepNetRaw bool) error {
+	if keepNetRaw {
+		return dropKeepingNetRaw(func() error {
+			return setIds(u)
+		})
+	}
+
+	return setIds(u)
+}
+
+// setIds switches the process to the user. Since Go 1.16, the calls apply to all threads of the process instead of the
+// calling one in Linux.
+func setIds(u *User) error {
+	// Groups must be dropped before the user, which will lose the permission to do so
+	err := syscall.Setgroups([]int{})
+	if err != nil {
+		return fmt.Errorf("set groups: %w", err)
+	}
+
+	err = syscall.Setgid(u.Gid)
+	if err != nil {
+		return fmt.Errorf("set gid: %w", err)
+	}
+
+	err = syscall.Setuid(u.Uid)
+	if err != nil {
+		return fmt.Errorf("set uid: %w", err)
+	}
+
+	// Verify privileges cannot be regained
+	if u.Uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("privileges can be regained")
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package routine
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Routine describes a registered goroutine.
+type Routine struct {
+	// Id is the identifier of the routine.
+	Id uint64 `json:"id"`
+	// Name is the name of the routine.
+	Name string `json:"name"`
+	// Start is the time the routine started.
+	Start time.Time `json:"start"`
+	done  chan struct{}
+}
+
+// Registry is a registry of long-lived goroutines with an upper bound.
+type Registry struct {
+	lock     sync.Mutex
+	routines map[uint64]*Routine
+	nextId   uint64
+	max      int
+}
+
+// NewRegistry returns a new registry which allows at most max goroutines. A max of 0 means unlimited.
+func NewRegistry(max int) *Registry {
+	return &Registry{
+		routines: make(map[uint64]*Routine),
+		max:      max,
+	}
+}
+
+// Go starts f in a new goroutine registered with name. The goroutine is unregistered after f returns.
+func (r *Registry) Go(name string, f func()) error {
+	r.lock.Lock()
+	if r.max > 0 && len(r.routines) >= r.max {
+		r.lock.Unlock()
+		return fmt.Errorf("too many routines (%d)", r.max)
+	}
+
+	routine := &Routine{
+		Id:    r.nextId,
+		Name:  name,
+		Start: time.Now(),
+		done:  make(chan struct{}),
+	}
+	r.routines[routine.Id] = routine
+	r.nextId++
+	r.lock.Unlock()
+
+	go func() {
+		defer func() {
+			r.lock.Lock()
+			delete(r.routines, routine.Id)
+			r.lock.Unlock()
+
+			close(routine.done)
+		}()
+
+		f()
+	}()
+
+	return nil
+}
+
+// Len returns the number of live goroutines.
+func (r *Registry) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.routines)
+}
+
+// Routines returns live goroutines ordered by the time they started.
+func (r *Registry) Routines() []Routine {
+	r.lock.Lock()
+	result := make([]Routine, 0, len(r.routines))
+	for _, routine := range r.routines {
+		result = append(result, *routine)
+	}
+	r.lock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+
+	return result
+}
+
+// Wait waits for all registered goroutines to exit until the timeout and returns goroutines still alive.
+func (r *Registry) Wait(timeout time.Duration) []Routine {
+	deadline := time.After(timeout)
+
+	for _, routine := range r.Routines() {
+		select {
+		case <-routine.done:
+			continue
+		case <-deadline:
+			return r.Routines()
+		}
+	}
+
+	return r.Routines()
+}
@@ -0,0 +1,110 @@
+package routine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegistryGo(t *testing.T) {
+	r := NewRegistry(0)
+
+	stop := make(chan struct{})
+	for _, name := range []string{"a", "b", "c"} {
+		err := r.Go(name, func() {
+			<-stop
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := r.Len(); n != 3 {
+		t.Errorf("%d routines, want 3", n)
+	}
+	routines := r.Routines()
+	for i, name := range []string{"a", "b", "c"} {
+		if routines[i].Name != name {
+			t.Errorf("routine %d is %s, want %s", i, routines[i].Name, name)
+		}
+	}
+
+	close(stop)
+	leaks := r.Wait(time.Second)
+	if len(leaks) != 0 {
+		t.Errorf("leak %d routines", len(leaks))
+	}
+	if n := r.Len(); n != 0 {
+		t.Errorf("%d routines after exiting, want 0", n)
+	}
+}
+
+func TestRegistryMax(t *testing.T) {
+	r := NewRegistry(2)
+
+	exit, stop := make(chan struct{}), make(chan struct{})
+	defer close(stop)
+	err := r.Go("exit", func() {
+		<-exit
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Go("stop", func() {
+		<-stop
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Go("over", func() {
+		t.Error("start the routine over the max")
+	})
+	if err == nil {
+		t.Error("start routines over the max")
+	}
+	if n := r.Len(); n != 2 {
+		t.Errorf("%d routines, want 2", n)
+	}
+
+	// Routines can be started again after others exit
+	close(exit)
+	deadline := time.Now().Add(time.Second)
+	for r.Len() >= 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	err = r.Go("again", func() {
+		<-stop
+	})
+	if err != nil {
+		t.Errorf("start routines after others exit: %v", err)
+	}
+}
+
+func TestRegistryWaitTimeout(t *testing.T) {
+	r := NewRegistry(0)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	err := r.Go("exit", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Go("leak", func() {
+		<-stop
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	leaks := r.Wait(100 * time.Millisecond)
+	if d := time.Now().Sub(start); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("wait %s, want 100ms", d)
+	}
+	if len(leaks) != 1 || leaks[0].Name != "leak" {
+		t.Fatalf("leak %v, want the routine leak", leaks)
+	}
+	if leaks[0].Start.After(time.Now()) || leaks[0].Start.Before(start.Add(-time.Second)) {
+		t.Errorf("leak the routine started at %s", leaks[0].Start)
+	}
+}
@@ -0,0 +1,219 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Version is the version of SOCKS.
+const Version = 5
+
+// methodNoAuth is the method of no authentication.
+const methodNoAuth = 0
+
+// methodNoAcceptable is replied when no methods of the client are acceptable.
+const methodNoAcceptable = 0xff
+
+// Commands in requests.
+const (
+	CommandConnect      = 1
+	CommandBind         = 2
+	CommandUDPAssociate = 3
+)
+
+// Address types in requests and datagrams.
+const (
+	addrTypeIPv4   = 1
+	addrTypeDomain = 3
+	addrTypeIPv6   = 4
+)
+
+// Replies to requests.
+const (
+	ReplySucceeded           = 0
+	ReplyFailure             = 1
+	ReplyNetworkUnreachable  = 3
+	ReplyHostUnreachable     = 4
+	ReplyConnectionRefused   = 5
+	ReplyTTLExpired          = 6
+	ReplyCommandNotSupported = 7
+	ReplyAddrNotSupported    = 8
+)
+
+// ErrAddrNotSupported is returned when an address is not an IPv4 address or a domain name.
+var ErrAddrNotSupported = errors.New("address type not support")
+
+// Request describes a request from a client.
+type Request struct {
+	// Command is the command of the request.
+	Command byte
+	// Addr is the destination address of the request like "example.com:80" or "1.2.3.4:80".
+	Addr string
+}
+
+// Handshake negotiates the method with the client. Only clients which accept no authentication are supported.
+func Handshake(rw io.ReadWriter) error {
+	b := make([]byte, 255)
+
+	_, err := io.ReadFull(rw, b[:2])
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if b[0] != Version {
+		return fmt.Errorf("version %d not support", b[0])
+	}
+
+	n := int(b[1])
+	_, err = io.ReadFull(rw, b[:n])
+	if err != nil {
+		return fmt.Errorf("read methods: %w", err)
+	}
+
+	for _, method := range b[:n] {
+		if method == methodNoAuth {
+			_, err = rw.Write([]byte{Version, methodNoAuth})
+			if err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
+
+			return nil
+		}
+	}
+
+	_, err = rw.Write([]byte{Version, methodNoAcceptable})
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return errors.New("no acceptable methods")
+}
+
+// ReadRequest reads a request from the client. The error wraps ErrAddrNotSupported if the address type is not
+// supported, and the command is returned so the client can be replied.
+func ReadRequest(r io.Reader) (*Request, error) {
+	b := make([]byte, 4)
+
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	if b[0] != Version {
+		return nil, fmt.Errorf("version %d not support", b[0])
+	}
+
+	addr, err := readAddr(r, b[3])
+	if err != nil {
+		return &Request{Command: b[1]}, err
+	}
+
+	return &Request{Command: b[1], Addr: addr}, nil
+}
+
+func readAddr(r io.Reader, t byte) (string, error) {
+	var host string
+
+	switch t {
+	case addrTypeIPv4:
+		b := make([]byte, net.IPv4len)
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return "", fmt.Errorf("read address: %w", err)
+		}
+		host = net.IP(b).String()
+	case addrTypeDomain:
+		b := make([]byte, 1)
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return "", fmt.Errorf("read address: %w", err)
+		}
+		b = make([]byte, b[0])
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return "", fmt.Errorf("read address: %w", err)
+		}
+		host = string(b)
+	default:
+		return "", fmt.Errorf("%w: %d", ErrAddrNotSupported, t)
+	}
+
+	b := make([]byte, 2)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return "", fmt.Errorf("read port: %w", err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b)))), nil
+}
+
+// appendAddr appends the IPv4 address and the port, and appends 0.0.0.0:0 if the IP is not an IPv4 address.
+func appendAddr(b []byte, ip net.IP, port uint16) []byte {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		ip4 = net.IPv4zero.To4()
+		port = 0
+	}
+
+	b = append(b, addrTypeIPv4)
+	b = append(b, ip4...)
+	b = append(b, byte(port>>8), byte(port))
+
+	return b
+}
+
+// WriteReply writes a reply with the bound address to the client.
+func WriteReply(w io.Writer, reply byte, ip net.IP, port uint16) error {
+	b := appendAddr([]byte{Version, reply, 0}, ip, port)
+
+	_, err := w.Write(b)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+// ParseDatagram parses a datagram from the client in a UDP association, and returns the destination address and the
+// data. Fragmented datagrams are not supported.
+func ParseDatagram(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("datagram too short")
+	}
+	if b[2] != 0 {
+		return "", nil, fmt.Errorf("fragment %d not support", b[2])
+	}
+
+	r := &reader{b: b[4:]}
+	addr, err := readAddr(r, b[3])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return addr, r.b, nil
+}
+
+// CreateDatagram returns a datagram to the client in a UDP association from the IPv4 address and the port.
+func CreateDatagram(ip net.IP, port uint16, data []byte) []byte {
+	b := appendAddr([]byte{0, 0, 0}, ip, port)
+
+	return append(b, data...)
+}
+
+// reader reads from bytes and keeps the remaining bytes.
+type reader struct {
+	b []byte
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(r.b) <= 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+
+	return n, nil
+}
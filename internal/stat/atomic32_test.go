@@ -0,0 +1,55 @@
+// +build 386 arm
+
+package stat
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestCountersAtomic adds to counters concurrently, which panics on 32-bit platforms if any 64-bit counter accessed
+// atomically is not aligned.
+func TestCountersAtomic(t *testing.T) {
+	const (
+		routines = 8
+		packets  = 1000
+	)
+
+	sizes := NewSizeMonitor()
+	counter := NewProtocolCounter()
+
+	var wg sync.WaitGroup
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < packets; j++ {
+				for _, direction := range []Direction{DirectionIn, DirectionOut} {
+					sizes.AddInner(direction, 100)
+					sizes.AddWire(direction, 2000)
+					for p := Protocol(0); p < protocols; p++ {
+						counter.Add(direction, p, 100)
+					}
+				}
+				sizes.Inner(DirectionIn).Counts()
+				counter.Stats()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, direction := range []Direction{DirectionIn, DirectionOut} {
+		if n := sizes.Inner(direction).Counts()[1]; n != routines*packets {
+			t.Errorf("inner sizes in direction %d: %d in bucket, expect %d", direction, n, routines*packets)
+		}
+		if n := sizes.Wire(direction).Counts()[6]; n != routines*packets {
+			t.Errorf("wire sizes in direction %d: %d in bucket, expect %d", direction, n, routines*packets)
+		}
+	}
+	for _, stats := range counter.Stats() {
+		if stats.InPackets != routines*packets || stats.InBytes != routines*packets*100 || stats.OutPackets != routines*packets || stats.OutBytes != routines*packets*100 {
+			t.Errorf("counted %s", stats)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// SizeBuckets are upper bounds of buckets in size histograms. Sizes larger than the last bucket are counted in an
+// overflow bucket.
+var SizeBuckets = [...]int{64, 128, 256, 512, 1024, 1500, 9000}
+
+// Histogram describes a histogram of sizes in fixed buckets.
+type Histogram struct {
+	counts [len(SizeBuckets) + 1]uint64
+	sum    uint64
+}
+
+// NewHistogram returns a new histogram.
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+// Add adds a size to the histogram.
+func (h *Histogram) Add(size int) {
+	i := 0
+	for ; i < len(SizeBuckets); i++ {
+		if size <= SizeBuckets[i] {
+			break
+		}
+	}
+
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(size))
+}
+
+// Counts returns counts of each bucket. The last count is the overflow bucket.
+func (h *Histogram) Counts() []uint64 {
+	counts := make([]uint64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+
+	return counts
+}
+
+// Count returns the total count.
+func (h *Histogram) Count() uint64 {
+	var n uint64
+	for _, count := range h.Counts() {
+		n = n + count
+	}
+
+	return n
+}
+
+// Sum returns the sum of all sizes.
+func (h *Histogram) Sum() uint64 {
+	return atomic.LoadUint64(&h.sum)
+}
+
+func bucketName(i int) string {
+	if i < len(SizeBuckets) {
+		return strconv.Itoa(SizeBuckets[i])
+	}
+
+	return "+Inf"
+}
+
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	type Bucket struct {
+		Le    string `json:"le"`
+		Count uint64 `json:"count"`
+	}
+
+	buckets := make([]Bucket, 0)
+	for i, count := range h.Counts() {
+		buckets = append(buckets, Bucket{
+			Le:    bucketName(i),
+			Count: count,
+		})
+	}
+
+	return json.Marshal(buckets)
+}
+
+func (h *Histogram) String() string {
+	sb := strings.Builder{}
+
+	for i, count := range h.Counts() {
+		sb.WriteString(fmt.Sprintf("  <= %s: %d\n", bucketName(i), count))
+	}
+
+	return sb.String()
+}
+
+// SizeMonitor describes size histograms of inner packets and frames carrying them in the tunnel in both directions.
+type SizeMonitor struct {
+	innerIn  *Histogram
+	innerOut *Histogram
+	wireIn   *Histogram
+	wireOut  *Histogram
+}
+
+// NewSizeMonitor returns a new size monitor.
+func NewSizeMonitor() *SizeMonitor {
+	return &SizeMonitor{
+		innerIn:  NewHistogram(),
+		innerOut: NewHistogram(),
+		wireIn:   NewHistogram(),
+		wireOut:  NewHistogram(),
+	}
+}
+
+// AddInner adds a size of an inner packet.
+func (monitor *SizeMonitor) AddInner(direction Direction, size int) {
+	switch direction {
+	case DirectionIn:
+		monitor.innerIn.Add(size)
+	case DirectionOut:
+		monitor.innerOut.Add(size)
+	default:
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+}
+
+// AddWire adds a size of a frame in the tunnel.
+func (monitor *SizeMonitor) AddWire(direction Direction, size int) {
+	switch direction {
+	case DirectionIn:
+		monitor.wireIn.Add(size)
+	case DirectionOut:
+		monitor.wireOut.Add(size)
+	default:
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+}
+
+// Inner returns the histogram of inner packets in the direction.
+func (monitor *SizeMonitor) Inner(direction Direction) *Histogram {
+	switch direction {
+	case DirectionIn:
+		return monitor.innerIn
+	case DirectionOut:
+		return monitor.innerOut
+	default:
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+}
+
+// Wire returns the histogram of frames on the wire in the direction.
+func (monitor *SizeMonitor) Wire(direction Direction) *Histogram {
+	switch direction {
+	case DirectionIn:
+		return monitor.wireIn
+	case DirectionOut:
+		return monitor.wireOut
+	default:
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+}
+
+func (monitor *SizeMonitor) MarshalJSON() ([]byte, error) {
+	type UnidirectionalSizeMonitor struct {
+		Inner *Histogram `json:"inner"`
+		Wire  *Histogram `json:"wire"`
+	}
+
+	return json.Marshal(&struct {
+		In  *UnidirectionalSizeMonitor `json:"in"`
+		Out *UnidirectionalSizeMonitor `json:"out"`
+	}{
+		In: &UnidirectionalSizeMonitor{
+			Inner: monitor.innerIn,
+			Wire:  monitor.wireIn,
+		},
+		Out: &UnidirectionalSizeMonitor{
+			Inner: monitor.innerOut,
+			Wire:  monitor.wireOut,
+		},
+	})
+}
+
+func (monitor *SizeMonitor) String() string {
+	sb := strings.Builder{}
+
+	sb.WriteString("Outbound inner sizes:\n")
+	sb.WriteString(monitor.innerOut.String())
+	sb.WriteString("Outbound wire sizes:\n")
+	sb.WriteString(monitor.wireOut.String())
+	sb.WriteString("Inbound inner sizes:\n")
+	sb.WriteString(monitor.innerIn.String())
+	sb.WriteString("Inbound wire sizes:\n")
+	sb.WriteString(monitor.wireIn.String())
+
+	return sb.String()
+}
@@ -0,0 +1,96 @@
+package stat
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PrometheusWriter writes metrics in Prometheus text format. Samples of a metric must be written together.
+type PrometheusWriter struct {
+	w    io.Writer
+	last string
+	err  error
+}
+
+// NewPrometheusWriter returns a new Prometheus writer writing to the writer.
+func NewPrometheusWriter(w io.Writer) *PrometheusWriter {
+	return &PrometheusWriter{w: w}
+}
+
+// Counter writes a sample of the counter. Labels are pairs of names and values.
+func (p *PrometheusWriter) Counter(name, help string, value uint64, labels ...string) {
+	p.write(name, help, "counter", strconv.FormatUint(value, 10), labels)
+}
+
+// Gauge writes a sample of the gauge. Labels are pairs of names and values.
+func (p *PrometheusWriter) Gauge(name, help string, value int, labels ...string) {
+	p.write(name, help, "gauge", strconv.Itoa(value), labels)
+}
+
+// Histogram writes samples of the histogram, which are cumulative buckets, the sum and the count. Labels are pairs of
+// names and values.
+func (p *PrometheusWriter) Histogram(name, help string, h *Histogram, labels ...string) {
+	var n uint64
+	for i, count := range h.Counts() {
+		n = n + count
+		p.sample(name, help, "histogram", name+"_bucket", strconv.FormatUint(n, 10), append(labels[:len(labels):len(labels)], "le", bucketName(i)))
+	}
+	p.sample(name, help, "histogram", name+"_sum", strconv.FormatUint(h.Sum(), 10), labels)
+	p.sample(name, help, "histogram", name+"_count", strconv.FormatUint(n, 10), labels)
+}
+
+// Err returns the first error in writing.
+func (p *PrometheusWriter) Err() error {
+	return p.err
+}
+
+func (p *PrometheusWriter) write(name, help, t, value string, labels []string) {
+	p.sample(name, help, t, name, value, labels)
+}
+
+// sample writes a sample of the metric, which is named differently in histograms.
+func (p *PrometheusWriter) sample(name, help, t, sample, value string, labels []string) {
+	if p.err != nil {
+		return
+	}
+	if len(labels)%2 != 0 {
+		panic(fmt.Errorf("labels of %s not in pairs", name))
+	}
+
+	sb := strings.Builder{}
+
+	// HELP and TYPE are written before the first sample
+	if name != p.last {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n", name, help))
+		sb.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, t))
+		p.last = name
+	}
+
+	sb.WriteString(sample)
+	if len(labels) > 0 {
+		sb.WriteString("{")
+		for i := 0; i < len(labels); i = i + 2 {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			sb.WriteString(fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabel(labels[i+1])))
+		}
+		sb.WriteString("}")
+	}
+	sb.WriteString(fmt.Sprintf(" %s\n", value))
+
+	_, err := io.WriteString(p.w, sb.String())
+	if err != nil {
+		p.err = err
+	}
+}
+
+// escapeLabel escapes the label value in Prometheus text format.
+func escapeLabel(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "\"", "\\\"")
+
+	return strings.ReplaceAll(s, "\n", "\\n")
+}
@@ -0,0 +1,48 @@
+package stat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrometheusHistogram(t *testing.T) {
+	h := NewHistogram()
+	for _, size := range []int{40, 100, 1500, 1501, 10000} {
+		h.Add(size)
+	}
+
+	sb := strings.Builder{}
+	p := NewPrometheusWriter(&sb)
+	p.Histogram("sizes", "Sizes.", h, "direction", "in")
+	p.Histogram("sizes", "Sizes.", NewHistogram(), "direction", "out")
+	if p.Err() != nil {
+		t.Fatal(p.Err())
+	}
+
+	want := `# HELP sizes Sizes.
+# TYPE sizes histogram
+sizes_bucket{direction="in",le="64"} 1
+sizes_bucket{direction="in",le="128"} 2
+sizes_bucket{direction="in",le="256"} 2
+sizes_bucket{direction="in",le="512"} 2
+sizes_bucket{direction="in",le="1024"} 2
+sizes_bucket{direction="in",le="1500"} 3
+sizes_bucket{direction="in",le="9000"} 4
+sizes_bucket{direction="in",le="+Inf"} 5
+sizes_sum{direction="in"} 13141
+sizes_count{direction="in"} 5
+sizes_bucket{direction="out",le="64"} 0
+sizes_bucket{direction="out",le="128"} 0
+sizes_bucket{direction="out",le="256"} 0
+sizes_bucket{direction="out",le="512"} 0
+sizes_bucket{direction="out",le="1024"} 0
+sizes_bucket{direction="out",le="1500"} 0
+sizes_bucket{direction="out",le="9000"} 0
+sizes_bucket{direction="out",le="+Inf"} 0
+sizes_sum{direction="out"} 0
+sizes_count{direction="out"} 0
+`
+	if sb.String() != want {
+		t.Errorf("write histogram:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
@@ -0,0 +1,105 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Protocol describes the transport protocol of traffic.
+type Protocol int
+
+const (
+	// ProtocolTCP describes the traffic is in TCP.
+	ProtocolTCP Protocol = iota
+	// ProtocolUDP describes the traffic is in UDP.
+	ProtocolUDP
+	// ProtocolICMPv4 describes the traffic is in ICMPv4.
+	ProtocolICMPv4
+	// ProtocolOther describes the traffic is in other protocols or fragments without transport layers.
+	ProtocolOther
+	protocols
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolTCP:
+		return "TCP"
+	case ProtocolUDP:
+		return "UDP"
+	case ProtocolICMPv4:
+		return "ICMPv4"
+	case ProtocolOther:
+		return "Other"
+	default:
+		return fmt.Sprintf("%d", p)
+	}
+}
+
+// ProtocolStats describes a snapshot of traffic in a protocol.
+type ProtocolStats struct {
+	Protocol   string `json:"protocol"`
+	InPackets  uint64 `json:"in-packets"`
+	InBytes    uint64 `json:"in-bytes"`
+	OutPackets uint64 `json:"out-packets"`
+	OutBytes   uint64 `json:"out-bytes"`
+}
+
+func (stats ProtocolStats) String() string {
+	return fmt.Sprintf("%s: in %s (%d packets), out %s (%d packets)", stats.Protocol, formatSize(stats.InBytes), stats.InPackets, formatSize(stats.OutBytes), stats.OutPackets)
+}
+
+// ProtocolCounter describes counts of packets and bytes by protocols in both directions. It is safe for concurrent use.
+type ProtocolCounter struct {
+	packets [2][protocols]uint64
+	bytes   [2][protocols]uint64
+}
+
+// NewProtocolCounter returns a new protocol counter.
+func NewProtocolCounter() *ProtocolCounter {
+	return &ProtocolCounter{}
+}
+
+// Add adds a packet of the protocol in the direction.
+func (counter *ProtocolCounter) Add(direction Direction, protocol Protocol, size int) {
+	if direction != DirectionIn && direction != DirectionOut {
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+	if protocol < 0 || protocol >= protocols {
+		protocol = ProtocolOther
+	}
+
+	atomic.AddUint64(&counter.packets[direction][protocol], 1)
+	atomic.AddUint64(&counter.bytes[direction][protocol], uint64(size))
+}
+
+// Stats returns a snapshot of traffic in all protocols.
+func (counter *ProtocolCounter) Stats() []ProtocolStats {
+	result := make([]ProtocolStats, 0, protocols)
+	for p := Protocol(0); p < protocols; p++ {
+		result = append(result, ProtocolStats{
+			Protocol:   p.String(),
+			InPackets:  atomic.LoadUint64(&counter.packets[DirectionIn][p]),
+			InBytes:    atomic.LoadUint64(&counter.bytes[DirectionIn][p]),
+			OutPackets: atomic.LoadUint64(&counter.packets[DirectionOut][p]),
+			OutBytes:   atomic.LoadUint64(&counter.bytes[DirectionOut][p]),
+		})
+	}
+
+	return result
+}
+
+func (counter *ProtocolCounter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(counter.Stats())
+}
+
+func (counter *ProtocolCounter) String() string {
+	sb := strings.Builder{}
+
+	for _, stats := range counter.Stats() {
+		sb.WriteString(fmt.Sprintf("%s\n", stats))
+	}
+
+	return sb.String()
+}